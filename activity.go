@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/export"
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+	"github.com/michaelhelvey/pgproxy/internal/slowlog"
+)
+
+// Follows a session's requests so that each can be exported as a query record once the upstream
+// has answered it.  Clients may pipeline requests, and the upstream answers them in order with one
+// ReadyForQuery each, so requests wait in a queue until their ReadyForQuery arrives.  Requests
+// that turn out to be slow also go to the slow query log.
+//
+// A nil *activity (export and the slow query log disabled) ignores everything.
+type activity struct {
+	client net.Conn
+
+	// the relay's two directions run concurrently
+	mu sync.Mutex
+	// requests forwarded to the upstream and not yet answered
+	requests []activityRequest
+	// extended protocol messages forwarded since the last Sync
+	batch *activityRequest
+}
+
+type activityRequest struct {
+	query string
+	start time.Time
+	// SQLSTATE of the error the upstream answered with, if any
+	code string
+	// a Sync on its own, which the upstream answers but isn't worth a record
+	empty bool
+}
+
+func newActivity(client net.Conn) *activity {
+	if !export.Enabled() && !slowlog.Enabled() {
+		return nil
+	}
+
+	return &activity{client: client}
+}
+
+// Called with each message the relay forwards from the client to the upstream
+func (a *activity) clientMessage(message *codec.Message) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch message.Type {
+	case codec.MessageTypeQuery:
+		a.requests = append(a.requests, activityRequest{query: message.ParseAsQuery().QueryString, start: time.Now()})
+	case codec.MessageTypeFunctionCall:
+		a.requests = append(a.requests, activityRequest{start: time.Now()})
+	case codec.MessageTypeParse:
+		a.startBatch()
+		if parsed, err := message.ParseAsParse(); err == nil {
+			if a.batch.query != "" {
+				a.batch.query += "; "
+			}
+			a.batch.query += parsed.QueryString
+		}
+	case codec.MessageTypeBind, codec.MessageTypeDescribe, codec.MessageTypeExecute, codec.MessageTypeClose:
+		a.startBatch()
+	case codec.MessageTypeSync:
+		if a.batch == nil {
+			a.requests = append(a.requests, activityRequest{empty: true})
+			return
+		}
+		a.requests = append(a.requests, *a.batch)
+		a.batch = nil
+	}
+}
+
+func (a *activity) startBatch() {
+	if a.batch == nil {
+		a.batch = &activityRequest{start: time.Now()}
+	}
+}
+
+// Called with each message the relay forwards from the upstream to the client
+func (a *activity) serverMessage(message *codec.Message) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.requests) == 0 {
+		return
+	}
+
+	switch message.Type {
+	case codec.MessageTypeErrorResponse:
+		// only the first error counts, the rest of an extended protocol batch is skipped anyway
+		if parsed, err := message.ParseAsErrorResponse(); err == nil && a.requests[0].code == "" {
+			a.requests[0].code = parsed.Code
+		}
+	case codec.MessageTypeReadyForQuery:
+		request := a.requests[0]
+		a.requests = a.requests[1:]
+		if request.empty {
+			return
+		}
+
+		duration := time.Since(request.start)
+		record := exportRecord(a.client, export.RecordQuery)
+		record.Query, record.Error = request.query, request.code
+		record.DurationMs = durationMs(duration)
+		export.Publish(record)
+
+		if slowlog.Slow(duration) {
+			// the session may lose its upstream connection right after this ReadyForQuery, so
+			// the target must be looked up now
+			target, explain := remote.SessionExplainer(a.client)
+			slowlog.Observe(slowlog.Query{
+				Session: record.Session, Entry: record.Entry, User: record.User, Database: record.Database,
+				Target: target, SQL: request.query, Duration: duration, Code: request.code,
+			}, explain)
+		}
+	}
+}
+
+func exportRecord(client net.Conn, recordType export.RecordType) export.Record {
+	id := remote.SessionIdentity(client)
+	return export.Record{
+		Type:       recordType,
+		Session:    id.Session,
+		ClientAddr: clientHost(client),
+		User:       id.User,
+		Database:   id.Database,
+		Entry:      id.Entry,
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/michaelhelvey/pgproxy/internal/audit"
+	"github.com/michaelhelvey/pgproxy/internal/auth"
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+)
+
+// Returned by handleClientStartup once an admin console session is over, as it has no upstream
+// to relay to
+var errConsoleFinished = errors.New("admin console session finished")
+
+// A console command's result set
+type consoleResult struct {
+	columns []string
+	rows    [][]*string
+}
+
+var consoleCommands = map[string]func() consoleResult{
+	"SHOW STATS":     showStats,
+	"SHOW POOLS":     showPools,
+	"SHOW UPSTREAMS": showUpstreams,
+	"SHOW USERS":     showUsers,
+	"SHOW MESSAGES":  showMessages,
+	// a pg_stat_activity for the proxy
+	"SELECT * FROM PGPROXY.SESSIONS": showSessions,
+}
+
+func init() {
+	// SHOW HELP lists the commands, so it can't be part of their initializer
+	consoleCommands["SHOW HELP"] = showHelp
+}
+
+// Serves the admin console, pgbouncer style: admin_users connect to the remote.AdminDatabase
+// database and run SHOW commands against the proxy itself.  Only the simple query protocol is
+// supported, as by psql.  Returns errConsoleFinished once the client disconnects.
+func serveConsole(client net.Conn, reader *bufio.Reader, user string, l *listener) error {
+	defer client.Close()
+
+	if !slices.Contains(l.config.AdminUsers, user) || l.userlist == nil {
+		rejectClient(client, codec.SQLStateInvalidAuthorization, fmt.Sprintf("user %q may not use the admin console", user))
+		return fmt.Errorf("user %q may not use the admin console", user)
+	}
+	err := auth.Authenticate(client, reader, user, l.userlist.Credential(user))
+	if err = finishAuthentication(client, user, "password", err, l); err != nil {
+		return err
+	}
+
+	for _, message := range []codec.Message{
+		codec.NewAuthenticationOkMessage(),
+		codec.NewParameterStatus("client_encoding", "UTF8"),
+		codec.NewParameterStatus("DateStyle", "ISO"),
+		codec.NewParameterStatus("standard_conforming_strings", "on"),
+		codec.NewReadyForQueryMessage(codec.BackendTransactionStatusIdle),
+	} {
+		if err = writePacket(client, message); err != nil {
+			return err
+		}
+	}
+
+	event := clientEvent(client, audit.ConnectionAccepted, "")
+	event.User, event.Database = user, remote.AdminDatabase
+	event.Details = map[string]any{"console": true}
+	audit.Record(event)
+	slog.Info("admin console session started", "user", user, "client", client.RemoteAddr().String())
+
+	for {
+		message, err := codec.ReadMessage(reader)
+		if err != nil {
+			if isClosedErr(err) {
+				return errConsoleFinished
+			}
+			return err
+		}
+
+		switch message.Type {
+		case codec.MessageTypeTerminate:
+			return errConsoleFinished
+		case codec.MessageTypeQuery:
+			if err = runConsoleCommand(client, message.ParseAsQuery().QueryString, user, l); err != nil {
+				return err
+			}
+		default:
+			rejectClient(client, codec.SQLStateFeatureNotSupported, "the admin console only supports simple queries")
+			return errConsoleFinished
+		}
+	}
+}
+
+func runConsoleCommand(client net.Conn, query string, user string, l *listener) error {
+	query = strings.TrimSpace(strings.TrimRight(strings.TrimSpace(query), ";"))
+	command := strings.ToUpper(strings.Join(strings.Fields(query), " "))
+
+	var buf []byte
+	if command == "" {
+		buf = append(buf, codec.NewEmptyQueryResponse().Data...)
+	} else if entry, statement, ok := parseScatter(query); ok {
+		buf = scatter(buf, entry, statement, user, l)
+	} else if run, ok := consoleCommands[command]; ok {
+		result := run()
+		buf = append(buf, codec.NewRowDescription(result.columns...).Data...)
+		for _, row := range result.rows {
+			buf = append(buf, codec.NewDataRow(row...).Data...)
+		}
+		buf = append(buf, codec.NewCommandComplete("SHOW").Data...)
+	} else {
+		buf = append(buf, codec.NewErrorResponse(codec.ErrorSeverityError, codec.SQLStateSyntaxError, fmt.Sprintf("invalid command %q, use SHOW HELP", query)).Data...)
+	}
+	buf = append(buf, codec.NewReadyForQueryMessage(codec.BackendTransactionStatusIdle).Data...)
+
+	_, err := client.Write(buf)
+	return err
+}
+
+const scatterUsage = "SCATTER <entry> <query>"
+
+// Splits a SCATTER command into its entry and query
+func parseScatter(query string) (entry, statement string, ok bool) {
+	// the query is trimmed, so its first field starts it
+	fields := strings.Fields(query)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "SCATTER") {
+		return "", "", false
+	}
+
+	rest := strings.TrimSpace(query[len(fields[0]):])
+	if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+		return rest[:i], strings.TrimSpace(rest[i:]), true
+	}
+	return rest, "", true
+}
+
+// Runs a query on every shard (target) of an entry, appending the rows, each led by the shard's
+// name, or the error to the response
+func scatter(buf []byte, name, statement, user string, l *listener) []byte {
+	var entry *remote.ConfigEntry
+	for _, e := range l.entries() {
+		if e.Name == name {
+			entry = &e
+		}
+	}
+	switch {
+	case name == "" || statement == "":
+		return append(buf, codec.NewErrorResponse(codec.ErrorSeverityError, codec.SQLStateSyntaxError, "usage: "+scatterUsage).Data...)
+	case entry == nil:
+		return append(buf, codec.NewErrorResponse(codec.ErrorSeverityError, codec.SQLStateInvalidCatalogName, fmt.Sprintf("no entry named %q", name)).Data...)
+	}
+
+	slog.Info("scattering query across shards", "user", user, "entry", name, "query", statement)
+	result, err := remote.Scatter(entry, statement)
+	if err != nil {
+		code := codec.SQLStateUnableToEstablishConnection
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			code = pgErr.Code
+		} else if errors.Is(err, remote.ErrShardsDisagree) {
+			code = codec.SQLStateDatatypeMismatch
+		}
+		return append(buf, codec.NewErrorResponse(codec.ErrorSeverityError, code, err.Error()).Data...)
+	}
+
+	buf = append(buf, codec.NewRowDescription(result.Columns...).Data...)
+	for _, row := range result.Rows {
+		values := make([]*string, len(row))
+		for i, value := range row {
+			if value != nil {
+				values[i] = text(string(value))
+			}
+		}
+		buf = append(buf, codec.NewDataRow(values...).Data...)
+	}
+	return append(buf, codec.NewCommandComplete(fmt.Sprintf("SELECT %d", len(result.Rows))).Data...)
+}
+
+func showHelp() consoleResult {
+	commands := make([]string, 0, len(consoleCommands))
+	for command := range consoleCommands {
+		commands = append(commands, command)
+	}
+	slices.Sort(commands)
+
+	result := consoleResult{columns: []string{"command"}}
+	for _, command := range commands {
+		result.rows = append(result.rows, []*string{text(command)})
+	}
+	result.rows = append(result.rows, []*string{text(scatterUsage)})
+
+	return result
+}
+
+// Like pgbouncer's SHOW STATS, per entry: times are in microseconds, averages are per second (or
+// per transaction, query and wait for the times) over the last minute.  total_sessions and
+// active_sessions are our own.
+func showStats() consoleResult {
+	result := consoleResult{columns: []string{
+		"entry", "database",
+		"total_xact_count", "total_query_count", "total_received", "total_sent",
+		"total_xact_time", "total_query_time", "total_wait_time",
+		"avg_xact_count", "avg_query_count", "avg_recv", "avg_sent",
+		"avg_xact_time", "avg_query_time", "avg_wait_time",
+		"total_sessions", "active_sessions",
+	}}
+
+	for _, s := range remote.EntryStats() {
+		result.rows = append(result.rows, []*string{
+			text(s.Entry), text(s.Database),
+			number(s.TotalTransactions), number(s.TotalQueries), number(s.TotalReceived), number(s.TotalSent),
+			micros(s.TotalTransactionTime), micros(s.TotalQueryTime), micros(s.TotalWaitTime),
+			rate(s.AvgTransactions), rate(s.AvgQueries), rate(s.AvgReceived), rate(s.AvgSent),
+			micros(s.AvgTransactionTime), micros(s.AvgQueryTime), micros(s.AvgWaitTime),
+			number(s.TotalSessions), number(s.ActiveSessions),
+		})
+	}
+
+	return result
+}
+
+// Messages relayed per entry, by who sent them (client or server) and type byte, e.g. client Q
+// for simple queries and server D for data rows
+func showMessages() consoleResult {
+	result := consoleResult{columns: []string{"entry", "direction", "type", "count"}}
+
+	for _, m := range remote.EntryMessages() {
+		result.rows = append(result.rows, []*string{
+			text(m.Entry), text(m.Direction), text(string(rune(m.Type))), number(m.Count),
+		})
+	}
+
+	return result
+}
+
+// Like pgbouncer's SHOW POOLS, per entry
+func showPools() consoleResult {
+	result := consoleResult{columns: []string{
+		"entry", "database", "cl_active", "cl_waiting", "cl_idle_in_transaction", "sv_active", "sv_idle",
+		"maxwait", "maxwait_us", "max_idle_in_transaction_us", "pool_mode",
+	}}
+
+	for _, p := range remote.Pools() {
+		result.rows = append(result.rows, []*string{
+			text(p.Entry), text(p.Database),
+			number(p.ClientsActive), number(p.ClientsWaiting), number(p.ClientsIdleInTransaction),
+			number(p.ServersActive), number(p.ServersIdle),
+			number(int64(p.MaxWait / time.Second)), number((p.MaxWait % time.Second).Microseconds()),
+			number(p.MaxIdleInTransaction.Microseconds()), text(p.PoolMode),
+		})
+	}
+
+	return result
+}
+
+// Per user of each entry: their sessions, and the upstream connections they hold or wait for
+func showUsers() consoleResult {
+	result := consoleResult{columns: []string{"entry", "user", "cl_active", "cl_waiting", "sv_active", "maxwait_us"}}
+
+	for _, u := range remote.PoolUsers() {
+		result.rows = append(result.rows, []*string{
+			text(u.Entry), text(u.User), number(u.ClientsActive), number(u.ClientsWaiting), number(u.ServersActive),
+			number(u.MaxWait.Microseconds()),
+		})
+	}
+
+	return result
+}
+
+// Per target of each entry: its upstream connections, and how sessions acquired them
+func showUpstreams() consoleResult {
+	result := consoleResult{columns: []string{
+		"entry", "target", "sv_open", "sv_in_use", "total_acquires", "total_acquire_timeouts", "avg_acquire_wait_us",
+	}}
+
+	for _, u := range remote.Upstreams() {
+		result.rows = append(result.rows, []*string{
+			text(u.Entry), text(u.Target), number(u.Open), number(u.InUse),
+			number(u.Acquires), number(u.AcquireTimeouts), number(u.AvgAcquireWait.Microseconds()),
+		})
+	}
+
+	return result
+}
+
+// Every client session, like Postgres' pg_stat_activity.  duration_us is how long the session has
+// been connected, query_duration_us how long its current query has been running (NULL unless
+// active), and backend_pid is NULL while the session holds no upstream connection.
+func showSessions() consoleResult {
+	result := consoleResult{columns: []string{
+		"session", "entry", "user", "database", "application_name", "client_addr", "state",
+		"backend_start", "xact_start", "query_start", "state_change", "duration_us", "query_duration_us", "query",
+		"target", "upstream", "backend_pid", "bytes_received", "bytes_sent", "bytes_buffered",
+		"protocol_anomalies",
+	}}
+
+	now := time.Now()
+	for _, s := range remote.Sessions() {
+		var queryDuration, backendPID *string
+		if s.State == "active" && !s.QueryStart.IsZero() {
+			queryDuration = micros(now.Sub(s.QueryStart))
+		}
+		if s.BackendPID != 0 {
+			backendPID = number(int64(s.BackendPID))
+		}
+
+		result.rows = append(result.rows, []*string{
+			text(s.Session), text(s.Entry), text(s.User), text(s.Database), text(s.ApplicationName), text(s.ClientAddr), text(s.State),
+			timestamp(s.Started), timestamp(s.TransactionStart), timestamp(s.QueryStart), timestamp(s.StateChange),
+			micros(now.Sub(s.Started)), queryDuration, text(s.Query),
+			text(s.Target), text(s.Upstream), backendPID, number(s.Received), number(s.Sent), number(s.Buffered),
+			number(s.Anomalies),
+		})
+	}
+
+	return result
+}
+
+func text(s string) *string {
+	return &s
+}
+
+func number[N int | int64 | uint64](n N) *string {
+	return text(fmt.Sprint(n))
+}
+
+func micros(d time.Duration) *string {
+	return number(d.Microseconds())
+}
+
+func rate(r float64) *string {
+	return text(strconv.FormatFloat(r, 'f', 0, 64))
+}
+
+// Formats a time like Postgres' timestamptz, NULL if zero
+func timestamp(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	return text(t.Format("2006-01-02 15:04:05.999999-07"))
+}
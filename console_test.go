@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestParseScatter(t *testing.T) {
+	for _, tc := range []struct {
+		query, entry, statement string
+		ok                      bool
+	}{
+		{"scatter orders SELECT count(*) FROM t", "orders", "SELECT count(*) FROM t", true},
+		{"SCATTER\torders\n  SELECT 'a  b'", "orders", "SELECT 'a  b'", true},
+		{"SCATTER orders", "orders", "", true},
+		{"SHOW POOLS", "", "", false},
+		{"SCATTERED orders SELECT 1", "", "", false},
+	} {
+		entry, statement, ok := parseScatter(tc.query)
+		if entry != tc.entry || statement != tc.statement || ok != tc.ok {
+			t.Errorf("%q: expected %q %q %v, got %q %q %v", tc.query, tc.entry, tc.statement, tc.ok, entry, statement, ok)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+var parkedSessions = metrics.NewGauge(
+	"pgproxy_parked_sessions", "Transaction pooled sessions parked between transactions (client_engine epoll).",
+)
+
+// Parks idle client sessions (client_engine "epoll"): rather than each keeping a goroutine blocked
+// reading its client, sessions between transactions hand their connection to the engine, whose
+// single goroutine waits for any of them to become readable and resumes the session then.  With
+// tens of thousands of mostly idle clients, their goroutines and read buffers would otherwise be
+// most of the proxy's memory.
+type engine struct {
+	poller poller
+
+	mu sync.Mutex
+	// by file descriptor
+	parked map[int]*parkableConn
+}
+
+// Waits for file descriptors to become readable, implemented per OS
+type poller interface {
+	add(fd int) error
+	remove(fd int) error
+	// calls `ready` with each file descriptor that became readable (or was hung up), forever
+	wait(ready func(fd int))
+}
+
+func newEngine() (*engine, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &engine{poller: p, parked: make(map[int]*parkableConn)}
+	go p.wait(e.ready)
+	return e, nil
+}
+
+// Wraps a newly accepted client connection so that its session can be parked.  Only plain TCP
+// connections can: TLS connections may hold decrypted data that the socket doesn't show.
+func (e *engine) wrap(conn net.Conn) net.Conn {
+	tcp, ok := conn.(*net.TCPConn)
+	if e == nil || !ok {
+		return conn
+	}
+	return &parkableConn{TCPConn: tcp, engine: e}
+}
+
+// A client connection of a listener with an engine
+type parkableConn struct {
+	*net.TCPConn
+	engine *engine
+
+	// set while the connection is parked
+	fd     int
+	resume func()
+}
+
+// Parks the connection until the client sends something or the connection is closed, and then calls
+// `resume`, which must not block.  Returns false if the connection can't be parked, in which case
+// the caller goes on reading it itself.
+func (c *parkableConn) park(resume func()) bool {
+	raw, err := c.TCPConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	fd := -1
+	if err = raw.Control(func(f uintptr) { fd = int(f) }); err != nil || fd < 0 {
+		return false
+	}
+
+	e := c.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c.fd, c.resume = fd, resume
+	e.parked[fd] = c
+	if err = e.poller.add(fd); err != nil {
+		slog.Warn("could not park session", "error", err)
+		delete(e.parked, fd)
+		c.resume = nil
+		return false
+	}
+	parkedSessions.Inc()
+
+	return true
+}
+
+// Closes the connection, first resuming its session if it is parked, so that the session sees the
+// connection closed and cleans up
+func (c *parkableConn) Close() error {
+	resume := c.engine.unpark(c)
+	err := c.TCPConn.Close()
+	if resume != nil {
+		resume()
+	}
+	return err
+}
+
+// Takes a connection off the poller, returning its resume function, or nil if it isn't parked
+func (e *engine) unpark(c *parkableConn) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.unparkLocked(c)
+}
+
+func (e *engine) unparkLocked(c *parkableConn) func() {
+	resume := c.resume
+	if resume == nil {
+		return nil
+	}
+	c.resume = nil
+	delete(e.parked, c.fd)
+	if err := e.poller.remove(c.fd); err != nil {
+		slog.Debug("could not remove parked session from poller", "error", err)
+	}
+	parkedSessions.Dec()
+
+	return resume
+}
+
+func (e *engine) ready(fd int) {
+	var resume func()
+	e.mu.Lock()
+	if c := e.parked[fd]; c != nil {
+		resume = e.unparkLocked(c)
+	}
+	e.mu.Unlock()
+
+	if resume != nil {
+		resume()
+	}
+}
+
+// Read buffers of parked sessions, which don't need one until they are resumed
+var readers = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
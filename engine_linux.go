@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"syscall"
+)
+
+type epoll struct {
+	fd int
+}
+
+func newPoller() (poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epoll{fd: fd}, nil
+}
+
+func (p *epoll) add(fd int) error {
+	// one event per parking: the session is resumed and takes the connection off the poller
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(fd)}
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, &event)
+}
+
+func (p *epoll) remove(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *epoll) wait(ready func(fd int)) {
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(p.fd, events, -1)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			slog.Error("fatal: could not wait for parked sessions", "error", err)
+			return
+		}
+
+		for _, event := range events[:n] {
+			ready(int(event.Fd))
+		}
+	}
+}
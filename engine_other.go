@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func newPoller() (poller, error) {
+	return nil, errors.New("client_engine epoll is only supported on Linux")
+}
@@ -0,0 +1,437 @@
+// HTTP API for inspecting and adjusting a running proxy.
+//
+// The admin API is disabled unless an address is passed with --admin-addr, and it has no
+// authentication of its own, so it should only ever be bound to a loopback or otherwise private
+// interface.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/audit"
+	"github.com/michaelhelvey/pgproxy/internal/lifecycle"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+)
+
+type targetStatus struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	Weight   int    `json:"weight"`
+	Draining bool   `json:"draining"`
+	Sessions int    `json:"sessions"`
+}
+
+type routeStatus struct {
+	Name     string         `json:"name"`
+	Affinity string         `json:"affinity"`
+	Shadow   bool           `json:"shadow"`
+	Barrier  bool           `json:"barrier"`
+	Targets  []targetStatus `json:"targets"`
+}
+
+type server struct{}
+
+func NewHandler() http.Handler {
+	s := &server{}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", healthz)
+	mux.HandleFunc("GET /readyz", readyz)
+	mux.HandleFunc("GET /routes", s.listRoutes)
+	mux.HandleFunc("POST /routes", s.putRoute(false))
+	mux.HandleFunc("PUT /routes/{entry}", s.putRoute(true))
+	mux.HandleFunc("DELETE /routes/{entry}", s.deleteRoute)
+	mux.HandleFunc("PUT /routes/{entry}/targets/{target}/weight", s.setTargetWeight)
+	mux.HandleFunc("POST /routes/{entry}/cutover", s.cutover)
+	mux.HandleFunc("POST /routes/{entry}/barrier", s.raiseBarrier)
+	mux.HandleFunc("DELETE /routes/{entry}/barrier", s.lowerBarrier)
+	mux.HandleFunc("POST /routes/{entry}/targets/{target}/drain", s.setTargetDraining(true))
+	mux.HandleFunc("DELETE /routes/{entry}/targets/{target}/drain", s.setTargetDraining(false))
+	mux.HandleFunc("DELETE /routes/{entry}/provider-cache", s.invalidateProviderCache)
+	mux.HandleFunc("POST /routes/{entry}/maintenance", s.setMaintenance(true))
+	mux.HandleFunc("DELETE /routes/{entry}/maintenance", s.setMaintenance(false))
+	mux.HandleFunc("POST /routes/{entry}/rotate-credentials", s.rotateCredentials)
+	mux.HandleFunc("GET /listeners/{listener}/ip-access", s.getIPAccess)
+	mux.HandleFunc("PUT /listeners/{listener}/ip-access", s.setIPAccess)
+
+	return mux
+}
+
+// Liveness: the proxy is up, even while draining
+func healthz(w http.ResponseWriter, r *http.Request) {
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// Readiness: whether the proxy should be sent new clients (see lifecycle.Ready)
+func readyz(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case lifecycle.Draining():
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+	case !lifecycle.Ready():
+		http.Error(w, "standby", http.StatusServiceUnavailable)
+	default:
+		_, _ = fmt.Fprintln(w, "ready")
+	}
+}
+
+func (s *server) findEntry(name string) *remote.ConfigEntry {
+	configs := remote.Routes()
+	for i := range configs {
+		if configs[i].Name == name {
+			return &configs[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *server) listRoutes(w http.ResponseWriter, r *http.Request) {
+	configs := remote.Routes()
+	routes := make([]routeStatus, 0, len(configs))
+	for i := range configs {
+		entry := &configs[i]
+		route := routeStatus{Name: entry.Name, Affinity: entry.Affinity, Shadow: entry.Shadow, Barrier: remote.BarrierRaised(entry.Name)}
+
+		for _, t := range entry.AllTargets() {
+			route.Targets = append(route.Targets, targetStatus{
+				Name:     t.Name,
+				Provider: t.Provider,
+				Weight:   entry.TargetWeight(t),
+				Draining: entry.IsDraining(t),
+				Sessions: remote.SessionCount(entry.Name, t.Name),
+			})
+		}
+
+		routes = append(routes, route)
+	}
+
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// Adds a route (POST /routes), or adds or replaces one (PUT /routes/{entry}), from an entry in the
+// body.  With ?persist=true the config file is rewritten to match.
+func (s *server) putRoute(replace bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var entry remote.ConfigEntry
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entry); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("expected an entry as the body: %w", err))
+			return
+		}
+		if name := r.PathValue("entry"); name != "" && entry.Name != name {
+			if entry.Name != "" {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("the entry is named %s rather than %s", entry.Name, name))
+				return
+			}
+			entry.Name = name
+		}
+
+		persist := r.URL.Query().Get("persist") == "true"
+		err := remote.PutRoute(entry, replace, persist)
+		switch {
+		case errors.Is(err, remote.ErrRouteExists):
+			writeError(w, http.StatusConflict, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		recordAction(r, entry.Name, "put route", map[string]any{"replace": replace, "persist": persist})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *server) deleteRoute(w http.ResponseWriter, r *http.Request) {
+	persist := r.URL.Query().Get("persist") == "true"
+	err := remote.DeleteRoute(r.PathValue("entry"), persist)
+	switch {
+	case errors.Is(err, remote.ErrNoRoute):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	recordAction(r, r.PathValue("entry"), "delete route", map[string]any{"persist": persist})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) setTargetWeight(w http.ResponseWriter, r *http.Request) {
+	entry := s.findEntry(r.PathValue("entry"))
+	if entry == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no entry named %s", r.PathValue("entry")))
+		return
+	}
+
+	var body struct {
+		Weight *int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Weight == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expected body of the form {\"weight\": <int>}"))
+		return
+	}
+
+	if err := remote.SetTargetWeight(entry, r.PathValue("target"), *body.Weight); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	slog.Info("admin: updated target weight", "entry", entry.Name, "target", r.PathValue("target"), "weight", *body.Weight)
+	recordAction(r, entry.Name, "set target weight", map[string]any{"target": r.PathValue("target"), "weight": *body.Weight})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) setTargetDraining(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := s.findEntry(r.PathValue("entry"))
+		if entry == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no entry named %s", r.PathValue("entry")))
+			return
+		}
+
+		if err := remote.SetTargetDraining(entry, r.PathValue("target"), draining); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		slog.Info("admin: updated target draining", "entry", entry.Name, "target", r.PathValue("target"), "draining", draining)
+		recordAction(r, entry.Name, "set target draining", map[string]any{"target": r.PathValue("target"), "draining": draining})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *server) setMaintenance(on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := s.findEntry(r.PathValue("entry"))
+		if entry == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no entry named %s", r.PathValue("entry")))
+			return
+		}
+
+		var body struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if on {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("expected body of the form {\"code\": \"57P03\", \"message\": \"...\"}"))
+				return
+			}
+		}
+
+		if err := remote.SetMaintenance(entry, on, body.Code, body.Message); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		details := map[string]any{"on": on}
+		if body.Message != "" {
+			details["message"] = body.Message
+		}
+		recordAction(r, entry.Name, "set maintenance", details)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *server) invalidateProviderCache(w http.ResponseWriter, r *http.Request) {
+	entry := s.findEntry(r.PathValue("entry"))
+	if entry == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no entry named %s", r.PathValue("entry")))
+		return
+	}
+
+	dropped := remote.InvalidateProviderCache(entry)
+	slog.Info("admin: invalidated provider cache", "entry", entry.Name, "dropped", dropped)
+	recordAction(r, entry.Name, "invalidate provider cache", map[string]any{"dropped": dropped})
+	writeJSON(w, http.StatusOK, map[string]int{"dropped": dropped})
+}
+
+func (s *server) rotateCredentials(w http.ResponseWriter, r *http.Request) {
+	entry := s.findEntry(r.PathValue("entry"))
+	if entry == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no entry named %s", r.PathValue("entry")))
+		return
+	}
+
+	recycled := remote.RotateCredentials(entry)
+	recordAction(r, entry.Name, "rotate credentials", map[string]any{"recycled": recycled})
+	writeJSON(w, http.StatusOK, map[string]int{"recycled": recycled})
+}
+
+// Default for how long a cutover waits for in-flight transactions before giving up
+const defaultCutoverTimeout = 30 * time.Second
+
+func (s *server) cutover(w http.ResponseWriter, r *http.Request) {
+	entry := s.findEntry(r.PathValue("entry"))
+	if entry == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no entry named %s", r.PathValue("entry")))
+		return
+	}
+
+	var body struct {
+		Target  string `json:"target"`
+		Timeout string `json:"timeout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Target == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expected body of the form {\"target\": <name>, \"timeout\": \"30s\"}"))
+		return
+	}
+
+	timeout := defaultCutoverTimeout
+	if body.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(body.Timeout); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout: %w", err))
+			return
+		}
+	}
+
+	closed, err := remote.Cutover(entry, body.Target, timeout)
+	details := map[string]any{"target": body.Target, "closed_sessions": closed}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	recordAction(r, entry.Name, "cutover", details)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"closed_sessions": closed})
+}
+
+// Defaults for how long raising a barrier waits for in-flight transactions, and how long the
+// barrier is held at most
+const (
+	defaultBarrierDrain = 30 * time.Second
+	defaultBarrierHold  = time.Minute
+)
+
+func (s *server) raiseBarrier(w http.ResponseWriter, r *http.Request) {
+	entry := s.findEntry(r.PathValue("entry"))
+	if entry == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no entry named %s", r.PathValue("entry")))
+		return
+	}
+
+	var body struct {
+		Drain string `json:"drain"`
+		Hold  string `json:"hold"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expected body of the form {\"drain\": \"30s\", \"hold\": \"1m\"}"))
+		return
+	}
+
+	drain, hold := defaultBarrierDrain, defaultBarrierHold
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{{"drain", body.Drain, &drain}, {"hold", body.Hold, &hold}} {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		if *d.dst, err = time.ParseDuration(d.value); err != nil || *d.dst <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %q", d.name, d.value))
+			return
+		}
+	}
+
+	err := remote.RaiseBarrier(entry, drain, hold)
+	details := map[string]any{"drain": drain.String(), "hold": hold.String()}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	recordAction(r, entry.Name, "raise barrier", details)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) lowerBarrier(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("entry")
+	recycled, err := remote.LowerBarrier(name)
+	if errors.Is(err, remote.ErrNoBarrier) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	recordAction(r, name, "lower barrier", map[string]any{"recycled": recycled})
+	writeJSON(w, http.StatusOK, map[string]int{"recycled": recycled})
+}
+
+func (s *server) getIPAccess(w http.ResponseWriter, r *http.Request) {
+	access, err := remote.IPAccessOf(r.PathValue("listener"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if access == nil {
+		access = &remote.IPAccess{}
+	}
+
+	writeJSON(w, http.StatusOK, access)
+}
+
+// Replaces a listener's ip_access until the config is next reloaded.  Empty lists accept
+// connections from anywhere.
+func (s *server) setIPAccess(w http.ResponseWriter, r *http.Request) {
+	var access remote.IPAccess
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&access); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expected body of the form {\"allow\": [<cidr>...], \"deny\": [<cidr>...]}"))
+		return
+	}
+
+	listener := r.PathValue("listener")
+	if err := remote.SetIPAccess(listener, &access); errors.Is(err, remote.ErrNoListener) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	slog.Info("admin: updated ip access", "listener", listener, "allow", access.Allow, "deny", access.Deny)
+	recordAction(r, "", "set ip access", map[string]any{"listener": listener, "allow": access.Allow, "deny": access.Deny})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func recordAction(r *http.Request, entry, action string, details map[string]any) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	audit.Record(audit.Event{Type: audit.AdminAction, ClientAddr: host, Entry: entry, Reason: action, Details: details})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("admin: could not write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,107 @@
+// Connection admission policy that lives outside the proxy, e.g. in OPA or an internal
+// authorization service.
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// How long a callout may take unless configured otherwise
+const DefaultWebhookTimeout = 5 * time.Second
+
+// What clients are told when the webhook rejects them, unless configured otherwise
+const DefaultRejectMessage = "connection rejected by admission policy"
+
+// Asks an HTTP endpoint whether to let a client in once it has authenticated.  The endpoint gets a
+// POST of a Request as JSON, and anything but a 200 rejects the client.
+type Webhook struct {
+	URL string `json:"url"`
+	// extra headers for the callout, e.g. an Authorization header
+	Headers map[string]string `json:"headers"`
+	// sent to rejected clients, defaults to DefaultRejectMessage
+	ErrorMessage string `json:"error_message"`
+	// let clients in if the endpoint can't be reached or doesn't answer in time, rather than
+	// rejecting them
+	FailOpen bool `json:"fail_open"`
+	// bounds each callout, defaults to DefaultWebhookTimeout
+	Timeout time.Duration `json:"-"`
+
+	client *http.Client
+}
+
+// What the webhook is told about a client
+type Request struct {
+	ClientAddr      string `json:"client_addr"`
+	User            string `json:"user"`
+	Database        string `json:"database"`
+	ApplicationName string `json:"application_name"`
+}
+
+// Why a client was rejected, with the message to send it
+type RejectedError struct {
+	Message string
+	reason  string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("admission webhook rejected connection: %s", e.reason)
+}
+
+func NewWebhook(config Webhook) *Webhook {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	if config.ErrorMessage == "" {
+		config.ErrorMessage = DefaultRejectMessage
+	}
+	config.client = &http.Client{Timeout: config.Timeout}
+
+	return &config
+}
+
+// Returns nil if the client may connect, a *RejectedError if it may not, or another error if
+// the webhook failed and FailOpen isn't set
+func (w *Webhook) Admit(request Request) error {
+	err := w.call(request)
+	if err != nil && w.FailOpen {
+		if _, rejected := err.(*RejectedError); !rejected {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (w *Webhook) call(request Request) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("admission webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode != http.StatusOK {
+		return &RejectedError{Message: w.ErrorMessage, reason: resp.Status}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package admission
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookAdmit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request.User != "alice" || request.Database != "app" || request.ClientAddr != "10.0.0.1" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	webhook := NewWebhook(Webhook{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}, ErrorMessage: "ask #dba"})
+
+	if err := webhook.Admit(Request{ClientAddr: "10.0.0.1", User: "alice", Database: "app"}); err != nil {
+		t.Errorf("expected client to be admitted, got %v", err)
+	}
+
+	var rejected *RejectedError
+	err := webhook.Admit(Request{ClientAddr: "10.0.0.1", User: "mallory", Database: "app"})
+	if !errors.As(err, &rejected) || rejected.Message != "ask #dba" {
+		t.Errorf("expected client to be rejected with the configured message, got %v", err)
+	}
+
+	// an unreachable endpoint rejects clients unless the webhook fails open
+	server.Close()
+	for _, failOpen := range []bool{false, true} {
+		webhook := NewWebhook(Webhook{URL: server.URL, FailOpen: failOpen, Timeout: time.Second})
+		err := webhook.Admit(Request{User: "alice"})
+		if failOpen != (err == nil) || errors.As(err, &rejected) {
+			t.Errorf("fail_open=%v: unexpected result %v", failOpen, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Security audit events: who connected, who failed to log in, which requests policies refused and
+// what admins changed.  Events go to their own sinks as JSON, separate from the debug log, so that
+// they can be shipped to a SIEM without parsing log lines.
+//
+// The event schema is stable: fields are only ever added, and SchemaVersion is bumped if one has
+// to change meaning.
+package audit
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+const SchemaVersion = 1
+
+type EventType string
+
+const (
+	// a client completed startup and its session is being relayed
+	ConnectionAccepted EventType = "connection_accepted"
+	// a client was turned away, at accept time or during startup
+	ConnectionRejected EventType = "connection_rejected"
+	AuthSucceeded      EventType = "auth_succeeded"
+	AuthFailed         EventType = "auth_failed"
+	// a source IP was banned after too many failed logins
+	ClientBanned EventType = "client_banned"
+	// a rule (e.g. an entry's access policy) refused a request
+	RequestRefused EventType = "request_refused"
+	// a change made through the admin API
+	AdminAction EventType = "admin_action"
+)
+
+type Event struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Type    EventType `json:"type"`
+	// the proxy's session ID, as in the upstream application_name
+	Session    string `json:"session,omitempty"`
+	ClientAddr string `json:"client_addr,omitempty"`
+	User       string `json:"user,omitempty"`
+	Database   string `json:"database,omitempty"`
+	Entry      string `json:"entry,omitempty"`
+	// the entry's labels
+	Labels map[string]string `json:"labels,omitempty"`
+	// why a connection or request was rejected, or what an admin action did
+	Reason  string         `json:"reason,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Where events go.  Any combination of sinks may be set.
+type Config struct {
+	// appends one JSON event per line
+	File    string         `json:"file"`
+	Syslog  *SyslogConfig  `json:"syslog"`
+	Webhook *WebhookConfig `json:"webhook"`
+}
+
+// How many events may wait for the sinks before new ones are dropped
+const queueSize = 4096
+
+// How many events are handed to the sinks at once
+const maxBatch = 100
+
+var droppedEvents = metrics.NewCounter("pgproxy_audit_events_dropped_total", "Audit events dropped because the sinks fell behind.")
+
+type sink interface {
+	write(events []Event) error
+	name() string
+}
+
+var queue chan Event
+
+// Opens the configured sinks and starts delivering events to them.  Events recorded before Start
+// (or without a config) are discarded.
+func Start(config *Config) error {
+	if config == nil {
+		return nil
+	}
+
+	var sinks []sink
+	if config.File != "" {
+		s, err := newFileSink(config.File)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, s)
+	}
+	if config.Syslog != nil {
+		s, err := newSyslogSink(config.Syslog)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, s)
+	}
+	if config.Webhook != nil {
+		sinks = append(sinks, newWebhookSink(config.Webhook))
+	}
+
+	queue = make(chan Event, queueSize)
+	go deliver(queue, sinks)
+
+	return nil
+}
+
+func deliver(queue <-chan Event, sinks []sink) {
+	batch := make([]Event, 0, maxBatch)
+	for event := range queue {
+		batch = append(batch[:0], event)
+		for len(batch) < maxBatch && len(queue) > 0 {
+			batch = append(batch, <-queue)
+		}
+
+		for _, s := range sinks {
+			if err := s.write(batch); err != nil {
+				slog.Error("could not write audit events", "sink", s.name(), "events", len(batch), "error", err)
+			}
+		}
+	}
+}
+
+// Queues an event for the sinks, filling in its version and time.  Never blocks: if the sinks fall
+// behind, the event is dropped and counted.
+func Record(event Event) {
+	if queue == nil {
+		return
+	}
+
+	event.Version = SchemaVersion
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	select {
+	case queue <- event:
+	default:
+		droppedEvents.Inc()
+	}
+}
+
+func marshalLines(events []Event) ([]byte, error) {
+	var buf []byte
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	return buf, nil
+}
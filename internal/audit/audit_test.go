@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordWritesToSinks(t *testing.T) {
+	var mu sync.Mutex
+	var posted []Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []Event
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		posted = append(posted, events...)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := Start(&Config{File: path, Webhook: &WebhookConfig{URL: server.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { queue = nil }()
+
+	Record(Event{Type: AuthFailed, ClientAddr: "10.0.0.1", User: "alice", Reason: "password mismatch"})
+	Record(Event{Type: AdminAction, Entry: "app", Reason: "cutover", Details: map[string]any{"target": "green"}})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(posted)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 events at the webhook, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in the audit file, got %d", len(lines))
+	}
+	first := lines[0]
+	if first["version"] != float64(SchemaVersion) || first["type"] != "auth_failed" || first["user"] != "alice" || first["time"] == nil {
+		t.Errorf("unexpected first event %v", first)
+	}
+	if _, ok := first["entry"]; ok {
+		t.Errorf("expected empty fields to be omitted, got %v", first)
+	}
+}
@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"time"
+)
+
+type fileSink struct {
+	file *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) name() string { return "file" }
+
+func (s *fileSink) write(events []Event) error {
+	buf, err := marshalLines(events)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(buf)
+	return err
+}
+
+type SyslogConfig struct {
+	// "udp", "tcp" or "unix", together with `address`.  Both empty means the local syslog daemon.
+	Network string `json:"network"`
+	Address string `json:"address"`
+	// defaults to "pgproxy"
+	Tag string `json:"tag"`
+}
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(config *SyslogConfig) (*syslogSink, error) {
+	tag := config.Tag
+	if tag == "" {
+		tag = "pgproxy"
+	}
+
+	writer, err := syslog.Dial(config.Network, config.Address, syslog.LOG_AUTH|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %w", err)
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) name() string { return "syslog" }
+
+func (s *syslogSink) write(events []Event) error {
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err := s.writer.Info(string(line)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type WebhookConfig struct {
+	// receives POSTs of JSON arrays of events
+	URL string `json:"url"`
+	// extra headers, e.g. an Authorization header
+	Headers map[string]string `json:"headers"`
+}
+
+type webhookSink struct {
+	config *WebhookConfig
+	client *http.Client
+}
+
+func newWebhookSink(config *WebhookConfig) *webhookSink {
+	return &webhookSink{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *webhookSink) name() string { return "webhook" }
+
+func (s *webhookSink) write(events []Event) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
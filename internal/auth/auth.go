@@ -0,0 +1,139 @@
+// Authentication of proxy clients.
+//
+// The proxy answers the client's startup itself, so it is also responsible for checking client
+// passwords.  Credentials are stored the same way postgres stores them in pg_authid.rolpassword
+// (a SCRAM-SHA-256 verifier, an md5 hash, or a plaintext password), and the exchange offered to
+// the client depends on which of those we have for them.
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+// Returned when the client completed the exchange but its password was wrong (or the user is
+// unknown; we don't tell clients which)
+var ErrPasswordMismatch = errors.New("password authentication failed")
+
+// A stored credential for a user, in one of the formats postgres keeps in pg_authid.rolpassword
+type Credential struct {
+	scram *scramVerifier
+	// "md5" followed by the hex md5 of password+user
+	md5 string
+	// plaintext password
+	password string
+}
+
+// Parses a credential as stored by postgres: "SCRAM-SHA-256$...", "md5..." or a plaintext password
+func ParseCredential(s string) (*Credential, error) {
+	if strings.HasPrefix(s, scramMechanism+"$") {
+		verifier, err := parseSCRAMVerifier(s)
+		if err != nil {
+			return nil, err
+		}
+		return &Credential{scram: verifier}, nil
+	}
+
+	if len(s) == 35 && strings.HasPrefix(s, "md5") {
+		if _, err := hex.DecodeString(s[3:]); err == nil {
+			return &Credential{md5: s}, nil
+		}
+	}
+
+	if s == "" {
+		return nil, errors.New("empty credential")
+	}
+
+	return &Credential{password: s}, nil
+}
+
+// Runs an authentication exchange with a client that has sent its startup message, checking the
+// password it proves knowledge of against `credential`.  A nil credential means the user is
+// unknown: the exchange still runs (so that clients can't probe for users), and always fails with
+// ErrPasswordMismatch.  Does not send AuthenticationOk on success.
+func Authenticate(w io.Writer, reader *bufio.Reader, user string, credential *Credential) error {
+	if credential == nil {
+		_ = scramExchange(w, reader, mockSCRAMVerifier())
+		return ErrPasswordMismatch
+	}
+
+	switch {
+	case credential.scram != nil:
+		return scramExchange(w, reader, credential.scram)
+	case credential.md5 != "":
+		return md5Exchange(w, reader, user, credential.md5)
+	default:
+		verifier, err := newSCRAMVerifier(credential.password)
+		if err != nil {
+			return err
+		}
+		return scramExchange(w, reader, verifier)
+	}
+}
+
+// Asks the client for its password in cleartext, for authentication methods that need the
+// password itself (e.g. to pass it on to another service).  Only use this over TLS.
+func ReadCleartextPassword(w io.Writer, reader *bufio.Reader) (string, error) {
+	if err := write(w, codec.NewAuthenticationRequest(codec.AuthenticationCleartextPassword, nil)); err != nil {
+		return "", err
+	}
+
+	message, err := codec.ReadMessage(reader)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := message.ParseAsPassword()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(data), "\x00"), nil
+}
+
+func md5Exchange(w io.Writer, reader *bufio.Reader, user string, stored string) error {
+	salt := make([]byte, 4)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	if err := write(w, codec.NewAuthenticationRequest(codec.AuthenticationMD5Password, salt)); err != nil {
+		return err
+	}
+
+	message, err := codec.ReadMessage(reader)
+	if err != nil {
+		return err
+	}
+
+	data, err := message.ParseAsPassword()
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(append([]byte(stored[3:]), salt...))
+	expected := "md5" + hex.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSuffix(string(data), "\x00")), []byte(expected)) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+func write(w io.Writer, message codec.Message) error {
+	_, err := w.Write(message.Data)
+	if err != nil {
+		return fmt.Errorf("could not write authentication request: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+// Connects a real client with `password` to a server that authenticates it against `credential`,
+// returning the client's and the server's errors
+func connect(t *testing.T, password string, credential *Credential) (error, error) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(serverConn)
+		if _, err := codec.ReadMessage(reader); err != nil {
+			serverErr <- err
+			return
+		}
+
+		err := Authenticate(serverConn, reader, "alice", credential)
+		if err != nil {
+			serverConn.Write(codec.NewErrorResponse(codec.ErrorSeverityFatal, codec.SQLStateInvalidPassword, err.Error()).Data)
+		} else {
+			serverConn.Write(codec.NewAuthenticationOkMessage().Data)
+			serverConn.Write(codec.NewReadyForQueryMessage(codec.BackendTransactionStatusIdle).Data)
+		}
+		serverErr <- err
+	}()
+
+	config, err := pgconn.ParseConfig(fmt.Sprintf("postgres://alice:%s@proxy/app?sslmode=disable", password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.LookupFunc = func(_ context.Context, host string) ([]string, error) { return []string{host}, nil }
+	config.DialFunc = func(context.Context, string, string) (net.Conn, error) { return clientConn, nil }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, clientErr := pgconn.ConnectConfig(ctx, config)
+	// closing the pipe rather than the client connection, which would wait for the server to read
+	// its Terminate; this also unblocks the server if the client gave up halfway
+	clientConn.Close()
+
+	return clientErr, <-serverErr
+}
+
+func TestAuthenticate(t *testing.T) {
+	verifier, err := newSCRAMVerifier("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := fmt.Sprintf(
+		"SCRAM-SHA-256$%d:%s$%s:%s", verifier.iterations, base64.StdEncoding.EncodeToString(verifier.salt),
+		base64.StdEncoding.EncodeToString(verifier.storedKey), base64.StdEncoding.EncodeToString(verifier.serverKey),
+	)
+	md5Sum := md5.Sum([]byte("secretalice"))
+
+	for _, raw := range []string{stored, "md5" + hex.EncodeToString(md5Sum[:]), "secret"} {
+		credential, err := ParseCredential(raw)
+		if err != nil {
+			t.Fatalf("could not parse %q: %v", raw, err)
+		}
+
+		if clientErr, serverErr := connect(t, "secret", credential); clientErr != nil || serverErr != nil {
+			t.Errorf("expected %q to accept the right password, got client error %v, server error %v", raw, clientErr, serverErr)
+		}
+
+		if _, serverErr := connect(t, "wrong", credential); !errors.Is(serverErr, ErrPasswordMismatch) {
+			t.Errorf("expected %q to reject the wrong password, got %v", raw, serverErr)
+		}
+	}
+
+	if _, serverErr := connect(t, "secret", nil); !errors.Is(serverErr, ErrPasswordMismatch) {
+		t.Errorf("expected unknown user to be rejected, got %v", serverErr)
+	}
+}
+
+func TestParseCredential(t *testing.T) {
+	for _, invalid := range []string{"", "SCRAM-SHA-256$4096:c2FsdA==$bad", "SCRAM-SHA-256$x:c2FsdA==$a:b"} {
+		if _, err := ParseCredential(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestUserlist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "userlist.txt")
+	write := func(content string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`;; comment
+"alice" "secret"
+"bob ""the builder""" "md5a2ff2d3b2f2a8d8e6a17c6e1e8d0e5b4"
+`, time.Now())
+	userlist, err := NewUserlist(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c := userlist.Credential("alice"); c == nil || c.password != "secret" {
+		t.Errorf("unexpected credential for alice: %+v", c)
+	}
+	if c := userlist.Credential(`bob "the builder"`); c == nil || c.md5 == "" {
+		t.Errorf("unexpected credential for bob: %+v", c)
+	}
+	if c := userlist.Credential("mallory"); c != nil {
+		t.Errorf("expected no credential for unknown user, got %+v", c)
+	}
+
+	// changes are picked up on the next check
+	write(`"carol" "secret"`+"\n", time.Now().Add(time.Minute))
+	userlist.checked = time.Time{}
+	if userlist.Credential("alice") != nil || userlist.Credential("carol") == nil {
+		t.Error("expected auth file to be reloaded")
+	}
+
+	// a broken file keeps the previous users
+	write(`"dave" "unterminated`+"\n", time.Now().Add(2*time.Minute))
+	userlist.checked = time.Time{}
+	if userlist.Credential("carol") == nil {
+		t.Error("expected previous users to be kept after a failed reload")
+	}
+}
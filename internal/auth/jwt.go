@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the JWKS is refetched unless configured otherwise
+const DefaultJWKSRefreshInterval = time.Hour
+
+// How long to wait between refetching the JWKS because a token names a key we don't have, so that
+// clients can't make us hammer the JWKS endpoint
+const jwksMissRefetchInterval = time.Minute
+
+// How far token validity checks tolerate clocks being out of sync
+const jwtClockSkew = 30 * time.Second
+
+// Lets clients log in with a JWT as their password, e.g. a short-lived workload identity token.
+// Tokens must be signed by a key from the JWKS, and name the user (and optionally the database)
+// the client logs in as.
+type JWT struct {
+	// where to fetch the JSON Web Key Set from, http(s):// or file://
+	JWKSURL string `json:"jwks_url"`
+	// required `iss` claim, if set
+	Issuer string `json:"issuer"`
+	// required `aud` claim (or one of them), if set
+	Audience string `json:"audience"`
+	// claim that must equal the user the client logs in as, defaults to "sub"
+	UserClaim string `json:"user_claim"`
+	// claim that must equal (or, if it's an array, contain) the database the client logs in to.
+	// Databases aren't restricted if unset.
+	DatabaseClaim string `json:"database_claim"`
+	// how often to refetch the JWKS, defaults to DefaultJWKSRefreshInterval
+	RefreshInterval time.Duration `json:"-"`
+}
+
+// Checks tokens against a JWT config, caching its JWKS
+type JWTVerifier struct {
+	config JWT
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// closed once the JWKS fetch under way finishes, nil without one
+	fetching chan struct{}
+}
+
+func NewJWTVerifier(config JWT) *JWTVerifier {
+	if config.UserClaim == "" {
+		config.UserClaim = "sub"
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultJWKSRefreshInterval
+	}
+
+	return &JWTVerifier{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Checks that `token` is valid and allows logging in as `user` to `database`, and returns its
+// claims.  Returns an error wrapping ErrPasswordMismatch if it doesn't.
+func (v *JWTVerifier) Authenticate(token, user, database string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrPasswordMismatch)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed token header", ErrPasswordMismatch)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token signature", ErrPasswordMismatch)
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPasswordMismatch, err)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed token claims", ErrPasswordMismatch)
+	}
+
+	if err := v.checkClaims(claims, user, database, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]any, user, database string, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: token has no expiry", ErrPasswordMismatch)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtClockSkew)) {
+		return fmt.Errorf("%w: token expired", ErrPasswordMismatch)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token not valid yet", ErrPasswordMismatch)
+	}
+
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return fmt.Errorf("%w: unexpected token issuer", ErrPasswordMismatch)
+	}
+	if v.config.Audience != "" && !claimContains(claims["aud"], v.config.Audience) {
+		return fmt.Errorf("%w: unexpected token audience", ErrPasswordMismatch)
+	}
+
+	if claims[v.config.UserClaim] != user {
+		return fmt.Errorf("%w: token doesn't allow user %q", ErrPasswordMismatch, user)
+	}
+	if v.config.DatabaseClaim != "" && !claimContains(claims[v.config.DatabaseClaim], database) {
+		return fmt.Errorf("%w: token doesn't allow database %q", ErrPasswordMismatch, database)
+	}
+
+	return nil
+}
+
+// Whether a claim is `value`, or an array containing it
+func claimContains(claim any, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []any:
+		return slices.Contains(c, any(value))
+	}
+
+	return false
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// The curve each ECDSA algorithm signs with, see RFC 7518 section 3.4
+var ecdsaCurves = map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		// notably "none" and the HMAC algorithms, which would let anyone holding the public key
+		// sign tokens
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(signed)
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(signed)
+		digest = sum[:]
+	}
+
+	invalid := errors.New("invalid token signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[0] {
+		case 'R':
+			err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case 'P':
+			err = rsa.VerifyPSS(k, hash, digest, signature, nil)
+		default:
+			return fmt.Errorf("algorithm %s doesn't match an RSA key", alg)
+		}
+		if err != nil {
+			return invalid
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || alg == "EdDSA" {
+			return fmt.Errorf("algorithm %s doesn't match an EC key", alg)
+		}
+		if k.Curve.Params().Name != ecdsaCurves[alg] {
+			return fmt.Errorf("algorithm %s doesn't match a %s key", alg, k.Curve.Params().Name)
+		}
+		if len(signature) != 2*size {
+			return invalid
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+	case ed25519.PublicKey:
+		if alg != "EdDSA" || !ed25519.Verify(k, signed, signature) {
+			return invalid
+		}
+	default:
+		return invalid
+	}
+
+	return nil
+}
+
+// Returns the JWKS key with the given ID (or the only key, if the token doesn't name one),
+// refetching the JWKS if it's stale or doesn't have the key.  The JWKS is fetched without holding
+// the lock, by one login at a time, the others waiting for it.
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	lookup := func() crypto.PublicKey {
+		if kid == "" && len(v.keys) == 1 {
+			for _, key := range v.keys {
+				return key
+			}
+		}
+		return v.keys[kid]
+	}
+
+	key := lookup()
+	for time.Since(v.fetched) >= v.config.RefreshInterval || (key == nil && time.Since(v.fetched) >= jwksMissRefetchInterval) {
+		if fetching := v.fetching; fetching != nil {
+			v.mu.Unlock()
+			<-fetching
+			v.mu.Lock()
+			key = lookup()
+			continue
+		}
+
+		fetching := make(chan struct{})
+		v.fetching = fetching
+		v.mu.Unlock()
+		keys, err := v.fetchKeys()
+		v.mu.Lock()
+		v.fetching = nil
+		close(fetching)
+
+		if err != nil {
+			slog.Error("could not fetch JWKS", "url", v.config.JWKSURL, "error", err)
+		} else {
+			v.keys = keys
+		}
+		// on errors too, so that an unreachable endpoint isn't retried for every login
+		v.fetched = time.Now()
+		key = lookup()
+	}
+
+	if key == nil {
+		if v.keys == nil {
+			return nil, errors.New("no JWKS available")
+		}
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrPasswordMismatch, kid)
+	}
+
+	return key, nil
+}
+
+func (v *JWTVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	if path, ok := strings.CutPrefix(v.config.JWKSURL, "file://"); ok {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	} else {
+		resp, err := v.client.Get(v.config.JWKSURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, err
+		}
+	}
+
+	return parseJWKS(data)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Parses the signing keys of a JWKS, skipping keys of unsupported types
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("malformed JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("skipping unusable JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) ([]byte, error) { return base64.RawURLEncoding.DecodeString(s) }
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on its curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
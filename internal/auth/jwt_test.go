@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type jwtSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func (s *jwtSigner) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"}) + "." + encode(claims)
+
+	var signature []byte
+	var err error
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (s *jwtSigner) jwk() map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch key := s.key.Public().(type) {
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": b64(key)}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": key.Curve.Params().Name, "x": b64(key.X.FillBytes(make([]byte, size))), "y": b64(key.Y.FillBytes(make([]byte, size)))}
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "n": b64(key.N.Bytes()), "e": "AQAB"}
+	}
+
+	return nil
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	signers := []*jwtSigner{{"ed", "EdDSA", edKey}, {"ec", "ES256", ecKey}, {"rsa", "RS256", rsaKey}}
+	rotated := &jwtSigner{"rotated", "EdDSA", edKey}
+	// a P-384 key, which ES256 tokens must not be accepted from
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	other := &jwtSigner{"ec384", "ES256", p384Key}
+
+	published := append(signers, other)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		var keys []map[string]string
+		for _, s := range published {
+			keys = append(keys, s.jwk())
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer server.Close()
+
+	verifier := NewJWTVerifier(JWT{
+		JWKSURL:       server.URL,
+		Issuer:        "https://issuer.example",
+		Audience:      "pgproxy",
+		UserClaim:     "db_role",
+		DatabaseClaim: "tenant",
+	})
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":     "https://issuer.example",
+			"aud":     []string{"other", "pgproxy"},
+			"exp":     time.Now().Add(time.Hour).Unix(),
+			"db_role": "alice",
+			"tenant":  []string{"app", "reports"},
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, s := range signers {
+		verified, err := verifier.Authenticate(s.sign(t, claims(nil)), "alice", "reports")
+		if err != nil {
+			t.Errorf("%s: expected valid token to be accepted, got %v", s.alg, err)
+		} else if verified["db_role"] != "alice" {
+			t.Errorf("%s: expected the token's claims, got %v", s.alg, verified)
+		}
+	}
+
+	signer := signers[0]
+	rejected := map[string]string{
+		"expired":        signer.sign(t, claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"not yet valid":  signer.sign(t, claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"no expiry":      signer.sign(t, claims(map[string]any{"exp": nil})),
+		"wrong issuer":   signer.sign(t, claims(map[string]any{"iss": "https://evil.example"})),
+		"wrong audience": signer.sign(t, claims(map[string]any{"aud": "other"})),
+		"other user":     signer.sign(t, claims(map[string]any{"db_role": "bob"})),
+		"other database": signer.sign(t, claims(map[string]any{"tenant": "billing"})),
+		"wrong alg":      (&jwtSigner{signer.kid, "ES256", ecKey}).sign(t, claims(nil)),
+		"wrong curve":    other.sign(t, claims(nil)),
+		"garbage":        "not-a-token",
+	}
+	valid := strings.Split(signer.sign(t, claims(nil)), ".")
+	rejected["tampered"] = valid[0] + "." + valid[1] + "." + valid[2][:len(valid[2])-4] + "AAAA"
+	rejected["unsigned"] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"ed"}`)) + "." + valid[1] + "."
+
+	for name, token := range rejected {
+		if _, err := verifier.Authenticate(token, "alice", "reports"); !errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("%s: expected token to be rejected, got %v", name, err)
+		}
+	}
+
+	// a token signed with a key that isn't published yet makes the JWKS be refetched, but not on
+	// every attempt
+	published = append(published, rotated)
+	token := rotated.sign(t, claims(nil))
+	before := fetches
+	if _, err := verifier.Authenticate(token, "alice", "app"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("expected unknown key to be rejected within the refetch interval, got %v", err)
+	}
+	verifier.fetched = verifier.fetched.Add(-jwksMissRefetchInterval)
+	if _, err := verifier.Authenticate(token, "alice", "app"); err != nil {
+		t.Errorf("expected rotated key to be picked up, got %v", err)
+	}
+	if fetches != before+1 {
+		t.Errorf("expected one refetch, got %d", fetches-before)
+	}
+}
+
+func TestJWTKeyFetch(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer := &jwtSigner{"ed", "EdDSA", edKey}
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{signer.jwk()}})
+	}))
+	defer server.Close()
+
+	verifier := NewJWTVerifier(JWT{JWKSURL: server.URL})
+	token := signer.sign(t, map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := verifier.Authenticate(token, "alice", "app"); err != nil {
+		t.Fatal(err)
+	}
+
+	// logins with unknown keys refetch the JWKS once between them, without holding up the others
+	verifier.fetched = verifier.fetched.Add(-jwksMissRefetchInterval)
+	unknown := (&jwtSigner{"unknown", "EdDSA", edKey}).sign(t, map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = verifier.Authenticate(unknown, "alice", "app")
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := verifier.Authenticate(token, "alice", "app"); err != nil {
+		t.Errorf("expected a known key to be used during the refetch, got %v", err)
+	}
+	close(release)
+	wg.Wait()
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("expected one refetch, got %d", n-1)
+	}
+}
@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How long an LDAP login may take unless configured otherwise
+const DefaultLDAPTimeout = 10 * time.Second
+
+// Checks client passwords by binding to an LDAP server as the client, like postgres' ldap
+// authentication method.  Either the DN to bind as is built directly from the user name
+// (`bind_dn`, "simple bind" mode), or the proxy first binds with its own credentials and searches
+// for the user's entry under `base_dn` ("search+bind" mode).
+type LDAP struct {
+	// ldap:// or ldaps:// URL of the server
+	URL string `json:"url"`
+	// DN to bind as, with {user} replaced by the client's user name, e.g.
+	// "uid={user},ou=people,dc=example,dc=com"
+	BindDN string `json:"bind_dn"`
+	// where to search for the user's entry in search+bind mode
+	BaseDN string `json:"base_dn"`
+	// attribute holding the user name in search+bind mode, defaults to "uid"
+	SearchAttribute string `json:"search_attribute"`
+	// credentials for the search, anonymous if unset
+	SearchBindDN       string `json:"search_bind_dn"`
+	SearchBindPassword string `json:"search_bind_password"`
+	// bounds the whole login, defaults to DefaultLDAPTimeout
+	Timeout time.Duration `json:"-"`
+}
+
+func (c *LDAP) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+
+	return DefaultLDAPTimeout
+}
+
+// Returns ErrPasswordMismatch if the server doesn't accept the password, or another error if the
+// server couldn't be asked.  The login is given up at `deadline` if that comes before the timeout
+// (zero for no deadline).
+func (c *LDAP) Authenticate(user, password string, deadline time.Time) error {
+	// an empty password would make this an unauthenticated bind, which servers accept for any DN
+	if password == "" || user == "" {
+		return ErrPasswordMismatch
+	}
+
+	if timeout := time.Now().Add(c.timeout()); deadline.IsZero() || timeout.Before(deadline) {
+		deadline = timeout
+	}
+	conn, err := c.dial(deadline)
+	if err != nil {
+		return fmt.Errorf("could not connect to LDAP server: %w", err)
+	}
+	defer conn.Close()
+
+	client := &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+	defer client.unbind()
+
+	dn := ""
+	if c.BaseDN == "" {
+		dn = strings.ReplaceAll(c.BindDN, "{user}", escapeDN(user))
+	} else {
+		if err := client.bind(c.SearchBindDN, c.SearchBindPassword); err != nil {
+			return fmt.Errorf("could not bind for LDAP search: %w", err)
+		}
+
+		attribute := c.SearchAttribute
+		if attribute == "" {
+			attribute = "uid"
+		}
+		dn, err = client.searchOne(c.BaseDN, attribute, user)
+		if errors.Is(err, errLDAPNoSuchUser) {
+			return ErrPasswordMismatch
+		}
+		if err != nil {
+			return fmt.Errorf("LDAP search failed: %w", err)
+		}
+	}
+
+	if err := client.bind(dn, password); err != nil {
+		var result *ldapResultError
+		if errors.As(err, &result) && result.code == ldapInvalidCredentials {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (c *LDAP) dial(deadline time.Time) (net.Conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// Escapes a user name for use as an attribute value in a DN (RFC 4514)
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// -------------------------------------------------------------------------------------------------
+// Just enough of the LDAPv3 protocol (RFC 4511) for simple binds and a single search, BER encoded
+// -------------------------------------------------------------------------------------------------
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+	berSequence    = 0x30
+
+	ldapBindRequest         = 0x60
+	ldapBindResponse        = 0x61
+	ldapUnbindRequest       = 0x42
+	ldapSearchRequest       = 0x63
+	ldapSearchResultEntry   = 0x64
+	ldapSearchResultDone    = 0x65
+	ldapSearchResultRef     = 0x73
+	ldapSimpleAuth          = 0x80
+	ldapFilterEqualityMatch = 0xa3
+
+	ldapInvalidCredentials = 49
+)
+
+var errLDAPNoSuchUser = errors.New("no such user")
+
+type ldapResultError struct {
+	code    int
+	message string
+}
+
+func (e *ldapResultError) Error() string {
+	return fmt.Sprintf("LDAP error %d: %s", e.code, e.message)
+}
+
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int
+}
+
+func (c *ldapConn) send(op []byte) error {
+	c.messageID++
+	_, err := c.conn.Write(ber(berSequence, berInt(berInteger, c.messageID), op))
+	return err
+}
+
+// Reads the next response, returning its protocol op tag and contents
+func (c *ldapConn) receive() (byte, []byte, error) {
+	tag, message, err := readBER(c.reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != berSequence {
+		return 0, nil, errors.New("malformed LDAP message")
+	}
+
+	// messageID, then the protocol op (then optional controls, which we ignore)
+	_, _, rest, err := splitBER(message)
+	if err != nil {
+		return 0, nil, err
+	}
+	opTag, op, _, err := splitBER(rest)
+	return opTag, op, err
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	err := c.send(ber(ldapBindRequest, berInt(berInteger, 3), ber(berOctetString, []byte(dn)), ber(ldapSimpleAuth, []byte(password))))
+	if err != nil {
+		return err
+	}
+
+	tag, op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if tag != ldapBindResponse {
+		return fmt.Errorf("unexpected LDAP response %#x to bind", tag)
+	}
+
+	return ldapResult(op)
+}
+
+// Searches the subtree under baseDN for exactly one entry with attribute=value, returning its DN
+func (c *ldapConn) searchOne(baseDN, attribute, value string) (string, error) {
+	filter := ber(ldapFilterEqualityMatch, ber(berOctetString, []byte(attribute)), ber(berOctetString, []byte(value)))
+	err := c.send(ber(ldapSearchRequest,
+		ber(berOctetString, []byte(baseDN)),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 2),    // size limit: we only need to know if there is more than one
+		berInt(berInteger, 0),
+		ber(berBoolean, []byte{0}),
+		filter,
+		ber(berSequence, ber(berOctetString, []byte("1.1"))), // no attributes
+	))
+	if err != nil {
+		return "", err
+	}
+
+	var dns []string
+	for {
+		tag, op, err := c.receive()
+		if err != nil {
+			return "", err
+		}
+
+		switch tag {
+		case ldapSearchResultEntry:
+			_, dn, _, err := splitBER(op)
+			if err != nil {
+				return "", err
+			}
+			dns = append(dns, string(dn))
+		case ldapSearchResultRef:
+			// referrals aren't followed
+		case ldapSearchResultDone:
+			if err := ldapResult(op); err != nil && len(dns) == 0 {
+				return "", err
+			}
+			switch len(dns) {
+			case 0:
+				return "", errLDAPNoSuchUser
+			case 1:
+				return dns[0], nil
+			default:
+				return "", fmt.Errorf("%d LDAP entries match %s=%s", len(dns), attribute, value)
+			}
+		default:
+			return "", fmt.Errorf("unexpected LDAP response %#x to search", tag)
+		}
+	}
+}
+
+func (c *ldapConn) unbind() {
+	_ = c.send(ber(ldapUnbindRequest))
+}
+
+// Checks an LDAPResult: resultCode, matchedDN, diagnosticMessage
+func ldapResult(op []byte) error {
+	_, code, rest, err := splitBER(op)
+	if err != nil {
+		return err
+	}
+	_, _, rest, err = splitBER(rest)
+	if err != nil {
+		return err
+	}
+	_, message, _, err := splitBER(rest)
+	if err != nil {
+		return err
+	}
+
+	if n := berToInt(code); n != 0 {
+		return &ldapResultError{code: n, message: string(message)}
+	}
+
+	return nil
+}
+
+func ber(tag byte, contents ...[]byte) []byte {
+	length := 0
+	for _, c := range contents {
+		length += len(c)
+	}
+
+	buf := []byte{tag}
+	switch {
+	case length < 0x80:
+		buf = append(buf, byte(length))
+	case length < 0x100:
+		buf = append(buf, 0x81, byte(length))
+	case length < 0x10000:
+		buf = append(buf, 0x82, byte(length>>8), byte(length))
+	default:
+		buf = append(buf, 0x84, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+
+	for _, c := range contents {
+		buf = append(buf, c...)
+	}
+
+	return buf
+}
+
+func berInt(tag byte, n int) []byte {
+	var contents []byte
+	for {
+		contents = append([]byte{byte(n)}, contents...)
+		n >>= 8
+		if n == 0 && contents[0] < 0x80 {
+			break
+		}
+	}
+
+	return ber(tag, contents)
+}
+
+func berToInt(contents []byte) int {
+	n := 0
+	for _, b := range contents {
+		n = n<<8 | int(b)
+	}
+
+	return n
+}
+
+// Largest LDAP message we accept from the server
+const maxLDAPMessage = 1 << 20
+
+func readBER(reader *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(header[1])
+	if length >= 0x80 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		lengthBytes := make([]byte, size)
+		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+			return 0, nil, err
+		}
+		length = berToInt(lengthBytes)
+	}
+	if length > maxLDAPMessage {
+		return 0, nil, errors.New("LDAP message too large")
+	}
+
+	contents := make([]byte, length)
+	if _, err := io.ReadFull(reader, contents); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], contents, nil
+}
+
+// Splits the first element off a BER encoded sequence of elements
+func splitBER(data []byte) (tag byte, contents []byte, rest []byte, err error) {
+	malformed := errors.New("malformed LDAP message")
+	if len(data) < 2 {
+		return 0, nil, nil, malformed
+	}
+
+	tag = data[0]
+	length, offset := int(data[1]), 2
+	if length >= 0x80 {
+		size := length & 0x7f
+		if size == 0 || size > 4 || len(data) < offset+size {
+			return 0, nil, nil, malformed
+		}
+		length = berToInt(data[offset : offset+size])
+		offset += size
+	}
+	if length < 0 || len(data)-offset < length {
+		return 0, nil, nil, malformed
+	}
+
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
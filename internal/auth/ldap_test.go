@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// A minimal LDAP server that knows the given DNs and passwords, with each DN's uid being its
+// first RDN value
+func fakeLDAPServer(t *testing.T, passwords map[string]string, uids map[string]string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	result := func(op byte, code int) []byte {
+		return ber(op, berInt(berEnumerated, code), ber(berOctetString), ber(berOctetString))
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					_, message, err := readBER(reader)
+					if err != nil {
+						return
+					}
+					_, id, rest, _ := splitBER(message)
+					tag, op, _, _ := splitBER(rest)
+					reply := func(op []byte) { conn.Write(ber(berSequence, ber(berInteger, id), op)) }
+
+					switch tag {
+					case ldapBindRequest:
+						_, _, rest, _ := splitBER(op)
+						_, dn, rest, _ := splitBER(rest)
+						_, password, _, _ := splitBER(rest)
+						code := ldapInvalidCredentials
+						if want, ok := passwords[string(dn)]; ok && want == string(password) {
+							code = 0
+						}
+						reply(result(ldapBindResponse, code))
+					case ldapSearchRequest:
+						// skip base, scope, deref, size and time limits and typesOnly to get to the filter
+						rest := op
+						for i := 0; i < 6; i++ {
+							_, _, rest, _ = splitBER(rest)
+						}
+						_, filter, _, _ := splitBER(rest)
+						_, attribute, filter, _ := splitBER(filter)
+						_, value, _, _ := splitBER(filter)
+						if string(attribute) == "uid" {
+							if dn, ok := uids[string(value)]; ok {
+								reply(ber(ldapSearchResultEntry, ber(berOctetString, []byte(dn)), ber(berSequence)))
+							}
+						}
+						reply(result(ldapSearchResultDone, 0))
+					default:
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return "ldap://" + ln.Addr().String()
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	url := fakeLDAPServer(t,
+		map[string]string{
+			"uid=alice,ou=people,dc=example": "secret",
+			"cn=proxy,dc=example":            "proxypass",
+		},
+		map[string]string{"alice": "uid=alice,ou=people,dc=example"},
+	)
+
+	modes := map[string]*LDAP{
+		"simple bind": {URL: url, BindDN: "uid={user},ou=people,dc=example"},
+		"search+bind": {URL: url, BaseDN: "dc=example", SearchBindDN: "cn=proxy,dc=example", SearchBindPassword: "proxypass"},
+	}
+
+	for name, ldap := range modes {
+		if err := ldap.Authenticate("alice", "secret", time.Time{}); err != nil {
+			t.Errorf("%s: expected right password to be accepted, got %v", name, err)
+		}
+
+		for _, login := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"bob", "secret"}} {
+			if err := ldap.Authenticate(login[0], login[1], time.Time{}); !errors.Is(err, ErrPasswordMismatch) {
+				t.Errorf("%s: expected %s/%q to be rejected, got %v", name, login[0], login[1], err)
+			}
+		}
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	if got := escapeDN(`a,b=c\ `); got != `a\,b\=c\\\ ` {
+		t.Errorf("unexpected escaped DN %q", got)
+	}
+}
+
+func TestLDAPDeadline(t *testing.T) {
+	// a server that never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ldap := &LDAP{URL: "ldap://" + ln.Addr().String(), BindDN: "uid={user},dc=example"}
+	start := time.Now()
+	if err := ldap.Authenticate("alice", "secret", time.Now().Add(100*time.Millisecond)); err == nil || errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("expected the login to fail for want of an answer, got %v", err)
+	}
+	if waited := time.Since(start); waited > DefaultLDAPTimeout/2 {
+		t.Errorf("expected the login to be given up at the deadline, waited %v", waited)
+	}
+}
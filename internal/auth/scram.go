@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+// The only SASL mechanism we offer.  We don't offer SCRAM-SHA-256-PLUS, since channel binding to
+// the client's TLS session would be meaningless for the upstream.
+const scramMechanism = "SCRAM-SHA-256"
+
+// Iteration count for verifiers we derive from plaintext passwords, the postgres default
+const scramIterations = 4096
+
+// A SCRAM-SHA-256 verifier, as stored by postgres:
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+	// set for mock verifiers, which never match
+	mock bool
+}
+
+func parseSCRAMVerifier(s string) (*scramVerifier, error) {
+	invalid := errors.New("invalid SCRAM-SHA-256 verifier")
+
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 {
+		return nil, invalid
+	}
+	iterationsAndSalt := strings.Split(parts[1], ":")
+	keys := strings.Split(parts[2], ":")
+	if len(iterationsAndSalt) != 2 || len(keys) != 2 {
+		return nil, invalid
+	}
+
+	var v scramVerifier
+	var err error
+	if v.iterations, err = strconv.Atoi(iterationsAndSalt[0]); err != nil || v.iterations < 1 {
+		return nil, invalid
+	}
+	if v.salt, err = base64.StdEncoding.DecodeString(iterationsAndSalt[1]); err != nil {
+		return nil, invalid
+	}
+	if v.storedKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil || len(v.storedKey) != sha256.Size {
+		return nil, invalid
+	}
+	if v.serverKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil || len(v.serverKey) != sha256.Size {
+		return nil, invalid
+	}
+
+	return &v, nil
+}
+
+// Derives a verifier for a plaintext password, with a fresh salt
+func newSCRAMVerifier(password string) (*scramVerifier, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	salted := hi([]byte(password), salt, scramIterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	return &scramVerifier{
+		iterations: scramIterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  hmacSHA256(salted, []byte("Server Key")),
+	}, nil
+}
+
+// A verifier for unknown users, so that their exchange looks like any other
+func mockSCRAMVerifier() *scramVerifier {
+	v := &scramVerifier{iterations: scramIterations, salt: make([]byte, 16), mock: true}
+	_, _ = rand.Read(v.salt)
+	return v
+}
+
+// Runs the server side of a SCRAM-SHA-256 exchange (RFC 5802, RFC 7677), as postgres does it:
+// the username in the client-first-message is ignored in favor of the startup user.
+func scramExchange(w io.Writer, reader *bufio.Reader, verifier *scramVerifier) error {
+	if err := write(w, codec.NewAuthenticationSASL(scramMechanism)); err != nil {
+		return err
+	}
+
+	message, err := codec.ReadMessage(reader)
+	if err != nil {
+		return err
+	}
+	initial, err := message.ParseAsSASLInitialResponse()
+	if err != nil {
+		return err
+	}
+	if initial.Mechanism != scramMechanism {
+		return fmt.Errorf("client selected unsupported SASL mechanism %q", initial.Mechanism)
+	}
+
+	// client-first-message: gs2-header client-first-message-bare
+	header, err := codec.ParseGS2Header(initial.Data)
+	if err != nil {
+		return err
+	}
+	if header.ChannelBinding == codec.ChannelBindingRequired || header.AuthzID != "" {
+		return errors.New("unsupported SCRAM channel binding or authorization identity")
+	}
+	gs2Header, clientFirstBare := header.Raw, header.Bare
+
+	clientNonce := ""
+	for _, attr := range strings.Split(clientFirstBare, ",") {
+		if strings.HasPrefix(attr, "r=") {
+			clientNonce = attr[2:]
+		}
+	}
+	if clientNonce == "" {
+		return errors.New("malformed SCRAM client-first-message")
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return err
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(verifier.salt), verifier.iterations)
+	if err := write(w, codec.NewAuthenticationSASLContinue([]byte(serverFirst))); err != nil {
+		return err
+	}
+
+	message, err = codec.ReadMessage(reader)
+	if err != nil {
+		return err
+	}
+	data, err := message.ParseAsSASLResponse()
+	if err != nil {
+		return err
+	}
+
+	// client-final-message: c=<channel binding>,r=<nonce>,p=<proof>
+	clientFinal := string(data)
+	proofIndex := strings.LastIndex(clientFinal, ",p=")
+	if proofIndex < 0 {
+		return errors.New("malformed SCRAM client-final-message")
+	}
+	clientFinalWithoutProof := clientFinal[:proofIndex]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofIndex+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return errors.New("malformed SCRAM client proof")
+	}
+
+	attrs := strings.Split(clientFinalWithoutProof, ",")
+	if len(attrs) < 2 || attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(gs2Header)) {
+		return errors.New("SCRAM channel binding does not match")
+	}
+	if attrs[1] != "r="+nonce {
+		return errors.New("SCRAM nonce does not match")
+	}
+
+	if verifier.mock {
+		return ErrPasswordMismatch
+	}
+
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+	clientSignature := hmacSHA256(verifier.storedKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	subtle.XORBytes(clientKey, proof, clientSignature)
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], verifier.storedKey) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(verifier.serverKey, authMessage))
+	return write(w, codec.NewAuthenticationSASLFinal([]byte(serverFinal)))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Hi() from RFC 5802, i.e. PBKDF2-HMAC-SHA-256 with a single output block
+func hi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+
+	result := bytes.Clone(u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		subtle.XORBytes(result, result, u)
+	}
+
+	return result
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the auth file is checked for changes
+const userlistReloadInterval = 10 * time.Second
+
+// Credentials read from an auth file in pgbouncer's userlist.txt format: one user per line, as
+// `"username" "password"`, where the password is stored like in pg_authid.rolpassword and a `"`
+// inside a quoted string is written as `""`.  Lines that don't start with a `"` are ignored.
+//
+// The file is reloaded when it changes, so users can be added or rotated without a restart.  If a
+// new version can't be parsed, the previous one stays in effect.
+type Userlist struct {
+	path string
+
+	mu          sync.Mutex
+	credentials map[string]*Credential
+	modTime     time.Time
+	checked     time.Time
+}
+
+func NewUserlist(path string) (*Userlist, error) {
+	u := &Userlist{path: path}
+	if err := u.load(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Returns the credential for a user, nil if the file doesn't list them
+func (u *Userlist) Credential(user string) *Credential {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if time.Since(u.checked) >= userlistReloadInterval {
+		u.checked = time.Now()
+
+		if info, err := os.Stat(u.path); err == nil && !info.ModTime().Equal(u.modTime) {
+			if err := u.load(); err != nil {
+				slog.Error("could not reload auth file, keeping the previous one", "error", err)
+			} else {
+				slog.Info("reloaded auth file", "path", u.path, "users", len(u.credentials))
+			}
+		}
+	}
+
+	return u.credentials[user]
+}
+
+func (u *Userlist) load() error {
+	info, err := os.Stat(u.path)
+	if err != nil {
+		return fmt.Errorf("could not read auth file: %w", err)
+	}
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return fmt.Errorf("could not read auth file: %w", err)
+	}
+
+	credentials, err := parseUserlist(data)
+	if err != nil {
+		return fmt.Errorf("could not parse auth file %s: %w", u.path, err)
+	}
+
+	u.credentials, u.modTime = credentials, info.ModTime()
+	return nil
+}
+
+func parseUserlist(data []byte) (map[string]*Credential, error) {
+	credentials := make(map[string]*Credential)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, `"`) {
+			continue
+		}
+
+		user, rest, err := quotedField(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		password, _, err := quotedField(strings.TrimLeft(rest, " \t"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		credential, err := ParseCredential(password)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		credentials[user] = credential
+	}
+
+	return credentials, scanner.Err()
+}
+
+// Splits a leading double quoted field (with "" as an escaped quote) off a string
+func quotedField(s string) (field string, rest string, err error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", errors.New("expected quoted field")
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+			continue
+		}
+		return b.String(), s[i+1:], nil
+	}
+
+	return "", "", errors.New("unterminated quoted field")
+}
@@ -0,0 +1,52 @@
+package codec
+
+// Builds a typed message field by field, filling in its length from what was written, so that
+// constructors don't have to size their buffers by hand:
+//
+//	NewBuilder(MessageTypeCommandComplete).String("SELECT 1").Message()
+type Builder struct {
+	data []byte
+}
+
+func NewBuilder(messageType MessageType) *Builder {
+	return &Builder{data: AppendHeader(make([]byte, 0, 64), messageType, 0)}
+}
+
+func (b *Builder) Byte(v byte) *Builder {
+	b.data = append(b.data, v)
+	return b
+}
+
+func (b *Builder) Int16(v int16) *Builder {
+	b.data = AppendInt16(b.data, v)
+	return b
+}
+
+func (b *Builder) Int32(v int32) *Builder {
+	b.data = AppendInt32(b.data, v)
+	return b
+}
+
+func (b *Builder) Uint32(v uint32) *Builder {
+	b.data = AppendUint32(b.data, v)
+	return b
+}
+
+// Appends a null terminated string
+func (b *Builder) String(s string) *Builder {
+	b.data = append(append(b.data, s...), 0)
+	return b
+}
+
+// Appends bytes as they are, without a length
+func (b *Builder) Bytes(p []byte) *Builder {
+	b.data = append(b.data, p...)
+	return b
+}
+
+// Returns the message, with its length set.  The builder must not be used afterwards.
+func (b *Builder) Message() Message {
+	length := uint32(len(b.data) - 1)
+	copy(b.data[1:MessageDataStartIndex], AppendUint32(nil, length))
+	return Message{Type: MessageType(b.data[0]), Length: length, Data: b.data}
+}
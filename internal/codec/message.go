@@ -26,7 +26,8 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"unicode"
+	"slices"
+	"sync/atomic"
 )
 
 type MessageParserState uint8
@@ -35,17 +36,214 @@ type MessageType byte
 const MessageDataStartIndex = 5
 
 const (
-	MessageTypeStartup         MessageType = '\x00'
-	MessageTypeSSLRequest                  = '\x01'
-	MessageTypeGSSENCRequest               = '\x02'
-	MessageTypeAuthentication              = 'R'
-	MessageTypeParameterStatus             = 'S'
-	MessageTypeQuery                       = 'Q'
-	MessageTypeReadyForQuery               = 'Z'
-	MessageTypeTerminate                   = 'X'
-	MessageTypeNotice                      = 'N'
+	MessageTypeStartup                  MessageType = '\x00'
+	MessageTypeSSLRequest                           = '\x01'
+	MessageTypeGSSENCRequest                        = '\x02'
+	MessageTypeAuthentication                       = 'R'
+	MessageTypeParameterStatus                      = 'S'
+	MessageTypeQuery                                = 'Q'
+	MessageTypeParse                                = 'P'
+	MessageTypeReadyForQuery                        = 'Z'
+	MessageTypeTerminate                            = 'X'
+	MessageTypeNotice                               = 'N'
+	MessageTypeErrorResponse                        = 'E'
+	MessageTypeNotificationResponse                 = 'A'
+	MessageTypeFunctionCallResponse                 = 'V'
+	MessageTypeNegotiateProtocolVersion             = 'v'
+	MessageTypePassword                             = 'p'
+	MessageTypeRowDescription                       = 'T'
+	MessageTypeEmptyQueryResponse                   = 'I'
+	MessageTypeCopyData                             = 'd'
+	MessageTypeCopyDone                             = 'c'
+	MessageTypeCopyFail                             = 'f'
+	MessageTypeCopyInResponse                       = 'G'
+	MessageTypeCopyBothResponse                     = 'W'
+	MessageTypeBackendKeyData                       = 'K'
+	MessageTypeParseComplete                        = '1'
+	MessageTypeBindComplete                         = '2'
+	MessageTypeCloseComplete                        = '3'
+	MessageTypeNoData                               = 'n'
+	MessageTypeParameterDescription                 = 't'
+	MessageTypePortalSuspended                      = 's'
 )
 
+// Frontend message types whose type byte is also used by a backend message, which is why String
+// can't tell them apart
+const (
+	MessageTypeBind         MessageType = 'B'
+	MessageTypeClose        MessageType = 'C'
+	MessageTypeDescribe     MessageType = 'D'
+	MessageTypeExecute      MessageType = 'E'
+	MessageTypeFunctionCall MessageType = 'F'
+	MessageTypeFlush        MessageType = 'H'
+	MessageTypeSync         MessageType = 'S'
+)
+
+// Backend message types whose type byte is also used by a frontend message
+const (
+	MessageTypeDataRow         MessageType = 'D'
+	MessageTypeCommandComplete MessageType = 'C'
+	MessageTypeCopyOutResponse MessageType = 'H'
+)
+
+// The smallest length (which counts the 4 length bytes, but not the type byte) a well formed message
+// of each type can have.  Where frontend and backend messages share a type byte, the smaller of
+// their minimums applies, e.g. Sync's for ParameterStatus.  Types missing here are unknown.
+var minimumLengths = map[MessageType]uint32{
+	MessageTypeAuthentication:           8,
+	MessageTypeParameterStatus:          4, // Sync
+	MessageTypeQuery:                    5,
+	MessageTypeParse:                    8,
+	MessageTypeReadyForQuery:            5,
+	MessageTypeTerminate:                4,
+	MessageTypeNotice:                   5,
+	MessageTypeErrorResponse:            5,
+	MessageTypeNotificationResponse:     10,
+	MessageTypeFunctionCallResponse:     8,
+	MessageTypeNegotiateProtocolVersion: 12,
+	MessageTypePassword:                 4, // an empty SASLResponse
+	MessageTypeRowDescription:           6,
+	MessageTypeEmptyQueryResponse:       4,
+	MessageTypeCopyData:                 4,
+	MessageTypeCopyDone:                 4,
+	MessageTypeCopyFail:                 5,
+	MessageTypeCopyInResponse:           7,
+	MessageTypeCopyBothResponse:         7,
+	MessageTypeBackendKeyData:           12,
+	MessageTypeParseComplete:            4,
+	MessageTypeBindComplete:             4,
+	MessageTypeCloseComplete:            4,
+	MessageTypeNoData:                   4,
+	MessageTypeParameterDescription:     6,
+	MessageTypePortalSuspended:          4,
+	MessageTypeBind:                     12,
+	MessageTypeClose:                    5, // CommandComplete
+	MessageTypeDescribe:                 6, // and DataRow
+	MessageTypeFunctionCall:             14,
+	MessageTypeFlush:                    4, // CopyOutResponse is longer
+}
+
+// The longest startup-style message (StartupMessage, SSLRequest, ...) accepted, as in postgres.
+// Their length comes first, so they are always told apart from typed messages by a first byte of 0.
+const MaxStartupLength = 10000
+
+// Whether a message starting with `firstByte` is a typed message rather than a startup-style one
+func IsTyped(firstByte byte) bool {
+	return firstByte != 0
+}
+
+// An error in what a peer sent, e.g. a message shorter than its type allows, as opposed to an
+// error reading it
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Reason
+}
+
+func protocolErrorf(format string, args ...any) error {
+	return &ProtocolError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Whether the protocol defines messages of the type, sent by either side
+func KnownMessageType(messageType MessageType) bool {
+	_, known := minimumLengths[messageType]
+	return known
+}
+
+// Message types frontends send once their session has started
+var frontendMessages = []MessageType{
+	MessageTypeQuery, MessageTypeParse, MessageTypeBind, MessageTypeExecute, MessageTypeDescribe,
+	MessageTypeClose, MessageTypeSync, MessageTypeFlush, MessageTypeFunctionCall, MessageTypeCopyData,
+	MessageTypeCopyDone, MessageTypeCopyFail, MessageTypeTerminate, MessageTypePassword,
+}
+
+// Message types backends send, during startup or once the session has started
+var backendMessages = []MessageType{
+	MessageTypeAuthentication, MessageTypeParameterStatus, MessageTypeBackendKeyData, MessageTypeReadyForQuery,
+	MessageTypeErrorResponse, MessageTypeNotice, MessageTypeNotificationResponse, MessageTypeFunctionCallResponse,
+	MessageTypeNegotiateProtocolVersion, MessageTypeRowDescription, MessageTypeDataRow, MessageTypeCommandComplete,
+	MessageTypeEmptyQueryResponse, MessageTypeCopyInResponse, MessageTypeCopyOutResponse, MessageTypeCopyBothResponse,
+	MessageTypeCopyData, MessageTypeCopyDone, MessageTypeParseComplete, MessageTypeBindComplete,
+	MessageTypeCloseComplete, MessageTypeNoData, MessageTypeParameterDescription, MessageTypePortalSuspended,
+}
+
+// Whether frontends send messages of the type, if `frontend`, or else backends.  Type bytes are
+// shared between the two, e.g. 'D' is a frontend's Describe and a backend's DataRow.
+func SentBy(messageType MessageType, frontend bool) bool {
+	if frontend {
+		return slices.Contains(frontendMessages, messageType)
+	}
+	return slices.Contains(backendMessages, messageType)
+}
+
+var strict atomic.Bool
+
+// Makes ReadMessage, ReadHeader and Validate refuse message types the protocol doesn't define,
+// rather than pass them on.  Off by default, so that protocol additions go through the proxy.
+func SetStrict(on bool) {
+	strict.Store(on)
+}
+
+// The longest typed message accepted, as in postgres
+const MaxMessageLength = 1<<30 - 1
+
+// Messages up to this long are read into a buffer of their announced size, longer ones into one
+// that grows as their bytes arrive, so that a peer can't make the proxy allocate more than it sends
+const eagerBodyLength = 64 * 1024
+
+// Checks the length a typed message announces, before anything is allocated for it
+func checkLength(messageType MessageType, length uint32) error {
+	// protocol message types are printable, and control characters would be taken for the types
+	// standing for startup-style messages
+	if messageType < ' ' {
+		return protocolErrorf("invalid message type %#x", byte(messageType))
+	}
+	if length > MaxMessageLength {
+		return protocolErrorf("invalid length %d for %s message, longer than %d", length, messageType, MaxMessageLength)
+	}
+
+	minimum, known := minimumLengths[messageType]
+	if !known {
+		if strict.Load() {
+			return protocolErrorf("unknown message type %s", messageType)
+		}
+		minimum = 4
+	}
+	if length < minimum {
+		return protocolErrorf("invalid length %d for %s message, expected at least %d", length, messageType, minimum)
+	}
+	return nil
+}
+
+// Checks that a message is well formed as far as the codec can tell without knowing which side sent
+// it: that its data matches its length, that it is at least as long as messages of its type can be,
+// and for a startup message, that its parameters are framed properly.  In strict mode (see
+// SetStrict) unknown message types are refused too.  ReadMessage already makes these checks,
+// except the parameters', which ParseStartupParameters makes.
+func (m *Message) Validate() error {
+	switch m.Type {
+	case MessageTypeStartup, MessageTypeSSLRequest, MessageTypeGSSENCRequest:
+		if len(m.Data) != int(m.Length) || m.Length < 8 || m.Length > MaxStartupLength {
+			return protocolErrorf("invalid length %d for %d byte %s message", m.Length, len(m.Data), m.Type)
+		}
+		if m.Type == MessageTypeStartup {
+			_, err := m.ParseStartupParameters()
+			return err
+		}
+		return nil
+	}
+
+	if len(m.Data) != int(m.Length)+1 || len(m.Data) < MessageDataStartIndex {
+		return protocolErrorf("invalid length %d for %d byte %s message", m.Length, len(m.Data), m.Type)
+	}
+	if MessageType(m.Data[0]) != m.Type || binary.BigEndian.Uint32(m.Data[1:]) != m.Length {
+		return protocolErrorf("header of %s message doesn't match its type and length", m.Type)
+	}
+	return checkLength(m.Type, m.Length)
+}
+
 func (m MessageType) String() string {
 	switch m {
 	case MessageTypeStartup:
@@ -58,12 +256,52 @@ func (m MessageType) String() string {
 		return "ParameterStatus(S)"
 	case MessageTypeQuery:
 		return "Query(Q)"
+	case MessageTypeParse:
+		return "Parse(P)"
 	case MessageTypeReadyForQuery:
 		return "ReadyForQuery(Z)"
 	case MessageTypeTerminate:
 		return "Terminate(X)"
 	case MessageTypeNotice:
 		return "MessageTypeNotice(N)"
+	case MessageTypeNotificationResponse:
+		return "NotificationResponse(A)"
+	case MessageTypeErrorResponse:
+		return "ErrorResponse(E)"
+	case MessageTypeFunctionCallResponse:
+		return "FunctionCallResponse(V)"
+	case MessageTypeNegotiateProtocolVersion:
+		return "NegotiateProtocolVersion(v)"
+	case MessageTypePassword:
+		return "Password(p)"
+	case MessageTypeRowDescription:
+		return "RowDescription(T)"
+	case MessageTypeEmptyQueryResponse:
+		return "EmptyQueryResponse(I)"
+	case MessageTypeCopyData:
+		return "CopyData(d)"
+	case MessageTypeCopyDone:
+		return "CopyDone(c)"
+	case MessageTypeCopyFail:
+		return "CopyFail(f)"
+	case MessageTypeCopyInResponse:
+		return "CopyInResponse(G)"
+	case MessageTypeCopyBothResponse:
+		return "CopyBothResponse(W)"
+	case MessageTypeBackendKeyData:
+		return "BackendKeyData(K)"
+	case MessageTypeParseComplete:
+		return "ParseComplete(1)"
+	case MessageTypeBindComplete:
+		return "BindComplete(2)"
+	case MessageTypeCloseComplete:
+		return "CloseComplete(3)"
+	case MessageTypeNoData:
+		return "NoData(n)"
+	case MessageTypeParameterDescription:
+		return "ParameterDescription(t)"
+	case MessageTypePortalSuspended:
+		return "PortalSuspended(s)"
 	default:
 		return "MessageType(" + string(m) + ")"
 	}
@@ -80,13 +318,35 @@ type MessageQueryParsed struct {
 	QueryString string
 }
 
-type ConnectionParams map[string]string
+type MessageParseParsed struct {
+	// name of the prepared statement, empty for the unnamed statement
+	Name        string
+	QueryString string
+}
 
-type StartupMessageParsed struct {
-	// TODO: parse other things like protocol
-	Params ConnectionParams
+// A fastpath function call, which is how libpq implements the lo_* large object functions
+type MessageFunctionCallParsed struct {
+	FunctionOID uint32
+	// arguments in their wire format, nil for SQL NULL
+	Arguments [][]byte
 }
 
+// The fields of an ErrorResponse (or NoticeResponse) we care about
+type MessageErrorResponseParsed struct {
+	Severity string
+	// SQLSTATE
+	Code    string
+	Message string
+}
+
+type ConnectionParams map[string]string
+
+// The protocol version the proxy speaks to clients
+const (
+	ProtocolMajorVersion = 3
+	ProtocolMinorVersion = 0
+)
+
 // -------------------------------------------------------------------------------------------------
 // Client message parsing
 // -------------------------------------------------------------------------------------------------
@@ -101,32 +361,114 @@ func (m *Message) ParseAsQuery() MessageQueryParsed {
 	}
 }
 
-func (m *Message) ParseStartupParameters() (StartupMessageParsed, error) {
-	// parameters start after 4 bytes of packet length + 4 bytes of protocol version
-	ps := m.Data[8:]
+func (m *Message) ParseAsParse() (MessageParseParsed, error) {
+	if m.Type != MessageTypeParse {
+		log.Panicf("ParseAsParse: expected message type %d, received %d", MessageTypeParse, m.Type)
+	}
+
+	data := m.Data[MessageDataStartIndex:]
+	nameEnd := bytes.IndexByte(data, 0)
+	if nameEnd < 0 {
+		return MessageParseParsed{}, fmt.Errorf("unterminated statement name in Parse message")
+	}
+
+	queryEnd := bytes.IndexByte(data[nameEnd+1:], 0)
+	if queryEnd < 0 {
+		return MessageParseParsed{}, fmt.Errorf("unterminated query string in Parse message")
+	}
+
+	return MessageParseParsed{
+		Name:        string(data[:nameEnd]),
+		QueryString: string(data[nameEnd+1 : nameEnd+1+queryEnd]),
+	}, nil
+}
+
+func (m *Message) ParseAsFunctionCall() (MessageFunctionCallParsed, error) {
+	if m.Type != MessageTypeFunctionCall {
+		log.Panicf("ParseAsFunctionCall: expected message type %d, received %d", MessageTypeFunctionCall, m.Type)
+	}
 
-	var parsed StartupMessageParsed
-	parsed.Params = make(map[string]string)
+	data := m.Data[MessageDataStartIndex:]
+	truncated := fmt.Errorf("truncated FunctionCall message")
 
-	j := 0
-	key := ""
-	value := ""
-	state := 0 // 0 = parsing key, 1 = parsing value
-	for i, c := range ps {
-		if c == 0 {
-			str := string(ps[j:i])
+	if len(data) < 6 {
+		return MessageFunctionCallParsed{}, truncated
+	}
+	parsed := MessageFunctionCallParsed{FunctionOID: binary.BigEndian.Uint32(data)}
 
-			if state == 0 {
-				key = str
-				state++
-			} else {
-				value = str
-				parsed.Params[key] = value
-				state--
-			}
+	// skip the argument format codes
+	formats := int(binary.BigEndian.Uint16(data[4:]))
+	data = data[6:]
+	if len(data) < 2*formats+2 {
+		return MessageFunctionCallParsed{}, truncated
+	}
+	data = data[2*formats:]
+
+	count := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	for i := 0; i < count; i++ {
+		if len(data) < 4 {
+			return MessageFunctionCallParsed{}, truncated
+		}
+		length := int32(binary.BigEndian.Uint32(data))
+		data = data[4:]
+
+		if length < 0 {
+			parsed.Arguments = append(parsed.Arguments, nil)
+			continue
+		}
+		if len(data) < int(length) {
+			return MessageFunctionCallParsed{}, truncated
+		}
+		parsed.Arguments = append(parsed.Arguments, data[:length])
+		data = data[length:]
+	}
+
+	return parsed, nil
+}
+
+// The body of a PasswordMessage or SASLResponse
+func (m *Message) ParseAsPassword() ([]byte, error) {
+	if m.Type != MessageTypePassword {
+		return nil, fmt.Errorf("expected password message, received %s", m.Type)
+	}
+
+	return m.Data[MessageDataStartIndex:], nil
+}
+
+// -------------------------------------------------------------------------------------------------
+// Server message parsing
+// -------------------------------------------------------------------------------------------------
+
+func (m *Message) ParseAsErrorResponse() (MessageErrorResponseParsed, error) {
+	if m.Type != MessageTypeErrorResponse && m.Type != MessageTypeNotice {
+		log.Panicf("ParseAsErrorResponse: expected message type %d, received %d", MessageTypeErrorResponse, m.Type)
+	}
+
+	var parsed MessageErrorResponseParsed
+	// the non-localized severity, which servers since 9.6 send along with the localized one
+	nonLocalized := false
+	data := m.Data[MessageDataStartIndex:]
+	for len(data) > 0 && data[0] != 0 {
+		end := bytes.IndexByte(data[1:], 0)
+		if end < 0 {
+			return MessageErrorResponseParsed{}, fmt.Errorf("unterminated field in ErrorResponse message")
+		}
 
-			j = i + 1
+		value := string(data[1 : 1+end])
+		switch data[0] {
+		case 'S':
+			if !nonLocalized {
+				parsed.Severity = value
+			}
+		case 'V':
+			parsed.Severity, nonLocalized = value, true
+		case 'C':
+			parsed.Code = value
+		case 'M':
+			parsed.Message = value
 		}
+		data = data[end+2:]
 	}
 
 	return parsed, nil
@@ -141,28 +483,23 @@ func ReadMessage(reader *bufio.Reader) (*Message, error) {
 		return nil, err
 	}
 
-	// I have NO idea if this is the right way to do this, it feels so hacky to me, but I'm not
-	// sure how else to differentiate between typeless and typed packets.  I thought about having
-	// something like a "parser state" (since startup messages will only come at the start of the
-	// connection, but that doesn't work since the client can ask for an SSL connection AFTER the
-	// startup packet in theory.  So for now I'm just exploiting the fact that all typed packets
-	// start with bytes in the letter range, and typeless ones start with big endian lengths, so the
-	// first byte will not typically be in that range.  Perhaps you could craft a really silly
-	// startup message that has just the right length to break this?
-	if unicode.IsLetter(rune(firstByte)) {
+	// Typeless packets can't be told apart from typed ones by a parser state, since the client can
+	// ask for an SSL connection after the startup packet in theory.  But they start with their big
+	// endian length, which is never more than MaxStartupLength, so their first byte is always 0,
+	// and no message type is 0.
+	if IsTyped(firstByte) {
 		// we have a regular message containing the message type in the startup byte
 		message.Type = MessageType(firstByte)
 		messageLen, err := readMessageLength(reader)
 		if err != nil {
 			return nil, fmt.Errorf("could not read length bytes: %w", err)
 		}
+		if err = checkLength(message.Type, messageLen); err != nil {
+			return nil, err
+		}
 
 		message.Length = messageLen
-		message.Data = make([]byte, messageLen+1) // +1 for the type byte
-
-		message.Data[0] = firstByte
-		binary.BigEndian.PutUint32(message.Data[1:5], messageLen)
-		_, err = io.ReadFull(reader, message.Data[5:])
+		message.Data, err = readBody(reader, AppendHeader(nil, message.Type, messageLen), int(messageLen)-4)
 		if err != nil {
 			return nil, fmt.Errorf("could not read message: %w", err)
 		}
@@ -179,6 +516,9 @@ func ReadMessage(reader *bufio.Reader) (*Message, error) {
 		}
 
 		messageLen := binary.BigEndian.Uint32(lengthBytes)
+		if messageLen < 8 || messageLen > MaxStartupLength {
+			return nil, protocolErrorf("invalid startup packet length %d", messageLen)
+		}
 		message.Length = messageLen
 
 		message.Data = make([]byte, messageLen)
@@ -198,7 +538,7 @@ func ReadMessage(reader *bufio.Reader) (*Message, error) {
 			} else if encryptionCode == 80877103 {
 				message.Type = MessageTypeSSLRequest
 			} else {
-				return nil, fmt.Errorf("unknown encryption code %d", encryptionCode)
+				return nil, protocolErrorf("unknown encryption code %d", encryptionCode)
 			}
 		} else {
 			// it's a startup message
@@ -209,6 +549,25 @@ func ReadMessage(reader *bufio.Reader) (*Message, error) {
 	}
 }
 
+// Reads the `n` bytes of a message's body, appending them to `prefix` (what was read of it before)
+func readBody(reader *bufio.Reader, prefix []byte, n int) ([]byte, error) {
+	data := make([]byte, len(prefix), len(prefix)+min(n, eagerBodyLength))
+	copy(data, prefix)
+
+	for n > 0 {
+		if len(data) == cap(data) {
+			data = slices.Grow(data, min(n, len(data)))
+		}
+		read, err := io.ReadFull(reader, data[len(data):min(cap(data), len(data)+n)])
+		data, n = data[:len(data)+read], n-read
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
 func readMessageLength(reader *bufio.Reader) (uint32, error) {
 	lengthBytes := make([]byte, 4)
 	_, err := io.ReadFull(reader, lengthBytes)
@@ -220,26 +579,94 @@ func readMessageLength(reader *bufio.Reader) (uint32, error) {
 	return messageLen, nil
 }
 
+// Reads the type and length of the next typed message, leaving `reader` at the start of its body,
+// which is length-4 bytes long.  Unlike ReadMessage it allocates nothing, so that messages that
+// are only passed through can be forwarded with AppendHeader and CopyBody without ever being held
+// in full.  Startup-style messages, which have no type byte, are an error.
+func ReadHeader(reader *bufio.Reader) (MessageType, uint32, error) {
+	header, err := reader.Peek(MessageDataStartIndex)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !IsTyped(header[0]) {
+		return 0, 0, protocolErrorf("expected a typed message, got first byte %#x", header[0])
+	}
+
+	messageType, length := MessageType(header[0]), binary.BigEndian.Uint32(header[1:])
+	if err = checkLength(messageType, length); err != nil {
+		return 0, 0, err
+	}
+	_, _ = reader.Discard(MessageDataStartIndex)
+	return messageType, length, nil
+}
+
+// Appends the type and length bytes of a message to `b`
+func AppendHeader(b []byte, messageType MessageType, length uint32) []byte {
+	return binary.BigEndian.AppendUint32(append(b, byte(messageType)), length)
+}
+
+// Copies the body of a message whose header ReadHeader returned from `src` to `dst`, straight out
+// of the reader's buffer, in pieces no larger than it
+func CopyBody(dst io.Writer, src *bufio.Reader, length uint32) error {
+	remaining := int(length) - 4
+	for remaining > 0 {
+		piece, err := src.Peek(min(remaining, src.Size()))
+		if len(piece) == 0 && err != nil {
+			return fmt.Errorf("could not read message: %w", err)
+		}
+		if _, err = dst.Write(piece); err != nil {
+			return err
+		}
+		_, _ = src.Discard(len(piece))
+		remaining -= len(piece)
+	}
+	return nil
+}
+
 // -------------------------------------------------------------------------------------------------
 // Server message encoding
 // -------------------------------------------------------------------------------------------------
 
 func NewAuthenticationOkMessage() Message {
-	// type + length + int32(0)
-	buf := make([]byte, 0, 9)
+	return NewAuthenticationRequest(0, nil)
+}
 
-	// packet length does not ever include the type byte
-	packetLen := uint32(cap(buf) - 1)
+// Authentication request codes, sent as the first field of an Authentication message
+const (
+	AuthenticationCleartextPassword = 3
+	AuthenticationMD5Password       = 5
+	AuthenticationSASL              = 10
+	AuthenticationSASLContinue      = 11
+	AuthenticationSASLFinal         = 12
+)
 
-	buf = append(buf, MessageTypeAuthentication)
-	buf = binary.BigEndian.AppendUint32(buf, packetLen)
-	buf = binary.BigEndian.AppendUint32(buf, 0)
+// Builds an Authentication message with the given request code and code specific data
+func NewAuthenticationRequest(code uint32, data []byte) Message {
+	return NewBuilder(MessageTypeAuthentication).Uint32(code).Bytes(data).Message()
+}
 
-	return Message{
-		Type:   MessageTypeAuthentication,
-		Length: packetLen,
-		Data:   buf,
+// Asks the client to authenticate with one of the given SASL mechanisms
+func NewAuthenticationSASL(mechanisms ...string) Message {
+	b := NewBuilder(MessageTypeAuthentication).Uint32(AuthenticationSASL)
+	for _, mechanism := range mechanisms {
+		b.String(mechanism)
 	}
+	return b.Byte(0).Message()
+}
+
+// Carries the server's challenge of a SASL exchange, e.g. SCRAM's server-first-message
+func NewAuthenticationSASLContinue(data []byte) Message {
+	return NewAuthenticationRequest(AuthenticationSASLContinue, data)
+}
+
+// Carries the server's outcome of a SASL exchange, e.g. SCRAM's server-final-message
+func NewAuthenticationSASLFinal(data []byte) Message {
+	return NewAuthenticationRequest(AuthenticationSASLFinal, data)
+}
+
+// The key a client cancels its queries with: 4 bytes before protocol 3.2, up to 256 since
+func NewBackendKeyData(processID uint32, secretKey []byte) Message {
+	return NewBuilder(MessageTypeBackendKeyData).Uint32(processID).Bytes(secretKey).Message()
 }
 
 type BackendTransactionStatus byte
@@ -251,113 +678,159 @@ const (
 )
 
 func NewReadyForQueryMessage(status BackendTransactionStatus) Message {
-	// type + length + byte(status)
-	buf := make([]byte, 0, 6)
-	buf = append(buf, MessageTypeReadyForQuery)
-	packetLen := uint32(cap(buf) - 1)
+	return NewBuilder(MessageTypeReadyForQuery).Byte(byte(status)).Message()
+}
 
-	buf = binary.BigEndian.AppendUint32(buf, packetLen)
-	buf = append(buf, byte(status))
+func NewParameterStatus(key string, value string) Message {
+	return NewBuilder(MessageTypeParameterStatus).String(key).String(value).Message()
+}
 
-	return Message{
-		Type:   MessageTypeReadyForQuery,
-		Length: packetLen,
-		Data:   buf,
-	}
+func NewNotice(msg string) Message {
+	// a human readable message, and the terminator of the fields
+	return NewBuilder(MessageTypeNotice).Byte('M').String(msg).Byte(0).Message()
 }
 
-func NewParameterStatus(key string, value string) Message {
-	buf := make([]byte, 0, MessageDataStartIndex+len(key)+len(value)+2)
-	packetLen := uint32(cap(buf) - 1)
+const (
+	ErrorSeverityError = "ERROR"
+	ErrorSeverityFatal = "FATAL"
+)
 
-	buf = append(buf, MessageTypeParameterStatus)
-	buf = binary.BigEndian.AppendUint32(buf, packetLen)
+// SQLSTATE codes for errors the proxy itself reports to clients, see
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	SQLStateOutOfMemory                 = "53200"
+	SQLStateTooManyConnections          = "53300"
+	SQLStateConfigurationLimitExceeded  = "53400"
+	SQLStateUnableToEstablishConnection = "08001"
+	SQLStateConnectionRejected          = "08004"
+	SQLStateInvalidCatalogName          = "3D000"
+	SQLStateFeatureNotSupported         = "0A000"
+	SQLStateProtocolViolation           = "08P01"
+	SQLStateInvalidAuthorization        = "28000"
+	SQLStateInvalidPassword             = "28P01"
+	SQLStateSyntaxError                 = "42601"
+	SQLStateInsufficientPrivilege       = "42501"
+	SQLStateDatatypeMismatch            = "42804"
+	// the server is starting up, shutting down or, for the proxy, in maintenance
+	SQLStateCannotConnectNow = "57P03"
+	// idle_in_transaction_session_timeout
+	SQLStateIdleInTransactionSessionTimeout = "25P03"
+	// transaction_timeout
+	SQLStateTransactionTimeout = "25P04"
+)
 
-	buf = append(buf, cString(key)...)
-	buf = append(buf, cString(value)...)
+func NewErrorResponse(severity string, code string, msg string) Message {
+	return NewBuilder(MessageTypeErrorResponse).
+		Byte('S').String(severity). // localized severity
+		Byte('V').String(severity). // non-localized severity
+		Byte('C').String(code).     // SQLSTATE code
+		Byte('M').String(msg).      // human readable message
+		Byte(0).
+		Message()
+}
 
-	return Message{
-		Type:   MessageTypeParameterStatus,
-		Length: packetLen,
-		Data:   buf,
+// OID of the text type, which the proxy uses for every column of the results it produces itself
+const TextOID = 25
+
+// Describes the columns of a result set whose values are all sent as text
+func NewRowDescription(columns ...string) Message {
+	b := NewBuilder(MessageTypeRowDescription).Int16(int16(len(columns)))
+	for _, column := range columns {
+		b.String(column).
+			Uint32(0). // not from a table
+			Int16(0).
+			Uint32(TextOID).
+			Int16(-1). // variable length
+			Int32(-1). // no type modifier
+			Int16(0)   // text format
 	}
+	return b.Message()
 }
 
-func NewNotice(msg string) Message {
-	buf := make([]byte, 0, MessageDataStartIndex+len(msg)+3)
-	packetLen := uint32(cap(buf) - 1)
-	buf = append(buf, MessageTypeNotice)
-	buf = binary.BigEndian.AppendUint32(buf, packetLen)
-	buf = append(buf, 'M') // human readable message
-	buf = append(buf, cString(msg)...)
-	buf = append(buf, 0) // expects multiple null terminators
-
-	return Message{
-		Type:   MessageTypeNotice,
-		Length: packetLen,
-		Data:   buf,
+// A row of a result set, with values in text format.  A nil value is sent as NULL.
+func NewDataRow(values ...*string) Message {
+	b := NewBuilder(MessageTypeDataRow).Int16(int16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			b.Int32(-1)
+			continue
+		}
+		b.Int32(int32(len(*value))).Bytes([]byte(*value))
 	}
+	return b.Message()
 }
 
-func cString(s string) []byte {
-	str := make([]byte, len(s)+1)
+// Tells the client a command finished, e.g. with tag "SHOW" or "SELECT 3"
+func NewCommandComplete(tag string) Message {
+	return NewBuilder(MessageTypeCommandComplete).String(tag).Message()
+}
 
-	copy(str, []byte(s))
-	str[len(s)] = 0
+// A simple query, for statements the proxy runs on an upstream connection itself (e.g. ROLLBACK)
+func NewQuery(sql string) Message {
+	return NewBuilder(MessageTypeQuery).String(sql).Message()
+}
 
-	return str
+func NewEmptyQueryResponse() Message {
+	return NewBuilder(MessageTypeEmptyQueryResponse).Message()
 }
 
-// I'm not sure that this is the right way to do these operations, but binary/encoding doesn't have
-// methods for signed integers out of the box
-func appendInt16(b []byte, v int16) []byte {
-	return appendSignedInt(b, v, 2)
+// Tells a client which protocol minor version we speak and which `_pq_.` protocol options from its
+// startup message we don't support, so that it can carry on without them
+func NewNegotiateProtocolVersion(minor uint32, unsupportedOptions []string) Message {
+	b := NewBuilder(MessageTypeNegotiateProtocolVersion).Uint32(minor).Uint32(uint32(len(unsupportedOptions)))
+	for _, option := range unsupportedOptions {
+		b.String(option)
+	}
+	return b.Message()
 }
 
-func readInt16(b []byte) int16 {
-	return readSignedInt[int16](b, 2)
+// Big endian integers, as the protocol sends them.  The Read functions panic if `b` is too short,
+// like the binary.BigEndian methods they wrap.
+
+func AppendInt16(b []byte, v int16) []byte {
+	return binary.BigEndian.AppendUint16(b, uint16(v))
 }
 
-func appendInt32(b []byte, v int32) []byte {
-	return appendSignedInt(b, v, 4)
+func AppendInt32(b []byte, v int32) []byte {
+	return binary.BigEndian.AppendUint32(b, uint32(v))
 }
 
-func readInt32(b []byte) int32 {
-	return readSignedInt[int32](b, 4)
+func AppendInt64(b []byte, v int64) []byte {
+	return binary.BigEndian.AppendUint64(b, uint64(v))
 }
 
-type sizedSignedInteger interface {
-	~int8 | ~int16 | ~int32 | ~int64
+func AppendUint16(b []byte, v uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, v)
 }
 
-func appendSignedInt[K sizedSignedInteger](b []byte, v K, size int) []byte {
-	writer := new(bytes.Buffer)
-	err := binary.Write(writer, binary.BigEndian, &v)
-	if err != nil {
-		panic(err)
-	}
+func AppendUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
 
-	t := make([]byte, size)
-	n, err := writer.Read(t)
-	if n != size || err != nil {
-		panic(fmt.Errorf("unexpected writer.Read, read = %d, err = %v", n, err))
-	}
+func AppendUint64(b []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, v)
+}
 
-	return append(b, t...)
+func ReadInt16(b []byte) int16 {
+	return int16(binary.BigEndian.Uint16(b))
 }
 
-func readSignedInt[K sizedSignedInteger](b []byte, size int) K {
-	if len(b) < size {
-		// FIXME: it would be really nice if this printed the type name of K
-		panic(fmt.Errorf("at least %d bytes required to parse int", size))
-	}
+func ReadInt32(b []byte) int32 {
+	return int32(binary.BigEndian.Uint32(b))
+}
 
-	var v K
-	buf := bytes.NewReader(b)
-	err := binary.Read(buf, binary.BigEndian, &v)
-	if err != nil {
-		panic(err)
-	}
+func ReadInt64(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func ReadUint16(b []byte) uint16 {
+	return binary.BigEndian.Uint16(b)
+}
+
+func ReadUint32(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
 
-	return v
+func ReadUint64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
 }
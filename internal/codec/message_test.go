@@ -1,7 +1,298 @@
 package codec
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
 
 func TestThisWorks(t *testing.T) {
 	t.Fail()
 }
+
+func TestParseAsFunctionCall(t *testing.T) {
+	// a call to function 952 (lo_open) with one binary format code and a trailing NULL argument
+	data := []byte{byte(MessageTypeFunctionCall), 0, 0, 0, 0}
+	data = binary.BigEndian.AppendUint32(data, 952)
+	data = binary.BigEndian.AppendUint16(data, 1)
+	data = binary.BigEndian.AppendUint16(data, 1)
+	data = binary.BigEndian.AppendUint16(data, 3)
+	data = binary.BigEndian.AppendUint32(data, 4)
+	data = binary.BigEndian.AppendUint32(data, 16401)
+	data = binary.BigEndian.AppendUint32(data, 4)
+	data = binary.BigEndian.AppendUint32(data, 0x40000)
+	data = binary.BigEndian.AppendUint32(data, 0xffffffff)
+	data = binary.BigEndian.AppendUint16(data, 1)
+	binary.BigEndian.PutUint32(data[1:], uint32(len(data)-1))
+
+	message := &Message{Type: MessageTypeFunctionCall, Length: uint32(len(data) - 1), Data: data}
+	call, err := message.ParseAsFunctionCall()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call.FunctionOID != 952 {
+		t.Errorf("unexpected function oid %d", call.FunctionOID)
+	}
+	if len(call.Arguments) != 3 || binary.BigEndian.Uint32(call.Arguments[0]) != 16401 || call.Arguments[2] != nil {
+		t.Errorf("unexpected arguments %v", call.Arguments)
+	}
+
+	message.Data = data[:len(data)-10]
+	if _, err := message.ParseAsFunctionCall(); err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
+
+func TestParseStartupProtocolVersion(t *testing.T) {
+	data := binary.BigEndian.AppendUint32(nil, 0)
+	data = binary.BigEndian.AppendUint16(data, 3)
+	data = binary.BigEndian.AppendUint16(data, 2)
+	data = append(data, "user\x00alice\x00_pq_.compression\x00on\x00\x00"...)
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+
+	parsed, err := (&Message{Type: MessageTypeStartup, Length: uint32(len(data)), Data: data}).ParseStartupParameters()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parsed.ProtocolMajor != 3 || parsed.ProtocolMinor != 2 {
+		t.Errorf("unexpected protocol version %d.%d", parsed.ProtocolMajor, parsed.ProtocolMinor)
+	}
+	if parsed.Params["user"] != "alice" || parsed.Params["_pq_.compression"] != "on" {
+		t.Errorf("unexpected params %v", parsed.Params)
+	}
+}
+
+func TestNewNegotiateProtocolVersion(t *testing.T) {
+	message := NewNegotiateProtocolVersion(0, []string{"_pq_.compression"})
+
+	want := []byte{'v', 0, 0, 0, 29, 0, 0, 0, 0, 0, 0, 0, 1}
+	want = append(want, "_pq_.compression\x00"...)
+	if !bytes.Equal(message.Data, want) {
+		t.Errorf("unexpected message %q", message.Data)
+	}
+	if message.Length != uint32(len(want)-1) {
+		t.Errorf("unexpected length %d", message.Length)
+	}
+}
+
+func TestParseAsErrorResponse(t *testing.T) {
+	message := NewErrorResponse(ErrorSeverityError, "40P01", "deadlock detected")
+
+	parsed, err := message.ParseAsErrorResponse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parsed.Severity != "ERROR" || parsed.Code != "40P01" || parsed.Message != "deadlock detected" {
+		t.Errorf("unexpected parsed error %+v", parsed)
+	}
+
+	// a server with lc_messages=de, whose localized severity isn't FATAL
+	fields := "SSCHWERWIEGEND\x00VFATAL\x00C57P01\x00Mbeendet\x00\x00"
+	data := binary.BigEndian.AppendUint32([]byte{'E'}, uint32(4+len(fields)))
+	localized := Message{Type: MessageTypeErrorResponse, Length: uint32(4 + len(fields)), Data: append(data, fields...)}
+	if parsed, err = localized.ParseAsErrorResponse(); err != nil || parsed.Severity != "FATAL" || parsed.Code != "57P01" {
+		t.Errorf("expected the non-localized severity, got %+v (%v)", parsed, err)
+	}
+}
+
+func TestNewResultSetMessages(t *testing.T) {
+	value := "42"
+	row := NewDataRow(&value, nil)
+	want := []byte{'D', 0, 0, 0, 16, 0, 2, 0, 0, 0, 2, '4', '2', 0xff, 0xff, 0xff, 0xff}
+	if !bytes.Equal(row.Data, want) {
+		t.Errorf("unexpected data row %v", row.Data)
+	}
+
+	description := NewRowDescription("total")
+	if int(description.Length) != len(description.Data)-1 || len(description.Data) != 7+len("total")+1+18 {
+		t.Errorf("unexpected row description %v", description.Data)
+	}
+	if oid := binary.BigEndian.Uint32(description.Data[7+len("total")+1+6:]); oid != TextOID {
+		t.Errorf("expected column type %d, got %d", TextOID, oid)
+	}
+
+	complete := NewCommandComplete("SHOW")
+	if !bytes.Equal(complete.Data, []byte{'C', 0, 0, 0, 9, 'S', 'H', 'O', 'W', 0}) {
+		t.Errorf("unexpected command complete %v", complete.Data)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	value := strings.Repeat("x", 10000)
+	row := NewDataRow(&value)
+	input := append(append([]byte{}, row.Data...), NewReadyForQueryMessage(BackendTransactionStatusIdle).Data...)
+	reader := bufio.NewReaderSize(bytes.NewReader(input), 16)
+
+	messageType, length, err := ReadHeader(reader)
+	if err != nil || messageType != MessageTypeDataRow || length != row.Length {
+		t.Fatalf("unexpected header %v %d (%v)", messageType, length, err)
+	}
+	var forwarded bytes.Buffer
+	forwarded.Write(AppendHeader(nil, messageType, length))
+	if err = CopyBody(&forwarded, reader, length); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(forwarded.Bytes(), row.Data) {
+		t.Errorf("expected the row forwarded as is, got %d bytes", forwarded.Len())
+	}
+	if messageType, _, err = ReadHeader(reader); err != nil || messageType != MessageTypeReadyForQuery {
+		t.Errorf("expected the next message's header, got %v (%v)", messageType, err)
+	}
+
+	truncated := bufio.NewReader(bytes.NewReader(row.Data[:100]))
+	if _, length, err = ReadHeader(truncated); err != nil {
+		t.Fatal(err)
+	}
+	if err = CopyBody(io.Discard, truncated, length); !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF copying a truncated body, got %v", err)
+	}
+	if _, _, err = ReadHeader(bufio.NewReader(bytes.NewReader([]byte{'D', 0, 0, 0, 3}))); err == nil {
+		t.Error("expected an error for a length shorter than the length field")
+	}
+}
+
+func TestIntegerHelpers(t *testing.T) {
+	b := AppendInt16(nil, -2)
+	b = AppendInt32(b, -1)
+	b = AppendInt64(b, -3)
+	b = AppendUint16(b, 0xfffe)
+	b = AppendUint32(b, 80877103)
+	b = AppendUint64(b, 1<<40)
+	if len(b) != 28 || !bytes.Equal(b[:6], []byte{0xff, 0xfe, 0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("unexpected encoding %v", b)
+	}
+
+	if v := ReadInt16(b); v != -2 {
+		t.Errorf("unexpected int16 %d", v)
+	}
+	if v := ReadInt32(b[2:]); v != -1 {
+		t.Errorf("unexpected int32 %d", v)
+	}
+	if v := ReadInt64(b[6:]); v != -3 {
+		t.Errorf("unexpected int64 %d", v)
+	}
+	if v := ReadUint16(b[14:]); v != 0xfffe {
+		t.Errorf("unexpected uint16 %d", v)
+	}
+	if v := ReadUint32(b[16:]); v != 80877103 {
+		t.Errorf("unexpected uint32 %d", v)
+	}
+	if v := ReadUint64(b[20:]); v != 1<<40 {
+		t.Errorf("unexpected uint64 %d", v)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	message := NewBackendKeyData(1234, []byte{0, 0, 0, 42})
+	want := []byte{'K', 0, 0, 0, 12, 0, 0, 4, 210, 0, 0, 0, 42}
+	if !bytes.Equal(message.Data, want) || message.Length != 12 || message.Type != MessageTypeBackendKeyData {
+		t.Errorf("unexpected BackendKeyData %v", message.Data)
+	}
+
+	message = NewAuthenticationSASL("SCRAM-SHA-256")
+	want = []byte{'R', 0, 0, 0, 23, 0, 0, 0, 10}
+	want = append(want, "SCRAM-SHA-256\x00\x00"...)
+	if !bytes.Equal(message.Data, want) {
+		t.Errorf("unexpected AuthenticationSASL %q", message.Data)
+	}
+
+	for _, message := range []Message{
+		NewAuthenticationOkMessage(), NewAuthenticationSASLFinal([]byte("v=abc")), NewParameterStatus("TimeZone", "UTC"),
+		NewNotice("hello"), NewErrorResponse(ErrorSeverityFatal, SQLStateProtocolViolation, "nope"), NewEmptyQueryResponse(),
+	} {
+		if int(message.Length) != len(message.Data)-1 || ReadUint32(message.Data[1:]) != message.Length {
+			t.Errorf("expected %v's length to match its content, got %d for %d bytes", message.Type, message.Length, len(message.Data))
+		}
+	}
+}
+
+func TestReadMessageValidates(t *testing.T) {
+	read := func(data []byte) (*Message, error) {
+		return ReadMessage(bufio.NewReader(bytes.NewReader(data)))
+	}
+
+	// ParseComplete's type byte isn't a letter
+	if message, err := read([]byte{'1', 0, 0, 0, 4}); err != nil || message.Type != MessageTypeParseComplete {
+		t.Errorf("expected a ParseComplete, got %v (%v)", message, err)
+	}
+	for name, data := range map[string][]byte{
+		"length shorter than its own field": {'D', 0, 0, 0, 3},
+		"ReadyForQuery without a status":    {'Z', 0, 0, 0, 4},
+		"huge startup packet":               {0, 0, 0x27, 0x11, 0, 3, 0, 0},
+		"startup packet without a version":  {0, 0, 0, 4},
+	} {
+		if _, err := read(data); err == nil {
+			t.Errorf("expected an error for a %s", name)
+		}
+	}
+
+	unknown := []byte{'@', 0, 0, 0, 4}
+	if _, err := read(unknown); err != nil {
+		t.Errorf("expected unknown message types to be passed on, got %v", err)
+	}
+	SetStrict(true)
+	defer SetStrict(false)
+	if _, err := read(unknown); err == nil {
+		t.Error("expected unknown message types to be refused in strict mode")
+	}
+}
+
+func TestParseStartupFraming(t *testing.T) {
+	if err := startupMessage("user\x00alice\x00\x00").Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, params := range []string{
+		"user\x00alice\x00",             // no terminator
+		"user\x00alice\x00database",     // a name without a value
+		"user\x00alice\x00database\x00", // a name with an unterminated value
+		"user\x00alice\x00\x00trailing", // data after the terminator
+	} {
+		if _, err := startupMessage(params).ParseStartupParameters(); err == nil {
+			t.Errorf("expected an error for parameters %q", params)
+		}
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	value := "42"
+	for _, message := range []Message{
+		NewQuery("SELECT 1"), NewDataRow(&value, nil), NewErrorResponse(ErrorSeverityError, SQLStateSyntaxError, "nope"),
+		NewReadyForQueryMessage(BackendTransactionStatusIdle), NewNegotiateProtocolVersion(0, []string{"_pq_.x"}),
+	} {
+		f.Add(message.Data)
+	}
+	f.Add([]byte{0, 0, 0, 17, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0, 'a', 0, 0, 0})
+	f.Add([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := ReadMessage(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		if message.Type != MessageTypeStartup {
+			if err = message.Validate(); err != nil {
+				t.Fatalf("ReadMessage returned a message that doesn't validate: %v", err)
+			}
+		}
+
+		// none of the parsers may panic on what ReadMessage lets through
+		switch message.Type {
+		case MessageTypeStartup:
+			_, _ = message.ParseStartupParameters()
+		case MessageTypeQuery:
+			message.ParseAsQuery()
+		case MessageTypeParse:
+			_, _ = message.ParseAsParse()
+		case MessageTypeFunctionCall:
+			_, _ = message.ParseAsFunctionCall()
+		case MessageTypePassword:
+			_, _ = message.ParseAsSASLInitialResponse()
+		case MessageTypeErrorResponse, MessageTypeNotice:
+			_, _ = message.ParseAsErrorResponse()
+		}
+	})
+}
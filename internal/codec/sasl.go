@@ -0,0 +1,169 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// SASL authentication (https://www.postgresql.org/docs/current/sasl-authentication.html): the
+// server offers mechanisms in an AuthenticationSASL message, the client picks one with a
+// SASLInitialResponse, and they exchange SASLResponses and AuthenticationSASLContinues until the
+// server sends an AuthenticationSASLFinal.  The client's messages are all PasswordMessages ('p').
+
+// The code and code specific data of an Authentication message
+type MessageAuthenticationParsed struct {
+	Code uint32
+	Data []byte
+}
+
+func (m *Message) ParseAsAuthentication() (MessageAuthenticationParsed, error) {
+	if m.Type != MessageTypeAuthentication {
+		return MessageAuthenticationParsed{}, fmt.Errorf("expected authentication message, received %s", m.Type)
+	}
+	if len(m.Data) < MessageDataStartIndex+4 {
+		return MessageAuthenticationParsed{}, fmt.Errorf("truncated authentication message")
+	}
+
+	return MessageAuthenticationParsed{
+		Code: ReadUint32(m.Data[MessageDataStartIndex:]),
+		Data: m.Data[MessageDataStartIndex+4:],
+	}, nil
+}
+
+// The data of an Authentication message with the given code
+func (m *Message) parseAuthentication(code uint32) ([]byte, error) {
+	parsed, err := m.ParseAsAuthentication()
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Code != code {
+		return nil, fmt.Errorf("expected authentication request %d, received %d", code, parsed.Code)
+	}
+	return parsed.Data, nil
+}
+
+// The SASL mechanisms a server offers, in its order of preference
+func (m *Message) ParseAsAuthenticationSASL() ([]string, error) {
+	data, err := m.parseAuthentication(AuthenticationSASL)
+	if err != nil {
+		return nil, err
+	}
+
+	var mechanisms []string
+	for len(data) > 0 && data[0] != 0 {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated mechanism in AuthenticationSASL message")
+		}
+		mechanisms = append(mechanisms, string(data[:end]))
+		data = data[end+1:]
+	}
+	if len(data) != 1 {
+		return nil, fmt.Errorf("malformed AuthenticationSASL message")
+	}
+
+	return mechanisms, nil
+}
+
+// The server's challenge, e.g. SCRAM's server-first-message
+func (m *Message) ParseAsAuthenticationSASLContinue() ([]byte, error) {
+	return m.parseAuthentication(AuthenticationSASLContinue)
+}
+
+// The server's outcome, e.g. SCRAM's server-final-message
+func (m *Message) ParseAsAuthenticationSASLFinal() ([]byte, error) {
+	return m.parseAuthentication(AuthenticationSASLFinal)
+}
+
+type MessageSASLInitialResponseParsed struct {
+	Mechanism string
+	// nil if the client sent no initial response
+	Data []byte
+}
+
+func (m *Message) ParseAsSASLInitialResponse() (MessageSASLInitialResponseParsed, error) {
+	data, err := m.ParseAsPassword()
+	if err != nil {
+		return MessageSASLInitialResponseParsed{}, err
+	}
+
+	nameEnd := bytes.IndexByte(data, 0)
+	if nameEnd < 0 || len(data) < nameEnd+5 {
+		return MessageSASLInitialResponseParsed{}, fmt.Errorf("malformed SASLInitialResponse message")
+	}
+
+	parsed := MessageSASLInitialResponseParsed{Mechanism: string(data[:nameEnd])}
+	length := ReadInt32(data[nameEnd+1:])
+	rest := data[nameEnd+5:]
+	if length >= 0 {
+		if int(length) != len(rest) {
+			return MessageSASLInitialResponseParsed{}, fmt.Errorf("malformed SASLInitialResponse message")
+		}
+		parsed.Data = rest
+	}
+
+	return parsed, nil
+}
+
+// The client's answer to a challenge, e.g. SCRAM's client-final-message
+func (m *Message) ParseAsSASLResponse() ([]byte, error) {
+	return m.ParseAsPassword()
+}
+
+// Channel binding flags of a GS2 header
+const (
+	// the client doesn't support channel binding
+	ChannelBindingUnsupported = 'n'
+	// the client supports it, but thinks the server doesn't
+	ChannelBindingNotOffered = 'y'
+	// the client binds the exchange to its channel (SCRAM-SHA-256-PLUS)
+	ChannelBindingRequired = 'p'
+)
+
+// The GS2 header a SCRAM client-first-message starts with (RFC 5802), which says whether the
+// client binds the exchange to its TLS channel
+type GS2Header struct {
+	// one of the ChannelBinding constants
+	ChannelBinding byte
+	// set with ChannelBindingRequired, e.g. "tls-server-end-point"
+	ChannelBindingType string
+	// the authorization identity, which postgres ignores, "" if not given
+	AuthzID string
+	// the header as sent, which the client-final-message's c= attribute carries
+	Raw string
+	// the client-first-message-bare after the header
+	Bare string
+}
+
+// Splits a SCRAM client-first-message, the Data of its SASLInitialResponse, into its GS2 header and
+// the rest
+func ParseGS2Header(clientFirst []byte) (GS2Header, error) {
+	s := string(clientFirst)
+	flag, rest, ok := strings.Cut(s, ",")
+	if !ok {
+		return GS2Header{}, fmt.Errorf("malformed SCRAM client-first-message")
+	}
+	authzID, bare, ok := strings.Cut(rest, ",")
+	if !ok {
+		return GS2Header{}, fmt.Errorf("malformed SCRAM client-first-message")
+	}
+
+	header := GS2Header{Raw: s[:len(s)-len(bare)], Bare: bare}
+	switch {
+	case flag == "n" || flag == "y":
+		header.ChannelBinding = flag[0]
+	case strings.HasPrefix(flag, "p=") && len(flag) > 2:
+		header.ChannelBinding, header.ChannelBindingType = ChannelBindingRequired, flag[2:]
+	default:
+		return GS2Header{}, fmt.Errorf("invalid SCRAM channel binding flag %q", flag)
+	}
+	if authzID != "" {
+		if !strings.HasPrefix(authzID, "a=") {
+			return GS2Header{}, fmt.Errorf("invalid SCRAM authorization identity %q", authzID)
+		}
+		header.AuthzID = authzID[2:]
+	}
+
+	return header, nil
+}
@@ -0,0 +1,50 @@
+package codec
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSASLMessages(t *testing.T) {
+	offer := NewAuthenticationSASL("SCRAM-SHA-256-PLUS", "SCRAM-SHA-256")
+	mechanisms, err := offer.ParseAsAuthenticationSASL()
+	if err != nil || !slices.Equal(mechanisms, []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"}) {
+		t.Errorf("unexpected mechanisms %v (%v)", mechanisms, err)
+	}
+	if _, err = offer.ParseAsAuthenticationSASLFinal(); err == nil {
+		t.Error("expected an error parsing an offer as the final message")
+	}
+
+	final := NewAuthenticationSASLFinal([]byte("v=c2lnbmF0dXJl"))
+	if data, err := final.ParseAsAuthenticationSASLFinal(); err != nil || string(data) != "v=c2lnbmF0dXJl" {
+		t.Errorf("unexpected final message %q (%v)", data, err)
+	}
+	ready := NewReadyForQueryMessage(BackendTransactionStatusIdle)
+	if _, err = ready.ParseAsAuthentication(); err == nil {
+		t.Error("expected an error parsing another message as an authentication request")
+	}
+}
+
+func TestParseGS2Header(t *testing.T) {
+	header, err := ParseGS2Header([]byte("p=tls-server-end-point,,n=,r=nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ChannelBinding != ChannelBindingRequired || header.ChannelBindingType != "tls-server-end-point" {
+		t.Errorf("unexpected channel binding %c %q", header.ChannelBinding, header.ChannelBindingType)
+	}
+	if header.Raw != "p=tls-server-end-point,," || header.Bare != "n=,r=nonce" {
+		t.Errorf("unexpected split %q %q", header.Raw, header.Bare)
+	}
+
+	header, err = ParseGS2Header([]byte("y,a=admin,n=,r=nonce"))
+	if err != nil || header.ChannelBinding != ChannelBindingNotOffered || header.AuthzID != "admin" {
+		t.Errorf("unexpected header %+v (%v)", header, err)
+	}
+
+	for _, clientFirst := range []string{"n=,r=nonce", "x,,n=,r=nonce", "n,admin,n=,r=nonce", "p=,,r=nonce"} {
+		if _, err := ParseGS2Header([]byte(clientFirst)); err == nil {
+			t.Errorf("expected an error for %q", clientFirst)
+		}
+	}
+}
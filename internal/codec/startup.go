@@ -0,0 +1,158 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type StartupMessageParsed struct {
+	ProtocolMajor uint16
+	ProtocolMinor uint16
+	Params        ConnectionParams
+	// the settings of the `options` parameter (see ParseOptions)
+	Options ConnectionParams
+	// the kind of replication connection the `replication` parameter asks for
+	Replication Replication
+}
+
+// The kind of replication connection a client asks for, as sent upstream in the `replication`
+// parameter
+type Replication string
+
+const (
+	ReplicationNone Replication = ""
+	// physical replication, replication=true (or any other true boolean)
+	ReplicationPhysical Replication = "true"
+	// logical replication, replication=database
+	ReplicationLogical Replication = "database"
+)
+
+// Parses the `replication` startup parameter like postgres: "database", or a boolean
+func ParseReplication(value string) (Replication, error) {
+	switch strings.ToLower(value) {
+	case "database":
+		return ReplicationLogical, nil
+	case "true", "on", "yes", "1":
+		return ReplicationPhysical, nil
+	case "", "false", "off", "no", "0":
+		return ReplicationNone, nil
+	default:
+		return ReplicationNone, fmt.Errorf("invalid value for parameter \"replication\": %q", value)
+	}
+}
+
+// Parses the protocol version and the parameters of a startup message, which are pairs of null
+// terminated names and values, followed by a single null byte
+func (m *Message) ParseStartupParameters() (StartupMessageParsed, error) {
+	var parsed StartupMessageParsed
+	if len(m.Data) < 8 {
+		return parsed, fmt.Errorf("startup message too short (%d bytes)", len(m.Data))
+	}
+
+	// parameters start after 4 bytes of packet length + 4 bytes of protocol version
+	ps := m.Data[8:]
+	parsed.ProtocolMajor = ReadUint16(m.Data[4:6])
+	parsed.ProtocolMinor = ReadUint16(m.Data[6:8])
+	parsed.Params = make(map[string]string)
+
+	for len(ps) > 0 && ps[0] != 0 {
+		keyEnd := bytes.IndexByte(ps, 0)
+		if keyEnd < 0 {
+			return parsed, fmt.Errorf("unterminated startup parameter name %q", ps)
+		}
+		key := string(ps[:keyEnd])
+		ps = ps[keyEnd+1:]
+
+		valueEnd := bytes.IndexByte(ps, 0)
+		if valueEnd < 0 {
+			return parsed, fmt.Errorf("startup parameter %q has no value", key)
+		}
+		parsed.Params[key] = string(ps[:valueEnd])
+		ps = ps[valueEnd+1:]
+	}
+	if len(ps) != 1 {
+		return parsed, fmt.Errorf("expected a terminator as the last byte of the startup message")
+	}
+
+	var err error
+	if parsed.Options, err = ParseOptions(parsed.Params["options"]); err != nil {
+		return parsed, err
+	}
+	if parsed.Replication, err = ParseReplication(parsed.Params["replication"]); err != nil {
+		return parsed, err
+	}
+
+	return parsed, nil
+}
+
+// Parses the `options` startup parameter, command-line arguments for the backend, into the
+// settings it makes: `-c name=value`, `-cname=value` or `--name=value`.  Arguments are separated
+// by whitespace, and a backslash takes the next character literally.  As in postgres, dashes in
+// names stand for underscores, and later settings override earlier ones.  Other switches are an
+// error, since we can't tell what they would do.
+func ParseOptions(options string) (ConnectionParams, error) {
+	settings := ConnectionParams{}
+
+	args, err := splitOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(args); i++ {
+		var setting string
+		switch arg := args[i]; {
+		case arg == "-c":
+			if i++; i == len(args) {
+				return nil, fmt.Errorf("missing setting after -c in options")
+			}
+			setting = args[i]
+		case strings.HasPrefix(arg, "--"):
+			setting = arg[2:]
+		case strings.HasPrefix(arg, "-c"):
+			setting = arg[2:]
+		default:
+			return nil, fmt.Errorf("unsupported argument %q in options", arg)
+		}
+
+		name, value, ok := strings.Cut(setting, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid setting %q in options, expected name=value", setting)
+		}
+		settings[strings.ReplaceAll(name, "-", "_")] = value
+	}
+
+	return settings, nil
+}
+
+func splitOptions(options string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, escaped := false, false
+
+	for _, c := range options {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			inArg, escaped = true, true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("options end with an unfinished escape")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
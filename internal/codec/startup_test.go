@@ -0,0 +1,48 @@
+package codec
+
+import (
+	"encoding/binary"
+	"maps"
+	"testing"
+)
+
+func startupMessage(params string) *Message {
+	data := binary.BigEndian.AppendUint32(nil, 0)
+	data = binary.BigEndian.AppendUint32(data, 3<<16)
+	data = append(data, params...)
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return &Message{Type: MessageTypeStartup, Length: uint32(len(data)), Data: data}
+}
+
+func TestParseStartupOptionsAndReplication(t *testing.T) {
+	parsed, err := startupMessage("user\x00alice\x00replication\x00database\x00options\x00-c search_path=app --statement-timeout=5s\x00\x00").ParseStartupParameters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Replication != ReplicationLogical {
+		t.Errorf("expected a logical replication connection, got %q", parsed.Replication)
+	}
+	if want := (ConnectionParams{"search_path": "app", "statement_timeout": "5s"}); !maps.Equal(parsed.Options, want) {
+		t.Errorf("unexpected options %v", parsed.Options)
+	}
+
+	if _, err = startupMessage("user\x00alice\x00replication\x00maybe\x00\x00").ParseStartupParameters(); err == nil {
+		t.Error("expected an error for an invalid replication value")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	settings, err := ParseOptions(`  -capplication_name=my\ app -c search_path=a,b  --search-path=c `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ConnectionParams{"application_name": "my app", "search_path": "c"}); !maps.Equal(settings, want) {
+		t.Errorf("unexpected settings %v", settings)
+	}
+
+	for _, options := range []string{"-c", "-c search_path", "-B 100", `--work_mem=1\`, "--=x"} {
+		if _, err := ParseOptions(options); err == nil {
+			t.Errorf("expected an error for options %q", options)
+		}
+	}
+}
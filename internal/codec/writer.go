@@ -0,0 +1,182 @@
+package codec
+
+import (
+	"io"
+	"sync"
+)
+
+// Bytes a Writer buffers before writing them out, the size of the backend's own send buffer
+const WriterBufferSize = 8192
+
+// Buffers of Writers, which only hold one while they have something buffered, so that the many
+// writers of idle sessions cost nothing
+var writerBuffers = sync.Pool{New: func() any {
+	b := make([]byte, 0, WriterBufferSize)
+	return &b
+}}
+
+// Buffers the messages written to a connection, so that a response made of many small messages
+// (e.g. the DataRows of a result set) goes out in a few writes rather than one per message.
+// Buffered messages are written out along with a message after which the other side waits for an
+// answer (see FlushesAfter), once the buffer is full, or on Flush.  Whoever writes the messages
+// must still Flush before waiting on anything else, e.g. the next message to forward.
+//
+// A Writer may be shared: each WriteMessage is written whole with respect to the others, and so is
+// a message written in pieces within Exclusive.  Once a write fails, every later call returns that
+// error.
+type Writer struct {
+	dst io.Writer
+
+	mu  sync.Mutex
+	buf *[]byte
+	err error
+}
+
+func NewWriter(dst io.Writer) *Writer {
+	return &Writer{dst: dst}
+}
+
+// Whether a message of the type ends a request or a response, so that the other side waits for
+// what was written before it.  Type bytes are shared between frontend and backend messages, so
+// some backend messages flush too (ParameterStatus, which shares Sync's, and CopyOutResponse,
+// which shares Flush's), which is harmless.
+func FlushesAfter(messageType MessageType) bool {
+	switch messageType {
+	// frontend messages the backend answers, or that end a COPY or the session
+	case MessageTypeQuery, MessageTypeSync, MessageTypeFlush, MessageTypeFunctionCall,
+		MessageTypeCopyDone, MessageTypeCopyFail, MessageTypeTerminate:
+		return true
+	// backend messages after which the frontend has its turn
+	case MessageTypeReadyForQuery, MessageTypeCopyInResponse, MessageTypeCopyBothResponse:
+		return true
+	default:
+		return false
+	}
+}
+
+// Buffers a message, and flushes it along with everything before it if FlushesAfter says so
+func (w *Writer) WriteMessage(message Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.write(message.Data); err != nil {
+		return err
+	}
+	if FlushesAfter(message.Type) {
+		return w.flush()
+	}
+	return nil
+}
+
+// Buffers raw bytes, e.g. the rest of a message whose header went through WriteMessage
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Runs `f` with the Writer to itself, other calls waiting until it returns, e.g. to copy a large
+// message over in pieces as it arrives.  `f` writes through `out`, which buffers like Write.
+func (w *Writer) Exclusive(f func(out io.Writer) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return f(heldWriter{w})
+}
+
+// Writes a message like WriteMessage, unless another call is writing or `ready` (asked with the
+// Writer held, so that nothing is written before the message either) says not to.  Returns
+// whether the message was written.  Meant for messages that can wait, e.g. keepalives.
+func (w *Writer) TryWriteMessage(message Message, ready func() bool) (bool, error) {
+	if !w.mu.TryLock() {
+		return false, nil
+	}
+	defer w.mu.Unlock()
+
+	if !ready() {
+		return false, nil
+	}
+	if err := w.write(message.Data); err != nil {
+		return false, err
+	}
+	if FlushesAfter(message.Type) {
+		return true, w.flush()
+	}
+	return true, nil
+}
+
+// The view of a Writer that Exclusive hands out, which writes without taking the lock
+type heldWriter struct {
+	w *Writer
+}
+
+func (h heldWriter) Write(p []byte) (int, error) {
+	if err := h.w.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writes out everything buffered
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.flush()
+}
+
+// The number of bytes waiting to be written out
+func (w *Writer) Buffered() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf == nil {
+		return 0
+	}
+	return len(*w.buf)
+}
+
+func (w *Writer) write(p []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.buf != nil && len(*w.buf)+len(p) > WriterBufferSize {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	// what doesn't fit in an empty buffer goes straight out
+	if len(p) >= WriterBufferSize {
+		if _, err := w.dst.Write(p); err != nil {
+			w.err = err
+		}
+		return w.err
+	}
+
+	if w.buf == nil {
+		w.buf = writerBuffers.Get().(*[]byte)
+	}
+	*w.buf = append(*w.buf, p...)
+	return nil
+}
+
+func (w *Writer) flush() error {
+	if w.err != nil || w.buf == nil {
+		return w.err
+	}
+
+	if len(*w.buf) > 0 {
+		if _, err := w.dst.Write(*w.buf); err != nil {
+			w.err = err
+		}
+	}
+	*w.buf = (*w.buf)[:0]
+	writerBuffers.Put(w.buf)
+	w.buf = nil
+	return w.err
+}
@@ -0,0 +1,92 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// Records each write, to count them
+type writes [][]byte
+
+func (w *writes) Write(p []byte) (int, error) {
+	*w = append(*w, bytes.Clone(p))
+	return len(p), nil
+}
+
+func TestWriter(t *testing.T) {
+	var out writes
+	w := NewWriter(&out)
+
+	value := "42"
+	var want []byte
+	for _, message := range []Message{NewRowDescription("answer"), NewDataRow(&value), NewDataRow(&value), NewCommandComplete("SELECT 2")} {
+		if err := w.WriteMessage(message); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, message.Data...)
+	}
+	if len(out) != 0 || w.Buffered() != len(want) {
+		t.Fatalf("expected the response to be buffered until its ReadyForQuery, got %d writes", len(out))
+	}
+
+	ready := NewReadyForQueryMessage(BackendTransactionStatusIdle)
+	if err := w.WriteMessage(ready); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, ready.Data...)
+	if len(out) != 1 || !bytes.Equal(out[0], want) || w.Buffered() != 0 {
+		t.Fatalf("expected the whole response in a single write, got %d writes", len(out))
+	}
+
+	// a message larger than the buffer goes straight out, after what was buffered before it
+	out = nil
+	large := bytes.Repeat([]byte{'x'}, WriterBufferSize+1)
+	_ = w.WriteMessage(NewDataRow(&value))
+	if _, err := w.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || len(out[1]) != len(large) || w.Buffered() != 0 {
+		t.Errorf("expected the buffered row and the large write, got %d writes", len(out))
+	}
+
+	if err := w.Flush(); err != nil || len(out) != 2 {
+		t.Errorf("expected nothing left to flush, got %d writes (%v)", len(out), err)
+	}
+}
+
+func TestWriterExclusive(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+
+	ready := NewReadyForQueryMessage(BackendTransactionStatusIdle)
+	written := make(chan error)
+	err := w.Exclusive(func(held io.Writer) error {
+		// a message written in pieces isn't interrupted by other writes
+		go func() { written <- w.WriteMessage(ready) }()
+		time.Sleep(10 * time.Millisecond)
+		if ok, err := w.TryWriteMessage(NewParameterStatus("DateStyle", "ISO"), func() bool { return true }); ok || err != nil {
+			t.Errorf("expected the keepalive to wait its turn, got %v (%v)", ok, err)
+		}
+		for _, piece := range []string{"D\x00\x00\x00\x0a", "\x00\x01", "\x00\x00\x00\x00"} {
+			if _, err := held.Write([]byte(piece)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+	if want := "D\x00\x00\x00\x0a\x00\x01\x00\x00\x00\x00" + string(ready.Data); out.String() != want {
+		t.Errorf("expected the row before the ReadyForQuery, got %q", out.String())
+	}
+
+	if ok, err := w.TryWriteMessage(NewParameterStatus("DateStyle", "ISO"), func() bool { return false }); ok || err != nil {
+		t.Errorf("expected nothing to be written unless ready, got %v (%v)", ok, err)
+	}
+}
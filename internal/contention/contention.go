@@ -0,0 +1,275 @@
+// Early warning of lock contention: counts the deadlocks (40P01) and serialization failures (40001)
+// upstreams report, and raises alerts when they come in bursts from one target or for one query
+// fingerprint, which usually means an application change introduced contention.
+package contention
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+const (
+	SQLStateDeadlockDetected     = "40P01"
+	SQLStateSerializationFailure = "40001"
+)
+
+const (
+	DefaultThreshold = 10
+	DefaultWindow    = time.Minute
+	DefaultCooldown  = 10 * time.Minute
+)
+
+// Bursts tracked at once before the quiet ones are forgotten
+const maxBursts = 1024
+
+var (
+	contentionErrors = metrics.NewCounterVec(
+		"pgproxy_contention_errors_total", "Deadlocks (40P01) and serialization failures (40001) upstreams reported.", "entry", "target", "sqlstate",
+	)
+	alertsRaised = metrics.NewCounterVec(
+		"pgproxy_contention_alerts_total", "Bursts of contention errors alerted on, by kind (target or query).", "entry", "kind",
+	)
+	alertsDropped = metrics.NewCounter(
+		"pgproxy_contention_alerts_dropped_total", "Contention alerts not sent to the webhook because it fell behind.",
+	)
+)
+
+type Config struct {
+	// errors within Window that make a burst, defaults to DefaultThreshold
+	Threshold int `json:"threshold"`
+	// defaults to DefaultWindow
+	Window time.Duration `json:"-"`
+	// how long after an alert further bursts from the same target or query are only counted,
+	// defaults to DefaultCooldown
+	Cooldown time.Duration `json:"-"`
+	// receives a POST of each alert as JSON, in addition to the log
+	Webhook *Webhook `json:"webhook"`
+}
+
+type Webhook struct {
+	URL string `json:"url"`
+	// extra headers, e.g. an Authorization header
+	Headers map[string]string `json:"headers"`
+}
+
+// A contention error an upstream sent a client
+type Error struct {
+	Entry  string
+	Target string
+	// SQLSTATE
+	Code string
+	// the query that failed, if known
+	Query string
+}
+
+type Alert struct {
+	Time time.Time `json:"time"`
+	// "target" for a burst from one target of the entry, "query" for a burst for one query
+	// fingerprint (see query.Fingerprint)
+	Kind   string `json:"kind"`
+	Entry  string `json:"entry"`
+	Target string `json:"target,omitempty"`
+	// the query's fingerprint, and the query normalized to leave its literals out
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Query       string `json:"query,omitempty"`
+	// errors within the window, by SQLSTATE
+	Errors        map[string]int `json:"errors"`
+	WindowSeconds float64        `json:"window_seconds"`
+}
+
+// Whether an error is one of those this package tracks
+func IsContention(code string) bool {
+	return code == SQLStateDeadlockDetected || code == SQLStateSerializationFailure
+}
+
+type burst struct {
+	// the most recent errors, oldest first, at most Threshold of them
+	errors    []observed
+	lastAlert time.Time
+}
+
+type observed struct {
+	at   time.Time
+	code string
+}
+
+type detector struct {
+	config Config
+	now    func() time.Time
+
+	mu     sync.Mutex
+	bursts map[string]*burst
+	alerts chan Alert
+}
+
+var current struct {
+	sync.Mutex
+	d *detector
+}
+
+// Starts raising alerts.  Contention errors are counted either way.
+func Start(config *Config) {
+	if config == nil {
+		return
+	}
+
+	d := newDetector(*config)
+	if config.Webhook != nil {
+		d.alerts = make(chan Alert, 64)
+		go deliver(config.Webhook, d.alerts)
+	}
+
+	current.Lock()
+	current.d = d
+	current.Unlock()
+}
+
+func newDetector(config Config) *detector {
+	if config.Threshold <= 0 {
+		config.Threshold = DefaultThreshold
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultWindow
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = DefaultCooldown
+	}
+
+	return &detector{config: config, now: time.Now, bursts: make(map[string]*burst)}
+}
+
+// Counts a contention error, and alerts if it completes a burst
+func Observe(e Error) {
+	contentionErrors.With(e.Entry, e.Target, e.Code).Inc()
+
+	current.Lock()
+	d := current.d
+	current.Unlock()
+	if d == nil {
+		return
+	}
+
+	for _, alert := range d.observe(e) {
+		alertsRaised.With(alert.Entry, alert.Kind).Inc()
+		slog.Warn("burst of contention errors", "kind", alert.Kind, "entry", alert.Entry, "target", alert.Target,
+			"fingerprint", alert.Fingerprint, "query", alert.Query, "errors", alert.Errors, "window", d.config.Window)
+
+		if d.alerts != nil {
+			select {
+			case d.alerts <- alert:
+			default:
+				alertsDropped.Inc()
+			}
+		}
+	}
+}
+
+func (d *detector) observe(e Error) []Alert {
+	now := d.now()
+	type keyed struct {
+		key   string
+		alert Alert
+	}
+	keys := []keyed{{"target\x00" + e.Entry + "\x00" + e.Target, Alert{Kind: "target", Entry: e.Entry, Target: e.Target}}}
+	if e.Query != "" {
+		fingerprint := query.Fingerprint(e.Query)
+		keys = append(keys, keyed{
+			"query\x00" + e.Entry + "\x00" + fingerprint,
+			Alert{Kind: "query", Entry: e.Entry, Fingerprint: fingerprint, Query: query.Normalize(e.Query)},
+		})
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.bursts) > maxBursts {
+		d.forget(now)
+	}
+
+	var alerts []Alert
+	for _, k := range keys {
+		b := d.bursts[k.key]
+		if b == nil {
+			b = &burst{}
+			d.bursts[k.key] = b
+		}
+
+		b.errors = append(b.errors, observed{now, e.Code})
+		if len(b.errors) > d.config.Threshold {
+			b.errors = b.errors[1:]
+		}
+		if len(b.errors) < d.config.Threshold || now.Sub(b.errors[0].at) > d.config.Window {
+			continue
+		}
+		if !b.lastAlert.IsZero() && now.Sub(b.lastAlert) < d.config.Cooldown {
+			continue
+		}
+
+		b.lastAlert = now
+		alert := k.alert
+		alert.Time, alert.WindowSeconds = now, d.config.Window.Seconds()
+		alert.Errors = make(map[string]int)
+		for _, o := range b.errors {
+			alert.Errors[o.code]++
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts
+}
+
+// Drops bursts that have been quiet for longer than the window and aren't cooling down
+func (d *detector) forget(now time.Time) {
+	for key, b := range d.bursts {
+		if now.Sub(b.errors[len(b.errors)-1].at) > d.config.Window && now.Sub(b.lastAlert) > d.config.Cooldown {
+			delete(d.bursts, key)
+		}
+	}
+}
+
+func deliver(webhook *Webhook, alerts <-chan Alert) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for alert := range alerts {
+		if err := post(client, webhook, alert); err != nil {
+			slog.Error("could not send contention alert", "url", webhook.URL, "error", err)
+		}
+	}
+}
+
+func post(client *http.Client, webhook *Webhook, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range webhook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
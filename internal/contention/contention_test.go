@@ -0,0 +1,78 @@
+package contention
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDetector(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d := newDetector(Config{Threshold: 3, Window: time.Minute, Cooldown: 10 * time.Minute})
+	d.now = func() time.Time { return now }
+
+	observe := func(target, sql string) []Alert {
+		return d.observe(Error{Entry: "app", Target: target, Code: SQLStateDeadlockDetected, Query: sql})
+	}
+
+	// spread out over more than the window: no burst
+	for i := 0; i < 3; i++ {
+		if alerts := observe("primary", "UPDATE accounts SET balance = balance - 1 WHERE id = 1"); len(alerts) != 0 {
+			t.Fatalf("expected no alert for spread out errors, got %+v", alerts)
+		}
+		now = now.Add(40 * time.Second)
+	}
+
+	// the same query with other literals, on two targets: a burst for the query first, and for
+	// the primary once it has had three errors within the window too
+	now = now.Add(2 * time.Minute)
+	observe("replica", "UPDATE accounts SET balance = balance - 2 WHERE id = 7")
+	observe("primary", "UPDATE accounts SET balance = balance - 3 WHERE id = 9")
+	alerts := observe("primary", "UPDATE accounts SET balance = balance - 4 WHERE id = 2")
+	if len(alerts) != 1 || alerts[0].Kind != "query" || alerts[0].Errors[SQLStateDeadlockDetected] != 3 ||
+		alerts[0].Query != "update accounts set balance = balance - ? where id = ?" {
+		t.Fatalf("expected a query alert, got %+v", alerts)
+	}
+	alerts = observe("primary", "UPDATE accounts SET balance = balance - 5 WHERE id = 3")
+	if len(alerts) != 1 || alerts[0].Kind != "target" || alerts[0].Target != "primary" {
+		t.Fatalf("expected a target alert only, the query cooling down, got %+v", alerts)
+	}
+
+	// cooling down
+	now = now.Add(time.Second)
+	if alerts := observe("primary", "UPDATE accounts SET balance = 0"); len(alerts) != 0 {
+		t.Errorf("expected no alert while cooling down, got %+v", alerts)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	received := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- alert
+	}))
+	defer server.Close()
+
+	Start(&Config{Threshold: 1, Webhook: &Webhook{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}}})
+	defer func() {
+		current.Lock()
+		current.d = nil
+		current.Unlock()
+	}()
+
+	Observe(Error{Entry: "app", Target: "primary", Code: SQLStateSerializationFailure})
+	select {
+	case alert := <-received:
+		if alert.Kind != "target" || alert.Errors[SQLStateSerializationFailure] != 1 {
+			t.Errorf("unexpected alert %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the webhook to receive an alert")
+	}
+}
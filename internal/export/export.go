@@ -0,0 +1,222 @@
+// Streams query activity (one record per completed request, plus session starts and ends) to
+// Kafka or NATS, for analyzing database access patterns outside the proxy.
+//
+// Records are queued and published in batches by a background goroutine per broker, so the relay
+// never waits on a broker.  If a broker is down or too slow, batches are retried with backoff while
+// its queue absorbs new records; once the queue is full, new records are dropped and counted.
+package export
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+const (
+	DefaultBatchSize      = 100
+	DefaultFlushInterval  = time.Second
+	DefaultQueueSize      = 10000
+	DefaultMaxQueryLength = 2048
+)
+
+// Bounds for retrying a batch the brokers didn't take
+const (
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+type RecordType string
+
+const (
+	// a request (simple query, extended protocol batch or function call) the upstream answered
+	RecordQuery        RecordType = "query"
+	RecordSessionStart RecordType = "session_start"
+	RecordSessionEnd   RecordType = "session_end"
+)
+
+type Record struct {
+	Type       RecordType `json:"type"`
+	Time       time.Time  `json:"time"`
+	Session    string     `json:"session"`
+	ClientAddr string     `json:"client_addr,omitempty"`
+	User       string     `json:"user,omitempty"`
+	Database   string     `json:"database,omitempty"`
+	Entry      string     `json:"entry,omitempty"`
+	// query records: the SQL (truncated to max_query_length, and empty for function calls and
+	// batches that only execute already prepared statements), and the SQLSTATE if it failed
+	Query string `json:"query,omitempty"`
+	Error string `json:"error,omitempty"`
+	// query records: from the request to its ReadyForQuery.  session_end records: the session.
+	DurationMs float64 `json:"duration_ms,omitempty"`
+}
+
+type Config struct {
+	Kafka *KafkaConfig `json:"kafka"`
+	NATS  *NATSConfig  `json:"nats"`
+	// records per published batch, defaults to DefaultBatchSize
+	BatchSize int `json:"batch_size"`
+	// how long a record may wait for its batch to fill, defaults to DefaultFlushInterval
+	FlushInterval time.Duration `json:"-"`
+	// records waiting to be published before new ones are dropped, defaults to DefaultQueueSize
+	QueueSize int `json:"queue_size"`
+	// bytes of query text to keep, defaults to DefaultMaxQueryLength; -1 leaves query text out
+	MaxQueryLength int `json:"max_query_length"`
+}
+
+// Something records can be published to
+type publisher interface {
+	// publishes a batch of encoded records, keyed by session so that a session's records stay in
+	// order
+	publish(keys, values [][]byte) error
+	name() string
+	close()
+}
+
+var (
+	exportedRecords = metrics.NewCounter("pgproxy_export_records_total", "Activity records published to Kafka or NATS.")
+	droppedRecords  = metrics.NewCounter("pgproxy_export_records_dropped_total", "Activity records dropped because the queue was full.")
+	failedBatches   = metrics.NewCounter("pgproxy_export_failed_batches_total", "Attempts to publish a batch of activity records that failed.")
+)
+
+// one queue per publisher, so that a broker being down doesn't hold up the others
+var (
+	queues         []chan Record
+	maxQueryLength int
+)
+
+// Starts publishing to the configured brokers.  Until then (or without a config), Enabled is false
+// and records are discarded.
+func Start(config *Config) error {
+	if config == nil || (config.Kafka == nil && config.NATS == nil) {
+		return nil
+	}
+
+	c := *config
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = DefaultFlushInterval
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = DefaultQueueSize
+	}
+	if c.MaxQueryLength == 0 {
+		c.MaxQueryLength = DefaultMaxQueryLength
+	}
+
+	var publishers []publisher
+	if c.Kafka != nil {
+		p, err := newKafkaPublisher(c.Kafka)
+		if err != nil {
+			return err
+		}
+		publishers = append(publishers, p)
+	}
+	if c.NATS != nil {
+		p, err := newNATSPublisher(c.NATS)
+		if err != nil {
+			return err
+		}
+		publishers = append(publishers, p)
+	}
+
+	maxQueryLength = c.MaxQueryLength
+	for _, p := range publishers {
+		queue := make(chan Record, c.QueueSize)
+		queues = append(queues, queue)
+		go run(queue, p, c.BatchSize, c.FlushInterval)
+	}
+
+	return nil
+}
+
+// Whether records are being exported, so that callers can skip the work of building them
+func Enabled() bool {
+	return len(queues) > 0
+}
+
+// Queues a record for publishing.  Never blocks.
+func Publish(record Record) {
+	if len(queues) == 0 {
+		return
+	}
+
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	switch {
+	case maxQueryLength < 0:
+		record.Query = ""
+	case len(record.Query) > maxQueryLength:
+		record.Query = record.Query[:maxQueryLength]
+	}
+
+	for _, queue := range queues {
+		select {
+		case queue <- record:
+		default:
+			droppedRecords.Inc()
+		}
+	}
+}
+
+func run(queue <-chan Record, p publisher, batchSize int, flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			publishBatch(p, batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case record, ok := <-queue:
+			if !ok {
+				flush()
+				p.close()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Publishes a batch, retrying until it succeeds.  While this retries, new records pile up in the
+// queue, and are dropped once it is full.
+func publishBatch(p publisher, batch []Record) {
+	keys, values := make([][]byte, 0, len(batch)), make([][]byte, 0, len(batch))
+	for _, record := range batch {
+		value, err := json.Marshal(record)
+		if err != nil {
+			slog.Error("could not encode activity record", "error", err)
+			continue
+		}
+		keys, values = append(keys, []byte(record.Session)), append(values, value)
+	}
+
+	backoff := time.Duration(0)
+	for {
+		err := p.publish(keys, values)
+		if err == nil {
+			exportedRecords.Add(uint64(len(values)))
+			return
+		}
+
+		failedBatches.Inc()
+		backoff = min(max(2*backoff, minRetryBackoff), maxRetryBackoff)
+		slog.Error("could not publish activity records, retrying", "publisher", p.name(), "records", len(values), "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+	}
+}
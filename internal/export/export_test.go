@@ -0,0 +1,250 @@
+package export
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Accepts one NATS client, answers its PINGs and sends the payloads it publishes to `published`
+func fakeNATSServer(t *testing.T, published chan<- string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		_, _ = conn.Write([]byte(`INFO {"server_id":"test","max_payload":1048576}` + "\r\n"))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 0:
+			case fields[0] == "PING":
+				_, _ = conn.Write([]byte("PONG\r\n"))
+			case fields[0] == "PUB" && len(fields) == 3:
+				n, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, n+2)
+				if _, err := io.ReadFull(reader, payload); err != nil {
+					return
+				}
+				published <- fields[1] + " " + string(payload[:n])
+			}
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestPublishToNATS(t *testing.T) {
+	published := make(chan string, 10)
+	addr := fakeNATSServer(t, published)
+
+	err := Start(&Config{NATS: &NATSConfig{URL: "nats://" + addr, Subject: "pgproxy.activity"}, FlushInterval: 10 * time.Millisecond, MaxQueryLength: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { queues = nil }()
+
+	if !Enabled() {
+		t.Fatal("expected export to be enabled")
+	}
+	Publish(Record{Type: RecordQuery, Session: "abc", User: "alice", Query: "SELECT * FROM accounts", Error: "42P01", DurationMs: 1.5})
+
+	select {
+	case message := <-published:
+		subject, payload, _ := strings.Cut(message, " ")
+		if subject != "pgproxy.activity" {
+			t.Errorf("expected subject pgproxy.activity, got %q", subject)
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(payload), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", payload, err)
+		}
+		if record.Type != RecordQuery || record.Session != "abc" || record.Error != "42P01" || record.Time.IsZero() {
+			t.Errorf("unexpected record %+v", record)
+		}
+		if record.Query != "SELECT *" {
+			t.Errorf("expected the query to be truncated to 8 bytes, got %q", record.Query)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record")
+	}
+}
+
+// Answers Metadata requests with a topic of `partitions` partitions led by itself, and Produce
+// requests with success, sending the records of each partition to `produced`
+func fakeKafkaBroker(t *testing.T, partitions int32, produced chan<- map[int32][]string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	host, portString, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			var size [4]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return
+			}
+			request := make([]byte, binary.BigEndian.Uint32(size[:]))
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			r := &kafkaReader{buf: request}
+			apiKey := r.int16()
+			r.int16() // version
+			correlationID := r.int32()
+			r.string() // client ID
+
+			resp := binary.BigEndian.AppendUint32(nil, uint32(correlationID))
+			switch apiKey {
+			case kafkaAPIMetadata:
+				r.arrayLen()
+				topic := r.string()
+				resp = binary.BigEndian.AppendUint32(resp, 1)
+				resp = binary.BigEndian.AppendUint32(resp, 1) // node ID
+				resp = appendKafkaString(resp, host)
+				resp = binary.BigEndian.AppendUint32(resp, uint32(port))
+				resp = binary.BigEndian.AppendUint16(resp, 0xffff) // rack
+				resp = binary.BigEndian.AppendUint32(resp, 1)      // controller
+				resp = binary.BigEndian.AppendUint32(resp, 1)
+				resp = binary.BigEndian.AppendUint16(resp, 0)
+				resp = appendKafkaString(resp, topic)
+				resp = append(resp, 0)
+				resp = binary.BigEndian.AppendUint32(resp, uint32(partitions))
+				for partition := range partitions {
+					resp = binary.BigEndian.AppendUint16(resp, 0)
+					resp = binary.BigEndian.AppendUint32(resp, uint32(partition))
+					resp = binary.BigEndian.AppendUint32(resp, 1) // leader
+					resp = binary.BigEndian.AppendUint32(resp, 0) // replicas
+					resp = binary.BigEndian.AppendUint32(resp, 0) // isr
+				}
+			case kafkaAPIProduce:
+				r.int16() // transactional ID
+				r.int16() // acks
+				r.int32() // timeout
+				r.arrayLen()
+				topic := r.string()
+				records := map[int32][]string{}
+				resp = binary.BigEndian.AppendUint32(resp, 1)
+				resp = appendKafkaString(resp, topic)
+				n := r.arrayLen()
+				resp = binary.BigEndian.AppendUint32(resp, uint32(n))
+				for range n {
+					partition := r.int32()
+					records[partition] = decodeRecordBatch(t, r.next(int(r.int32())))
+					resp = binary.BigEndian.AppendUint32(resp, uint32(partition))
+					resp = binary.BigEndian.AppendUint16(resp, 0)
+					resp = binary.BigEndian.AppendUint64(resp, 0)
+					resp = binary.BigEndian.AppendUint64(resp, 0xffffffffffffffff)
+				}
+				resp = binary.BigEndian.AppendUint32(resp, 0) // throttle time
+				produced <- records
+			}
+
+			if _, err := conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(resp))), resp...)); err != nil {
+				return
+			}
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// Returns the values of a record batch, as "key=value"
+func decodeRecordBatch(t *testing.T, batch []byte) []string {
+	t.Helper()
+
+	if len(batch) < 61 || batch[16] != 2 {
+		t.Fatalf("invalid record batch %x", batch)
+	}
+	if int(binary.BigEndian.Uint32(batch[8:])) != len(batch)-12 {
+		t.Errorf("record batch length %d doesn't match its size %d", binary.BigEndian.Uint32(batch[8:]), len(batch)-12)
+	}
+	if crc := crc32.Checksum(batch[21:], castagnoli); crc != binary.BigEndian.Uint32(batch[17:]) {
+		t.Errorf("record batch CRC mismatch")
+	}
+
+	count := int(binary.BigEndian.Uint32(batch[57:]))
+	records := batch[61:]
+	var values []string
+	for range count {
+		_, n := binary.Varint(records)
+		records = records[n+1:] // length, attributes
+		for range 2 {           // timestamp and offset deltas
+			_, n = binary.Varint(records)
+			records = records[n:]
+		}
+		keyLength, n := binary.Varint(records)
+		key := records[n : n+int(keyLength)]
+		records = records[n+int(keyLength):]
+		valueLength, n := binary.Varint(records)
+		value := records[n : n+int(valueLength)]
+		records = records[n+int(valueLength)+1:] // headers
+		values = append(values, string(key)+"="+string(value))
+	}
+
+	return values
+}
+
+func TestPublishToKafka(t *testing.T) {
+	produced := make(chan map[int32][]string, 1)
+	addr := fakeKafkaBroker(t, 4, produced)
+
+	p, err := newKafkaPublisher(&KafkaConfig{Brokers: []string{addr}, Topic: "activity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("a")}
+	values := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	if err := p.publish(keys, values); err != nil {
+		t.Fatal(err)
+	}
+
+	records := <-produced
+	total, sessionA := 0, []string{}
+	for _, values := range records {
+		total += len(values)
+		for _, value := range values {
+			if strings.HasPrefix(value, "a=") {
+				sessionA = append(sessionA, value)
+			}
+		}
+	}
+	if total != 3 {
+		t.Errorf("expected 3 records, got %v", records)
+	}
+	// records of a session share a partition, in order
+	if strings.Join(sessionA, ",") != "a=1,a=3" {
+		t.Errorf("expected session a's records in one partition in order, got %v", records)
+	}
+}
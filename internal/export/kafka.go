@@ -0,0 +1,394 @@
+package export
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type KafkaConfig struct {
+	// host:port of one or more brokers to discover the cluster from
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	// connect to the brokers with TLS
+	TLS bool `json:"tls"`
+}
+
+const (
+	kafkaTimeout  = 10 * time.Second
+	kafkaClientID = "pgproxy"
+
+	kafkaAPIProduce  = 0
+	kafkaAPIMetadata = 3
+
+	// the oldest versions that support record batches (Kafka 0.11)
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 1
+
+	// wait for the partition leader to write the batch, but not for replicas
+	kafkaAcks = 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Publishes records with the Kafka protocol: the topic's partition leaders are looked up with a
+// Metadata request, and records are sent to them as record batches in Produce requests.  Records
+// with the same key (session) go to the same partition, so they stay in order.
+type kafkaPublisher struct {
+	config *KafkaConfig
+	// nil until metadata has been fetched, and reset on any error so that it is fetched again
+	partitions []int32
+	leaders    map[int32]string
+	conns      map[string]*kafkaConn
+	// requests and responses are matched by correlation ID
+	correlationID int32
+}
+
+type kafkaConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newKafkaPublisher(config *KafkaConfig) (*kafkaPublisher, error) {
+	if len(config.Brokers) == 0 {
+		return nil, errors.New("kafka export needs at least one broker")
+	}
+	if config.Topic == "" {
+		return nil, errors.New("kafka export needs a topic")
+	}
+
+	return &kafkaPublisher{config: config, conns: map[string]*kafkaConn{}}, nil
+}
+
+func (p *kafkaPublisher) name() string { return "kafka" }
+
+func (p *kafkaPublisher) publish(keys, values [][]byte) error {
+	if p.partitions == nil {
+		if err := p.fetchMetadata(); err != nil {
+			p.close()
+			return err
+		}
+	}
+
+	// group records by partition, then partitions by leader
+	byPartition := map[int32][]int{}
+	for i, key := range keys {
+		h := fnv.New32a()
+		_, _ = h.Write(key)
+		partition := p.partitions[h.Sum32()%uint32(len(p.partitions))]
+		byPartition[partition] = append(byPartition[partition], i)
+	}
+	byLeader := map[string][]int32{}
+	for partition := range byPartition {
+		leader, ok := p.leaders[partition]
+		if !ok {
+			p.close()
+			return fmt.Errorf("partition %d of topic %s has no leader", partition, p.config.Topic)
+		}
+		byLeader[leader] = append(byLeader[leader], partition)
+	}
+
+	now := time.Now().UnixMilli()
+	for leader, partitions := range byLeader {
+		batches := make(map[int32][]byte, len(partitions))
+		for _, partition := range partitions {
+			indexes := byPartition[partition]
+			batchKeys, batchValues := make([][]byte, len(indexes)), make([][]byte, len(indexes))
+			for i, index := range indexes {
+				batchKeys[i], batchValues[i] = keys[index], values[index]
+			}
+			batches[partition] = encodeRecordBatch(batchKeys, batchValues, now)
+		}
+
+		if err := p.produce(leader, batches); err != nil {
+			p.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sends one Produce request for the given partitions to their leader
+func (p *kafkaPublisher) produce(leader string, batches map[int32][]byte) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, 0xffff) // transactional_id: null
+	body = binary.BigEndian.AppendUint16(body, kafkaAcks)
+	body = binary.BigEndian.AppendUint32(body, uint32(kafkaTimeout.Milliseconds()))
+	body = binary.BigEndian.AppendUint32(body, 1) // one topic
+	body = appendKafkaString(body, p.config.Topic)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(batches)))
+	for partition, batch := range batches {
+		body = binary.BigEndian.AppendUint32(body, uint32(partition))
+		body = binary.BigEndian.AppendUint32(body, uint32(len(batch)))
+		body = append(body, batch...)
+	}
+
+	resp, err := p.roundTrip(leader, kafkaAPIProduce, kafkaProduceVersion, body)
+	if err != nil {
+		return err
+	}
+
+	r := &kafkaReader{buf: resp}
+	for range r.arrayLen() {
+		topic := r.string()
+		for range r.arrayLen() {
+			partition := r.int32()
+			code := r.int16()
+			r.skip(8 + 8) // base_offset, log_append_time
+			if r.err == nil && code != 0 {
+				return fmt.Errorf("kafka rejected records for %s/%d with error code %d", topic, partition, code)
+			}
+		}
+	}
+
+	return r.err
+}
+
+// Looks up the topic's partitions and their leaders from the first broker that answers
+func (p *kafkaPublisher) fetchMetadata() error {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, p.config.Topic)
+
+	var errs []error
+	for _, broker := range p.config.Brokers {
+		resp, err := p.roundTrip(broker, kafkaAPIMetadata, kafkaMetadataVersion, body)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", broker, err))
+			continue
+		}
+
+		return p.parseMetadata(resp)
+	}
+
+	return fmt.Errorf("could not fetch kafka metadata: %w", errors.Join(errs...))
+}
+
+func (p *kafkaPublisher) parseMetadata(resp []byte) error {
+	r := &kafkaReader{buf: resp}
+
+	brokers := map[int32]string{}
+	for range r.arrayLen() {
+		node := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.nullableString() // rack
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // controller_id
+
+	var partitions []int32
+	leaders := map[int32]string{}
+	for range r.arrayLen() {
+		code := r.int16()
+		topic := r.string()
+		r.skip(1) // is_internal
+		if r.err == nil && code != 0 {
+			return fmt.Errorf("kafka metadata for topic %s has error code %d", topic, code)
+		}
+
+		for range r.arrayLen() {
+			r.int16() // error_code, e.g. LEADER_NOT_AVAILABLE while the leader is elected
+			partition := r.int32()
+			leader := r.int32()
+			r.skip(4 * int(r.arrayLen())) // replicas
+			r.skip(4 * int(r.arrayLen())) // isr
+
+			partitions = append(partitions, partition)
+			if address, ok := brokers[leader]; ok {
+				leaders[partition] = address
+			}
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("kafka topic %s has no partitions", p.config.Topic)
+	}
+
+	p.partitions, p.leaders = partitions, leaders
+	return nil
+}
+
+// Sends a request to a broker and returns the body of its response
+func (p *kafkaPublisher) roundTrip(broker string, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	c, err := p.conn(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	p.correlationID++
+	correlationID := p.correlationID
+
+	header := make([]byte, 4, 4+14+len(kafkaClientID))
+	header = binary.BigEndian.AppendUint16(header, uint16(apiKey))
+	header = binary.BigEndian.AppendUint16(header, uint16(apiVersion))
+	header = binary.BigEndian.AppendUint32(header, uint32(correlationID))
+	header = appendKafkaString(header, kafkaClientID)
+	binary.BigEndian.PutUint32(header, uint32(len(header)-4+len(body)))
+
+	_ = c.conn.SetDeadline(time.Now().Add(2 * kafkaTimeout))
+	if _, err := c.conn.Write(append(header, body...)); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 64<<20 {
+		return nil, fmt.Errorf("invalid kafka response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, resp); err != nil {
+		return nil, err
+	}
+	if got := int32(binary.BigEndian.Uint32(resp)); got != correlationID {
+		return nil, fmt.Errorf("kafka response for request %d, expected %d", got, correlationID)
+	}
+
+	return resp[4:], nil
+}
+
+func (p *kafkaPublisher) conn(broker string) (*kafkaConn, error) {
+	if c, ok := p.conns[broker]; ok {
+		return c, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", broker, kafkaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.TLS {
+		host, _, _ := net.SplitHostPort(broker)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+		_ = tlsConn.SetDeadline(time.Now().Add(kafkaTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c := &kafkaConn{conn: conn, reader: bufio.NewReader(conn)}
+	p.conns[broker] = c
+	return c, nil
+}
+
+// Closes all connections and forgets the metadata, so that the next publish starts over
+func (p *kafkaPublisher) close() {
+	for broker, c := range p.conns {
+		_ = c.conn.Close()
+		delete(p.conns, broker)
+	}
+	p.partitions, p.leaders = nil, nil
+}
+
+// Encodes records as an uncompressed, non-transactional record batch (magic 2)
+func encodeRecordBatch(keys, values [][]byte, timestamp int64) []byte {
+	var records []byte
+	for i := range values {
+		var record []byte
+		record = append(record, 0)                     // attributes
+		record = binary.AppendVarint(record, 0)        // timestamp delta
+		record = binary.AppendVarint(record, int64(i)) // offset delta
+		record = binary.AppendVarint(record, int64(len(keys[i])))
+		record = append(record, keys[i]...)
+		record = binary.AppendVarint(record, int64(len(values[i])))
+		record = append(record, values[i]...)
+		record = binary.AppendVarint(record, 0) // headers
+
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+
+	// everything after the CRC, which the CRC covers
+	var tail []byte
+	tail = binary.BigEndian.AppendUint16(tail, 0) // attributes: no compression
+	tail = binary.BigEndian.AppendUint32(tail, uint32(len(values)-1))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(timestamp))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(timestamp))
+	tail = binary.BigEndian.AppendUint64(tail, 0xffffffffffffffff) // producer ID: none
+	tail = binary.BigEndian.AppendUint16(tail, 0xffff)             // producer epoch
+	tail = binary.BigEndian.AppendUint32(tail, 0xffffffff)         // base sequence
+	tail = binary.BigEndian.AppendUint32(tail, uint32(len(values)))
+	tail = append(tail, records...)
+
+	var batch []byte
+	batch = binary.BigEndian.AppendUint64(batch, 0) // base offset, assigned by the broker
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(tail)))
+	batch = binary.BigEndian.AppendUint32(batch, 0xffffffff) // partition leader epoch
+	batch = append(batch, 2)                                 // magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(tail, castagnoli))
+	return append(batch, tail...)
+}
+
+func appendKafkaString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// Reads a Kafka response body.  The first error sticks, and makes all further reads return zero
+// values, so that callers can check it once at the end.
+type kafkaReader struct {
+	buf []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = errors.New("kafka response too short")
+		return nil
+	}
+
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *kafkaReader) skip(n int) { r.next(n) }
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+// Reads an array's length, treating a null array as empty
+func (r *kafkaReader) arrayLen() int32 {
+	return max(r.int32(), 0)
+}
+
+func (r *kafkaReader) string() string {
+	return string(r.next(int(r.int16())))
+}
+
+func (r *kafkaReader) nullableString() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
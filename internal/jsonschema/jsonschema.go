@@ -0,0 +1,175 @@
+// JSON Schemas describing what encoding/json decodes into Go types, generated from the types
+// themselves so that they can't drift from the code.
+package jsonschema
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// The dialect of the documents Generator produces
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+type Schema = map[string]any
+
+// Implemented by types that decode from something other than their Go type suggests, e.g. a
+// time.Duration written as "30s".  JSONSchema is called on a pointer to the zero value.
+type Describer interface {
+	JSONSchema() Schema
+}
+
+var (
+	describerType = reflect.TypeFor[Describer]()
+	rawType       = reflect.TypeFor[json.RawMessage]()
+	unmarshaler   = reflect.TypeFor[json.Unmarshaler]()
+)
+
+// Builds the schemas of several types into one document, sharing the definitions of the structs
+// they use.  Structs are described as objects without additional properties, so that typos in
+// field names are caught even though encoding/json ignores unknown fields.
+type Generator struct {
+	defs  Schema
+	names map[reflect.Type]string
+	// package of the first struct described, whose structs are named without their package
+	home string
+}
+
+func New() *Generator {
+	return &Generator{defs: make(Schema), names: make(map[reflect.Type]string)}
+}
+
+// Returns the schema of `t`, referring to the definitions of the structs it uses
+func (g *Generator) For(t reflect.Type) Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == rawType {
+		return Schema{}
+	}
+	if s, ok := describe(t); ok {
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Schema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// base64, as encoding/json writes []byte
+			return Schema{"type": "string"}
+		}
+		return Schema{"type": "array", "items": g.For(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": g.For(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return Schema{"$ref": "#/$defs/" + g.define(t)}
+	default:
+		// interfaces, and custom unmarshalers without a Describer
+		return Schema{}
+	}
+}
+
+// Wraps `root` into a document with the definitions of every struct used so far
+func (g *Generator) Document(root Schema) Schema {
+	doc := Schema{"$schema": Draft}
+	for k, v := range root {
+		doc[k] = v
+	}
+	if len(g.defs) > 0 {
+		doc["$defs"] = g.defs
+	}
+	return doc
+}
+
+func describe(t reflect.Type) (Schema, bool) {
+	if reflect.PointerTo(t).Implements(describerType) {
+		return reflect.New(t).Interface().(Describer).JSONSchema(), true
+	}
+	if reflect.PointerTo(t).Implements(unmarshaler) {
+		return Schema{}, true
+	}
+	return nil, false
+}
+
+// Adds the definition of a struct, named after the type, and its package for structs of other
+// packages than the first one described
+func (g *Generator) define(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+
+	if g.home == "" {
+		g.home = t.PkgPath()
+	}
+	name := t.Name()
+	if t.PkgPath() != g.home {
+		name = path.Base(t.PkgPath()) + "." + name
+	}
+	// name the struct before describing its fields, which may refer back to it
+	g.names[t] = name
+	g.defs[name] = g.object(t)
+
+	return name
+}
+
+func (g *Generator) object(t reflect.Type) Schema {
+	properties := make(Schema)
+	g.fields(t, properties)
+	return Schema{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+// Adds the fields of a struct to `properties`, flattening embedded structs like encoding/json: a
+// struct's own fields win over those of the structs it embeds.
+func (g *Generator) fields(t reflect.Type, properties Schema) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			e := f.Type
+			if e.Kind() == reflect.Pointer {
+				e = e.Elem()
+			}
+			if e.Kind() == reflect.Struct {
+				embedded = append(embedded, e)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.For(f.Type)
+	}
+
+	for _, e := range embedded {
+		promoted := make(Schema)
+		g.fields(e, promoted)
+		for name, s := range promoted {
+			if _, ok := properties[name]; !ok {
+				properties[name] = s
+			}
+		}
+	}
+}
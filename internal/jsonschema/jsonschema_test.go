@@ -0,0 +1,55 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type duration time.Duration
+
+func (*duration) JSONSchema() Schema {
+	return Schema{"type": "string"}
+}
+
+type base struct {
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+}
+
+type node struct {
+	base
+	Comment  int             `json:"comment"`
+	Timeout  *duration       `json:"timeout"`
+	Children []*node         `json:"children"`
+	Labels   map[string]bool `json:"labels"`
+	Extra    json.RawMessage `json:"extra"`
+	Ignored  string          `json:"-"`
+	internal string
+	Default  uint8
+}
+
+func TestGenerator(t *testing.T) {
+	g := New()
+	doc := g.Document(g.For(reflect.TypeFor[[]node]()))
+
+	got, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"$defs":{"node":{"additionalProperties":false,"properties":{` +
+		`"Default":{"minimum":0,"type":"integer"},` +
+		`"children":{"items":{"$ref":"#/$defs/node"},"type":"array"},` +
+		`"comment":{"type":"integer"},` +
+		`"extra":{},` +
+		`"labels":{"additionalProperties":{"type":"boolean"},"type":"object"},` +
+		`"name":{"type":"string"},` +
+		`"timeout":{"type":"string"}` +
+		`},"type":"object"}},` +
+		`"$schema":"https://json-schema.org/draft/2020-12/schema",` +
+		`"items":{"$ref":"#/$defs/node"},"type":"array"}`
+	if string(got) != want {
+		t.Errorf("unexpected schema\n got: %s\nwant: %s", got, want)
+	}
+}
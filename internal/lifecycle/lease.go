@@ -0,0 +1,388 @@
+package lifecycle
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	// the Kubernetes API is reached with the pod's service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// Kubernetes' MicroTime format
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Elects one proxy of an active/standby pair (or larger group) as active with a Kubernetes Lease
+// (coordination.k8s.io/v1).  Only the holder of the lease is ready, so a Service in front of the
+// group sends clients to it alone, and a standby takes over once the active proxy lets the lease
+// go on shutdown or stops renewing it.
+type LeaseConfig struct {
+	// name of the Lease object, created if it doesn't exist
+	Name string `json:"name"`
+	// defaults to the pod's namespace
+	Namespace string `json:"namespace"`
+	// who holds the lease, defaults to $POD_NAME or the hostname (which is the pod name)
+	Identity string `json:"identity"`
+	// annotation set to "active" or "standby" on the pod ($POD_NAME) as the proxy's role
+	// changes, e.g. "pgproxy.io/role"; no annotation if empty
+	PodAnnotation string `json:"pod_annotation"`
+	// how long the lease lasts without being renewed, defaults to DefaultLeaseDuration
+	Duration time.Duration `json:"-"`
+	// how often the lease is renewed (or a standby tries to take it), defaults to a third of
+	// the duration
+	RenewInterval time.Duration `json:"-"`
+}
+
+type elector struct {
+	config *LeaseConfig
+	api    *kubeClient
+	pod    string
+
+	// serializes rounds, as releasing on shutdown races with the renew loop
+	mu sync.Mutex
+	// when we last sent a successful renewal, zero if we don't hold the lease.  We only count as
+	// leader until the lease would expire from then, even if the API is unreachable in between.
+	renewed atomic.Int64
+	// the role last set on the pod
+	role string
+}
+
+var current atomic.Pointer[elector]
+
+// Starts competing for the lease in the background.  The proxy is unready until it holds it.
+func StartLease(config *LeaseConfig) error {
+	if config == nil {
+		return nil
+	}
+
+	api, namespace, err := inClusterClient()
+	if err != nil {
+		return err
+	}
+	e, err := newElector(config, api, namespace)
+	if err != nil {
+		return err
+	}
+
+	current.Store(e)
+	go e.run()
+	return nil
+}
+
+// Lets the lease go if we hold it, so that a standby can take over straight away rather than
+// waiting for it to expire.  The proxy stays unready.
+func ReleaseLease() {
+	if e := current.Load(); e != nil {
+		e.release()
+	}
+}
+
+func newElector(config *LeaseConfig, api *kubeClient, namespace string) (*elector, error) {
+	c := *config
+	if c.Name == "" {
+		return nil, errors.New("lease: name is required")
+	}
+	if c.Namespace == "" {
+		c.Namespace = namespace
+	}
+	if c.Identity == "" {
+		c.Identity = os.Getenv("POD_NAME")
+	}
+	if c.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("lease: no identity: %w", err)
+		}
+		c.Identity = hostname
+	}
+	if c.Duration <= 0 {
+		c.Duration = DefaultLeaseDuration
+	}
+	if c.RenewInterval <= 0 || c.RenewInterval >= c.Duration {
+		c.RenewInterval = c.Duration / 3
+	}
+
+	return &elector{config: &c, api: api, pod: os.Getenv("POD_NAME")}, nil
+}
+
+func (e *elector) run() {
+	for {
+		if err := e.tryAcquireOrRenew(); err != nil {
+			slog.Error("could not acquire or renew lease", "lease", e.config.Name, "error", err)
+		}
+		e.updateRole()
+		time.Sleep(e.config.RenewInterval)
+	}
+}
+
+func (e *elector) isLeader() bool {
+	renewed := e.renewed.Load()
+	return renewed != 0 && time.Since(time.Unix(0, renewed)) < e.config.Duration
+}
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// kept as is, for the resourceVersion that makes updates conditional
+	Metadata map[string]any `json:"metadata"`
+	Spec     leaseSpec      `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string     `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int        `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *microTime `json:"acquireTime,omitempty"`
+	RenewTime            *microTime `json:"renewTime,omitempty"`
+	LeaseTransitions     int        `json:"leaseTransitions,omitempty"`
+}
+
+type microTime struct {
+	time.Time
+}
+
+func (t microTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(microTimeFormat))
+}
+
+func (t *microTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+	t.Time = parsed
+	return err
+}
+
+func (e *elector) leasesPath() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", url.PathEscape(e.config.Namespace))
+}
+
+// One round of the election: takes the lease if it is free or has expired, renews it if we hold it
+func (e *elector) tryAcquireOrRenew() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if Draining() {
+		return nil
+	}
+
+	var l lease
+	status, err := e.api.do(http.MethodGet, e.leasesPath()+"/"+url.PathEscape(e.config.Name), nil, &l)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	switch status {
+	case http.StatusNotFound:
+		l = lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease", Metadata: map[string]any{"name": e.config.Name}}
+	case http.StatusOK:
+		if holder := l.Spec.HolderIdentity; holder != "" && holder != e.config.Identity && l.Spec.RenewTime != nil &&
+			now.Before(l.Spec.RenewTime.Add(time.Duration(l.Spec.LeaseDurationSeconds)*time.Second)) {
+			e.renewed.Store(0)
+			return nil
+		}
+	default:
+		return fmt.Errorf("unexpected status %d getting lease", status)
+	}
+
+	if l.Spec.HolderIdentity != e.config.Identity {
+		if status == http.StatusOK {
+			l.Spec.LeaseTransitions++
+		}
+		l.Spec.AcquireTime = &microTime{now}
+		slog.Info("acquiring lease", "lease", e.config.Name, "identity", e.config.Identity, "previousHolder", l.Spec.HolderIdentity)
+	}
+	l.Spec.HolderIdentity = e.config.Identity
+	l.Spec.LeaseDurationSeconds = int((e.config.Duration + time.Second - 1) / time.Second)
+	l.Spec.RenewTime = &microTime{now}
+
+	method, path, expected := http.MethodPut, e.leasesPath()+"/"+url.PathEscape(e.config.Name), http.StatusOK
+	if status == http.StatusNotFound {
+		method, path, expected = http.MethodPost, e.leasesPath(), http.StatusCreated
+	}
+	status, err = e.api.do(method, path, &l, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict {
+		// someone else updated the lease since we read it; find out who next round
+		e.renewed.Store(0)
+		return nil
+	}
+	if status != expected {
+		return fmt.Errorf("unexpected status %d writing lease", status)
+	}
+
+	e.renewed.Store(now.UnixNano())
+	return nil
+}
+
+func (e *elector) release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.isLeader() {
+		return
+	}
+	e.renewed.Store(0)
+
+	var l lease
+	path := e.leasesPath() + "/" + url.PathEscape(e.config.Name)
+	status, err := e.api.do(http.MethodGet, path, nil, &l)
+	if err == nil && status == http.StatusOK && l.Spec.HolderIdentity == e.config.Identity {
+		l.Spec.HolderIdentity = ""
+		l.Spec.LeaseDurationSeconds = 1
+		l.Spec.RenewTime = &microTime{time.Now()}
+		status, err = e.api.do(http.MethodPut, path, &l, nil)
+	}
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	if err != nil {
+		slog.Error("could not release lease", "lease", e.config.Name, "error", err)
+		return
+	}
+
+	slog.Info("released lease", "lease", e.config.Name, "identity", e.config.Identity)
+	e.setRole("standby")
+}
+
+// Sets the pod annotation to our current role, if it changed
+func (e *elector) updateRole() {
+	role := "standby"
+	if e.isLeader() {
+		role = "active"
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.setRole(role)
+}
+
+// Called with the elector locked
+func (e *elector) setRole(role string) {
+	if role == e.role {
+		return
+	}
+	if e.config.PodAnnotation == "" || e.pod == "" {
+		e.role = role
+		return
+	}
+
+	patch := map[string]any{"metadata": map[string]any{"annotations": map[string]string{e.config.PodAnnotation: role}}}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(e.config.Namespace), url.PathEscape(e.pod))
+	status, err := e.api.do(http.MethodPatch, path, patch, nil)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	if err != nil {
+		slog.Error("could not annotate pod with its role", "pod", e.pod, "role", role, "error", err)
+		return
+	}
+
+	e.role = role
+}
+
+// A minimal client for the Kubernetes API
+type kubeClient struct {
+	server    string
+	client    *http.Client
+	tokenFile string
+}
+
+// Returns a client authenticated as the pod's service account, and the pod's namespace
+func inClusterClient() (*kubeClient, string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, "", errors.New("lease: not running in Kubernetes (KUBERNETES_SERVICE_HOST is unset)")
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, "", fmt.Errorf("lease: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, "", errors.New("lease: no certificates in the service account's ca.crt")
+	}
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, "", fmt.Errorf("lease: %w", err)
+	}
+
+	return &kubeClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		tokenFile: serviceAccountDir + "/token",
+	}, strings.TrimSpace(string(namespace)), nil
+}
+
+// Sends `body` (if not nil) as JSON and decodes a 2xx response into `out` (if not nil).  Returns
+// the response status, so callers can tell e.g. a missing object or a conflict from other
+// failures.
+func (c *kubeClient) do(method, path string, body, out any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.server+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		contentType := "application/json"
+		if method == http.MethodPatch {
+			contentType = "application/merge-patch+json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.tokenFile != "" {
+		// service account tokens are rotated, so read the current one every time
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode/100 == 2 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("invalid response: %w", err)
+		}
+	}
+
+	return resp.StatusCode, nil
+}
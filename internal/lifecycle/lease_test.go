@@ -0,0 +1,130 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves a single Lease in namespace "ns", rejecting updates based on a stale resourceVersion like
+// the API server does, and records pod annotation patches
+type fakeLeaseAPI struct {
+	mu          sync.Mutex
+	lease       *lease
+	version     int
+	annotations map[string]string
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/ns/pods/") {
+		var patch struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&patch)
+		for key, value := range patch.Metadata.Annotations {
+			f.annotations[strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/ns/pods/")+" "+key] = value
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(f.lease)
+	case http.MethodPost, http.MethodPut:
+		var l lease
+		_ = json.NewDecoder(r.Body).Decode(&l)
+		if r.Method == http.MethodPost && f.lease != nil ||
+			r.Method == http.MethodPut && (f.lease == nil || l.Metadata["resourceVersion"] != strconv.Itoa(f.version)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.version++
+		l.Metadata["resourceVersion"] = strconv.Itoa(f.version)
+		f.lease = &l
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_ = json.NewEncoder(w).Encode(f.lease)
+	}
+}
+
+func TestLeaseElection(t *testing.T) {
+	api := &fakeLeaseAPI{annotations: map[string]string{}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := &kubeClient{server: server.URL, client: server.Client()}
+
+	newTestElector := func(identity string) *elector {
+		e, err := newElector(&LeaseConfig{Name: "pgproxy", Identity: identity, PodAnnotation: "pgproxy.io/role", Duration: time.Minute}, client, "ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.pod = identity
+		return e
+	}
+	active, standby := newTestElector("a"), newTestElector("b")
+
+	for _, e := range []*elector{active, standby, active, standby} {
+		if err := e.tryAcquireOrRenew(); err != nil {
+			t.Fatal(err)
+		}
+		e.updateRole()
+	}
+	if !active.isLeader() || standby.isLeader() {
+		t.Fatalf("expected a to hold the lease, got a=%v b=%v", active.isLeader(), standby.isLeader())
+	}
+	if api.annotations["a pgproxy.io/role"] != "active" || api.annotations["b pgproxy.io/role"] != "standby" {
+		t.Errorf("expected pods to be annotated with their roles, got %v", api.annotations)
+	}
+
+	active.release()
+	if active.isLeader() || api.lease.Spec.HolderIdentity != "" {
+		t.Fatalf("expected the lease to be released, got %+v", api.lease.Spec)
+	}
+
+	if err := standby.tryAcquireOrRenew(); err != nil {
+		t.Fatal(err)
+	}
+	if !standby.isLeader() || api.lease.Spec.HolderIdentity != "b" || api.lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("expected b to take over the lease, got %+v", api.lease.Spec)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	api := &fakeLeaseAPI{annotations: map[string]string{}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := &kubeClient{server: server.URL, client: server.Client()}
+
+	stale := time.Now().Add(-time.Minute)
+	api.lease = &lease{
+		Metadata: map[string]any{"name": "pgproxy", "resourceVersion": "0"},
+		Spec:     leaseSpec{HolderIdentity: "gone", LeaseDurationSeconds: 15, RenewTime: &microTime{stale}},
+	}
+
+	e, err := newElector(&LeaseConfig{Name: "pgproxy", Identity: "b"}, client, "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.tryAcquireOrRenew(); err != nil {
+		t.Fatal(err)
+	}
+	if !e.isLeader() || api.lease.Spec.HolderIdentity != "b" {
+		t.Errorf("expected b to take over the expired lease, got %+v", api.lease.Spec)
+	}
+}
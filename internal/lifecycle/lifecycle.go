@@ -0,0 +1,45 @@
+// Readiness of the proxy as a whole, for orchestrators like Kubernetes: the proxy stops being
+// ready when it starts draining for shutdown, and while it is the standby of an active/standby
+// pair (see StartLease).
+package lifecycle
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How long draining sessions get to finish on shutdown unless configured otherwise, leaving room
+// for the delay within Kubernetes' default 30 second termination grace period
+const DefaultShutdownTimeout = 25 * time.Second
+
+// How the proxy shuts down on SIGTERM
+type ShutdownConfig struct {
+	// how long to keep accepting clients after turning unready, while load balancers (e.g. a
+	// Service's endpoints) catch up
+	Delay time.Duration `json:"-"`
+	// how long sessions may take to finish their transactions once the proxy stops accepting
+	// clients, defaults to DefaultShutdownTimeout.  Sessions still open after that are closed.
+	Timeout time.Duration `json:"-"`
+}
+
+var draining atomic.Bool
+
+// Marks the proxy as draining, which makes it unready for good
+func StartDraining() {
+	draining.Store(true)
+}
+
+func Draining() bool {
+	return draining.Load()
+}
+
+// Whether the proxy should be sent new clients: it isn't draining and, if it is part of an
+// active/standby pair, holds the lease
+func Ready() bool {
+	if draining.Load() {
+		return false
+	}
+
+	e := current.Load()
+	return e == nil || e.isLeader()
+}
@@ -0,0 +1,165 @@
+// A memory budget for the proxy: the bytes of messages relays hold while forwarding them are
+// counted per session and in total, and sessions wait to read their next message while the total
+// is over budget, so that a burst of large messages slows sessions down rather than growing the
+// heap until the process is killed.  New client connections are refused while the proxy is over
+// budget, or while the Go heap is larger than allowed.
+package memory
+
+import (
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pgmetrics "github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// How often the heap size is sampled
+const heapSampleInterval = time.Second
+
+var (
+	waits = pgmetrics.NewCounter(
+		"pgproxy_memory_waits_total", "Times a session waited to read a message because the proxy was over its message_bytes budget.",
+	)
+	refusals = pgmetrics.NewCounterVec(
+		"pgproxy_memory_refused_connections_total", "Client connections refused because the proxy was over its memory budget, by reason (messages or heap).", "reason",
+	)
+)
+
+func init() {
+	budget.released = sync.NewCond(&budget.Mutex)
+
+	pgmetrics.NewGaugeFunc("pgproxy_memory_held_bytes", "Bytes of messages relays hold while forwarding them.", nil, func(emit func([]string, int64)) {
+		emit(nil, budget.held.Load())
+	})
+	pgmetrics.NewGaugeFunc("pgproxy_memory_heap_bytes", "Bytes of heap objects, as last sampled for the heap_bytes limit.", nil, func(emit func([]string, int64)) {
+		emit(nil, heap.Load())
+	})
+}
+
+type Config struct {
+	// bytes of messages the relays may hold at once, unlimited if 0
+	MessageBytes int64 `json:"message_bytes"`
+	// heap size beyond which new client connections are refused, unlimited if 0
+	HeapBytes int64 `json:"heap_bytes"`
+}
+
+// Held bytes are counted without taking the lock, which only orders sessions waiting for bytes to
+// be released against the releases
+var budget struct {
+	sync.Mutex
+	messageBytes, heapBytes atomic.Int64
+	held                    atomic.Int64
+	// sessions waiting for held bytes to be released, and how they are woken
+	waiting  atomic.Int64
+	released *sync.Cond
+}
+
+// the latest heap size sample, 0 until sampling starts
+var heap atomic.Int64
+
+// Starts enforcing a budget.  Held bytes are counted either way.
+func Start(config *Config) {
+	if config == nil {
+		return
+	}
+
+	budget.messageBytes.Store(config.MessageBytes)
+	budget.heapBytes.Store(config.HeapBytes)
+	if config.HeapBytes > 0 {
+		go sampleHeap()
+	}
+}
+
+func sampleHeap() {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	for {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() == metrics.KindUint64 {
+			heap.Store(int64(sample[0].Value.Uint64()))
+		}
+		time.Sleep(heapSampleInterval)
+	}
+}
+
+// The bytes a session holds
+type Account struct {
+	held atomic.Int64
+}
+
+// Reserves `n` bytes for a message about to be read, waiting while that would take the proxy over
+// its message_bytes budget.  A session that already holds bytes (its other direction is forwarding
+// a message) never waits, since what it holds may only be released once this direction makes
+// progress, and neither does a message that arrives while nothing at all is held, however large.
+//
+// A nil Account only counts towards the total.
+func (a *Account) Acquire(n int) {
+	if limit := budget.messageBytes.Load(); limit > 0 && !a.holds() {
+		budget.Lock()
+		// counted before checking, so that a release in between is sure to wake us
+		budget.waiting.Add(1)
+		waited := false
+		for held := budget.held.Load(); held > 0 && held+int64(n) > limit; held = budget.held.Load() {
+			if !waited {
+				waits.Inc()
+				waited = true
+			}
+			budget.released.Wait()
+		}
+		budget.waiting.Add(-1)
+		budget.Unlock()
+	}
+
+	budget.held.Add(int64(n))
+	if a != nil {
+		a.held.Add(int64(n))
+	}
+}
+
+// Gives back bytes taken with Acquire
+func (a *Account) Release(n int) {
+	if n == 0 {
+		return
+	}
+
+	budget.held.Add(-int64(n))
+	if a != nil {
+		a.held.Add(-int64(n))
+	}
+	if budget.waiting.Load() > 0 {
+		budget.Lock()
+		budget.released.Broadcast()
+		budget.Unlock()
+	}
+}
+
+func (a *Account) holds() bool {
+	return a != nil && a.held.Load() > 0
+}
+
+// The bytes a session holds
+func (a *Account) Held() int64 {
+	if a == nil {
+		return 0
+	}
+	return a.held.Load()
+}
+
+// Whether a new client connection must be refused, and why ("messages" or "heap").  Refusals are
+// counted.
+func Refuse() (bool, string) {
+	messageBytes, heapBytes := budget.messageBytes.Load(), budget.heapBytes.Load()
+
+	reason := ""
+	switch {
+	case messageBytes > 0 && budget.held.Load() >= messageBytes:
+		reason = "messages"
+	case heapBytes > 0 && heap.Load() > heapBytes:
+		reason = "heap"
+	default:
+		return false, ""
+	}
+
+	refusals.With(reason).Inc()
+	return true, reason
+}
@@ -0,0 +1,49 @@
+package memory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	Start(&Config{MessageBytes: 100})
+	defer budget.messageBytes.Store(0)
+
+	var first, second Account
+	first.Acquire(80)
+
+	acquired := make(chan struct{})
+	go func() {
+		second.Acquire(50)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected a session to wait while the budget is used up")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a session that already holds bytes goes over the budget rather than wait on itself
+	first.Acquire(50)
+	if refuse, reason := Refuse(); !refuse || reason != "messages" {
+		t.Errorf("expected new connections to be refused over the budget, got %v %q", refuse, reason)
+	}
+
+	first.Release(130)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting session to go ahead once bytes were released")
+	}
+	if second.Held() != 50 || budget.held.Load() != 50 {
+		t.Errorf("unexpected held bytes %d (%d in total)", second.Held(), budget.held.Load())
+	}
+
+	second.Release(50)
+	// nothing else held: a message larger than the whole budget still goes through
+	second.Acquire(500)
+	second.Release(500)
+	if refuse, _ := Refuse(); refuse {
+		t.Error("expected new connections to be let in again")
+	}
+}
@@ -0,0 +1,222 @@
+// A minimal metrics registry, exposed in the Prometheus text format on the admin API's /metrics
+// endpoint, and optionally pushed to a statsd agent.
+//
+// We only need counters and gauges (optionally with labels), so rather than pulling in the full
+// Prometheus client this implements just enough of the exposition format to be scraped.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+// A family of metrics of the same type, distinguished by label values
+type vec[M any] struct {
+	mu     sync.RWMutex
+	labels []string
+	series map[string]*M
+}
+
+func (v *vec[M]) with(values ...string) *M {
+	if len(values) != len(v.labels) {
+		panic(fmt.Errorf("expected %d label values, got %d", len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\x00")
+
+	v.mu.RLock()
+	m := v.series[key]
+	v.mu.RUnlock()
+	if m != nil {
+		return m
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if m = v.series[key]; m == nil {
+		m = new(M)
+		v.series[key] = m
+	}
+
+	return m
+}
+
+// Calls f for every series, sorted by label values for stable output
+func (v *vec[M]) each(f func(values []string, m *M)) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		f(strings.Split(k, "\x00"), v.series[k])
+	}
+}
+
+type CounterVec struct {
+	vec[Counter]
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values...)
+}
+
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values...)
+}
+
+type metric struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	// calls emit with the label values and current value of every series
+	collect func(emit func(values []string, value int64))
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics []metric
+}{}
+
+func register(m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, existing := range registry.metrics {
+		if existing.name == m.name {
+			panic(fmt.Errorf("metric %s registered twice", m.name))
+		}
+	}
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Returns the registered metrics, sorted by name
+func registered() []metric {
+	registry.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	return metrics
+}
+
+func NewCounter(name, help string) *Counter {
+	c := new(Counter)
+	register(metric{name, help, "counter", nil, func(emit func([]string, int64)) {
+		emit(nil, int64(c.Value()))
+	}})
+
+	return c
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := new(Gauge)
+	register(metric{name, help, "gauge", nil, func(emit func([]string, int64)) {
+		emit(nil, g.Value())
+	}})
+
+	return g
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec[Counter]{labels: labels, series: make(map[string]*Counter)}}
+	register(metric{name, help, "counter", labels, func(emit func([]string, int64)) {
+		v.each(func(values []string, c *Counter) { emit(values, int64(c.Value())) })
+	}})
+
+	return v
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{vec[Gauge]{labels: labels, series: make(map[string]*Gauge)}}
+	register(metric{name, help, "gauge", labels, func(emit func([]string, int64)) {
+		v.each(func(values []string, g *Gauge) { emit(values, g.Value()) })
+	}})
+
+	return v
+}
+
+// Registers a gauge whose series are computed when the metrics are read, by calling `collect`,
+// which must call `emit` with the label values and value of each series
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(values []string, value int64))) {
+	register(metric{name, help, "gauge", labels, collect})
+}
+
+// Writes every registered metric in the Prometheus text exposition format
+func Write(w io.Writer) {
+	for _, m := range registered() {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		m.collect(func(values []string, value int64) {
+			if len(values) == 0 {
+				fmt.Fprintf(w, "%s %d\n", m.name, value)
+				return
+			}
+
+			pairs := make([]string, len(values))
+			for i, v := range values {
+				pairs[i] = fmt.Sprintf("%s=%q", m.labels[i], v)
+			}
+			fmt.Fprintf(w, "%s{%s} %d\n", m.name, strings.Join(pairs, ","), value)
+		})
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
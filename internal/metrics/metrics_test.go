@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteExposition(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests handled.")
+	c.Add(3)
+
+	v := NewCounterVec("test_errors_total", "Errors by code.", "code")
+	v.With("53300").Inc()
+	v.With("08006").Inc()
+	v.With("53300").Inc()
+
+	var out strings.Builder
+	Write(&out)
+
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\ntest_requests_total 3\n",
+		"test_errors_total{code=\"08006\"} 1\ntest_errors_total{code=\"53300\"} 2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestStatsdPush(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sessions := NewGaugeVec("test_statsd_sessions", "Sessions.", "entry", "upstream")
+	sessions.With("app", "10.0.0.1").Set(4)
+	queries := NewCounter("test_statsd_queries_total", "Queries.")
+	queries.Add(5)
+
+	read := func(s *statsd) string {
+		if err := s.push(); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, maxStatsdPacket)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	dog, err := newStatsd(&StatsdConfig{Address: conn.LocalAddr().String(), Prefix: "db.", DogStatsD: true, Tags: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := read(dog)
+	for _, want := range []string{
+		"db.test_statsd_sessions:4|g|#env:prod,entry:app,upstream:10.0.0.1",
+		"db.test_statsd_queries_total:5|c|#env:prod",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected push to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	// counters are pushed as the increase since the last push
+	queries.Add(2)
+	if out = read(dog); !strings.Contains(out, "db.test_statsd_queries_total:2|c") {
+		t.Errorf("expected the counter's increase, got:\n%s", out)
+	}
+
+	plain, err := newStatsd(&StatsdConfig{Address: conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out = read(plain); !strings.Contains(out, "test_statsd_sessions.app.10_0_0_1:4|g") {
+		t.Errorf("expected label values in the metric name, got:\n%s", out)
+	}
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DefaultStatsdInterval = 10 * time.Second
+
+// Keeps UDP packets under a typical MTU, so they aren't fragmented
+const maxStatsdPacket = 1432
+
+// Pushes every registered metric to a statsd (or DogStatsD) agent, for monitoring that doesn't
+// scrape Prometheus endpoints
+type StatsdConfig struct {
+	// host:port of the agent, reached over UDP
+	Address string `json:"address"`
+	// prepended to every metric name, e.g. "db."
+	Prefix string `json:"prefix"`
+	// send labels (entry, database, upstream, ...) as DogStatsD tags.  Plain statsd has no tags,
+	// so without this label values are appended to the metric name instead.
+	DogStatsD bool `json:"dogstatsd"`
+	// tags added to every metric, e.g. {"env": "prod"}; DogStatsD only
+	Tags map[string]string `json:"tags"`
+	// how often to push, defaults to DefaultStatsdInterval
+	Interval time.Duration `json:"-"`
+}
+
+type statsd struct {
+	config *StatsdConfig
+	conn   net.Conn
+	// constant tags, formatted
+	tags []string
+	// counters are pushed as the increase since the previous push
+	lastCounts map[string]int64
+}
+
+// Starts pushing metrics to the configured agent in the background
+func StartStatsd(config *StatsdConfig) error {
+	if config == nil {
+		return nil
+	}
+
+	s, err := newStatsd(config)
+	if err != nil {
+		return err
+	}
+
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultStatsdInterval
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.push(); err != nil {
+				slog.Error("could not push metrics to statsd", "address", config.Address, "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func newStatsd(config *StatsdConfig) (*statsd, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsd address: %w", err)
+	}
+
+	var tags []string
+	for key, value := range config.Tags {
+		tags = append(tags, statsdTag(key, value))
+	}
+	sort.Strings(tags)
+
+	return &statsd{config: config, conn: conn, tags: tags, lastCounts: map[string]int64{}}, nil
+}
+
+// Sends the current value of every metric, a packet at a time
+func (s *statsd) push() error {
+	var packet []byte
+	send := func() error {
+		if len(packet) == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(packet)
+		packet = packet[:0]
+		return err
+	}
+
+	for _, m := range registered() {
+		var lines []string
+		m.collect(func(values []string, value int64) {
+			kind := "g"
+			if m.typ == "counter" {
+				key := m.name + "\x00" + strings.Join(values, "\x00")
+				value, s.lastCounts[key] = value-s.lastCounts[key], value
+				if value == 0 {
+					return
+				}
+				kind = "c"
+			}
+			lines = append(lines, s.line(m, values, value, kind))
+		})
+
+		for _, line := range lines {
+			if len(packet) > 0 && len(packet)+1+len(line) > maxStatsdPacket {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+	}
+
+	return send()
+}
+
+func (s *statsd) line(m metric, values []string, value int64, kind string) string {
+	name := s.config.Prefix + m.name
+	if !s.config.DogStatsD {
+		for _, v := range values {
+			name += "." + statsdNameReplacer.Replace(v)
+		}
+		return fmt.Sprintf("%s:%d|%s", name, value, kind)
+	}
+
+	tags := append([]string(nil), s.tags...)
+	for i, v := range values {
+		tags = append(tags, statsdTag(m.labels[i], v))
+	}
+	if len(tags) == 0 {
+		return fmt.Sprintf("%s:%d|%s", name, value, kind)
+	}
+	return fmt.Sprintf("%s:%d|%s|#%s", name, value, kind, strings.Join(tags, ","))
+}
+
+func statsdTag(key, value string) string {
+	return statsdTagReplacer.Replace(key) + ":" + statsdTagReplacer.Replace(value)
+}
+
+// Replaces the characters that delimit values and tags in the statsd line format, plus the dots
+// that separate the segments of a name
+var (
+	statsdTagReplacer  = strings.NewReplacer("|", "_", ",", "_", "#", "_", " ", "_", "\n", "_")
+	statsdNameReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", " ", "_", "\n", "_", ":", "_", "@", "_", ".", "_")
+)
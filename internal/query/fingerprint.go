@@ -0,0 +1,40 @@
+package query
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Returns the shape of a query, with comments and whitespace dropped, keywords lowercased, and
+// literals and parameters replaced by `?`, so that `SELECT * FROM t WHERE id IN (1, 2)` and
+// `select * from t where id in ($1)` both become `select * from t where id in ( ? )`.  Lists of
+// literals collapse into a single `?`.
+func Normalize(sql string) string {
+	var parts []string
+
+	for _, t := range Tokenize(sql) {
+		text := t.Text
+		switch t.Kind {
+		case TokenString, TokenNumber, TokenParam:
+			text = "?"
+		}
+
+		// `?, ?` -> `?`
+		if n := len(parts); text == "?" && n >= 2 && parts[n-1] == "," && parts[n-2] == "?" {
+			parts = parts[:n-1]
+			continue
+		}
+		parts = append(parts, text)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Returns a short identifier for the shape of a query (see Normalize), which queries that only
+// differ in their literals share
+func Fingerprint(sql string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(Normalize(sql)))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,289 @@
+package query
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A condition confining statements to some of the rows of some tables, `column = 'value'`, as for
+// row level tenancy on shared tables
+type Predicate struct {
+	// the tables, by name or schema.name
+	Tables []string
+	Column string
+	Value  string
+}
+
+// Keywords that may follow a table without being its alias
+var notAlias = map[string]bool{
+	"where": true, "group": true, "having": true, "order": true, "limit": true, "offset": true,
+	"on": true, "using": true, "union": true, "except": true, "intersect": true, "returning": true,
+	"set": true, "values": true, "window": true, "for": true, "select": true, "fetch": true,
+	"join": true, "inner": true, "left": true, "right": true, "full": true, "cross": true,
+	"natural": true, "tablesample": true,
+}
+
+// Keywords after which a table is used in ways the predicate can't confine, e.g. TRUNCATE or
+// COPY, or by DDL
+var unconfinedKeywords = map[string]bool{
+	"table": true, "truncate": true, "references": true, "copy": true, "lock": true,
+}
+
+// A replacement of sql[start:end]
+type edit struct {
+	start, end int
+	text       string
+}
+
+// Rewrites the statements of `sql` so that they only see and change the rows of the predicate's
+// tables that match it: the tables read in FROM, JOIN and USING lists are replaced by subqueries
+// of their matching rows, and the predicate is added to the WHERE of UPDATE and DELETE statements
+// (and of ON CONFLICT DO UPDATE) on them.  INSERTs are left alone, and any other use of the tables,
+// e.g. by COPY, TRUNCATE, MERGE or DDL, is an error.  As with Schemas, tables named in string
+// literals or dynamic SQL aren't found, and neither is what an UPDATE sets the column to checked.
+func (p *Predicate) Apply(sql string) (string, error) {
+	tokens := Tokenize(sql)
+
+	var edits []edit
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && !(tokens[i].Kind == TokenPunct && tokens[i].Text == ";") {
+			continue
+		}
+		end := len(sql)
+		if i < len(tokens) {
+			end = tokens[i].Pos
+		}
+		statementEdits, err := p.confine(tokens[start:i], end, end == len(sql))
+		if err != nil {
+			return "", err
+		}
+		edits = append(edits, statementEdits...)
+		start = i + 1
+	}
+
+	// from last to first, so that the positions of the others stay put
+	slices.SortStableFunc(edits, func(a, b edit) int { return b.start - a.start })
+	for _, e := range edits {
+		sql = sql[:e.start] + e.text + sql[e.end:]
+	}
+	return sql, nil
+}
+
+// The edits confining one statement, which ends at `end`, the end of the text if `last`
+func (p *Predicate) confine(statement []Token, end int, last bool) ([]edit, error) {
+	var edits []edit
+	fromList := false
+	// for each open parenthesis, the word before it, whether it is in a FROM list, and whether it
+	// opens a FROM item, e.g. a parenthesized join, whose tables are confined like the list's
+	type paren struct {
+		word     string
+		fromList bool
+		item     bool
+	}
+	var parens []paren
+	// how to qualify the column for ON CONFLICT DO UPDATE, once an INSERT into a table was seen
+	inserted := ""
+
+	for i := 0; i < len(statement); i++ {
+		t := statement[i]
+		switch {
+		case t.Kind == TokenPunct && t.Text == "(":
+			before := word(statement, i-1)
+			item := fromList && (before == "from" || before == "join" ||
+				i > 0 && statement[i-1].Kind == TokenPunct && (statement[i-1].Text == "," ||
+					statement[i-1].Text == "(" && len(parens) > 0 && parens[len(parens)-1].item))
+			parens = append(parens, paren{before, fromList, item})
+		case t.Kind == TokenPunct && t.Text == ")" && len(parens) > 0:
+			fromList = parens[len(parens)-1].fromList
+			parens = parens[:len(parens)-1]
+		case t.Kind == TokenWord && t.Text == "using":
+			// DELETE ... USING and MERGE ... USING list tables, JOIN ... USING columns, after which
+			// the list goes on
+			if !(i+1 < len(statement) && statement[i+1].Text == "(") {
+				fromList = true
+			}
+		case t.Kind == TokenWord && t.Text == "on" && fromList:
+			// a join condition, after which the list may go on
+		case t.Kind == TokenWord && fromListEnd[t.Text]:
+			fromList = false
+		case t.Kind == TokenWord && t.Text == "from":
+			fromList = len(parens) == 0 || !fromFunctions[parens[len(parens)-1].word]
+		case t.Kind == TokenWord && t.Text == "update" && word(statement, i-1) == "do" && inserted != "":
+			whereEdits, err := p.where(statement, i+1, end, last, inserted)
+			if err != nil {
+				return nil, err
+			}
+			edits = append(edits, whereEdits...)
+		}
+		if t.Kind != TokenWord && t.Kind != TokenQuotedIdent {
+			continue
+		}
+
+		// the whole dotted name
+		parts := []string{identifier(t)}
+		j := i + 1
+		for j+1 < len(statement) && statement[j].Kind == TokenPunct && statement[j].Text == "." &&
+			(statement[j+1].Kind == TokenWord || statement[j+1].Kind == TokenQuotedIdent) {
+			parts = append(parts, identifier(statement[j+1]))
+			j += 2
+		}
+		name, first := i, i
+		i = j - 1
+		if !p.confines(parts) {
+			continue
+		}
+		call := j < len(statement) && statement[j].Text == "("
+
+		k := name - 1
+		if word(statement, k) == "only" {
+			first, k = k, k-1
+		}
+		keyword := word(statement, k)
+		alias := ""
+		if word(statement, j) == "as" && j+1 < len(statement) {
+			alias = identifier(statement[j+1])
+		} else if j < len(statement) && (statement[j].Kind == TokenQuotedIdent || statement[j].Kind == TokenWord && !notAlias[statement[j].Text]) {
+			alias = identifier(statement[j])
+		}
+		qualifier := quoteIdent(parts[len(parts)-1])
+		if alias != "" {
+			qualifier = quoteIdent(alias)
+		}
+
+		switch {
+		case keyword == "from" && word(statement, k-1) == "delete",
+			keyword == "update" && !slices.Contains([]string{"for", "key", "do", "on"}, word(statement, k-1)):
+			whereEdits, err := p.where(statement, j, end, last, qualifier)
+			if err != nil {
+				return nil, err
+			}
+			edits = append(edits, whereEdits...)
+
+		case keyword == "into" && word(statement, k-1) == "insert":
+			// an alias needs AS here, e.g. INSERT INTO t AS x
+			inserted = quoteIdent(parts[len(parts)-1])
+			if word(statement, j) == "as" {
+				inserted = qualifier
+			}
+
+		case keyword == "into" && word(statement, k-1) == "merge", unconfinedKeywords[keyword]:
+			return nil, fmt.Errorf("table %s can only be used in SELECT, INSERT, UPDATE and DELETE statements", quoteName(parts))
+
+		case call:
+			// a function of the same name
+
+		case (keyword == "from" || keyword == "using") && fromList, keyword == "join",
+			k >= 0 && statement[k].Kind == TokenPunct && statement[k].Text == "," && fromList,
+			k >= 0 && statement[k].Kind == TokenPunct && statement[k].Text == "(" && len(parens) > 0 && parens[len(parens)-1].item:
+			next := end
+			if j < len(statement) {
+				next = statement[j].Pos
+			}
+			only := ""
+			if first != name {
+				only = "ONLY "
+			}
+			text := fmt.Sprintf("(SELECT * FROM %s%s WHERE %s) ", only, quoteName(parts), p.condition(""))
+			if alias == "" {
+				text += qualifier + " "
+			}
+			edits = append(edits, edit{statement[first].Pos, next, text})
+		}
+	}
+
+	return edits, nil
+}
+
+// The edits adding the predicate to the WHERE of an UPDATE or DELETE, which is looked for from
+// `from` on, up to its RETURNING or the end of the statement (or of the parentheses it is in)
+func (p *Predicate) where(statement []Token, from, end int, last bool, qualifier string) ([]edit, error) {
+	where, stop := -1, end
+	depth := 0
+	for i := from; i < len(statement); i++ {
+		t := statement[i]
+		if t.Kind == TokenPunct && t.Text == "(" {
+			depth++
+		} else if t.Kind == TokenPunct && t.Text == ")" {
+			if depth--; depth < 0 {
+				stop, last = t.Pos, false
+				break
+			}
+		} else if depth == 0 && t.Kind == TokenWord && t.Text == "where" {
+			if word(statement, i+1) == "current" && word(statement, i+2) == "of" {
+				return nil, fmt.Errorf("WHERE CURRENT OF can't be confined to %s", p.condition(qualifier))
+			}
+			where = i
+		} else if depth == 0 && t.Kind == TokenWord && t.Text == "returning" {
+			stop, last = t.Pos, false
+			break
+		}
+	}
+
+	// a comment at the very end would swallow what comes after it on its line
+	newline := ""
+	if last {
+		newline = "\n"
+	}
+	if where < 0 {
+		return []edit{{stop, stop, fmt.Sprintf("%s WHERE %s ", newline, p.condition(qualifier))}}, nil
+	}
+	// the condition starts with the token after WHERE
+	open := stop
+	if where+1 < len(statement) {
+		open = statement[where+1].Pos
+	}
+	return []edit{
+		{open, open, "("},
+		{stop, stop, fmt.Sprintf("%s) AND %s ", newline, p.condition(qualifier))},
+	}, nil
+}
+
+// Whether a (dotted) table name is one of the predicate's tables.  Unqualified names match
+// whatever the schema, since the search_path isn't known.
+func (p *Predicate) confines(parts []string) bool {
+	name, schema := parts[len(parts)-1], ""
+	if len(parts) > 1 {
+		schema = parts[len(parts)-2]
+	}
+	for _, table := range p.Tables {
+		tableSchema, tableName, qualified := strings.Cut(table, ".")
+		if !qualified {
+			tableSchema, tableName = "", table
+		}
+		if tableName == name && (tableSchema == "" || schema == "" || tableSchema == schema) {
+			return true
+		}
+	}
+	return false
+}
+
+// `column = 'value'`, the column qualified if `qualifier` isn't empty
+func (p *Predicate) condition(qualifier string) string {
+	column := quoteIdent(p.Column)
+	if qualifier != "" {
+		column = qualifier + "." + column
+	}
+	return column + " = " + quoteLiteral(p.Value)
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteName(parts []string) string {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = quoteIdent(part)
+	}
+	return strings.Join(quoted, ".")
+}
+
+// Quotes a string literal the same whether or not standard_conforming_strings is on
+func quoteLiteral(s string) string {
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `'`, `''`) + `'`
+	}
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
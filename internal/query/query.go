@@ -0,0 +1,516 @@
+// Lightweight analysis of SQL text flowing through the proxy.
+//
+// This is deliberately not a SQL parser: it tokenizes just well enough to skip over comments,
+// string literals and quoted identifiers, so that keyword checks don't get fooled by something
+// like `SELECT 'SET x = 1'`.
+package query
+
+import (
+	"slices"
+	"strings"
+)
+
+type TokenKind uint8
+
+const (
+	// keyword or unquoted identifier, lowercased
+	TokenWord TokenKind = iota
+	// "quoted identifier", including the quotes
+	TokenQuotedIdent
+	// string literal, including quotes/dollar tags
+	TokenString
+	// numeric literal
+	TokenNumber
+	// $1 style parameter placeholder
+	TokenParam
+	// any other single character, e.g. `(`, `;` or `=`
+	TokenPunct
+)
+
+type Token struct {
+	Kind TokenKind
+	Text string
+	// byte offset of the token in the SQL text
+	Pos int
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '$'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Splits SQL text into tokens, dropping whitespace and comments.  Unterminated literals or comments
+// simply run to the end of the input.
+func Tokenize(sql string) []Token {
+	var tokens []Token
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			// block comments nest in postgres
+			depth := 0
+			for i < len(sql) {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+
+		case (c == 'u' || c == 'U') && i+2 < len(sql) && sql[i+1] == '&' && (sql[i+2] == '"' || sql[i+2] == '\''):
+			// U&"..." identifiers and U&'...' strings with unicode escapes, which identifier decodes
+			start := i
+			quote := sql[i+2]
+			i += 3
+			for i < len(sql) {
+				if sql[i] == quote {
+					if i+1 < len(sql) && sql[i+1] == quote {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			kind := TokenQuotedIdent
+			if quote == '\'' {
+				kind = TokenString
+			}
+			tokens = append(tokens, Token{kind, sql[start:min(i, len(sql))], start})
+
+		case c == '\'' || ((c == 'e' || c == 'E') && i+1 < len(sql) && sql[i+1] == '\''):
+			start := i
+			escapes := c != '\''
+			if escapes {
+				i++
+			}
+			i++
+			for i < len(sql) {
+				if escapes && sql[i] == '\\' {
+					i += 2
+					continue
+				}
+				if sql[i] == '\'' {
+					// '' is an escaped quote
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, Token{TokenString, sql[start:min(i, len(sql))], start})
+
+		case c == '"':
+			start := i
+			i++
+			for i < len(sql) {
+				if sql[i] == '"' {
+					if i+1 < len(sql) && sql[i+1] == '"' {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, Token{TokenQuotedIdent, sql[start:min(i, len(sql))], start})
+
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			start := i
+			i++
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, Token{TokenParam, sql[start:i], start})
+
+		case c == '$':
+			// dollar quoted string: $tag$ ... $tag$
+			end := strings.IndexByte(sql[i+1:], '$')
+			tag := ""
+			if end >= 0 {
+				tag = sql[i : i+end+2]
+			}
+			if tag == "" || strings.IndexFunc(tag[1:len(tag)-1], func(r rune) bool { return r < 0x80 && !isIdentChar(byte(r)) }) >= 0 {
+				tokens = append(tokens, Token{TokenPunct, "$", i})
+				i++
+				break
+			}
+
+			start := i
+			closing := strings.Index(sql[i+len(tag):], tag)
+			if closing < 0 {
+				i = len(sql)
+			} else {
+				i += len(tag) + closing + len(tag)
+			}
+			tokens = append(tokens, Token{TokenString, sql[start:i], start})
+
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			start := i
+			for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.' || sql[i] == 'e' || sql[i] == 'E') {
+				i++
+			}
+			tokens = append(tokens, Token{TokenNumber, sql[start:i], start})
+
+		case isIdentStart(c):
+			start := i
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, Token{TokenWord, strings.ToLower(sql[start:i]), start})
+
+		default:
+			tokens = append(tokens, Token{TokenPunct, string(c), i})
+			i++
+		}
+	}
+
+	// a UESCAPE 'c' clause belongs to the U& token before it, whose escape character it sets
+	for i := 0; i+2 < len(tokens); i++ {
+		if len(tokens[i].Text) > 2 && tokens[i].Text[1] == '&' && tokens[i+1].Kind == TokenWord && tokens[i+1].Text == "uescape" && tokens[i+2].Kind == TokenString {
+			tokens[i].Text += " UESCAPE " + tokens[i+2].Text
+			tokens = slices.Delete(tokens, i+1, i+3)
+		}
+	}
+
+	return tokens
+}
+
+// Splits tokens into statements on top level semicolons, dropping empty statements
+func Statements(tokens []Token) [][]Token {
+	var statements [][]Token
+
+	start := 0
+	for i, t := range tokens {
+		if t.Kind == TokenPunct && t.Text == ";" {
+			if i > start {
+				statements = append(statements, tokens[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(tokens) {
+		statements = append(statements, tokens[start:])
+	}
+
+	return statements
+}
+
+func word(tokens []Token, i int) string {
+	if i >= 0 && i < len(tokens) && tokens[i].Kind == TokenWord {
+		return tokens[i].Text
+	}
+
+	return ""
+}
+
+// Parses `SET [SESSION | LOCAL] name { TO | = } value`, returning the parameter's name and its value
+// (unquoted and lowercased, "default" for DEFAULT).  Values of several tokens, like lists, are
+// joined with spaces.
+func SetParameter(statement []Token) (name, value string, ok bool) {
+	if word(statement, 0) != "set" {
+		return "", "", false
+	}
+
+	i := 1
+	if w := word(statement, i); w == "session" || w == "local" {
+		i++
+	}
+	if i+2 > len(statement) || statement[i].Kind != TokenWord {
+		return "", "", false
+	}
+	name = statement[i].Text
+	if to := statement[i+1]; !(to.Kind == TokenWord && to.Text == "to") && !(to.Kind == TokenPunct && to.Text == "=") {
+		return "", "", false
+	}
+
+	var values []string
+	for _, t := range statement[i+2:] {
+		text := t.Text
+		if t.Kind == TokenString && strings.HasPrefix(text, "'") {
+			text = strings.ReplaceAll(strings.Trim(text, "'"), "''", "'")
+		}
+		values = append(values, strings.ToLower(text))
+	}
+	if len(values) == 0 {
+		return "", "", false
+	}
+
+	return name, strings.Join(values, " "), true
+}
+
+// Session level advisory lock functions.  The pg_advisory_xact_* variants are released at the end
+// of the transaction, so they're fine.
+var sessionAdvisoryLocks = map[string]bool{
+	"pg_advisory_lock":            true,
+	"pg_advisory_lock_shared":     true,
+	"pg_try_advisory_lock":        true,
+	"pg_try_advisory_lock_shared": true,
+}
+
+// Reports whether a statement changes state that outlives the current transaction (and so ties the
+// client to its backend), along with a short reason like "SET" or "LISTEN".
+func MutatesSessionState(statement []Token) (bool, string) {
+	for i, t := range statement {
+		if t.Kind == TokenWord && sessionAdvisoryLocks[t.Text] && i+1 < len(statement) && statement[i+1].Text == "(" {
+			return true, "advisory lock"
+		}
+	}
+
+	switch word(statement, 0) {
+	case "set":
+		// SET LOCAL, SET TRANSACTION and SET CONSTRAINTS only last until the end of the transaction
+		switch word(statement, 1) {
+		case "local", "transaction", "constraints":
+			return false, ""
+		}
+		return true, "SET"
+
+	case "prepare":
+		// PREPARE TRANSACTION is two phase commit, not a prepared statement
+		if word(statement, 1) == "transaction" {
+			return false, ""
+		}
+		return true, "PREPARE"
+
+	case "listen":
+		return true, "LISTEN"
+
+	case "load":
+		return true, "LOAD"
+
+	case "create":
+		// CREATE [GLOBAL | LOCAL] { TEMP | TEMPORARY } { TABLE | SEQUENCE | VIEW } ...
+		for i := 1; i <= 2; i++ {
+			if w := word(statement, i); w == "temp" || w == "temporary" {
+				return true, "temporary object"
+			}
+		}
+
+	case "declare":
+		// cursors declared WITH HOLD outlive their transaction
+		for i := 1; i+1 < len(statement); i++ {
+			if word(statement, i) == "with" && word(statement, i+1) == "hold" {
+				return true, "cursor WITH HOLD"
+			}
+		}
+	}
+
+	return false, ""
+}
+
+// Reports whether a batch of statements, e.g. from a simple Query message, changes state that
+// outlives it.  Changes made inside a transaction block that the batch itself rolls back (e.g.
+// `BEGIN; SET x = 1; ROLLBACK`) are undone with it and don't count.
+func BatchMutatesSessionState(statements [][]Token) (bool, string) {
+	// the first change made inside the current transaction block, if any
+	inBlock, pending := false, ""
+
+	for _, statement := range statements {
+		switch TransactionBoundary(statement) {
+		case BoundaryBegin:
+			inBlock = true
+			continue
+		case BoundaryCommit:
+			if pending != "" {
+				return true, pending
+			}
+			inBlock = false
+			continue
+		case BoundaryRollback:
+			inBlock, pending = false, ""
+			continue
+		}
+
+		mutates, reason := MutatesSessionState(statement)
+		if !mutates {
+			continue
+		}
+		if !inBlock {
+			return true, reason
+		}
+		if pending == "" {
+			pending = reason
+		}
+	}
+
+	// a block left open may still be committed by a later request
+	if pending != "" {
+		return true, pending
+	}
+	return false, ""
+}
+
+// Whether a batch of statements leaves a transaction block open, e.g. `BEGIN; UPDATE ...` but not
+// `BEGIN; UPDATE ...; COMMIT`
+func OpensTransaction(statements [][]Token) bool {
+	open := false
+	for _, statement := range statements {
+		switch TransactionBoundary(statement) {
+		case BoundaryBegin:
+			open = true
+		case BoundaryCommit, BoundaryRollback:
+			open = false
+		}
+	}
+	return open
+}
+
+// How a statement delimits transaction blocks
+type Boundary uint8
+
+const (
+	BoundaryNone Boundary = iota
+	// BEGIN or START TRANSACTION
+	BoundaryBegin
+	// COMMIT or END
+	BoundaryCommit
+	// ROLLBACK or ABORT, but not ROLLBACK TO SAVEPOINT, which stays in the block
+	BoundaryRollback
+)
+
+func TransactionBoundary(statement []Token) Boundary {
+	switch word(statement, 0) {
+	case "begin":
+		return BoundaryBegin
+	case "start":
+		if word(statement, 1) == "transaction" {
+			return BoundaryBegin
+		}
+	case "commit", "end":
+		// COMMIT PREPARED finishes a two phase transaction, not the current block
+		if word(statement, 1) != "prepared" {
+			return BoundaryCommit
+		}
+	case "rollback", "abort":
+		for i := 1; i < len(statement); i++ {
+			if w := word(statement, i); w == "to" || w == "prepared" {
+				return BoundaryNone
+			}
+		}
+		return BoundaryRollback
+	}
+
+	return BoundaryNone
+}
+
+// What a statement does, for statistics and for telling reads from writes
+type Kind string
+
+const (
+	// SELECT, SHOW, EXPLAIN and the like, which could run on a read-only replica
+	KindRead Kind = "read"
+	// DML, DDL and anything else that needs the primary
+	KindWrite Kind = "write"
+	// transaction control: BEGIN, COMMIT, ROLLBACK, SAVEPOINT...
+	KindTransaction Kind = "transaction"
+	// session and utility statements: SET, PREPARE, LISTEN, DISCARD...
+	KindOther Kind = "other"
+)
+
+// Classifies a statement.  Statements we don't recognize count as writes, so that anything
+// routing on the result errs on the side of the primary.
+func Classify(statement []Token) Kind {
+	switch word(statement, 0) {
+	case "select", "values", "table":
+		if selectWrites(statement) {
+			return KindWrite
+		}
+		return KindRead
+	case "with":
+		// data modifying CTEs, e.g. WITH moved AS (DELETE FROM ... RETURNING *) ...
+		for i := range statement {
+			switch word(statement, i) {
+			case "insert", "update", "delete", "merge":
+				return KindWrite
+			}
+		}
+		if selectWrites(statement) {
+			return KindWrite
+		}
+		return KindRead
+	case "show", "fetch", "move", "close":
+		return KindRead
+	case "explain":
+		// EXPLAIN ANALYZE runs the statement, which may write.  Its options come before the
+		// statement, either bare or in parentheses.
+		for i := 1; i < len(statement); i++ {
+			switch word(statement, i) {
+			case "analyze", "analyse":
+				return KindWrite
+			case "select", "insert", "update", "delete", "merge", "with", "values", "table", "execute",
+				"create", "declare":
+				return KindRead
+			}
+		}
+		return KindRead
+	case "copy":
+		for i := range statement {
+			switch word(statement, i) {
+			case "from":
+				return KindWrite
+			case "to":
+				return KindRead
+			}
+		}
+		return KindWrite
+	case "begin", "start", "commit", "end", "rollback", "abort", "savepoint", "release":
+		return KindTransaction
+	case "prepare":
+		if word(statement, 1) == "transaction" {
+			return KindTransaction
+		}
+		return KindOther
+	case "set", "reset", "discard", "listen", "unlisten", "notify", "execute", "deallocate",
+		"declare", "load":
+		return KindOther
+	}
+
+	return KindWrite
+}
+
+// Whether a SELECT writes (SELECT INTO creates a table) or takes row locks (FOR UPDATE/SHARE), so
+// that it must run on the primary
+func selectWrites(statement []Token) bool {
+	for i := range statement {
+		switch word(statement, i) {
+		case "into":
+			return true
+		case "for":
+			switch word(statement, i+1) {
+			case "update", "share", "no", "key":
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package query
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTokenizeSkipsCommentsAndLiterals(t *testing.T) {
+	tokens := Tokenize(`SELECT 'it''s; -- not a comment', $tag$ ; $tag$ /* a /* nested */ comment */ FROM "My;Table" -- trailing`)
+
+	var texts []string
+	for _, tok := range tokens {
+		texts = append(texts, tok.Text)
+	}
+
+	expected := []string{"select", `'it''s; -- not a comment'`, ",", "$tag$ ; $tag$", "from", `"My;Table"`}
+	if len(texts) != len(expected) {
+		t.Fatalf("expected tokens %q, got %q", expected, texts)
+	}
+	for i := range expected {
+		if texts[i] != expected[i] {
+			t.Errorf("token %d: expected %q, got %q", i, expected[i], texts[i])
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	statements := Statements(Tokenize("BEGIN; SELECT ';'; ; COMMIT"))
+	if len(statements) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(statements))
+	}
+	if statements[2][0].Text != "commit" {
+		t.Errorf("expected last statement to be COMMIT, got %q", statements[2][0].Text)
+	}
+}
+
+func TestMutatesSessionState(t *testing.T) {
+	cases := []struct {
+		sql      string
+		mutates  bool
+		describe string
+	}{
+		{"SET search_path = app", true, "SET"},
+		{"set session statement_timeout = 0", true, "SET"},
+		{"SET LOCAL statement_timeout = 0", false, ""},
+		{"SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", false, ""},
+		{"PREPARE q AS SELECT 1", true, "PREPARE"},
+		{"PREPARE TRANSACTION 'foo'", false, ""},
+		{"LISTEN jobs", true, "LISTEN"},
+		{"CREATE TEMP TABLE t (id int)", true, "temporary object"},
+		{"CREATE GLOBAL TEMPORARY TABLE t (id int)", true, "temporary object"},
+		{"CREATE TABLE t (id int)", false, ""},
+		{"DECLARE c CURSOR WITH HOLD FOR SELECT 1", true, "cursor WITH HOLD"},
+		{"SELECT pg_advisory_lock(42)", true, "advisory lock"},
+		{"SELECT pg_advisory_xact_lock(42)", false, ""},
+		{"SELECT 'SET x = 1'", false, ""},
+		{"/* SET */ SELECT 1", false, ""},
+	}
+
+	for _, c := range cases {
+		mutates, reason := MutatesSessionState(Tokenize(c.sql))
+		if mutates != c.mutates || reason != c.describe {
+			t.Errorf("%q: expected (%v, %q), got (%v, %q)", c.sql, c.mutates, c.describe, mutates, reason)
+		}
+	}
+}
+
+func TestBatchMutatesSessionState(t *testing.T) {
+	cases := []struct {
+		sql     string
+		mutates bool
+	}{
+		{"SELECT 1; SELECT 2", false},
+		{"SELECT 1; SET search_path = app", true},
+		{"BEGIN; SET search_path = app; COMMIT", true},
+		{"BEGIN; SET search_path = app; ROLLBACK", false},
+		{"START TRANSACTION; LISTEN jobs; ABORT; SELECT 1", false},
+		{"BEGIN; SAVEPOINT s; SET x = 1; ROLLBACK TO SAVEPOINT s; COMMIT", true},
+		{"BEGIN; SET search_path = app", true},
+		{"BEGIN; SET LOCAL statement_timeout = 0; COMMIT", false},
+	}
+
+	for _, c := range cases {
+		if mutates, _ := BatchMutatesSessionState(Statements(Tokenize(c.sql))); mutates != c.mutates {
+			t.Errorf("%q: expected mutates=%v, got %v", c.sql, c.mutates, mutates)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		sql  string
+		kind Kind
+	}{
+		{"SELECT * FROM users", KindRead},
+		{"SELECT * FROM users FOR UPDATE", KindWrite},
+		{"SELECT * INTO archive FROM users", KindWrite},
+		{"WITH recent AS (SELECT 1) SELECT * FROM recent", KindRead},
+		{"WITH moved AS (DELETE FROM jobs RETURNING *) INSERT INTO done SELECT * FROM moved", KindWrite},
+		{"SHOW search_path", KindRead},
+		{"EXPLAIN SELECT 1", KindRead},
+		{"EXPLAIN (ANALYZE, BUFFERS) DELETE FROM jobs", KindWrite},
+		{"COPY users TO STDOUT", KindRead},
+		{"COPY users FROM STDIN", KindWrite},
+		{"INSERT INTO users VALUES (1)", KindWrite},
+		{"CREATE TABLE t (id int)", KindWrite},
+		{"BEGIN", KindTransaction},
+		{"PREPARE TRANSACTION 'foo'", KindTransaction},
+		{"SET search_path = app", KindOther},
+		{"VACUUM users", KindWrite},
+	}
+
+	for _, c := range cases {
+		statements := Statements(Tokenize(c.sql))
+		if kind := Classify(statements[0]); kind != c.kind {
+			t.Errorf("%q: expected %s, got %s", c.sql, c.kind, kind)
+		}
+	}
+}
+
+func TestSetParameter(t *testing.T) {
+	cases := []struct {
+		sql, name, value string
+		ok               bool
+	}{
+		{"SET statement_timeout = 0", "statement_timeout", "0", true},
+		{"set local lock_timeout to '5s'", "lock_timeout", "5s", true},
+		{"SET SESSION statement_timeout TO DEFAULT", "statement_timeout", "default", true},
+		{"SET search_path = app, public", "search_path", "app , public", true},
+		{"SET TIME ZONE 'UTC'", "", "", false},
+		{"SELECT set_config('statement_timeout', '0', false)", "", "", false},
+	}
+
+	for _, c := range cases {
+		name, value, ok := SetParameter(Tokenize(c.sql))
+		if name != c.name || value != c.value || ok != c.ok {
+			t.Errorf("%q: expected (%q, %q, %v), got (%q, %q, %v)", c.sql, c.name, c.value, c.ok, name, value, ok)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	same := []string{
+		"SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'x'",
+		"select *\n  from t -- by id\n where id in ($1) and name = $2",
+		"SELECT * FROM t WHERE id IN (4) AND name = $$y$$",
+	}
+	for _, sql := range same {
+		if got := Normalize(sql); got != "select * from t where id in ( ? ) and name = ?" {
+			t.Errorf("unexpected normalization of %q: %q", sql, got)
+		}
+		if Fingerprint(sql) != Fingerprint(same[0]) {
+			t.Errorf("expected %q to share a fingerprint with %q", sql, same[0])
+		}
+	}
+	if Fingerprint("SELECT * FROM u WHERE id = 1") == Fingerprint(same[0]) {
+		t.Error("expected different queries to have different fingerprints")
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	cases := map[string][]string{
+		"SELECT o.id, o.total FROM orders o":                                   nil,
+		"SELECT * FROM acme.orders o JOIN globex.customers c ON o.c = c.id":    {"acme", "globex"},
+		"SELECT * FROM orders, globex.customers":                               {"globex"},
+		`INSERT INTO "Globex".orders (id) VALUES (1)`:                          {"Globex"},
+		"UPDATE globex.orders SET paid = true":                                 {"globex"},
+		"SELECT globex.orders.id FROM orders":                                  {"globex"},
+		"SELECT globex.secret(1)":                                              {"globex"},
+		"SELECT extract(year FROM o.created_at), o.id FROM orders o":           nil,
+		"SELECT 'globex.orders'::regclass":                                     nil,
+		"SELECT * FROM db.globex.orders WHERE orders.id IN (SELECT 1)":         {"globex"},
+		`SELECT * FROM U&"gl\006Fbex".orders`:                                  {"globex"},
+		"SELECT * FROM orders WHERE id IN (SELECT id FROM globex.orders), x.y": {"globex"},
+	}
+	for sql, want := range cases {
+		if got := Schemas(Tokenize(sql)); !slices.Equal(got, want) {
+			t.Errorf("Schemas(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
+
+func TestPredicateApply(t *testing.T) {
+	p := &Predicate{Tables: []string{"orders", "public.items"}, Column: "tenant_id", Value: "o'brien"}
+	cases := map[string]string{
+		"SELECT 1":                              "SELECT 1",
+		"SELECT * FROM orders o WHERE o.id = 1": `SELECT * FROM (SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') o WHERE o.id = 1`,
+		"SELECT * FROM customers c JOIN public.orders ON orders.c = c.id, items":
+		/**/ `SELECT * FROM customers c JOIN (SELECT * FROM "public"."orders" WHERE "tenant_id" = 'o''brien') "orders" ON orders.c = c.id, (SELECT * FROM "items" WHERE "tenant_id" = 'o''brien') "items" `,
+		"SELECT * FROM other.items, ONLY orders AS x":
+		/**/ `SELECT * FROM other.items, (SELECT * FROM ONLY "orders" WHERE "tenant_id" = 'o''brien') AS x`,
+		"UPDATE orders SET paid = true WHERE id = 1 OR id = 2 RETURNING id":
+		/**/ `UPDATE orders SET paid = true WHERE (id = 1 OR id = 2 ) AND "orders"."tenant_id" = 'o''brien' RETURNING id`,
+		"DELETE FROM orders o USING orders p WHERE o.id = p.id; SELECT 1":
+		/**/ `DELETE FROM orders o USING (SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') p WHERE (o.id = p.id) AND "o"."tenant_id" = 'o''brien' ; SELECT 1`,
+		"WITH d AS (DELETE FROM orders RETURNING *) SELECT count(*) FROM d":
+		/**/ `WITH d AS (DELETE FROM orders  WHERE "orders"."tenant_id" = 'o''brien' RETURNING *) SELECT count(*) FROM d`,
+		"DELETE FROM orders -- everything":
+		/**/ "DELETE FROM orders -- everything\n WHERE \"orders\".\"tenant_id\" = 'o''brien' ",
+		"INSERT INTO orders (id) VALUES (1) ON CONFLICT (id) DO UPDATE SET paid = true":
+		/**/ `INSERT INTO orders (id) VALUES (1) ON CONFLICT (id) DO UPDATE SET paid = true` + "\n" + ` WHERE "orders"."tenant_id" = 'o''brien' `,
+		"SELECT extract(year FROM orders.created_at) FROM invoices": "SELECT extract(year FROM orders.created_at) FROM invoices",
+		"SELECT * FROM (orders CROSS JOIN customers)":
+		/**/ `SELECT * FROM ((SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') "orders" CROSS JOIN customers)`,
+		"SELECT * FROM (orders o JOIN customers c ON true)":
+		/**/ `SELECT * FROM ((SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') o JOIN customers c ON true)`,
+		"SELECT * FROM invoices, ((customers c JOIN orders ON true))":
+		/**/ `SELECT * FROM invoices, ((customers c JOIN (SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') "orders" ON true))`,
+		"SELECT * FROM a JOIN b USING (orders)": "SELECT * FROM a JOIN b USING (orders)",
+		"SELECT * FROM invoices, ((orders) CROSS JOIN x)":
+		/**/ `SELECT * FROM invoices, (((SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') "orders" ) CROSS JOIN x)`,
+		`SELECT * FROM U&"orders"`:
+		/**/ `SELECT * FROM (SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') "orders" `,
+		`SELECT * FROM u&"\006Frders" o`:
+		/**/ `SELECT * FROM (SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') o`,
+		`SELECT * FROM U&"!006Frders" /* escape */ UESCAPE '!', public.U&"\+000069tems"`:
+		/**/ `SELECT * FROM (SELECT * FROM "orders" WHERE "tenant_id" = 'o''brien') "orders" , (SELECT * FROM "public"."items" WHERE "tenant_id" = 'o''brien') "items" `,
+		`SELECT * FROM U&"\006Frders\\"`: `SELECT * FROM U&"\006Frders\\"`,
+	}
+	for sql, want := range cases {
+		if got, err := p.Apply(sql); err != nil || got != want {
+			t.Errorf("Apply(%q) = %q (%v), want %q", sql, got, err, want)
+		}
+	}
+
+	for _, sql := range []string{"TRUNCATE orders", "COPY orders TO STDOUT", "COPY orders (id) TO STDOUT", "MERGE INTO orders USING x ON true DO NOTHING", "DELETE FROM orders WHERE CURRENT OF c"} {
+		if _, err := p.Apply(sql); err == nil {
+			t.Errorf("expected %q to be refused", sql)
+		}
+	}
+
+	p.Value = `a\b`
+	if got, _ := p.Apply("SELECT * FROM orders"); got != `SELECT * FROM (SELECT * FROM "orders" WHERE "tenant_id" = E'a\\b') "orders" ` {
+		t.Errorf("unexpected quoting of a backslash: %s", got)
+	}
+}
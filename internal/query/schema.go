@@ -0,0 +1,175 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Keywords after which a name is a relation
+var relationKeywords = map[string]bool{
+	"from": true, "join": true, "into": true, "update": true, "table": true, "truncate": true,
+	"only": true, "references": true,
+}
+
+// Functions whose arguments use FROM, e.g. `extract(year FROM o.created_at)`
+var fromFunctions = map[string]bool{"extract": true, "substring": true, "trim": true, "overlay": true}
+
+// Keywords that end the list of relations of a FROM clause
+var fromListEnd = map[string]bool{
+	"where": true, "group": true, "having": true, "order": true, "limit": true, "offset": true,
+	"on": true, "using": true, "union": true, "except": true, "intersect": true, "returning": true,
+	"set": true, "values": true, "window": true, "for": true, "select": true, "fetch": true,
+}
+
+// The schemas a statement names explicitly: of qualified relations (after FROM, JOIN, INTO,
+// UPDATE and the like, or in the list of a FROM clause), of qualified function calls, and of column
+// references qualified with their schema (`schema.table.column`).  Unquoted names are lowercased,
+// quoted ones unquoted.  Two part names elsewhere are taken as `table.column` (or alias), and names
+// inside string literals, e.g. of a `'schema.table'::regclass`, aren't found.
+func Schemas(statement []Token) []string {
+	var schemas []string
+	fromList := false
+	// for each open parenthesis, the word before it and whether it is in a FROM list
+	type paren struct {
+		word     string
+		fromList bool
+	}
+	var parens []paren
+
+	for i := 0; i < len(statement); i++ {
+		t := statement[i]
+		switch {
+		case t.Kind == TokenPunct && t.Text == "(":
+			parens = append(parens, paren{word(statement, i-1), fromList})
+		case t.Kind == TokenPunct && t.Text == ")" && len(parens) > 0:
+			fromList = parens[len(parens)-1].fromList
+			parens = parens[:len(parens)-1]
+		case t.Kind == TokenWord && fromListEnd[t.Text]:
+			fromList = false
+		case t.Kind == TokenWord && t.Text == "from":
+			fromList = len(parens) == 0 || !fromFunctions[parens[len(parens)-1].word]
+		}
+		if t.Kind != TokenWord && t.Kind != TokenQuotedIdent {
+			continue
+		}
+
+		// the whole dotted name, e.g. schema.table.*
+		parts := []string{identifier(t)}
+		j := i + 1
+		for j+1 < len(statement) && statement[j].Kind == TokenPunct && statement[j].Text == "." {
+			next := statement[j+1]
+			if next.Kind != TokenWord && next.Kind != TokenQuotedIdent && next.Text != "*" {
+				break
+			}
+			parts = append(parts, identifier(next))
+			j += 2
+		}
+		if len(parts) == 1 {
+			continue
+		}
+
+		var prev Token
+		if i > 0 {
+			prev = statement[i-1]
+		}
+		relation := prev.Kind == TokenWord && relationKeywords[prev.Text] && (prev.Text != "from" || fromList) ||
+			prev.Kind == TokenPunct && prev.Text == "," && fromList
+		call := j < len(statement) && statement[j].Kind == TokenPunct && statement[j].Text == "("
+
+		switch {
+		case relation || call:
+			// schema.name, or database.schema.name
+			schemas = append(schemas, parts[len(parts)-2])
+		case len(parts) >= 3:
+			// schema.table.column, or database.schema.table.column
+			schemas = append(schemas, parts[len(parts)-3])
+		}
+		i = j - 1
+	}
+
+	return schemas
+}
+
+// The name a word or quoted identifier token stands for
+func identifier(t Token) string {
+	if t.Kind != TokenQuotedIdent {
+		return t.Text
+	}
+	text, escape := t.Text, "\\"
+	unicode := len(text) > 2 && text[1] == '&'
+	if unicode {
+		text = text[2:]
+		if quoted, clause, ok := strings.Cut(text, " UESCAPE "); ok {
+			text, escape = quoted, strings.ReplaceAll(strings.Trim(clause, "'"), "''", "'")
+		}
+	}
+	name := strings.ReplaceAll(strings.Trim(text, `"`), `""`, `"`)
+	if unicode {
+		if decoded, ok := unescapeUnicode(name, escape); ok {
+			return decoded
+		}
+	}
+	return name
+}
+
+// Decodes the `\XXXX` and `\+XXXXXX` escapes of a U& identifier (or UTF-16 surrogate pairs of
+// them), with `\\` standing for the escape character itself, as postgres does.  Not ok for
+// invalid escapes, which postgres refuses.
+func unescapeUnicode(s, escape string) (string, bool) {
+	if len(escape) != 1 {
+		return "", false
+	}
+	var b strings.Builder
+	var high rune
+	for len(s) > 0 {
+		if s[0] != escape[0] {
+			if high != 0 {
+				return "", false
+			}
+			b.WriteByte(s[0])
+			s = s[1:]
+			continue
+		}
+		if len(s) > 1 && s[1] == escape[0] {
+			if high != 0 {
+				return "", false
+			}
+			b.WriteByte(escape[0])
+			s = s[2:]
+			continue
+		}
+
+		digits := 4
+		s = s[1:]
+		if len(s) > 0 && s[0] == '+' {
+			digits, s = 6, s[1:]
+		}
+		if len(s) < digits {
+			return "", false
+		}
+		code, err := strconv.ParseUint(s[:digits], 16, 32)
+		if err != nil {
+			return "", false
+		}
+		s = s[digits:]
+
+		r := rune(code)
+		switch {
+		case high != 0:
+			if r = utf16.DecodeRune(high, r); r == utf8.RuneError {
+				return "", false
+			}
+			high = 0
+		case utf16.IsSurrogate(r):
+			high = r
+			continue
+		}
+		if r == 0 || !utf8.ValidRune(r) {
+			return "", false
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), high == 0
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// How failed logins are throttled.  Zero values take the defaults below.
+type LockoutPolicy struct {
+	// failures from one source IP within Window before it is banned
+	MaxFailures int
+	// how long failures are remembered after the last one
+	Window time.Duration
+	// how long a banned IP is refused
+	BanDuration time.Duration
+	// delay before answering the first failure, doubling with each further one
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+const (
+	DefaultLockoutMaxFailures = 10
+	DefaultLockoutWindow      = 10 * time.Minute
+	DefaultLockoutBanDuration = 15 * time.Minute
+	DefaultLockoutBaseDelay   = 100 * time.Millisecond
+	DefaultLockoutMaxDelay    = 5 * time.Second
+)
+
+// Tracks failed logins per source IP and per user, to slow down password guessing: each failure
+// is answered after an exponentially growing delay, and IPs with too many failures are banned for
+// a while.  Users are never banned, so that an attacker can't lock legitimate users out, but
+// failures against a user from many IPs still slow each other down.  Safe for concurrent use.
+type Lockout struct {
+	policy LockoutPolicy
+
+	mu      sync.Mutex
+	records map[string]*failures
+	swept   time.Time
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	bannedUntil time.Time
+}
+
+func NewLockout(policy LockoutPolicy) *Lockout {
+	if policy.MaxFailures <= 0 {
+		policy.MaxFailures = DefaultLockoutMaxFailures
+	}
+	if policy.Window <= 0 {
+		policy.Window = DefaultLockoutWindow
+	}
+	if policy.BanDuration <= 0 {
+		policy.BanDuration = DefaultLockoutBanDuration
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = DefaultLockoutBaseDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = DefaultLockoutMaxDelay
+	}
+
+	return &Lockout{policy: policy, records: make(map[string]*failures), swept: time.Now()}
+}
+
+func ipKey(ip string) string     { return "ip:" + ip }
+func userKey(user string) string { return "user:" + user }
+
+// Whether connections from `ip` are currently refused
+func (l *Lockout) Banned(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := l.records[ipKey(ip)]
+	return r != nil && time.Now().Before(r.bannedUntil)
+}
+
+// Records a failed login, returning how long to wait before telling the client, and whether this
+// failure got the IP banned
+func (l *Lockout) Fail(ip, user string) (delay time.Duration, banned bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	record := func(key string) *failures {
+		r := l.records[key]
+		if r == nil || (now.Sub(r.last) > l.policy.Window && !now.Before(r.bannedUntil)) {
+			r = &failures{}
+			l.records[key] = r
+		}
+		r.count++
+		r.last = now
+		return r
+	}
+	byIP, byUser := record(ipKey(ip)), record(userKey(user))
+
+	if byIP.count >= l.policy.MaxFailures && !now.Before(byIP.bannedUntil) {
+		byIP.bannedUntil = now.Add(l.policy.BanDuration)
+		banned = true
+	}
+
+	delay = l.policy.BaseDelay
+	for n := max(byIP.count, byUser.count); n > 1 && delay < l.policy.MaxDelay; n-- {
+		delay *= 2
+	}
+
+	return min(delay, l.policy.MaxDelay), banned
+}
+
+// Records a successful login, forgetting the user's failures.  The IP's failures are kept, so
+// that an attacker with one valid account can't use it to reset their count.
+func (l *Lockout) Succeed(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.records, userKey(user))
+}
+
+// Forgets records that have expired, at most once per window
+func (l *Lockout) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.policy.Window {
+		return
+	}
+	l.swept = now
+
+	for key, r := range l.records {
+		if now.Sub(r.last) > l.policy.Window && !now.Before(r.bannedUntil) {
+			delete(l.records, key)
+		}
+	}
+}
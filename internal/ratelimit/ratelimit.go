@@ -0,0 +1,115 @@
+// Token bucket rate limiting, used to protect the proxy and its upstreams from bursts of clients.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// A classic token bucket: holds up to `burst` tokens and refills at `rate` tokens per second.
+// Safe for concurrent use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = max(1, int(rate))
+	}
+
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Takes a token if one is available
+func (b *Bucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Takes `n` tokens whether or not there are enough, going into debt if not, and returns how long
+// the bucket takes to get out of debt: how long to wait before doing what the tokens were taken for.
+// Take(0) only tells how long that is.
+func (b *Bucket) Take(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// A set of buckets keyed by e.g. source IP.  Buckets that have refilled completely are forgotten
+// periodically, so that the set doesn't grow without bound.
+type Keyed struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// How often to forget buckets of keys that haven't been seen in a while
+const sweepInterval = time.Minute
+
+func NewKeyed(rate float64, burst int) *Keyed {
+	return &Keyed{rate: rate, burst: burst, buckets: make(map[string]*Bucket), lastSweep: time.Now()}
+}
+
+func (k *Keyed) Allow(key string) bool {
+	return k.bucket(key).Allow()
+}
+
+// Takes `n` tokens from the key's bucket, see Bucket.Take
+func (k *Keyed) Take(key string, n float64) time.Duration {
+	return k.bucket(key).Take(n)
+}
+
+func (k *Keyed) bucket(key string) *Bucket {
+	k.mu.Lock()
+	now := time.Now()
+	if now.Sub(k.lastSweep) > sweepInterval {
+		for key, b := range k.buckets {
+			if b.full(now) {
+				delete(k.buckets, key)
+			}
+		}
+		k.lastSweep = now
+	}
+
+	b := k.buckets[key]
+	if b == nil {
+		b = NewBucket(k.rate, k.burst)
+		k.buckets[key] = b
+	}
+	k.mu.Unlock()
+
+	return b
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketBurstAndRefill(t *testing.T) {
+	b := NewBucket(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("expected token %d of burst to be allowed", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("expected bucket to be empty after burst")
+	}
+
+	// pretend 200ms passed, which refills 2 tokens at 10/s
+	b.last = b.last.Add(-200 * time.Millisecond)
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("expected bucket to refill over time")
+	}
+	if b.Allow() {
+		t.Fatal("expected bucket to only refill in proportion to elapsed time")
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	b := NewBucket(100, 100)
+
+	if wait := b.Take(50); wait != 0 {
+		t.Fatalf("expected no wait within the burst, got %v", wait)
+	}
+	// 50 tokens short at 100/s
+	if wait := b.Take(100); wait < 490*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatalf("expected to wait about 500ms to get out of debt, got %v", wait)
+	}
+	if wait := b.Take(0); wait == 0 {
+		t.Fatal("expected the bucket to still be in debt")
+	}
+	if b.Allow() {
+		t.Fatal("expected no token while in debt")
+	}
+
+	b.last = b.last.Add(-time.Second)
+	if wait := b.Take(0); wait != 0 {
+		t.Fatalf("expected the debt to be paid off after a second, got %v", wait)
+	}
+}
+
+func TestKeyedIsolatesKeys(t *testing.T) {
+	k := NewKeyed(1, 1)
+
+	if !k.Allow("10.0.0.1") {
+		t.Fatal("expected first request from 10.0.0.1 to be allowed")
+	}
+	if k.Allow("10.0.0.1") {
+		t.Fatal("expected second request from 10.0.0.1 to be limited")
+	}
+	if !k.Allow("10.0.0.2") {
+		t.Fatal("expected 10.0.0.2 to have its own bucket")
+	}
+}
+
+func TestLockoutDelaysAndBans(t *testing.T) {
+	l := NewLockout(LockoutPolicy{MaxFailures: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond})
+
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		delay, banned := l.Fail("10.0.0.1", "alice")
+		if delay != want || banned {
+			t.Fatalf("failure %d: expected delay %v without ban, got %v, %v", i+1, want, delay, banned)
+		}
+	}
+	if l.Banned("10.0.0.1") {
+		t.Fatal("expected IP not to be banned below the threshold")
+	}
+
+	if delay, banned := l.Fail("10.0.0.1", "alice"); delay != 300*time.Millisecond || !banned {
+		t.Fatalf("expected capped delay and a ban, got %v, %v", delay, banned)
+	}
+	if !l.Banned("10.0.0.1") || l.Banned("10.0.0.2") {
+		t.Fatal("expected only the failing IP to be banned")
+	}
+
+	// failures for the same user from another IP are slowed down too, until the user logs in
+	if delay, _ := l.Fail("10.0.0.2", "alice"); delay != 300*time.Millisecond {
+		t.Fatalf("expected delay to follow the user across IPs, got %v", delay)
+	}
+	l.Succeed("alice")
+	if delay, _ := l.Fail("10.0.0.3", "alice"); delay != 100*time.Millisecond {
+		t.Fatalf("expected a successful login to reset the user's failures, got %v", delay)
+	}
+
+	// bans and failures expire
+	record := l.records[ipKey("10.0.0.1")]
+	record.bannedUntil = time.Now()
+	record.last = time.Now().Add(-DefaultLockoutWindow - time.Second)
+	if l.Banned("10.0.0.1") {
+		t.Fatal("expected ban to expire")
+	}
+	if delay, banned := l.Fail("10.0.0.1", "bob"); delay != 100*time.Millisecond || banned {
+		t.Fatalf("expected failures to be forgotten after the window, got %v, %v", delay, banned)
+	}
+}
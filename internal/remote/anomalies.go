@@ -0,0 +1,60 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// Kinds of protocol anomalies, see ProtocolAnomaly
+const (
+	// a message type the protocol doesn't define, which is passed on unless strict_protocol is set
+	AnomalyUnknownType = "unknown_type"
+	// a message the codec refused, e.g. one shorter than its type allows, which ends the session
+	AnomalyMalformed = "malformed"
+	// a message the peer has no business sending at this point, e.g. a backend message from a
+	// client, or a startup message in the middle of a session
+	AnomalyUnexpected = "unexpected"
+)
+
+var protocolAnomalies = metrics.NewCounterVec(
+	"pgproxy_protocol_anomalies_total", "Protocol anomalies in what clients and upstreams sent, by direction and kind.", "entry", "direction", "kind",
+)
+
+var ErrTooManyAnomalies = errors.New("too many protocol anomalies")
+
+// The most protocol anomalies a session may have before it is ended, unlimited if 0
+func maxProtocolAnomalies() int {
+	routes.RLock()
+	defer routes.RUnlock()
+
+	if routes.config == nil {
+		return 0
+	}
+	return routes.config.MaxProtocolAnomalies
+}
+
+// Called by the relay for every anomaly in the messages of a session, sent by the client or the
+// server (`direction`).  Logs and counts it, and returns an error wrapping ErrTooManyAnomalies once
+// the session has had max_protocol_anomalies of them, in which case the relay ends the session.
+func ProtocolAnomaly(client net.Conn, direction, kind, detail string) error {
+	associations.Lock()
+	var entry, session, user string
+	count := 0
+	if a := associations.m[client]; a != nil {
+		a.anomalies++
+		entry, session, user, count = a.entry, a.session, a.user, a.anomalies
+	}
+	associations.Unlock()
+
+	protocolAnomalies.With(entry, direction, kind).Inc()
+	slog.Warn("protocol anomaly", "session", session, "entry", entry, "user", user, "direction", direction, "kind", kind, "detail", detail, "count", count)
+
+	if limit := maxProtocolAnomalies(); limit > 0 && count >= limit {
+		return fmt.Errorf("%w: %d in session %s", ErrTooManyAnomalies, count, session)
+	}
+	return nil
+}
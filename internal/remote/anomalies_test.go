@@ -0,0 +1,36 @@
+package remote
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProtocolAnomaly(t *testing.T) {
+	entry := &ConfigEntry{Name: "anomalous"}
+	client, _, cleanup := associate(&association{session: "s1", config: entry, entry: entry.Name})
+	defer cleanup()
+	routes.Lock()
+	previous := routes.config
+	routes.config = &Config{MaxProtocolAnomalies: 2}
+	routes.Unlock()
+	defer func() {
+		routes.Lock()
+		routes.config = previous
+		routes.Unlock()
+	}()
+
+	if err := ProtocolAnomaly(client, "client", AnomalyUnknownType, "MessageType(y)"); err != nil {
+		t.Fatalf("expected the first anomaly to be let through, got %v", err)
+	}
+	if err := ProtocolAnomaly(client, "client", AnomalyUnexpected, "ReadyForQuery(Z)"); !errors.Is(err, ErrTooManyAnomalies) {
+		t.Errorf("expected the session to be ended at max_protocol_anomalies, got %v", err)
+	}
+	if n := protocolAnomalies.With(entry.Name, "client", AnomalyUnknownType).Value(); n != 1 {
+		t.Errorf("expected one unknown message type counted, got %d", n)
+	}
+	for _, s := range Sessions() {
+		if s.Session == "s1" && s.Anomalies != 2 {
+			t.Errorf("expected the session to have 2 anomalies, got %d", s.Anomalies)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package remote
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/ratelimit"
+)
+
+var asyncMessagesDropped = metrics.NewCounterVec(
+	"pgproxy_async_messages_dropped_total", "Notices and notifications from upstreams not forwarded to clients under an entry's async_message_limit, by type and reason (size or rate).", "entry", "type", "reason",
+)
+
+// Bounds the notices and notifications an upstream sends a client on its own accord, so that a
+// misconfigured upstream (e.g. a trigger raising a NOTICE per row) can't bury a slow client in
+// them.  Messages over the limits are dropped rather than forwarded.
+type AsyncMessageLimit struct {
+	// the largest notice or notification forwarded, in bytes, unlimited if 0
+	MaxSize int `json:"max_size"`
+	// notices and notifications forwarded per second to each session, unlimited if 0
+	PerSecond float64 `json:"per_second"`
+	// how many may be forwarded at once above the rate, defaults to per_second (at least 1)
+	Burst int `json:"burst"`
+
+	sessions *ratelimit.Keyed
+}
+
+func (l *AsyncMessageLimit) validate() error {
+	if l.MaxSize < 0 || l.PerSecond < 0 || l.Burst < 0 {
+		return errors.New("max_size, per_second and burst can't be negative")
+	}
+	if l.MaxSize == 0 && l.PerSecond == 0 {
+		return errors.New("max_size or per_second is required")
+	}
+
+	if l.PerSecond > 0 {
+		l.sessions = ratelimit.NewKeyed(l.PerSecond, l.Burst)
+	}
+	return nil
+}
+
+// Called by the relay for every message from the upstream.  Returns true if the message is a
+// notice or notification the entry's async_message_limit drops, in which case the relay doesn't
+// forward it.  The first message dropped in a session is logged, the rest only counted.
+func DropAsyncMessage(client net.Conn, message *codec.Message) bool {
+	kind := ""
+	switch message.Type {
+	case codec.MessageTypeNotice:
+		kind = "notice"
+	case codec.MessageTypeNotificationResponse:
+		kind = "notification"
+	default:
+		return false
+	}
+
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.config.AsyncMessageLimit == nil {
+		associations.Unlock()
+		return false
+	}
+	limit := a.config.AsyncMessageLimit
+	reason := ""
+	switch {
+	case limit.MaxSize > 0 && int(message.Length)+1 > limit.MaxSize:
+		reason = "size"
+	case limit.sessions != nil && !limit.sessions.Allow(a.session):
+		reason = "rate"
+	default:
+		associations.Unlock()
+		return false
+	}
+	a.asyncDropped++
+	first := a.asyncDropped == 1
+	associations.Unlock()
+
+	asyncMessagesDropped.With(a.entry, kind, reason).Inc()
+	if first {
+		slog.Warn(
+			"dropping asynchronous messages from upstream", "entry", a.entry, "session", a.session,
+			"type", kind, "reason", reason, "size", message.Length+1,
+		)
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package remote
+
+import (
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestDropAsyncMessage(t *testing.T) {
+	entry := &ConfigEntry{Name: "noisy", AsyncMessageLimit: &AsyncMessageLimit{MaxSize: 64, PerSecond: 0.001, Burst: 2}}
+	if err := entry.AsyncMessageLimit.validate(); err != nil {
+		t.Fatal(err)
+	}
+	client, _, cleanup := associate(&association{session: "s1", config: entry, entry: entry.Name})
+	defer cleanup()
+
+	notice := &codec.Message{Type: codec.MessageTypeNotice, Length: 20}
+	if !DropAsyncMessage(client, &codec.Message{Type: codec.MessageTypeNotice, Length: 100}) {
+		t.Error("expected a notice over max_size to be dropped")
+	}
+	for i := range 2 {
+		if DropAsyncMessage(client, notice) {
+			t.Errorf("expected notice %d to be within the burst", i)
+		}
+	}
+	if !DropAsyncMessage(client, &codec.Message{Type: codec.MessageTypeNotificationResponse, Length: 20}) {
+		t.Error("expected a notification over the rate to be dropped")
+	}
+	if DropAsyncMessage(client, &codec.Message{Type: codec.MessageTypeDataRow, Length: 100}) {
+		t.Error("expected other messages never to be dropped")
+	}
+
+	if n := asyncMessagesDropped.With(entry.Name, "notice", "size").Value(); n != 1 {
+		t.Errorf("expected one notice dropped for its size, got %d", n)
+	}
+	if n := asyncMessagesDropped.With(entry.Name, "notification", "rate").Value(); n != 1 {
+		t.Errorf("expected one notification dropped for the rate, got %d", n)
+	}
+
+	if err := (&AsyncMessageLimit{}).validate(); err == nil {
+		t.Error("expected an async_message_limit without limits to be rejected")
+	}
+}
@@ -0,0 +1,108 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// Read-after-DDL barriers: while a schema migration runs on an entry's upstream, the entry is
+// paused like for a cutover, so that new requests (and new sessions) wait for the migration
+// rather than running against half of it.  Lowering the barrier recycles the entry's pooled
+// connections (see recyclePools), so that no request runs on a backend holding plans or prepared
+// statements from before the migration, which would fail with "cached plan must not change result
+// type".  Clients see a latency blip instead of errors.
+//
+// Barriers are raised and lowered through the admin API, around the migration.  A barrier that
+// isn't lowered within its hold duration lowers itself, so that a migration runner that dies
+// doesn't leave the entry paused.
+
+var barrierHeld = metrics.NewCounterVec(
+	"pgproxy_barrier_held_microseconds_total", "Time entries spent behind a read-after-DDL barrier.", "entry",
+)
+
+// Raised barriers by entry name, with the timer lowering each once its hold runs out
+var barriers = struct {
+	sync.Mutex
+	m map[string]*barrier
+}{m: make(map[string]*barrier)}
+
+type barrier struct {
+	raised time.Time
+	expire *time.Timer
+}
+
+// Returned by LowerBarrier for an entry without a barrier
+var ErrNoBarrier = errors.New("no barrier raised")
+
+// Raises a barrier on an entry: pauses it and waits for its in-flight requests and transactions to
+// finish, giving up (and resuming the entry) after `drain`.  Once raised, the barrier is held until
+// LowerBarrier, or for at most `hold`.
+func RaiseBarrier(entry *ConfigEntry, drain, hold time.Duration) error {
+	if !pauseEntry(entry.Name) {
+		return fmt.Errorf("entry %s is already paused", entry.Name)
+	}
+	slog.Info("barrier: pausing entry", "entry", entry.Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for inFlightSessions(entry.Name) > 0 {
+		select {
+		case <-ctx.Done():
+			resumeEntry(entry.Name)
+			return fmt.Errorf("barrier on %s not raised: %d sessions still in flight after %s", entry.Name, inFlightSessions(entry.Name), drain)
+		case <-ticker.C:
+		}
+	}
+
+	barriers.Lock()
+	barriers.m[entry.Name] = &barrier{
+		raised: time.Now(),
+		expire: time.AfterFunc(hold, func() {
+			if _, err := LowerBarrier(entry.Name); err == nil {
+				slog.Warn("barrier: lowered after its hold ran out", "entry", entry.Name, "hold", hold)
+			}
+		}),
+	}
+	barriers.Unlock()
+
+	slog.Info("barrier: raised", "entry", entry.Name, "hold", hold)
+	return nil
+}
+
+// Lowers an entry's barrier, recycling its pooled connections and resuming it.  Returns the number
+// of connections recycled.
+func LowerBarrier(name string) (int, error) {
+	barriers.Lock()
+	b := barriers.m[name]
+	delete(barriers.m, name)
+	barriers.Unlock()
+	if b == nil {
+		return 0, fmt.Errorf("%w on entry %s", ErrNoBarrier, name)
+	}
+	b.expire.Stop()
+
+	// before resuming, so that the requests held back get new connections
+	recycled := recyclePools(name, "barrier lowered")
+	resumeEntry(name)
+
+	held := time.Since(b.raised)
+	barrierHeld.With(name).Add(uint64(held.Microseconds()))
+	slog.Info("barrier: lowered", "entry", name, "held", held, "recycled", recycled)
+	return recycled, nil
+}
+
+// Whether an entry has a barrier raised
+func BarrierRaised(name string) bool {
+	barriers.Lock()
+	defer barriers.Unlock()
+	return barriers.m[name] != nil
+}
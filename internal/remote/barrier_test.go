@@ -0,0 +1,64 @@
+package remote
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestBarrier(t *testing.T) {
+	entry := &ConfigEntry{Name: "migrating"}
+
+	a := &association{config: entry, entry: entry.Name, pending: 1, txStatus: codec.BackendTransactionStatusIdle}
+	_, _, cleanup := associate(a)
+	defer cleanup()
+
+	if err := RaiseBarrier(entry, 100*time.Millisecond, time.Minute); err == nil {
+		t.Fatal("expected the barrier to be refused while a request is in flight")
+	}
+	if BarrierRaised(entry.Name) {
+		t.Error("expected no barrier after a failed raise")
+	}
+	associations.Lock()
+	paused := pauseGates[entry.Name] != nil
+	a.pending = 0
+	associations.Unlock()
+	if paused {
+		t.Error("expected the entry to be resumed after a failed raise")
+	}
+
+	if err := RaiseBarrier(entry, time.Second, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !BarrierRaised(entry.Name) {
+		t.Error("expected the barrier to be raised")
+	}
+	if err := RaiseBarrier(entry, time.Second, time.Minute); err == nil {
+		t.Error("expected a second barrier to be refused")
+	}
+	if _, err := LowerBarrier(entry.Name); err != nil {
+		t.Fatal(err)
+	}
+	associations.Lock()
+	paused = pauseGates[entry.Name] != nil
+	associations.Unlock()
+	if paused || BarrierRaised(entry.Name) {
+		t.Error("expected lowering the barrier to resume the entry")
+	}
+	if _, err := LowerBarrier(entry.Name); !errors.Is(err, ErrNoBarrier) {
+		t.Errorf("expected no barrier to lower, got %v", err)
+	}
+
+	if err := RaiseBarrier(entry, time.Second, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for BarrierRaised(entry.Name) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if BarrierRaised(entry.Name) {
+		t.Error("expected the barrier to lower itself once its hold ran out")
+	}
+}
@@ -0,0 +1,49 @@
+package remote
+
+import (
+	"net"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+var clientKeepalives = metrics.NewCounterVec(
+	"pgproxy_client_keepalives_total", "Keepalive messages sent to idle clients, see client_keepalive.", "entry",
+)
+
+// The entry's client_keepalive for a session, 0 if off.  Replication sessions stream on their own
+// and never get keepalives.
+func ClientKeepalive(client net.Conn) time.Duration {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil || a.replication != "" {
+		return 0
+	}
+	return time.Duration(a.config.ClientKeepalive)
+}
+
+// When the session last went idle, and whether it still is: waiting for its client's next
+// request, in a transaction or not
+func IdleSince(client net.Conn) (time.Time, bool) {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil || !a.waitingSince.IsZero() || a.replication != "" || a.pending > 0 || a.unsynced {
+		return time.Time{}, false
+	}
+	return a.stateChange, true
+}
+
+// Called by the relay for every keepalive it sent the client
+func CountClientKeepalive(client net.Conn) {
+	associations.Lock()
+	a := associations.m[client]
+	associations.Unlock()
+
+	if a != nil {
+		clientKeepalives.With(a.entry).Inc()
+	}
+}
@@ -0,0 +1,39 @@
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestIdleSince(t *testing.T) {
+	entry := &ConfigEntry{Name: "keepalive", ClientKeepalive: Duration(time.Minute)}
+	a := &association{config: entry, entry: entry.Name, txStatus: codec.BackendTransactionStatusIdle, stats: statsFor(entry.Name, "app"), stateChange: time.Now()}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	if interval := ClientKeepalive(client); interval != time.Minute {
+		t.Errorf("expected the entry's client_keepalive, got %v", interval)
+	}
+	if _, idle := IdleSince(client); !idle {
+		t.Error("expected a new session to be idle")
+	}
+
+	BeginRequest(client, codec.MessageTypeQuery)
+	if _, idle := IdleSince(client); idle {
+		t.Error("expected a session running a request not to be idle")
+	}
+	before := time.Now()
+	EndRequest(client, codec.BackendTransactionStatusInTransaction)
+	if since, idle := IdleSince(client); !idle || since.Before(before) {
+		t.Errorf("expected the session to be idle in its transaction since its request ended, got %v %v", since, idle)
+	}
+
+	associations.Lock()
+	a.replication = "physical"
+	associations.Unlock()
+	if _, idle := IdleSince(client); idle || ClientKeepalive(client) != 0 {
+		t.Error("expected replication sessions never to get keepalives")
+	}
+}
@@ -0,0 +1,789 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/admission"
+	"github.com/michaelhelvey/pgproxy/internal/audit"
+	"github.com/michaelhelvey/pgproxy/internal/auth"
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/contention"
+	"github.com/michaelhelvey/pgproxy/internal/export"
+	"github.com/michaelhelvey/pgproxy/internal/lifecycle"
+	"github.com/michaelhelvey/pgproxy/internal/memory"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/ratelimit"
+	"github.com/michaelhelvey/pgproxy/internal/slowlog"
+)
+
+const (
+	// each session has a goroutine blocked reading its client, with a read buffer, throughout
+	ClientEngineGoroutines = "goroutines"
+	// sessions between transactions are parked: one goroutine waits for all their clients with
+	// epoll (Linux only), and they get a goroutine and read buffer back once their client sends
+	// something
+	ClientEngineEpoll = "epoll"
+)
+
+// Address the proxy listens on for client connections unless configured otherwise
+const DefaultListenAddr = "127.0.0.1:5433"
+
+// Database name that admin_users connect to for the admin console, rather than an entry
+const AdminDatabase = "pgproxy"
+
+// Top level proxy configuration.  For backwards compatibility, a config file may also be just a
+// JSON array of entries, in which case everything else takes its default value.
+type Config struct {
+	// address to listen for client connections on
+	Listen string `json:"listen"`
+	// several addresses to accept clients on, each with its own TLS settings and entries, in
+	// place of `listen` and `tls`
+	Listeners []ListenerConfig `json:"listeners"`
+	// maximum number of concurrent client sessions, unlimited if 0
+	MaxClientConn int `json:"max_client_conn"`
+	// limit on how quickly new client connections are accepted
+	AcceptRateLimit *AcceptRateLimit `json:"accept_rate_limit"`
+	// source addresses `listen` accepts connections from, in place of a listener's own
+	// `ip_access`; anywhere if unset
+	IPAccess *IPAccess `json:"ip_access"`
+	// socket options for accepted client connections
+	TCP *TCPOptions `json:"tcp"`
+	// TLS for client connections, plaintext only if unset
+	TLS *TLSConfig `json:"tls"`
+	// accept loops for `listen`, in place of a listener's own `acceptors`
+	Acceptors Acceptors `json:"acceptors"`
+	// file of user credentials (in pgbouncer's userlist.txt format) clients must authenticate
+	// with, for entries without an auth_query
+	AuthFile string `json:"auth_file"`
+	// LDAP server for entries with `auth: "ldap"`
+	LDAP *LDAPConfig `json:"ldap"`
+	// token validation for entries with `auth: "jwt"`
+	JWT *JWTConfig `json:"jwt"`
+	// where security audit events go, nowhere if unset
+	Audit *audit.Config `json:"audit"`
+	// throttling of failed client logins, off if unset
+	AuthLockout *AuthLockout `json:"auth_lockout"`
+	// HTTP endpoint asked whether to let each authenticated client in
+	AdmissionWebhook *AdmissionWebhookConfig `json:"admission_webhook"`
+	// alerts on bursts of deadlocks and serialization failures, off if unset
+	ContentionAlerts *ContentionAlertsConfig `json:"contention_alerts"`
+	// how transaction pooled sessions wait between transactions: ClientEngineGoroutines (the
+	// default) or ClientEngineEpoll
+	ClientEngine string `json:"client_engine"`
+	// refuse messages of types the protocol doesn't define, from clients and upstreams alike,
+	// rather than pass them on (see codec.SetStrict)
+	StrictProtocol bool `json:"strict_protocol"`
+	// how many protocol anomalies (see ProtocolAnomaly) a session may have before it is ended,
+	// unlimited if 0
+	MaxProtocolAnomalies int `json:"max_protocol_anomalies"`
+	// limits on the memory relays hold for messages in flight and on the heap, beyond which
+	// sessions are slowed down and new clients refused; unlimited if unset
+	Memory *memory.Config `json:"memory"`
+	// logging of requests the upstream is slow to answer, off if unset
+	SlowQueries *SlowQueriesConfig `json:"slow_queries"`
+	// streaming of query activity to Kafka or NATS, off if unset
+	Export *ExportConfig `json:"export"`
+	// statsd/DogStatsD agent to push metrics to, in addition to serving them on the admin API
+	Statsd *StatsdConfig `json:"statsd"`
+	// how the proxy drains on SIGTERM, and the lease it competes for if it is part of an
+	// active/standby pair
+	Lifecycle *LifecycleConfig `json:"lifecycle"`
+	// users who may connect to the admin console database (see AdminDatabase), authenticating
+	// with the auth_file
+	AdminUsers []string `json:"admin_users"`
+	// how long a write to either side of a session may block before the session is torn down,
+	// unlimited if unset
+	WriteTimeout Duration `json:"write_timeout"`
+	// how long a session may sit in a transaction without sending anything before it is rolled
+	// back and closed, unlimited if unset
+	IdleInTransactionSessionTimeout Duration `json:"idle_in_transaction_session_timeout"`
+	// the notice clients receive once connected through to their upstream, for entries that
+	// don't set their own
+	StartupNotice *StartupNotice `json:"startup_notice"`
+	// keys whose values are masked in logs and error messages, on top of redact.DefaultKeys
+	SensitiveKeys []string `json:"sensitive_keys"`
+	// the entries of the file and of its `include`s, with `defaults` merged in (see configFile)
+	Entries []ConfigEntry `json:"entries"`
+}
+
+// An address clients connect to, with the entries they can reach through it, e.g. a port for
+// application traffic to the primary and another that only exposes read-only replicas
+type ListenerConfig struct {
+	// names the listener in logs, and the socket systemd passes for it (FileDescriptorName=)
+	Name string `json:"name"`
+	// host:port, or the path of a Unix socket
+	Listen string `json:"listen"`
+	// TLS for the listener's clients, plaintext only if unset
+	TLS *TLSConfig `json:"tls"`
+	// names of the entries the listener's clients may connect to, all of them if empty
+	Entries []string `json:"entries"`
+	// accept tunnels from other pgproxies (an entry's tunnel.pgproxy) instead of clients, whose
+	// streams are then handled like clients of the listener.  Needs `tls` with client_cert
+	// "require".
+	Tunnel bool `json:"tunnel"`
+	// sockets bound to the address with SO_REUSEPORT, each with its own accept loop, so that the
+	// kernel spreads new connections across them; one if unset
+	Acceptors Acceptors `json:"acceptors"`
+	// source addresses the listener accepts connections from, anywhere if unset
+	IPAccess *IPAccess `json:"ip_access"`
+}
+
+// A number of accept loops, written in config files as a number or as "cpus" for one per CPU
+type Acceptors int
+
+// Stands for one accept loop per CPU
+const acceptorsPerCPU Acceptors = -1
+
+func (a *Acceptors) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s != "cpus" {
+			return fmt.Errorf("expected a number of acceptors or \"cpus\", got %q", s)
+		}
+		*a = acceptorsPerCPU
+		return nil
+	}
+
+	var n int
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("expected a number of acceptors or \"cpus\": %w", err)
+	}
+	if n < 0 {
+		return fmt.Errorf("acceptors can't be negative, got %d", n)
+	}
+	*a = Acceptors(n)
+	return nil
+}
+
+func (a Acceptors) MarshalJSON() ([]byte, error) {
+	if a == acceptorsPerCPU {
+		return json.Marshal("cpus")
+	}
+	return json.Marshal(int(a))
+}
+
+// Returns how many accept loops to run, at least one
+func (a Acceptors) Count() int {
+	if a == acceptorsPerCPU {
+		return runtime.NumCPU()
+	}
+	return max(int(a), 1)
+}
+
+// Returns the listeners to accept clients on: `listeners`, or `listen` with `tls` and every
+// entry if there are none
+func (c *Config) AllListeners() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+
+	return []ListenerConfig{{Name: "default", Listen: c.Listen, TLS: c.TLS, Acceptors: c.Acceptors, IPAccess: c.IPAccess}}
+}
+
+// Returns the entries the listener's clients may connect to
+func (l *ListenerConfig) Scope(entries []ConfigEntry) []ConfigEntry {
+	if len(l.Entries) == 0 {
+		return entries
+	}
+
+	var scoped []ConfigEntry
+	for _, entry := range entries {
+		if slices.Contains(l.Entries, entry.Name) {
+			scoped = append(scoped, entry)
+		}
+	}
+	return scoped
+}
+
+// Whether the listener is on a Unix socket rather than TCP
+func (l *ListenerConfig) Unix() bool {
+	return strings.HasPrefix(l.Listen, "/")
+}
+
+func (c *Config) validateListeners() error {
+	names := map[string]bool{}
+	for _, l := range c.Listeners {
+		if l.Name == "" || l.Listen == "" {
+			return errors.New("listeners need a name and a listen address")
+		}
+		if names[l.Name] {
+			return fmt.Errorf("duplicate listener %s", l.Name)
+		}
+		names[l.Name] = true
+		if l.Tunnel && (l.TLS == nil || l.TLS.ClientCert != ClientCertRequire) {
+			return fmt.Errorf("listener %s accepts tunnels, which requires tls with client_cert \"require\"", l.Name)
+		}
+
+		for _, name := range l.Entries {
+			if !slices.ContainsFunc(c.Entries, func(e ConfigEntry) bool { return e.Name == name }) {
+				return fmt.Errorf("listener %s refers to unknown entry %s", l.Name, name)
+			}
+		}
+	}
+
+	for _, l := range c.AllListeners() {
+		if l.Unix() && (l.Acceptors > 1 || l.Acceptors == acceptorsPerCPU) {
+			return fmt.Errorf("listener %s is a Unix socket, which can only have one acceptor", l.Name)
+		}
+		if l.Unix() && l.IPAccess != nil {
+			return fmt.Errorf("listener %s is a Unix socket, whose clients have no IP address for ip_access", l.Name)
+		}
+		if _, err := l.IPAccess.parse(); err != nil {
+			return fmt.Errorf("listener %s: ip_access: %w", l.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Stands for the upstream's address in a startup notice's message
+const upstreamPlaceholder = "{upstream}"
+
+// The notice sent to clients once they are connected through to their upstream.  Some clients are
+// confused by it, and it tells end users where the upstream is, so it can be changed or left out.
+type StartupNotice struct {
+	// send no notice
+	Disable bool `json:"disable"`
+	// replaces the default text, with {upstream} standing for the upstream's address
+	Message string `json:"message"`
+	// leave the upstream's address out of the default text
+	HideUpstream bool `json:"hide_upstream"`
+}
+
+func (n *StartupNotice) validate() error {
+	if n != nil && n.HideUpstream && strings.Contains(n.Message, upstreamPlaceholder) {
+		return errors.New("message refers to {upstream}, which hide_upstream hides")
+	}
+	return nil
+}
+
+// Returns the notice's text for a client connected to `upstream`, "" if no notice should be sent
+func (n *StartupNotice) Text(upstream string) string {
+	switch {
+	case n == nil:
+		return "PGPROXY: proxy successfully connected through to remote at: " + upstream
+	case n.Disable:
+		return ""
+	case n.Message != "":
+		return strings.ReplaceAll(n.Message, upstreamPlaceholder, upstream)
+	case n.HideUpstream:
+		return "PGPROXY: proxy successfully connected through to remote"
+	default:
+		return "PGPROXY: proxy successfully connected through to remote at: " + upstream
+	}
+}
+
+type AcceptRateLimit struct {
+	// sustained rate of new connections per second
+	PerSecond float64 `json:"per_second"`
+	// how many connections may be accepted at once above the sustained rate, defaults to
+	// per_second
+	Burst int `json:"burst"`
+	// apply the limit to each source IP separately rather than to the listener as a whole
+	PerIP bool `json:"per_ip"`
+}
+
+// Slows down and eventually bans source IPs that keep failing to log in.  Zero values take the
+// ratelimit.DefaultLockout* defaults.
+type AuthLockout struct {
+	// failures from one IP within `window` before it is banned for `ban_duration`
+	MaxFailures int      `json:"max_failures"`
+	Window      Duration `json:"window"`
+	BanDuration Duration `json:"ban_duration"`
+	// failed logins are answered after `base_delay`, doubling with each further failure from the
+	// same IP or for the same user, up to `max_delay`
+	BaseDelay Duration `json:"base_delay"`
+	MaxDelay  Duration `json:"max_delay"`
+}
+
+func (c *AuthLockout) Build() *ratelimit.Lockout {
+	if c == nil {
+		return nil
+	}
+
+	return ratelimit.NewLockout(ratelimit.LockoutPolicy{
+		MaxFailures: c.MaxFailures,
+		Window:      time.Duration(c.Window),
+		BanDuration: time.Duration(c.BanDuration),
+		BaseDelay:   time.Duration(c.BaseDelay),
+		MaxDelay:    time.Duration(c.MaxDelay),
+	})
+}
+
+type ConfigMatch struct {
+	// for now just match on the database of the connection params
+	Database string `json:"database"`
+	// only match clients whose certificate was issued to this name (CN or SAN)
+	ClientCert string `json:"client_cert"`
+	// only match clients whose startup `options` make these settings (e.g. `-c
+	// pgproxy.route=analytics`), for applications that can't pick a database of their own
+	Options map[string]string `json:"options"`
+	// only match users whose whole name matches this regular expression, whose capture groups
+	// fill in the entry's placeholders (see tenant.go)
+	User string `json:"user"`
+}
+
+// Whether the settings of a client's startup `options` include every one the entry matches on
+func (m *ConfigMatch) matchesOptions(options codec.ConnectionParams) bool {
+	for name, value := range m.Options {
+		if set, ok := options[name]; !ok || set != value {
+			return false
+		}
+	}
+	return true
+}
+
+type ConfigEntry struct {
+	// human readable identifier for the entry
+	Name string `json:"name"`
+	// arbitrary labels (e.g. team, environment) attached to the logs, audit events and metrics of
+	// the entry's sessions
+	Labels map[string]string `json:"labels"`
+	// how to identify the connection based on params
+	Match ConfigMatch `json:"match"`
+	// only try the entry out: clients it would be matched to are logged and counted, but keep going
+	// to the entry they match otherwise
+	Shadow bool `json:"shadow"`
+	// what type to cast provider meta to
+	Provider string `json:"provider"`
+	// some kind data used by the provider
+	ProviderMeta map[string]string `json:"provider_meta"`
+	// multiple upstreams for the entry, used instead of provider/provider_meta when present
+	Targets []ConfigTarget `json:"targets"`
+	// how long to reuse what providers resolve provider_meta to, asked every time if unset
+	ProviderCache *ProviderCacheConfig `json:"provider_cache"`
+	// how to pick between targets for a new session, see AffinityNone and AffinityClient
+	Affinity string `json:"affinity"`
+	// optional overrides for the database/user sent in the upstream startup message
+	Rewrite ConfigRewrite `json:"rewrite"`
+	// socket options for upstream connections
+	TCP *TCPOptions `json:"tcp"`
+	// restrictions on upstream TLS, for providers whose connection strings enable it
+	UpstreamTLS *TLSPolicy `json:"upstream_tls"`
+	// overrides the proxy-wide startup_notice for the entry's clients
+	StartupNotice *StartupNotice `json:"startup_notice"`
+	// ParameterStatus values advertised to the entry's clients at startup, e.g. server_version
+	// or TimeZone, in addition to or in place of the proxy's own
+	ServerParameters map[string]string `json:"server_parameters"`
+	// how to reach upstreams that aren't directly routable, e.g. through an SSH jump host
+	Tunnel *TunnelConfig `json:"tunnel"`
+	// timeouts set on upstream connections, and optionally enforced on clients
+	Guardrails *Guardrails `json:"guardrails"`
+	// confines the entry's clients to their tenant's rows of tables shared between tenants
+	Tenancy *Tenancy `json:"tenancy"`
+	// dial the upstream once the client sends its first message rather than during startup, so
+	// that clients which connect and leave without a query (health checks, connection warmers)
+	// cost nothing upstream.  Clients find out that the upstream is unreachable at their first
+	// query instead, and get no startup notice.  Replication connections are always dialed
+	// during startup.
+	LazyConnect bool `json:"lazy_connect"`
+	// give sessions a new upstream connection when theirs drops while they are idle outside a
+	// transaction (e.g. because the upstream restarted), setting up their SET values and prepared
+	// statements again, rather than ending them.  Session pooling mode only.
+	Reconnect bool `json:"reconnect"`
+	// how long to wait for an upstream connection before failing the client's startup, defaults
+	// to DefaultConnectTimeout
+	ConnectTimeout Duration `json:"connect_timeout"`
+	// how long a client's transaction (or autocommitted request) may run before it is rolled back
+	// and the session ended, unlimited if unset
+	MaxTransactionDuration Duration `json:"max_transaction_duration"`
+	// how long a client of a pooled entry may leave what the upstream sends it unread before its
+	// request is canceled and the client disconnected, unlimited if unset
+	SlowClientTimeout Duration `json:"slow_client_timeout"`
+	// how long a session may sit idle before its client is sent a keepalive message, and between
+	// keepalives, so that NATs and load balancers don't drop the connection; off if unset
+	ClientKeepalive Duration `json:"client_keepalive"`
+	// how the proxy answers the entry's clients while it is in maintenance, see Maintenance
+	Maintenance *Maintenance `json:"maintenance"`
+	// which client startup parameters reach the upstream, see StartupParameters
+	StartupParameters *StartupParameters `json:"startup_parameters"`
+	// bounds the notices and notifications forwarded to each of the entry's clients
+	AsyncMessageLimit *AsyncMessageLimit `json:"async_message_limit"`
+	// bounds how many of the entry's upstream connections are opened at once, unlimited if unset
+	DialLimit *DialLimit `json:"dial_limit"`
+	// "session" (the default), "transaction" or "statement", see PoolModeSession,
+	// PoolModeTransaction and PoolModeStatement
+	PoolMode string `json:"pool_mode"`
+	// number of upstream connections per target to keep open and ready at all times.  Entries with
+	// a min_pool_size return upstream connections to a pool when client sessions end, instead of
+	// closing them.
+	MinPoolSize int `json:"min_pool_size"`
+	// pool size, reserve and client limits for the entry
+	Pool *PoolConfig `json:"pool"`
+	// query run on pooled connections when a session ends, before the connection is reused.
+	// Defaults to DefaultServerResetQuery, set to "" to disable.
+	ServerResetQuery *string `json:"server_reset_query"`
+	// query run on the upstream to look up the stored password of a client, which must then
+	// authenticate to the proxy with it.  Gets the user name as $1 and returns the user's
+	// pg_authid.rolpassword in its last column, e.g.
+	// "SELECT usename, passwd FROM pg_shadow WHERE usename = $1".  Clients are trusted if unset.
+	AuthQuery string `json:"auth_query"`
+	// how clients of the entry authenticate instead of a stored password, see AuthLDAP and AuthJWT
+	Auth string `json:"auth"`
+	// when and how much users may use the entry, unrestricted if unset
+	Policy *AccessPolicy `json:"policy"`
+	// SQLSTATEs (or classes of them) after which an upstream connection is closed rather than
+	// pooled, e.g. "25006" for a primary that became a read-only replica.  Connections whose
+	// backend ended with a FATAL or PANIC error are never pooled.
+	RecycleOnError []string `json:"recycle_on_error"`
+	// pool, timeout and policy settings for specific users of the entry
+	Overrides []ConfigOverride `json:"overrides"`
+
+	// 1 + the index of the override applied to the entry by forUser, 0 if none
+	override int
+	// what the entry's placeholders were rendered as by forClient, empty if it has none
+	rendered string
+}
+
+// Identifies the pool (and other per-upstream state) of a target of the entry: users with an
+// override and clients whose upstream settings render differently get pools of their own
+func (e *ConfigEntry) poolKey(target ConfigTarget) string {
+	return e.Name + "\x00" + strconv.Itoa(e.override) + "\x00" + e.rendered + "\x00" + target.Name
+}
+
+// Values for ConfigEntry.Auth
+const (
+	// clients send their password in cleartext, and the proxy checks it with an LDAP bind
+	AuthLDAP = "ldap"
+	// clients send a JWT as their password, and the proxy checks its signature and claims
+	AuthJWT = "jwt"
+)
+
+type LDAPConfig struct {
+	auth.LDAP
+	// bounds each login, defaults to auth.DefaultLDAPTimeout
+	Timeout Duration `json:"timeout"`
+}
+
+func (c *LDAPConfig) Authenticator() *auth.LDAP {
+	if c == nil {
+		return nil
+	}
+
+	ldap := c.LDAP
+	ldap.Timeout = time.Duration(c.Timeout)
+	return &ldap
+}
+
+type JWTConfig struct {
+	auth.JWT
+	// how often to refetch the JWKS, defaults to auth.DefaultJWKSRefreshInterval
+	RefreshInterval Duration `json:"refresh_interval"`
+}
+
+func (c *JWTConfig) Verifier() *auth.JWTVerifier {
+	if c == nil {
+		return nil
+	}
+
+	jwt := c.JWT
+	jwt.RefreshInterval = time.Duration(c.RefreshInterval)
+	return auth.NewJWTVerifier(jwt)
+}
+
+type AdmissionWebhookConfig struct {
+	admission.Webhook
+	// bounds each callout, defaults to admission.DefaultWebhookTimeout
+	Timeout Duration `json:"timeout"`
+}
+
+func (c *AdmissionWebhookConfig) Build() *admission.Webhook {
+	if c == nil {
+		return nil
+	}
+
+	webhook := c.Webhook
+	webhook.Timeout = time.Duration(c.Timeout)
+	return admission.NewWebhook(webhook)
+}
+
+type ContentionAlertsConfig struct {
+	contention.Config
+	// defaults to contention.DefaultWindow
+	Window Duration `json:"window"`
+	// defaults to contention.DefaultCooldown
+	Cooldown Duration `json:"cooldown"`
+}
+
+func (c *ContentionAlertsConfig) Build() *contention.Config {
+	if c == nil {
+		return nil
+	}
+
+	config := c.Config
+	config.Window, config.Cooldown = time.Duration(c.Window), time.Duration(c.Cooldown)
+	return &config
+}
+
+type SlowQueriesConfig struct {
+	slowlog.Config
+	Threshold Duration `json:"threshold"`
+	// defaults to slowlog.DefaultExplainInterval
+	ExplainInterval Duration `json:"explain_interval"`
+	// defaults to slowlog.DefaultExplainTimeout
+	ExplainTimeout Duration `json:"explain_timeout"`
+}
+
+func (c *SlowQueriesConfig) Build() *slowlog.Config {
+	if c == nil {
+		return nil
+	}
+
+	config := c.Config
+	config.Threshold = time.Duration(c.Threshold)
+	config.ExplainInterval, config.ExplainTimeout = time.Duration(c.ExplainInterval), time.Duration(c.ExplainTimeout)
+	return &config
+}
+
+type ExportConfig struct {
+	export.Config
+	// how long a record may wait for its batch to fill, defaults to export.DefaultFlushInterval
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+func (c *ExportConfig) Build() *export.Config {
+	if c == nil {
+		return nil
+	}
+
+	config := c.Config
+	config.FlushInterval = time.Duration(c.FlushInterval)
+	return &config
+}
+
+type StatsdConfig struct {
+	metrics.StatsdConfig
+	// how often to push, defaults to metrics.DefaultStatsdInterval
+	Interval Duration `json:"interval"`
+}
+
+func (c *StatsdConfig) Build() *metrics.StatsdConfig {
+	if c == nil {
+		return nil
+	}
+
+	config := c.StatsdConfig
+	config.Interval = time.Duration(c.Interval)
+	return &config
+}
+
+type LifecycleConfig struct {
+	ShutdownDelay   Duration     `json:"shutdown_delay"`
+	ShutdownTimeout Duration     `json:"shutdown_timeout"`
+	Lease           *LeaseConfig `json:"lease"`
+}
+
+type LeaseConfig struct {
+	lifecycle.LeaseConfig
+	Duration      Duration `json:"duration"`
+	RenewInterval Duration `json:"renew_interval"`
+}
+
+// Returns how to shut down and the lease to compete for, nil if none
+func (c *LifecycleConfig) Build() (lifecycle.ShutdownConfig, *lifecycle.LeaseConfig) {
+	if c == nil {
+		return lifecycle.ShutdownConfig{}, nil
+	}
+
+	shutdown := lifecycle.ShutdownConfig{Delay: time.Duration(c.ShutdownDelay), Timeout: time.Duration(c.ShutdownTimeout)}
+	if c.Lease == nil {
+		return shutdown, nil
+	}
+
+	lease := c.Lease.LeaseConfig
+	lease.Duration, lease.RenewInterval = time.Duration(c.Lease.Duration), time.Duration(c.Lease.RenewInterval)
+	return shutdown, &lease
+}
+
+// Rewrites the identity the proxy presents to the upstream, so that e.g. clients can connect to
+// `app` while the upstream database is actually `app_prod_v2`.  Empty fields leave whatever the
+// provider returned untouched.
+type ConfigRewrite struct {
+	Database string `json:"database"`
+	User     string `json:"user"`
+	// the schema clients are confined to, so that one client-visible database can serve a schema
+	// per tenant: the search_path of upstream connections is set to it, and statements that name
+	// other schemas or change the search_path are refused (see CheckSchema).  Case sensitive, like
+	// a quoted identifier.
+	Schema string `json:"schema"`
+}
+
+func (r ConfigRewrite) apply(config *pgx.ConnConfig) {
+	if r.Database != "" {
+		config.Database = r.Database
+	}
+
+	if r.User != "" {
+		config.User = r.User
+	}
+
+	if r.Schema != "" {
+		config.RuntimeParams["search_path"] = pgx.Identifier{r.Schema}.Sanitize()
+	}
+}
+
+func ReadConfigFromFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{Listen: DefaultListenAddr}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err = json.Unmarshal(data, &config); err != nil {
+			return nil, err
+		}
+	}
+	if config.Entries, err = readEntries(path, data, nil, nil); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(config.Entries))
+	for _, entry := range config.Entries {
+		if entry.Name != "" && names[entry.Name] {
+			return nil, fmt.Errorf("entry %s is defined more than once", entry.Name)
+		}
+		names[entry.Name] = true
+
+		if err := config.validateEntry(&entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = config.StartupNotice.validate(); err != nil {
+		return nil, fmt.Errorf("invalid startup_notice: %w", err)
+	}
+	if err = config.validateListeners(); err != nil {
+		return nil, err
+	}
+	if config.ClientEngine != "" && config.ClientEngine != ClientEngineGoroutines && config.ClientEngine != ClientEngineEpoll {
+		return nil, fmt.Errorf("unknown client_engine %q", config.ClientEngine)
+	}
+	if config.MaxProtocolAnomalies < 0 {
+		return nil, errors.New("max_protocol_anomalies can't be negative")
+	}
+	if config.SlowQueries != nil && config.SlowQueries.Threshold <= 0 {
+		return nil, errors.New("slow_queries needs a threshold")
+	}
+
+	return &config, nil
+}
+
+// Checks an entry, as read from the config file or added through the admin API
+func (c *Config) validateEntry(entry *ConfigEntry) error {
+	switch entry.Auth {
+	case "":
+	case AuthLDAP:
+		if c.LDAP == nil {
+			return fmt.Errorf("entry %s uses LDAP authentication, but no ldap server is configured", entry.Name)
+		}
+	case AuthJWT:
+		if c.JWT == nil || c.JWT.JWKSURL == "" {
+			return fmt.Errorf("entry %s uses JWT authentication, but no jwt.jwks_url is configured", entry.Name)
+		}
+	default:
+		return fmt.Errorf("entry %s has unknown auth method %q", entry.Name, entry.Auth)
+	}
+
+	if entry.Tunnel != nil {
+		if _, err := entry.Tunnel.dialer(); err != nil {
+			return fmt.Errorf("entry %s has an invalid tunnel: %w", entry.Name, err)
+		}
+	}
+
+	if entry.Reconnect && entry.sharesConnections() {
+		return fmt.Errorf("entry %s can only reconnect sessions in session pooling mode", entry.Name)
+	}
+
+	if entry.LazyConnect && entry.AuthQuery != "" {
+		return fmt.Errorf("entry %s can't use lazy_connect with auth_query, which runs on the upstream during startup", entry.Name)
+	}
+
+	names := make(map[string]bool)
+	for _, t := range entry.AllTargets() {
+		if t.Provider != "" && getProvider(t.Provider) == nil {
+			return fmt.Errorf("entry %s uses unknown provider %q", entry.Name, t.Provider)
+		}
+		if len(entry.Targets) > 0 && t.Name == "" {
+			return fmt.Errorf("entry %s has a target without a name", entry.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("entry %s has more than one target named %q", entry.Name, t.Name)
+		}
+		names[t.Name] = true
+		if t.Weight != nil && *t.Weight < 0 {
+			return fmt.Errorf("target %s of entry %s has a negative weight", t.Name, entry.Name)
+		}
+	}
+
+	if entry.ProviderCache != nil && entry.ProviderCache.TTL <= 0 {
+		return fmt.Errorf("entry %s has a provider_cache without a ttl", entry.Name)
+	}
+
+	if entry.DialLimit != nil {
+		if err := entry.DialLimit.validate(); err != nil {
+			return fmt.Errorf("entry %s has an invalid dial_limit: %w", entry.Name, err)
+		}
+	}
+
+	if entry.Maintenance != nil {
+		if err := entry.Maintenance.validate(); err != nil {
+			return fmt.Errorf("entry %s has an invalid maintenance: %w", entry.Name, err)
+		}
+	}
+
+	if entry.AsyncMessageLimit != nil {
+		if err := entry.AsyncMessageLimit.validate(); err != nil {
+			return fmt.Errorf("entry %s has an invalid async_message_limit: %w", entry.Name, err)
+		}
+	}
+
+	if entry.Tenancy != nil {
+		if err := entry.Tenancy.validate(); err != nil {
+			return fmt.Errorf("entry %s has an invalid tenancy: %w", entry.Name, err)
+		}
+	}
+
+	if err := validateRecycleOnError(entry.RecycleOnError); err != nil {
+		return fmt.Errorf("entry %s has an invalid recycle_on_error: %w", entry.Name, err)
+	}
+
+	if err := entry.validate(); err != nil {
+		return fmt.Errorf("entry %s has %w", entry.Name, err)
+	}
+	if err := entry.validateTemplates(); err != nil {
+		return fmt.Errorf("entry %s: %w", entry.Name, err)
+	}
+	if err := entry.validateOverrides(); err != nil {
+		return fmt.Errorf("entry %s has an invalid %w", entry.Name, err)
+	}
+
+	for key, value := range entry.ServerParameters {
+		if key == "" {
+			return fmt.Errorf("entry %s has a server parameter without a name", entry.Name)
+		}
+		// upstream connections are always UTF8, and the proxy doesn't convert
+		if strings.EqualFold(key, "client_encoding") && !strings.EqualFold(value, "UTF8") {
+			return fmt.Errorf("entry %s can only advertise client_encoding UTF8", entry.Name)
+		}
+	}
+
+	if err := entry.StartupNotice.validate(); err != nil {
+		return fmt.Errorf("entry %s has an invalid startup_notice: %w", entry.Name, err)
+	}
+	if err := validateLabels(entry.Labels); err != nil {
+		return fmt.Errorf("entry %s has an %w", entry.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package remote
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/jsonschema"
+)
+
+func readTestConfig(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return ReadConfigFromFile(path)
+}
+
+func TestListeners(t *testing.T) {
+	config, err := readTestConfig(t, `{
+		"listeners": [
+			{"name": "app", "listen": "127.0.0.1:5433"},
+			{"name": "readonly", "listen": "/tmp/.s.PGSQL.5434", "entries": ["replica"]}
+		],
+		"entries": [{"name": "primary"}, {"name": "replica"}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := config.AllListeners()
+	if len(listeners) != 2 || listeners[0].Unix() || !listeners[1].Unix() {
+		t.Fatalf("expected a TCP and a Unix socket listener, got %+v", listeners)
+	}
+	if scoped := listeners[0].Scope(config.Entries); len(scoped) != 2 {
+		t.Errorf("expected the app listener to reach every entry, got %+v", scoped)
+	}
+	if scoped := listeners[1].Scope(config.Entries); len(scoped) != 1 || scoped[0].Name != "replica" {
+		t.Errorf("expected the readonly listener to only reach the replica, got %+v", scoped)
+	}
+
+	config, err = readTestConfig(t, `{"entries": [{"name": "primary"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listeners := config.AllListeners(); len(listeners) != 1 || listeners[0].Listen != DefaultListenAddr {
+		t.Errorf("expected a single listener on %s, got %+v", DefaultListenAddr, listeners)
+	}
+
+	_, err = readTestConfig(t, `{"listeners": [{"name": "ro", "listen": ":5434", "entries": ["nope"]}], "entries": []}`)
+	if err == nil || !strings.Contains(err.Error(), "unknown entry nope") {
+		t.Errorf("expected an unknown entry error, got %v", err)
+	}
+
+	config, err = readTestConfig(t, `{"acceptors": "cpus", "listeners": [{"name": "app", "listen": ":5433", "acceptors": 4}], "entries": []}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Acceptors.Count() != runtime.NumCPU() || config.AllListeners()[0].Acceptors.Count() != 4 {
+		t.Errorf("unexpected acceptors %d and %d", config.Acceptors.Count(), config.AllListeners()[0].Acceptors.Count())
+	}
+	_, err = readTestConfig(t, `{"listen": "/tmp/.s.PGSQL.5433", "acceptors": 2, "entries": []}`)
+	if err == nil || !strings.Contains(err.Error(), "only have one acceptor") {
+		t.Errorf("expected a Unix socket with several acceptors to be refused, got %v", err)
+	}
+	_, err = readTestConfig(t, `{"acceptors": -1, "entries": []}`)
+	if err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Errorf("expected negative acceptors to be refused, got %v", err)
+	}
+}
+
+func TestStartupNotice(t *testing.T) {
+	const upstream = "10.0.0.5:5432"
+	for _, tt := range []struct {
+		notice *StartupNotice
+		text   string
+	}{
+		{nil, "PGPROXY: proxy successfully connected through to remote at: 10.0.0.5:5432"},
+		{&StartupNotice{Disable: true}, ""},
+		{&StartupNotice{HideUpstream: true}, "PGPROXY: proxy successfully connected through to remote"},
+		{&StartupNotice{Message: "connected to {upstream}"}, "connected to 10.0.0.5:5432"},
+		{&StartupNotice{Message: "welcome", HideUpstream: true}, "welcome"},
+	} {
+		if text := tt.notice.Text(upstream); text != tt.text {
+			t.Errorf("expected %+v to give %q, got %q", tt.notice, tt.text, text)
+		}
+	}
+
+	_, err := readTestConfig(t, `{
+		"startup_notice": {"message": "via {upstream}", "hide_upstream": true},
+		"entries": []
+	}`)
+	if err == nil {
+		t.Error("expected a message showing the upstream that hide_upstream hides to be rejected")
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json": `{
+			"defaults": {"pool_mode": "transaction", "connect_timeout": "2s"},
+			"include": ["entries.d/*.json", "legacy.json"],
+			"entries": [{"name": "main"}]
+		}`,
+		"entries.d/b.json": `{"entries": [{"name": "b", "pool_mode": "session"}]}`,
+		"entries.d/a.json": `{"defaults": {"connect_timeout": "5s"}, "entries": [{"name": "a"}]}`,
+		"legacy.json":      `[{"name": "legacy"}]`,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := ReadConfigFromFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range config.Entries {
+		names = append(names, e.Name)
+	}
+	if strings.Join(names, ",") != "main,a,b,legacy" {
+		t.Fatalf("expected entries in include order, got %v", names)
+	}
+	for _, tt := range []struct {
+		mode    string
+		timeout time.Duration
+	}{
+		{PoolModeTransaction, 2 * time.Second},
+		{PoolModeTransaction, 5 * time.Second},
+		{PoolModeSession, 2 * time.Second},
+		{PoolModeTransaction, 2 * time.Second},
+	} {
+		e := config.Entries[0]
+		config.Entries = config.Entries[1:]
+		if e.poolMode() != tt.mode || e.connectTimeout() != tt.timeout {
+			t.Errorf("expected %s to have pool_mode %s and connect_timeout %s, got %s and %s", e.Name, tt.mode, tt.timeout, e.poolMode(), e.connectTimeout())
+		}
+	}
+
+	for _, tt := range []struct{ config, err string }{
+		{`{"include": ["config.json"]}`, "include cycle"},
+		{`{"include": ["missing.json"]}`, "does not exist"},
+		{`{"include": ["legacy.json"], "entries": [{"name": "legacy"}]}`, "more than once"},
+		{`{"defaults": {"name": "x"}}`, "name"},
+		{`{"defaults": {"pool_mode": "connection"}, "entries": [{"name": "main"}]}`, "unknown pool_mode"},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(tt.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ReadConfigFromFile(filepath.Join(dir, "config.json"))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("expected %s to be rejected with %q, got %v", tt.config, tt.err, err)
+		}
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	defs := ConfigSchema()["$defs"].(jsonschema.Schema)
+	file := defs["schemaFile"].(jsonschema.Schema)["properties"].(jsonschema.Schema)
+	entry := defs["ConfigEntry"].(jsonschema.Schema)["properties"].(jsonschema.Schema)
+
+	for _, key := range []string{"listeners", "include", "defaults", "entries"} {
+		if file[key] == nil {
+			t.Errorf("expected config files to accept %s", key)
+		}
+	}
+
+	// the example config only uses settings the schema knows about
+	data, err := os.ReadFile("../../config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]any
+	if err = json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		for key := range e {
+			if entry[key] == nil {
+				t.Errorf("expected entries to accept %s", key)
+			}
+		}
+	}
+}
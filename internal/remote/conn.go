@@ -2,117 +2,1037 @@ package remote
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net"
-	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/auth"
 	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
 )
 
-var AssociatedClients = make(map[net.Conn]*pgx.Conn)
+// How long to wait for an upstream connection (including its startup handshake) unless the entry
+// configures connect_timeout
+const DefaultConnectTimeout = 10 * time.Second
 
-func GetOrAllocConnection(client net.Conn, configs []ConfigEntry, params *codec.ConnectionParams) (remote net.Conn, err error) {
+var ErrConnectTimeout = errors.New("timed out connecting to upstream")
+
+// Whether the session has no request in flight and is not in a transaction, i.e. its upstream
+// connection could be handed to another client
+func (a *association) idle() bool {
+	return a.pending == 0 && !a.unsynced && a.txStatus == codec.BackendTransactionStatusIdle
+}
+
+func (e *ConfigEntry) connectTimeout() time.Duration {
+	if e.ConnectTimeout > 0 {
+		return time.Duration(e.ConnectTimeout)
+	}
+
+	return DefaultConnectTimeout
+}
+
+const (
+	// a client keeps its upstream connection for its whole session
+	PoolModeSession = "session"
+	// a client only holds an upstream connection while it is in a transaction, unless it changes
+	// session state that ties it to that connection (see Pin)
+	PoolModeTransaction = "transaction"
+	// like transaction pooling, but clients may not open transaction blocks, so that connections
+	// go back to the pool after every request (see CheckStatementPooling)
+	PoolModeStatement = "statement"
+)
+
+func (e *ConfigEntry) poolMode() string {
+	switch {
+	case e.PoolMode != "":
+		return e.PoolMode
+	case e.Pool != nil && e.Pool.PoolMode != "":
+		return e.Pool.PoolMode
+	default:
+		return PoolModeSession
+	}
+}
+
+// Whether clients of the entry only hold an upstream connection while they need one, i.e. it uses
+// transaction or statement pooling
+func (e *ConfigEntry) sharesConnections() bool {
+	return e.poolMode() == PoolModeTransaction || e.poolMode() == PoolModeStatement
+}
+
+// Whether upstream connections for the entry go back to a pool rather than being closed
+func (e *ConfigEntry) pooled() bool {
+	return e.MinPoolSize > 0 || e.Pool.size() > 0 || e.sharesConnections()
+}
+
+var sessionPins = metrics.NewCounterVec(
+	"pgproxy_session_pins_total", "Sessions pinned to their upstream connection in transaction pooling mode.", "entry", "reason",
+)
+
+// Sessions by entry, database and the upstream host they started on
+var (
+	clientSessions = metrics.NewGaugeVec(
+		"pgproxy_client_sessions", "Client sessions currently open.", "entry", "database", "upstream",
+	)
+	clientSessionsStarted = metrics.NewCounterVec(
+		"pgproxy_client_sessions_total", "Client sessions started.", "entry", "database", "upstream",
+	)
+)
+
+// The upstream side of a client session
+type association struct {
+	client  net.Conn
+	session string
+	// the entry the client matched, and what we need to pick a target for it
+	config          *ConfigEntry
+	entry           string
+	user            string
+	database        string
+	applicationName string
+	// the client's startup parameters forwarded to its upstream connections, see StartupParameters
+	parameters map[string]string
+	// the `replication` startup parameter sent upstream, empty for regular sessions
+	replication string
+	// host of the upstream connection the session started on, for metrics
+	upstream string
+	// when the session started, and its traffic counters (see SessionTraffic)
+	started time.Time
+	traffic *Traffic
+	// counters of the entry, and when the current request and transaction started
+	stats            *entryStats
+	requestStart     time.Time
+	transactionStart time.Time
+	// when the session started waiting for an upstream connection, zero if it isn't waiting
+	waitingSince time.Time
+	// when the session last went from idle to active or back, like pg_stat_activity's
+	// state_change
+	stateChange time.Time
+	// protocol anomalies in what the client or its upstream sent, see ProtocolAnomaly
+	anomalies int
+	// whether the session started while its entry was in maintenance, see ServeMaintenance
+	maintenance bool
+	// notices and notifications not forwarded to the client, see DropAsyncMessage
+	asyncDropped int
+	// whether the client authenticated and was let in by the entry's access policy, i.e. counts
+	// towards its user's session limit
+	admitted bool
+	// what the entry's templates are rendered with once the client authenticated, see
+	// ConnectClient
+	startup  codec.ConnectionParams
+	captures map[string]string
+	// the claims of the token the client authenticated with, see SetClaims
+	claims map[string]string
+	// whether the session got through startup and is counted in the session metrics
+	counted bool
+
+	// the current upstream connection.  In transaction pooling mode this is only set while the
+	// client is in a transaction.
+	conn   *pgx.Conn
+	target string
+	// the pool the connection goes back to, nil if the entry isn't pooled
+	pool *pool
+	// whether the connection must be closed rather than pooled, see UpstreamError
+	discard bool
+
+	// the number of requests (Query, Sync or FunctionCall messages) forwarded to the upstream whose
+	// ReadyForQuery we haven't seen yet.  Pipelining clients can have many in flight at once.
+	pending int
+	// whether the client has sent extended protocol messages (Parse, Bind, ...) that aren't
+	// followed by a Sync yet
+	unsynced bool
+	// transaction status from the last ReadyForQuery the upstream sent
+	txStatus codec.BackendTransactionStatus
+	// why the session is tied to its upstream connection in transaction pooling mode, empty if it
+	// isn't
+	pinned string
+	// the session state to set up again on a new upstream connection, nil unless the entry
+	// reconnects (see Reconnect)
+	replay *sessionState
+	// closed once the session is reconnected, nil unless it is being reconnected
+	reconnecting chan struct{}
+}
+
+// Upstream connections by client connection.  The lock also guards the mutable fields of every
+// association and the entry pause gates (see cutover.go).
+var associations = struct {
+	sync.Mutex
+	m map[net.Conn]*association
+}{m: make(map[net.Conn]*association)}
+
+// Returns the upstream connection of a client that got through startup, nil if it has none (see
+// ConfigEntry.LazyConnect).  With `params`, routes a new client and connects it in one go instead
+// (see RouteClient and ConnectClient).
+func GetOrAllocConnection(client net.Conn, sessionID string, configs []ConfigEntry, params *codec.ConnectionParams) (remote net.Conn, err error) {
 
 	if params == nil {
-		remote := AssociatedClients[client]
+		associations.Lock()
+		defer associations.Unlock()
+
+		remote := associations.m[client]
 		if remote == nil {
 			return nil, errors.New("no associated client")
 		}
+		if remote.conn == nil {
+			// connected lazily, see ConfigEntry.LazyConnect
+			return nil, nil
+		}
 
-		return remote.PgConn().Conn(), nil
+		return remote.conn.PgConn().Conn(), nil
 	}
 
-	var entry *ConfigEntry = nil
-	for _, e := range configs {
-		if e.Match.Database == (*params)["database"] {
-			entry = &e
+	if err = RouteClient(client, sessionID, configs, *params); err != nil {
+		return nil, err
+	}
+	return ConnectClient(client)
+}
+
+// Routes a new client to the entry it matches and registers its session, without giving it an
+// upstream connection yet, so that clients don't hold one before they authenticate (see
+// ConnectClient).  Returns a *PolicyError for a client the entry turns away.
+func RouteClient(client net.Conn, sessionID string, configs []ConfigEntry, params codec.ConnectionParams) error {
+	// already checked along with the startup message
+	options, _ := codec.ParseOptions(params["options"])
+
+	entry, captures := matchEntry(configs, client, params, options, false)
+	if slices.ContainsFunc(configs, func(e ConfigEntry) bool { return e.Shadow }) {
+		if shadow, _ := matchEntry(configs, client, params, options, true); shadow != nil && shadow.Shadow {
+			shadowRouted(entry, shadow, params)
 		}
 	}
 
 	if entry == nil {
-		return nil, fmt.Errorf("could not match against database=%s", (*params)["database"])
+		return fmt.Errorf("could not match against database=%s", params["database"])
+	}
+	entry = entry.forUser(params["user"])
+
+	now := time.Now()
+	a := &association{
+		client:          client,
+		session:         sessionID,
+		config:          entry,
+		entry:           entry.Name,
+		user:            params["user"],
+		database:        params["database"],
+		applicationName: upstreamApplicationName(entry.StartupParameters.applicationName(params["application_name"]), client.RemoteAddr(), sessionID),
+		parameters:      entry.StartupParameters.forwarded(params, options),
+		replication:     replicationMode(params),
+		txStatus:        codec.BackendTransactionStatusIdle,
+		stats:           statsFor(entry.Name, entry.Match.Database),
+		started:         now,
+		stateChange:     now,
+		startup:         params,
+		captures:        captures,
+	}
+	if entry.Reconnect {
+		a.replay = &sessionState{}
+	}
+	if entry.Guardrails != nil && entry.Guardrails.Enforce {
+		// clients may not raise the timeouts at startup either
+		for name := range entry.Guardrails.limits() {
+			delete(a.parameters, name)
+		}
+	}
+
+	var err error
+	if a.maintenance, err = checkMaintenance(a); err != nil {
+		return err
+	}
+
+	associations.Lock()
+	defer associations.Unlock()
+	if limit := entry.Pool.maxClientConn(a.user); limit > 0 && entrySessions(entry) >= limit {
+		return &PolicyError{
+			Code:    codec.SQLStateTooManyConnections,
+			Message: fmt.Sprintf("too many client connections for %s", entry.Name),
+		}
 	}
+	associations.m[client] = a
+	return nil
+}
+
+// Renders the entry's templates for a routed client (see RouteClient) and gives it an upstream
+// connection, unless the entry connects lazily or is in maintenance.  Returns the connection the
+// client already has if it was connected before.  The client's session is dropped if it can't be
+// connected.
+func ConnectClient(client net.Conn) (net.Conn, error) {
+	associations.Lock()
+	a := associations.m[client]
+	associations.Unlock()
 
-	provider := getProvider(entry.Provider)
-	if provider == nil {
-		return nil, fmt.Errorf("could not identify auth provider for type %s", entry.Provider)
+	if a == nil {
+		return nil, errors.New("no associated client")
+	}
+	if a.counted {
+		if a.conn == nil {
+			return nil, nil
+		}
+		return a.conn.PgConn().Conn(), nil
 	}
 
-	conn, err := provider.GetConnection(entry.ProviderMeta)
+	drop := func() {
+		associations.Lock()
+		delete(associations.m, client)
+		associations.Unlock()
+	}
+
+	entry, err := a.config.forClient(a.startup, a.captures, a.claims)
 	if err != nil {
+		drop()
 		return nil, err
 	}
+	associations.Lock()
+	a.config = entry
+	associations.Unlock()
+
+	if a.maintenance {
+		// answered by the proxy, see ServeMaintenance
+		a.countSession()
+		return nil, nil
+	}
 
-	AssociatedClients[client] = conn
-	return AssociatedClients[client].PgConn().Conn(), nil
+	if entry.LazyConnect && a.replication == "" {
+		// the relay attaches the session once the client sends its first message
+		a.countSession()
+		return nil, nil
+	}
+
+	// even in transaction pooling mode we take a connection during startup, so that clients find
+	// out straight away if their upstream is unreachable
+	if err := attach(a); err != nil {
+		drop()
+		return nil, err
+	}
+
+	associations.Lock()
+	a.upstream = a.conn.Config().Host
+	associations.Unlock()
+	a.countSession()
+
+	return a.conn.PgConn().Conn(), nil
 }
 
-func Cleanup(client net.Conn) error {
-	remote := AssociatedClients[client]
-	if remote == nil {
-		return errors.New("no associated client")
+// The entry a client is routed to: the last that matches, unless an earlier one matched through
+// the client's options.  Shadow entries are only considered if `shadow` is set.
+func matchEntry(configs []ConfigEntry, client net.Conn, params codec.ConnectionParams, options map[string]string, shadow bool) (*ConfigEntry, map[string]string) {
+	var entry *ConfigEntry
+	var captures map[string]string
+	for _, e := range configs {
+		if e.Shadow && !shadow {
+			continue
+		}
+		if e.Match.Database != params["database"] || !e.Match.matchesClientCert(client) || !e.Match.matchesOptions(options) {
+			continue
+		}
+		userCaptures, ok := e.Match.matchUser(params["user"])
+		if !ok {
+			continue
+		}
+		// a client that picked an entry through its options gets it, whatever comes after
+		if entry != nil && len(entry.Match.Options) > 0 && len(e.Match.Options) == 0 {
+			continue
+		}
+		entry, captures = &e, userCaptures
 	}
 
-	return remote.Close(context.Background())
+	return entry, captures
 }
 
-type ConfigMatch struct {
-	// for now just match on the database of the connection params
-	Database string `json:"database"`
+// Counts a session that got through startup
+func (a *association) countSession() {
+	a.counted = true
+	clientSessions.With(a.entry, a.database, a.upstream).Inc()
+	clientSessionsStarted.With(a.entry, a.database, a.upstream).Inc()
+	a.stats.sessions.Add(1)
 }
 
-type ConfigEntry struct {
-	// human readable identifier for the entry
-	Name string `json:"name"`
-	// how to identify the connection based on params
-	Match ConfigMatch `json:"match"`
-	// what type to cast provider meta to
-	Provider string `json:"provider"`
-	// some kind data used by the provider
-	ProviderMeta map[string]string `json:"provider_meta"`
+// Gives a session an upstream connection, taken from the pool if the entry is pooled
+func attach(a *association) (err error) {
+	start := time.Now()
+	associations.Lock()
+	a.waitingSince = start
+	associations.Unlock()
+	defer func() {
+		associations.Lock()
+		a.waitingSince = time.Time{}
+		associations.Unlock()
+		if err == nil {
+			a.stats.waits.Inc()
+			a.stats.waitTime.Add(uint64(time.Since(start).Microseconds()))
+		}
+	}()
+
+	waitWhilePaused(a.entry)
+
+	target, err := a.config.selectTarget(a.user, a.database, a.client.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	slog.Debug("selected target for client", "entry", a.entry, "target", target.Name)
+	acquireStart := time.Now()
+	defer func() { countAcquire(a.entry, target.Name, time.Since(acquireStart), err) }()
+
+	var conn *pgx.Conn
+	var p *pool
+	// replication connections can't run regular queries, so they never come from or go back to a
+	// pool
+	if a.config.pooled() && a.replication == "" {
+		p = getPool(a.config, target)
+
+		// in transaction pooling mode clients switch connections all the time, so don't pay for
+		// re-tagging the connection each time
+		tag := a.applicationName
+		if a.config.sharesConnections() {
+			tag = ""
+		}
+		conn, err = p.get(tag, a.applicationName, a.user)
+		if err == nil && len(a.parameters) > 0 {
+			if err = setParameters(conn, a.parameters, a.config.connectTimeout()); err != nil {
+				p.returned(conn)
+				conn.Close(context.Background())
+				p.closed()
+			}
+		}
+	} else {
+		conn, err = connect(a.config, target, a.applicationName, a.replication, a.parameters)
+	}
+	if err != nil {
+		return err
+	}
+
+	associations.Lock()
+	a.conn, a.target, a.pool = conn, target.Name, p
+	associations.Unlock()
+
+	return nil
 }
 
-type ConfigProvider interface {
-	GetConnection(metadata map[string]string) (*pgx.Conn, error)
+// Whether the client's entry uses transaction (or statement) pooling, in which case the relay must
+// Attach before forwarding client messages and Detach once the client is idle
+func IsTransactionPooled(client net.Conn) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	return a != nil && a.replication == "" && a.config.sharesConnections()
 }
 
-type StaticProvider struct{}
+// The value to send upstream as the `replication` startup parameter for a client, empty if the
+// client wants a regular session.  `database=replication` is how physical replication is spelled
+// in pg_hba.conf, so we treat it the same as `replication=true`.
+func replicationMode(params codec.ConnectionParams) string {
+	// invalid values were refused along with the startup message
+	mode, _ := codec.ParseReplication(params["replication"])
+	if mode == codec.ReplicationNone && params["database"] == "replication" {
+		mode = codec.ReplicationPhysical
+	}
+
+	return string(mode)
+}
 
-func (p StaticProvider) GetConnection(metadata map[string]string) (*pgx.Conn, error) {
-	url := metadata["url"]
-	if len(url) == 0 {
-		return nil, errors.New("not able to find required 'url' key on provider_meta")
+// Called once a client authenticated with a token, whose claims the entry's templates may then use
+// (see ConnectClient)
+func SetClaims(client net.Conn, claims map[string]any) {
+	associations.Lock()
+	defer associations.Unlock()
+
+	if a := associations.m[client]; a != nil {
+		a.claims = claimValues(claims)
 	}
+}
 
-	slog.Info("StaticProvider: getting new connection from url", "url", url)
+// Whether a client's credential is looked up with the auth_query of its entry, on an upstream
+// connection it must be given (see ConnectClient) before it authenticates
+func AuthQueryClient(client net.Conn) bool {
+	associations.Lock()
+	defer associations.Unlock()
 
-	return pgx.Connect(context.Background(), url)
+	a := associations.m[client]
+	return a != nil && a.config.AuthQuery != ""
 }
 
-func getProvider(typ string) ConfigProvider {
-	switch typ {
-	case "static":
-		return StaticProvider{}
-	default:
+// Looks up the credential a client must authenticate with, using the auth_query of its entry on
+// the upstream connection it was given.  `required` is false if the entry doesn't authenticate
+// clients.  A nil credential with `required` set means the user is unknown.
+func ClientCredential(client net.Conn, user string) (credential *auth.Credential, required bool, err error) {
+	associations.Lock()
+	a := associations.m[client]
+	associations.Unlock()
+
+	if a == nil {
+		return nil, false, errors.New("no associated client")
+	}
+	if a.config.AuthQuery == "" {
+		return nil, false, nil
+	}
+	if a.conn == nil {
+		return nil, true, errors.New("no upstream connection to run auth_query on")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.connectTimeout())
+	defer cancel()
+
+	result := a.conn.PgConn().ExecParams(ctx, a.config.AuthQuery, [][]byte{[]byte(user)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return nil, true, fmt.Errorf("auth_query failed: %w", result.Err)
+	}
+
+	if len(result.Rows) == 0 {
+		return nil, true, nil
+	}
+	row := result.Rows[0]
+	if len(row) == 0 || row[len(row)-1] == nil {
+		return nil, true, nil
+	}
+
+	credential, err = auth.ParseCredential(string(row[len(row)-1]))
+	if err != nil {
+		slog.Warn("could not parse credential returned by auth_query", "entry", a.entry, "user", user, "error", err)
+		return nil, true, nil
+	}
+
+	return credential, true, nil
+}
+
+// The entry's `auth` method for a client, empty if the client authenticates with a stored password
+// (or not at all)
+func AuthMethod(client net.Conn) string {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
+		return ""
+	}
+
+	return a.config.Auth
+}
+
+// Who a client session is, for audit events
+type Identity struct {
+	Session  string
+	Entry    string
+	User     string
+	Database string
+	// the entry's labels
+	Labels map[string]string
+}
+
+// Returns the identity of a client session, empty if the client hasn't got past matching an entry
+func SessionIdentity(client net.Conn) Identity {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
+		return Identity{}
+	}
+
+	return Identity{Session: a.session, Entry: a.entry, User: a.user, Database: a.database, Labels: a.config.Labels}
+}
+
+// Returns the transaction status to report in the ReadyForQuery that ends the client's startup:
+// that of its upstream connection, which a pooled connection that wasn't reset properly may not
+// have left idle, or idle if it has none yet
+func StartupTransactionStatus(client net.Conn) codec.BackendTransactionStatus {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
+		return codec.BackendTransactionStatusIdle
+	}
+	if a.conn != nil {
+		switch status := codec.BackendTransactionStatus(a.conn.PgConn().TxStatus()); status {
+		case codec.BackendTransactionStatusIdle, codec.BackendTransactionStatusInTransaction, codec.BackendTransactionStatusFailed:
+			a.txStatus = status
+		}
+	}
+	return a.txStatus
+}
+
+// Returns the startup notice of the client's entry, nil if it has none of its own
+func EntryStartupNotice(client net.Conn) *StartupNotice {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
 		return nil
 	}
+	return a.config.StartupNotice
+}
+
+// Whether the client opened a replication session, whose traffic (CopyBoth and streamed WAL) the
+// relay must pass through untouched
+func IsReplication(client net.Conn) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	return a != nil && a.replication != ""
+}
+
+// A ParameterStatus the proxy sends a client at startup
+type ServerParameter struct {
+	Key, Value string
+}
+
+// Returns the server parameters to advertise to the client at startup, in order: client_encoding
+// and DateStyle, server_version and integer_datetimes as the upstream reported them for
+// replication sessions, and the entry's server_parameters, which take precedence
+func AdvertisedParameters(client net.Conn) []ServerParameter {
+	associations.Lock()
+	var configured map[string]string
+	replication := false
+	if a := associations.m[client]; a != nil {
+		configured, replication = a.config.ServerParameters, a.replication != ""
+	}
+	associations.Unlock()
+
+	params := []ServerParameter{{"client_encoding", "UTF8"}, {"DateStyle", "ISO"}}
+	if replication {
+		// replication clients check these before they start streaming
+		upstream := ServerParameters(client, "server_version", "integer_datetimes")
+		for _, key := range []string{"server_version", "integer_datetimes"} {
+			if value, ok := upstream[key]; ok {
+				params = append(params, ServerParameter{key, value})
+			}
+		}
+	}
+
+	for i, param := range params {
+		if value, ok := configured[param.Key]; ok {
+			params[i].Value = value
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(configured)) {
+		if !slices.ContainsFunc(params, func(p ServerParameter) bool { return p.Key == key }) {
+			params = append(params, ServerParameter{key, configured[key]})
+		}
+	}
+
+	return params
+}
+
+// Returns the values the client's upstream reported for the given server parameters, skipping any
+// it didn't report
+func ServerParameters(client net.Conn, keys ...string) map[string]string {
+	associations.Lock()
+	defer associations.Unlock()
+
+	values := make(map[string]string)
+	a := associations.m[client]
+	if a == nil || a.conn == nil {
+		return values
+	}
+
+	for _, key := range keys {
+		if value := a.conn.PgConn().ParameterStatus(key); value != "" {
+			values[key] = value
+		}
+	}
+
+	return values
+}
+
+// Transaction pooling mode: returns the client's upstream connection, taking one from the pool if
+// the client doesn't currently hold one.  `attached` is true if a new connection was taken.
+func Attach(client net.Conn) (remote net.Conn, attached bool, err error) {
+	associations.Lock()
+	a := associations.m[client]
+	associations.Unlock()
+
+	if a == nil {
+		return nil, false, errors.New("no associated client")
+	}
+
+	if a.conn != nil {
+		return a.conn.PgConn().Conn(), false, nil
+	}
+
+	if err := attach(a); err != nil {
+		return nil, false, err
+	}
+
+	return a.conn.PgConn().Conn(), true, nil
+}
+
+// Transaction pooling mode: whether the client can give up its upstream connection, i.e. it has
+// no request in flight, is not in a transaction, and is not pinned
+func CanDetach(client net.Conn) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	return a != nil && a.conn != nil && a.pinned == "" && a.idle()
+}
+
+// Transaction pooling mode: returns the client's upstream connection to the pool between
+// transactions.  `reusable` has the same meaning as for Release.
+func Detach(client net.Conn, reusable bool) {
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.conn == nil {
+		associations.Unlock()
+		return
+	}
+	conn, p, target := a.conn, a.pool, a.target
+	reusable = reusable && !a.discard
+	a.conn, a.target, a.pool, a.discard = nil, "", nil, false
+	associations.Unlock()
+
+	returnToPool(conn, p, a.entry, target, reusable, false)
+}
+
+// Transaction pooling mode: ties the client to its current upstream connection for the rest of the
+// session, because it changed session state (e.g. with SET or LISTEN) that the next client of the
+// connection must not see, and that this client would lose if it moved to another connection
+func Pin(client net.Conn, reason string) {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil || a.pinned != "" || !a.config.sharesConnections() {
+		return
+	}
+
+	a.pinned = reason
+	sessionPins.With(a.entry, reason).Inc()
+	slog.Info("pinning session to its upstream connection", "entry", a.entry, "target", a.target, "reason", reason)
+}
+
+// The config upstream connections to a target of an entry are dialed with, before the settings of
+// the client they are for
+func upstreamConfig(entry *ConfigEntry, target ConfigTarget) (*pgx.ConnConfig, error) {
+	connConfig, err := resolveConnConfig(entry, target)
+	if err != nil {
+		return nil, classifyConnectError(entry.Name, err)
+	}
+
+	entry.Rewrite.apply(connConfig)
+
+	entry.UpstreamTLS.apply(connConfig.TLSConfig)
+	for _, fallback := range connConfig.Fallbacks {
+		entry.UpstreamTLS.apply(fallback.TLSConfig)
+	}
+
+	if err = entry.Tunnel.apply(connConfig); err != nil {
+		return nil, err
+	}
+
+	if entry.TCP != nil {
+		dial := connConfig.DialFunc
+		connConfig.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := entry.TCP.Apply(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			return conn, nil
+		}
+	}
+
+	return connConfig, nil
 }
 
-func ReadConfigFromFile(path string) ([]ConfigEntry, error) {
-	data, err := os.ReadFile(path)
+// The config the proxy dials the first target of an entry with for a client that sends no startup
+// parameters, for tools that connect to the entry's upstream directly (e.g. `pgproxy psql`)
+func UpstreamConfig(entry *ConfigEntry) (*pgx.ConnConfig, error) {
+	if entry.templated() {
+		return nil, fmt.Errorf("entry %s is filled in from its clients' connection parameters", entry.Name)
+	}
+	connConfig, err := upstreamConfig(entry, entry.AllTargets()[0])
 	if err != nil {
 		return nil, err
 	}
+	entry.StartupParameters.apply(connConfig.RuntimeParams)
+	entry.Guardrails.apply(connConfig.RuntimeParams)
+	connConfig.ConnectTimeout = entry.connectTimeout()
+	return connConfig, nil
+}
 
-	var entries []ConfigEntry
-	err = json.Unmarshal(data, &entries)
+// Dials a new upstream connection to a target of an entry.  `replication` is passed through as the
+// startup parameter of the same name, unless empty, and so are the client's forwarded `parameters`.
+func connect(entry *ConfigEntry, target ConfigTarget, applicationName string, replication string, parameters map[string]string) (*pgx.Conn, error) {
+	connConfig, err := upstreamConfig(entry, target)
 	if err != nil {
 		return nil, err
 	}
 
-	return entries, nil
+	maps.Copy(connConfig.RuntimeParams, parameters)
+	entry.StartupParameters.apply(connConfig.RuntimeParams)
+	connConfig.RuntimeParams["application_name"] = applicationName
+	if replication != "" {
+		connConfig.RuntimeParams["replication"] = replication
+	} else {
+		entry.Guardrails.apply(connConfig.RuntimeParams)
+	}
+
+	timeout := entry.connectTimeout()
+	connConfig.ConnectTimeout = timeout
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	release, err := entry.DialLimit.acquire(ctx, entry.Name)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s after %s waiting for a dial_limit slot", ErrConnectTimeout, target.Name, timeout)
+	}
+	defer release()
+
+	conn, err := pgx.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return nil, fmt.Errorf("%w %s after %s", ErrConnectTimeout, target.Name, timeout)
+		}
+		return nil, classifyConnectError(entry.Name, err)
+	}
+
+	return conn, nil
+}
+
+// Called by the relay before forwarding a message from the client.  If the session is between
+// requests and its entry is paused (e.g. during a cutover), this blocks until the entry resumes, so
+// that no new work reaches the upstream while it is paused.  Likewise, a session being reconnected
+// (see Reconnect) waits for its new upstream connection.
+//
+// Clients may pipeline requests instead of waiting for each ReadyForQuery, so we count the
+// messages the upstream will answer with a ReadyForQuery rather than assuming lockstep.
+func BeginRequest(client net.Conn, messageType codec.MessageType) {
+	associations.Lock()
+	defer associations.Unlock()
+
+	for {
+		a := associations.m[client]
+		if a == nil {
+			return
+		}
+
+		gate := pauseGates[a.entry]
+		if gate == nil {
+			gate = a.reconnecting
+		}
+		if !a.idle() || gate == nil {
+			a.startRequest(messageType)
+			switch messageType {
+			case codec.MessageTypeQuery, codec.MessageTypeFunctionCall:
+				a.pending++
+			case codec.MessageTypeSync:
+				a.pending++
+				a.unsynced = false
+			case codec.MessageTypeParse, codec.MessageTypeBind, codec.MessageTypeDescribe,
+				codec.MessageTypeExecute, codec.MessageTypeClose:
+				a.unsynced = true
+			}
+			return
+		}
+
+		associations.Unlock()
+		<-gate
+		associations.Lock()
+	}
+}
+
+// Called by the relay for every ReadyForQuery the upstream sends back to the client.  Returns true
+// if the session's target is draining (or the proxy is shutting down) and the session is now idle,
+// in which case the relay should close the session once it has forwarded the ReadyForQuery.
+func EndRequest(client net.Conn, status codec.BackendTransactionStatus) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
+		return false
+	}
+
+	if a.pending > 0 {
+		a.pending--
+	}
+	a.endRequest(status)
+	a.txStatus = status
+	if a.pending == 0 && !a.unsynced {
+		a.stateChange = time.Now()
+	}
+
+	return a.idle() && (isDraining(a.entry, a.target) || shuttingDown.Load())
+}
+
+// Whether the session is in a transaction with nothing in flight, waiting for the client's next
+// request
+func IdleInTransaction(client net.Conn) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	return a != nil && a.idleInTransaction()
+}
+
+// Returns the number of sessions currently associated with a target
+func SessionCount(entry, target string) int {
+	associations.Lock()
+	defer associations.Unlock()
+
+	n := 0
+	for _, a := range associations.m {
+		if a.entry == entry && a.target == target {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Returns the number of sessions of an entry, counting the sessions of each of its overrides
+// separately.  Called with the associations lock held.
+func entrySessions(entry *ConfigEntry) int {
+	n := 0
+	for _, a := range associations.m {
+		if a.entry == entry.Name && a.config.override == entry.override {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Closes every idle session on a target.  Closing both sockets unblocks the session's relay, which
+// then runs its usual cleanup.
+func closeIdleSessions(entry, target string) int {
+	return closeIdle(func(a *association) bool {
+		return a.entry == entry && a.target == target && a.conn != nil
+	})
+}
+
+// Set once the proxy is shutting down, after which sessions are closed as soon as they are idle
+var shuttingDown atomic.Bool
+
+// Makes every session close once it is idle, and closes those that already are, including
+// transaction pooled sessions between transactions.  Returns the number of sessions closed.
+func DrainSessions() int {
+	shuttingDown.Store(true)
+	return closeIdle(func(a *association) bool { return true })
+}
+
+func closeIdle(match func(a *association) bool) int {
+	type session struct {
+		client net.Conn
+		conn   *pgx.Conn
+	}
+
+	associations.Lock()
+	var idle []session
+	for _, a := range associations.m {
+		if match(a) && a.idle() {
+			idle = append(idle, session{a.client, a.conn})
+		}
+	}
+	associations.Unlock()
+
+	for _, a := range idle {
+		if err := a.client.Close(); err != nil {
+			slog.Error("could not close client", "error", err)
+		}
+		if a.conn == nil {
+			continue
+		}
+		if err := a.conn.PgConn().Conn().Close(); err != nil {
+			slog.Error("could not close upstream", "error", err)
+		}
+	}
+
+	return len(idle)
+}
+
+// Postgres silently truncates identifiers to NAMEDATALEN-1 bytes
+const maxApplicationNameLen = 63
+
+// Builds the application_name for an upstream connection so that DBAs looking at pg_stat_activity
+// can attribute backend sessions to the real client behind the proxy, e.g.
+// "psql [10.0.0.4 pgproxy:1a2b3c4d]".  If the result is too long, the client's own
+// application_name is truncated so that the proxy suffix survives.
+func upstreamApplicationName(clientAppName string, clientAddr net.Addr, sessionID string) string {
+	host := clientAddr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	suffix := fmt.Sprintf("[%s pgproxy:%s]", host, sessionID)
+	if clientAppName == "" {
+		return suffix
+	}
+
+	if room := maxApplicationNameLen - len(suffix) - 1; len(clientAppName) > room {
+		clientAppName = clientAppName[:max(room, 0)]
+	}
+
+	return clientAppName + " " + suffix
+}
+
+// Whether the client's upstream connection goes back to a pool when the session ends.  The relay
+// must not half-close pooled connections.
+func IsPooled(client net.Conn) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	return a != nil && a.pool != nil
+}
+
+// Ends a session.  If the upstream connection is pooled, `reusable` is true (i.e. the relay
+// stopped cleanly without leaving unread upstream data behind) and the upstream is idle, the
+// connection goes back into its pool; otherwise it is closed.
+func Release(client net.Conn, reusable bool) error {
+	associations.Lock()
+	remote := associations.m[client]
+	delete(associations.m, client)
+	associations.Unlock()
+
+	if remote == nil {
+		return errors.New("no associated client")
+	}
+	if remote.counted {
+		clientSessions.With(remote.entry, remote.database, remote.upstream).Dec()
+	}
+
+	if remote.conn == nil {
+		// transaction pooling mode, between transactions
+		return nil
+	}
+
+	if remote.pool == nil {
+		return remote.conn.Close(context.Background())
+	}
+
+	return returnToPool(remote.conn, remote.pool, remote.entry, remote.target, reusable && remote.idle() && !remote.discard, true)
+}
+
+// Hands a connection back to its pool, or closes it if it can't be reused
+func returnToPool(conn *pgx.Conn, p *pool, entry, target string, reusable bool, reset bool) error {
+	p.returned(conn)
+	if reusable && !conn.IsClosed() && !isDraining(entry, target) {
+		// the relay may have interrupted its last read with a deadline
+		if err := conn.PgConn().Conn().SetDeadline(time.Time{}); err == nil {
+			p.release(conn, reset)
+			return nil
+		}
+	}
+
+	defer p.closed()
+	return conn.Close(context.Background())
+}
+
+// Ends a session, closing its upstream connection
+func Cleanup(client net.Conn) error {
+	return Release(client, false)
 }
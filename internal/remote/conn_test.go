@@ -0,0 +1,292 @@
+package remote
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+// Registers `a` for a new client connection, as the proxy does once it routes a client.  Returns
+// the client, the other end of its connection, and a cleanup that unregisters and closes them.
+func associate(a *association) (client net.Conn, peer net.Conn, cleanup func()) {
+	client, peer = net.Pipe()
+	a.client = client
+	associations.Lock()
+	associations.m[client] = a
+	associations.Unlock()
+
+	return client, peer, func() {
+		associations.Lock()
+		delete(associations.m, client)
+		associations.Unlock()
+		client.Close()
+		peer.Close()
+	}
+}
+
+func TestUpstreamApplicationName(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.4"), Port: 51234}
+
+	if got := upstreamApplicationName("psql", addr, "1a2b3c4d"); got != "psql [10.0.0.4 pgproxy:1a2b3c4d]" {
+		t.Errorf("unexpected application_name: %q", got)
+	}
+
+	if got := upstreamApplicationName("", addr, "1a2b3c4d"); got != "[10.0.0.4 pgproxy:1a2b3c4d]" {
+		t.Errorf("unexpected application_name without client name: %q", got)
+	}
+
+	long := upstreamApplicationName(strings.Repeat("x", 100), addr, "1a2b3c4d")
+	if len(long) != maxApplicationNameLen {
+		t.Errorf("expected application_name to be truncated to %d bytes, got %d", maxApplicationNameLen, len(long))
+	}
+	if !strings.HasSuffix(long, "[10.0.0.4 pgproxy:1a2b3c4d]") {
+		t.Errorf("expected truncated application_name to keep proxy suffix: %q", long)
+	}
+}
+
+func TestReplicationMode(t *testing.T) {
+	cases := []struct {
+		params codec.ConnectionParams
+		want   string
+	}{
+		{codec.ConnectionParams{"database": "app"}, ""},
+		{codec.ConnectionParams{"database": "app", "replication": "false"}, ""},
+		{codec.ConnectionParams{"database": "app", "replication": "database"}, "database"},
+		{codec.ConnectionParams{"replication": "true"}, "true"},
+		{codec.ConnectionParams{"replication": "ON"}, "true"},
+		{codec.ConnectionParams{"database": "replication"}, "true"},
+	}
+
+	for _, c := range cases {
+		if got := replicationMode(c.params); got != c.want {
+			t.Errorf("replicationMode(%v) = %q, want %q", c.params, got, c.want)
+		}
+	}
+}
+
+func TestSelectTargetClientAffinity(t *testing.T) {
+	entry := ConfigEntry{
+		Name:     "multi",
+		Affinity: AffinityClient,
+		Targets:  []ConfigTarget{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}},
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.4"), Port: 51234}
+	otherPort := &net.TCPAddr{IP: net.ParseIP("10.0.0.4"), Port: 40000}
+
+	first, _ := entry.selectTarget("alice", "app", addr)
+	for i := 0; i < 10; i++ {
+		if got, _ := entry.selectTarget("alice", "app", otherPort); got.Name != first.Name {
+			t.Fatalf("expected reconnecting client to stick to target %s, got %s", first.Name, got.Name)
+		}
+	}
+
+	// removing a target that the client wasn't routed to must not move the client
+	var remaining []ConfigTarget
+	for _, target := range entry.Targets {
+		if target.Name == first.Name || len(remaining) < 2 {
+			remaining = append(remaining, target)
+		}
+	}
+	entry.Targets = remaining
+	if got, _ := entry.selectTarget("alice", "app", addr); got.Name != first.Name {
+		t.Errorf("expected client to stay on target %s after removing another target, got %s", first.Name, got.Name)
+	}
+}
+
+func TestSelectTargetWeights(t *testing.T) {
+	zero := 0
+	entry := ConfigEntry{
+		Name:    "canary",
+		Targets: []ConfigTarget{{Name: "blue"}, {Name: "green", Weight: &zero}},
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.4"), Port: 51234}
+
+	for i := 0; i < 20; i++ {
+		if got, _ := entry.selectTarget("alice", "app", addr); got.Name != "blue" {
+			t.Fatalf("expected target with weight 0 to never be selected, got %s", got.Name)
+		}
+	}
+
+	if err := SetTargetWeight(&entry, "blue", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTargetWeight(&entry, "green", 5); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := entry.selectTarget("alice", "app", addr); got.Name != "green" {
+		t.Errorf("expected runtime weight override to route to green, got %s", got.Name)
+	}
+
+	if err := SetTargetWeight(&entry, "purple", 1); err == nil {
+		t.Error("expected error setting weight of unknown target")
+	}
+
+	negative := -3
+	entry = ConfigEntry{
+		Name:    "negative",
+		Targets: []ConfigTarget{{Name: "blue", Weight: &negative}, {Name: "green"}},
+	}
+	if _, err := entry.selectTarget("alice", "app", addr); err == nil {
+		t.Error("expected targets whose weights don't add up to a positive total to be refused")
+	}
+
+	valid := `{"entries": [{"name": "canary", "match": {"database": "app"}, "targets": [{"name": "blue"}, {"name": "green", "weight": 0}]}]}`
+	if _, err := readTestConfig(t, valid); err != nil {
+		t.Fatal(err)
+	}
+	for _, targets := range []string{
+		`[{"name": "blue", "weight": -1}, {"name": "green"}]`,
+		`[{"name": "blue"}, {"provider": "none"}]`,
+		`[{"name": "blue"}, {"name": "blue"}]`,
+	} {
+		json := `{"entries": [{"name": "canary", "match": {"database": "app"}, "targets": ` + targets + `}]}`
+		if _, err := readTestConfig(t, json); err == nil {
+			t.Errorf("expected targets %s to be refused", targets)
+		}
+	}
+}
+
+func TestPipelinedRequestsKeepSessionBusy(t *testing.T) {
+	a := &association{config: &ConfigEntry{Name: "pipeline"}, entry: "pipeline", txStatus: codec.BackendTransactionStatusIdle}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	// two pipelined batches, each ending in a Sync, with no ReadyForQuery in between
+	for i := 0; i < 2; i++ {
+		for _, messageType := range []codec.MessageType{codec.MessageTypeParse, codec.MessageTypeBind, codec.MessageTypeExecute, codec.MessageTypeSync} {
+			BeginRequest(client, messageType)
+		}
+	}
+	// a third batch that isn't synced yet
+	BeginRequest(client, codec.MessageTypeParse)
+
+	for i := 0; i < 2; i++ {
+		if a.idle() {
+			t.Fatalf("expected session to be busy before ReadyForQuery %d", i+1)
+		}
+		EndRequest(client, codec.BackendTransactionStatusIdle)
+	}
+	if a.idle() {
+		t.Fatal("expected session with unsynced messages to be busy")
+	}
+
+	BeginRequest(client, codec.MessageTypeSync)
+	EndRequest(client, codec.BackendTransactionStatusIdle)
+	if !a.idle() {
+		t.Fatal("expected session to be idle once every Sync was answered")
+	}
+}
+
+func TestAdvertisedParameters(t *testing.T) {
+	entry := &ConfigEntry{Name: "params", ServerParameters: map[string]string{
+		"server_version": "16.4", "TimeZone": "UTC", "DateStyle": "ISO, MDY",
+	}}
+	client, _, cleanup := associate(&association{config: entry, entry: entry.Name, txStatus: codec.BackendTransactionStatusIdle})
+	defer cleanup()
+
+	expected := []ServerParameter{
+		{"client_encoding", "UTF8"}, {"DateStyle", "ISO, MDY"}, {"TimeZone", "UTC"}, {"server_version", "16.4"},
+	}
+	if params := AdvertisedParameters(client); !slices.Equal(params, expected) {
+		t.Errorf("expected %v, got %v", expected, params)
+	}
+}
+
+func TestMatchOptions(t *testing.T) {
+	configs := []ConfigEntry{
+		{Name: "analytics", Match: ConfigMatch{Database: "app", Options: map[string]string{"pgproxy.route": "analytics"}}, LazyConnect: true},
+		{Name: "app", Match: ConfigMatch{Database: "app"}, LazyConnect: true},
+	}
+
+	cases := map[string]string{
+		"":                                      "app",
+		"-c pgproxy.route=analytics":            "analytics",
+		"--pgproxy.route=analytics -c geqo=off": "analytics",
+		"-c pgproxy.route=reporting":            "app",
+	}
+	for options, want := range cases {
+		client, other := net.Pipe()
+		params := codec.ConnectionParams{"database": "app", "user": "alice", "options": options}
+		if _, err := GetOrAllocConnection(client, "session", configs, &params); err != nil {
+			t.Fatalf("unexpected error for options %q: %v", options, err)
+		}
+
+		associations.Lock()
+		if got := associations.m[client].entry; got != want {
+			t.Errorf("expected options %q to match %s, got %s", options, want, got)
+		}
+		associations.Unlock()
+		Release(client, true)
+		client.Close()
+		other.Close()
+	}
+}
+
+func TestShadowEntry(t *testing.T) {
+	configs := []ConfigEntry{
+		{Name: "app", Match: ConfigMatch{Database: "app"}, LazyConnect: true},
+		{Name: "app-next", Match: ConfigMatch{Database: "app", User: "etl_.*"}, Shadow: true, LazyConnect: true},
+	}
+	shadowed := shadowRoutes.With("app", "app-next")
+	before := shadowed.Value()
+
+	for _, user := range []string{"etl_nightly", "alice"} {
+		client, other := net.Pipe()
+		params := codec.ConnectionParams{"database": "app", "user": user}
+		if _, err := GetOrAllocConnection(client, "session", configs, &params); err != nil {
+			t.Fatalf("unexpected error for %s: %v", user, err)
+		}
+
+		associations.Lock()
+		if got := associations.m[client].entry; got != "app" {
+			t.Errorf("expected %s to keep going to app, got %s", user, got)
+		}
+		associations.Unlock()
+		Release(client, true)
+		client.Close()
+		other.Close()
+	}
+
+	if counted := shadowed.Value() - before; counted != 1 {
+		t.Errorf("expected one session counted for the shadow entry, got %d", counted)
+	}
+}
+
+func TestRouteClientBeforeConnecting(t *testing.T) {
+	configs := []ConfigEntry{{Name: "routed", Match: ConfigMatch{Database: "app"}, Provider: "none"}}
+	sessions := clientSessions.With("routed", "app", "")
+	before := sessions.Value()
+
+	client, other := net.Pipe()
+	defer client.Close()
+	defer other.Close()
+	if err := RouteClient(client, "session", configs, codec.ConnectionParams{"database": "app", "user": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	associations.Lock()
+	a := associations.m[client]
+	associations.Unlock()
+	if a == nil || a.conn != nil || a.counted {
+		t.Fatalf("expected the client to be routed without an upstream connection, got %+v", a)
+	}
+
+	// e.g. the client didn't authenticate
+	if err := Release(client, true); err != nil || sessions.Value() != before {
+		t.Errorf("expected the session to go without being counted, got %v (%d)", err, sessions.Value()-before)
+	}
+
+	if err := RouteClient(client, "session", configs, codec.ConnectionParams{"database": "app", "user": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConnectClient(client); err == nil {
+		t.Fatal("expected the upstream connection to fail")
+	}
+	associations.Lock()
+	defer associations.Unlock()
+	if associations.m[client] != nil {
+		t.Error("expected the session to be dropped once it couldn't be connected")
+	}
+}
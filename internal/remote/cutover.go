@@ -0,0 +1,124 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Entries that are currently paused, keyed by entry name.  The channel is closed when the entry
+// resumes.  Guarded by the associations lock.
+var pauseGates = make(map[string]chan struct{})
+
+// Pauses an entry, returning false if it is already paused (by a cutover or a barrier), which
+// is then left to whoever paused it to resume
+func pauseEntry(name string) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	if pauseGates[name] != nil {
+		return false
+	}
+	pauseGates[name] = make(chan struct{})
+	return true
+}
+
+func resumeEntry(name string) {
+	associations.Lock()
+	defer associations.Unlock()
+
+	if gate := pauseGates[name]; gate != nil {
+		close(gate)
+		delete(pauseGates, name)
+	}
+}
+
+func waitWhilePaused(name string) {
+	associations.Lock()
+	gate := pauseGates[name]
+	associations.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+}
+
+// Returns the number of sessions on the entry that are in the middle of a request or transaction
+func inFlightSessions(name string) int {
+	associations.Lock()
+	defer associations.Unlock()
+
+	n := 0
+	for _, a := range associations.m {
+		if a.entry == name && !a.idle() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Switches all traffic for an entry over to a single target (e.g. from "blue" to "green"):
+//
+//  1. pause the entry, so that new sessions and new requests from idle sessions wait
+//  2. wait for in-flight requests and transactions to finish, giving up after `timeout`
+//  3. route all new sessions to the target, and close the now quiesced sessions on other targets
+//     so that their clients reconnect to the new target
+//  4. resume the entry
+//
+// If in-flight transactions don't finish in time, the entry is resumed without switching.  Returns
+// the number of sessions that were closed.
+func Cutover(entry *ConfigEntry, target string, timeout time.Duration) (int, error) {
+	found := false
+	for _, t := range entry.AllTargets() {
+		if t.Name == target {
+			found = true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("entry %s has no target named %s", entry.Name, target)
+	}
+
+	slog.Info("cutover: pausing entry", "entry", entry.Name, "target", target)
+	if !pauseEntry(entry.Name) {
+		return 0, fmt.Errorf("entry %s is already paused", entry.Name)
+	}
+	defer resumeEntry(entry.Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for inFlightSessions(entry.Name) > 0 {
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("cutover of %s aborted: %d sessions still in flight after %s", entry.Name, inFlightSessions(entry.Name), timeout)
+		case <-ticker.C:
+		}
+	}
+
+	for _, t := range entry.AllTargets() {
+		weight := 0
+		if t.Name == target {
+			weight = 1
+		}
+
+		if err := SetTargetWeight(entry, t.Name, weight); err != nil {
+			return 0, err
+		}
+	}
+
+	// every session on the other targets is idle now, since the entry is paused
+	closed := 0
+	for _, t := range entry.AllTargets() {
+		if t.Name != target {
+			closed += closeIdleSessions(entry.Name, t.Name)
+		}
+	}
+
+	slog.Info("cutover: switched entry to target", "entry", entry.Name, "target", target, "closedSessions", closed)
+	return closed, nil
+}
@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+var (
+	dialsQueued = metrics.NewGaugeVec(
+		"pgproxy_dials_queued", "Upstream connections of an entry waiting for a dial_limit slot.", "entry",
+	)
+	dialWaitTime = metrics.NewCounterVec(
+		"pgproxy_dial_wait_microseconds_total", "Time upstream connections spent waiting for a dial_limit slot (including jitter).", "entry",
+	)
+)
+
+// Funnels an entry's upstream dials, so that a storm of clients reconnecting at once (after a
+// deploy or a failover) reaches the upstream's authentication a few at a time rather than all
+// together.  Dials over the limit wait their turn, which counts towards connect_timeout.
+type DialLimit struct {
+	// how many of the entry's upstream connections may be opened at once, unlimited if 0
+	MaxConcurrent int `json:"max_concurrent"`
+	// each dial first waits a random time up to this long, so that clients arriving together
+	// don't dial in lockstep
+	Jitter Duration `json:"jitter"`
+}
+
+func (l *DialLimit) validate() error {
+	if l.MaxConcurrent < 0 || l.Jitter < 0 {
+		return errors.New("max_concurrent and jitter can't be negative")
+	}
+	if l.MaxConcurrent == 0 && l.Jitter == 0 {
+		return errors.New("max_concurrent or jitter is required")
+	}
+	return nil
+}
+
+// The slots of each entry's dial_limit, by entry name, so that they are shared by the entry's
+// targets, the copies made for its users and clients, and a replacement of the entry with the same
+// limit
+var dialSlots = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+func (l *DialLimit) slots(entry string) chan struct{} {
+	dialSlots.Lock()
+	defer dialSlots.Unlock()
+
+	slots := dialSlots.m[entry]
+	if slots == nil || cap(slots) != l.MaxConcurrent {
+		slots = make(chan struct{}, l.MaxConcurrent)
+		dialSlots.m[entry] = slots
+	}
+	return slots
+}
+
+// Waits for the jitter and then for a slot to dial one of the entry's upstream connections, giving
+// up when `ctx` is done.  The returned function gives the slot back.
+func (l *DialLimit) acquire(ctx context.Context, entry string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	dialsQueued.With(entry).Inc()
+	defer func() {
+		dialsQueued.With(entry).Dec()
+		dialWaitTime.With(entry).Add(uint64(time.Since(start).Microseconds()))
+	}()
+
+	if l.Jitter > 0 {
+		timer := time.NewTimer(rand.N(time.Duration(l.Jitter)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if l.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+
+	slots := l.slots(entry)
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,54 @@
+package remote
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDialLimit(t *testing.T) {
+	limit := &DialLimit{MaxConcurrent: 1, Jitter: Duration(10 * time.Millisecond)}
+	if err := limit.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := limit.acquire(context.Background(), "storm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the only slot is taken
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = limit.acquire(ctx, "storm"); err == nil {
+		t.Fatal("expected a dial over the limit to wait until it gives up")
+	}
+	if _, err = limit.acquire(context.Background(), "other"); err != nil {
+		t.Fatalf("expected another entry to have slots of its own, got %v", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		next, err := limit.acquire(context.Background(), "storm")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- next
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the dial to wait for the slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case next := <-acquired:
+		next()
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting dial to get the slot once it was given back")
+	}
+
+	if err := (&DialLimit{}).validate(); err == nil {
+		t.Error("expected an empty dial_limit to be invalid")
+	}
+}
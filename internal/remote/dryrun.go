@@ -0,0 +1,44 @@
+package remote
+
+import (
+	"log/slog"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// Policies and guardrails with dry_run set, and shadow entries, are evaluated as usual but not
+// enforced: what they would have done is logged and counted, so that a change can be checked
+// against live traffic before it is turned on.
+var (
+	dryRunRefusals = metrics.NewCounterVec(
+		"pgproxy_dry_run_refusals_total", "Sessions and requests a dry_run policy or guardrail would have refused, by rule.", "entry", "rule",
+	)
+	shadowRoutes = metrics.NewCounterVec(
+		"pgproxy_shadow_routes_total", "Client sessions that would have been routed to a shadow entry, by the entry they were routed to instead (empty if none).", "entry", "shadow",
+	)
+)
+
+// Records what a dry run policy would have refused.  Only reads what is set when the association
+// is made, so the associations lock needn't be held.
+func wouldRefuse(a *association, rule string, err *PolicyError) {
+	slog.Info(
+		"dry run policy would have refused", "entry", a.entry, "rule", rule, "user", a.user,
+		"session", a.session, "code", err.Code, "message", err.Message,
+	)
+	dryRunRefusals.With(a.entry, rule).Inc()
+}
+
+// Records a client that would have been routed to a shadow entry rather than to `entry`, which is
+// nil if the client matches no other entry
+func shadowRouted(entry *ConfigEntry, shadow *ConfigEntry, params codec.ConnectionParams) {
+	name := ""
+	if entry != nil {
+		name = entry.Name
+	}
+	slog.Info(
+		"client would have been routed to shadow entry", "entry", name, "shadow", shadow.Name,
+		"user", params["user"], "database", params["database"],
+	)
+	shadowRoutes.With(name, shadow.Name).Inc()
+}
@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/slowlog"
+)
+
+// Connections slow statements are explained on, one per entry (and override) and target, so that
+// EXPLAIN neither takes a connection from the pool nor runs in a client's session state.  They
+// are read-only, and serve one EXPLAIN at a time.
+var diagnostics = struct {
+	sync.Mutex
+	m map[string]*diagnosticConn
+}{m: make(map[string]*diagnosticConn)}
+
+type diagnosticConn struct {
+	sync.Mutex
+	entry  *ConfigEntry
+	target ConfigTarget
+	// nil until first used, and closed by an EXPLAIN that ran out of time until the next one
+	conn *pgx.Conn
+}
+
+// Explains a statement, dialing the connection first if need be.  The caller's context bounds the
+// EXPLAIN; one that runs out leaves the connection closed, to be dialed again next time.
+func (d *diagnosticConn) explain(ctx context.Context, statement string) (json.RawMessage, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.conn == nil || d.conn.IsClosed() {
+		conn, err := connect(d.entry, d.target, "pgproxy [explain]", "", nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.Exec(ctx, "SET default_transaction_read_only = on"); err != nil {
+			conn.Close(context.Background())
+			return nil, err
+		}
+		d.conn = conn
+	}
+
+	// the extended protocol refuses several statements in one, whatever the caller checked
+	result := d.conn.PgConn().ExecParams(ctx, "EXPLAIN (FORMAT JSON) "+statement, nil, nil, nil, nil).Read()
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	if len(result.Rows) == 0 || len(result.Rows[0]) == 0 {
+		return nil, errors.New("EXPLAIN returned no plan")
+	}
+
+	var plan bytes.Buffer
+	if err := json.Compact(&plan, result.Rows[0][0]); err != nil {
+		return nil, err
+	}
+	return plan.Bytes(), nil
+}
+
+// Returns the target the client's session is currently using, and a function explaining statements
+// on a diagnostic connection to it.  Both are empty if the session isn't using a target.
+func SessionExplainer(client net.Conn) (string, slowlog.ExplainFunc) {
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.target == "" {
+		associations.Unlock()
+		return "", nil
+	}
+	entry, targetName := a.config, a.target
+	associations.Unlock()
+
+	var target ConfigTarget
+	for _, t := range entry.AllTargets() {
+		if t.Name == targetName {
+			target = t
+		}
+	}
+	if target.Name == "" {
+		return "", nil
+	}
+
+	key := entry.poolKey(target)
+	diagnostics.Lock()
+	d := diagnostics.m[key]
+	if d == nil {
+		d = &diagnosticConn{entry: entry, target: target}
+		diagnostics.m[key] = d
+	}
+	diagnostics.Unlock()
+
+	return target.Name, d.explain
+}
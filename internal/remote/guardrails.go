@@ -0,0 +1,143 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+// Timeouts set on an entry's upstream connections, so that a runaway query or a forgotten
+// transaction can't hold locks or a backend forever.  They are sent in the startup message, so
+// they are also what RESET (and so DISCARD ALL) goes back to.
+type Guardrails struct {
+	StatementTimeout                Duration `json:"statement_timeout"`
+	LockTimeout                     Duration `json:"lock_timeout"`
+	IdleInTransactionSessionTimeout Duration `json:"idle_in_transaction_session_timeout"`
+	// refuse SET statements that raise (or disable) one of the timeouts above
+	Enforce bool `json:"enforce"`
+	// with enforce, only log and count the SET statements that would be refused
+	DryRun bool `json:"dry_run"`
+}
+
+func (g *Guardrails) validate() error {
+	for name, limit := range g.limits() {
+		if limit < time.Millisecond {
+			return fmt.Errorf("%s must be at least 1ms", name)
+		}
+	}
+	if g.Enforce && len(g.limits()) == 0 {
+		return errors.New("enforce requires at least one timeout")
+	}
+	if g.DryRun && !g.Enforce {
+		return errors.New("dry_run requires enforce")
+	}
+	return nil
+}
+
+// The configured timeouts by GUC name
+func (g *Guardrails) limits() map[string]time.Duration {
+	limits := make(map[string]time.Duration)
+	if g == nil {
+		return limits
+	}
+	for name, limit := range map[string]Duration{
+		"statement_timeout":                   g.StatementTimeout,
+		"lock_timeout":                        g.LockTimeout,
+		"idle_in_transaction_session_timeout": g.IdleInTransactionSessionTimeout,
+	} {
+		if limit != 0 {
+			limits[name] = time.Duration(limit)
+		}
+	}
+	return limits
+}
+
+// Adds the timeouts to the runtime parameters of an upstream connection, in milliseconds
+func (g *Guardrails) apply(params map[string]string) {
+	for name, limit := range g.limits() {
+		params[name] = strconv.FormatInt(limit.Milliseconds(), 10)
+	}
+}
+
+// Returns a *PolicyError if a statement raises one of the enforced timeouts
+func (g *Guardrails) check(statement []query.Token) error {
+	if g == nil || !g.Enforce {
+		return nil
+	}
+
+	name, value, ok := query.SetParameter(statement)
+	if !ok {
+		return nil
+	}
+	limit, ok := g.limits()[name]
+	if !ok || value == "default" {
+		return nil
+	}
+
+	// 0 disables the timeout, so it counts as raising it as far as it goes
+	if setting, ok := parseTimeout(value); ok && setting > 0 && setting <= limit {
+		return nil
+	}
+	return &PolicyError{
+		Code:    codec.SQLStateInsufficientPrivilege,
+		Message: fmt.Sprintf("%s may not be set above %s", name, limit),
+	}
+}
+
+// Units of time GUCs, see https://www.postgresql.org/docs/current/config-setting.html
+var timeoutUnits = map[string]time.Duration{
+	"us": time.Microsecond, "ms": time.Millisecond, "s": time.Second, "min": time.Minute,
+	"h": time.Hour, "d": 24 * time.Hour,
+}
+
+// Parses the value of a timeout GUC, e.g. "5000" (milliseconds), "5s" or "1min"
+func parseTimeout(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	number := strings.TrimRightFunc(value, func(r rune) bool { return r >= 'a' && r <= 'z' })
+	unit := time.Millisecond
+	if suffix := strings.TrimSpace(value[len(number):]); suffix != "" {
+		var ok bool
+		if unit, ok = timeoutUnits[suffix]; !ok {
+			return 0, false
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n * float64(unit)), true
+}
+
+// Called by the relay like CheckRequest.  Returns a *PolicyError for a request with a SET that
+// raises one of the timeouts the entry's guardrails enforce, which ends the session if requests
+// are in flight, like ApplyTenancy.  `SELECT set_config(...)` isn't caught.
+func CheckGuardrails(client net.Conn, message *codec.Message) error {
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.config.Guardrails == nil || !a.config.Guardrails.Enforce {
+		associations.Unlock()
+		return nil
+	}
+	guardrails, status, inFlight := a.config.Guardrails, a.txStatus, a.pending > 0 || a.unsynced
+	associations.Unlock()
+
+	for _, statement := range messageStatements(message) {
+		var policyErr *PolicyError
+		if err := guardrails.check(statement); errors.As(err, &policyErr) {
+			if guardrails.DryRun {
+				wouldRefuse(a, "guardrails", policyErr)
+				continue
+			}
+			policyErr.Status, policyErr.Fatal = status, inFlight
+			return policyErr
+		}
+	}
+	return nil
+}
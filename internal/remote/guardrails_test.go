@@ -0,0 +1,66 @@
+package remote
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+func TestGuardrails(t *testing.T) {
+	guardrails := &Guardrails{StatementTimeout: Duration(30 * time.Second), LockTimeout: Duration(5 * time.Second), Enforce: true}
+
+	params := map[string]string{}
+	guardrails.apply(params)
+	if params["statement_timeout"] != "30000" || params["lock_timeout"] != "5000" || len(params) != 2 {
+		t.Errorf("expected the timeouts in milliseconds, got %v", params)
+	}
+
+	for _, tt := range []struct {
+		sql     string
+		refused bool
+	}{
+		{"SET statement_timeout = 10000", false},
+		{"SET statement_timeout = '30s'", false},
+		{"SET LOCAL lock_timeout TO '1min'", true},
+		{"SET statement_timeout = 0", true},
+		{"SET statement_timeout = '2h'", true},
+		{"SET statement_timeout TO DEFAULT", false},
+		{"SET idle_in_transaction_session_timeout = 0", false},
+		{"SET work_mem = '1GB'", false},
+	} {
+		var policyErr *PolicyError
+		err := guardrails.check(query.Statements(query.Tokenize(tt.sql))[0])
+		if refused := errors.As(err, &policyErr); refused != tt.refused {
+			t.Errorf("%q: expected refused=%v, got %v", tt.sql, tt.refused, err)
+		}
+	}
+
+	if err := (&Guardrails{Enforce: true}).validate(); err == nil {
+		t.Error("expected enforcing no timeouts to be rejected")
+	}
+}
+
+func TestCheckGuardrailsPipelined(t *testing.T) {
+	entry := &ConfigEntry{Name: "app", Guardrails: &Guardrails{StatementTimeout: Duration(30 * time.Second), Enforce: true}}
+	a := &association{config: entry, entry: entry.Name, txStatus: codec.BackendTransactionStatusIdle}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	var policyErr *PolicyError
+	message := codec.NewQuery("SET statement_timeout = 0")
+	if err := CheckGuardrails(client, &message); !errors.As(err, &policyErr) || policyErr.Fatal {
+		t.Errorf("expected the statement to be refused in place, got %v", err)
+	}
+
+	// a SET sent as the second Parse of a pipeline
+	associations.Lock()
+	a.unsynced = true
+	associations.Unlock()
+	message = codec.NewBuilder(codec.MessageTypeParse).String("").String("SET statement_timeout = 0").Int16(0).Message()
+	if err := CheckGuardrails(client, &message); !errors.As(err, &policyErr) || !policyErr.Fatal {
+		t.Errorf("expected a pipelined statement to end the session, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The parts of a config file that make up its entries.  The proxy-wide settings of included files
+// are ignored, only the top-level file's apply.
+type configFile struct {
+	// more files of entries, relative to the including file's directory.  Globs are expanded
+	// in lexical order.
+	Include []string `json:"include"`
+	// settings for every entry of the file, and of the files it includes, that doesn't set them
+	// itself.  Settings are merged whole: an entry that sets `pool` replaces the default `pool`
+	// entirely.  An included file's defaults are merged over its includer's in the same way.
+	Defaults map[string]json.RawMessage   `json:"defaults"`
+	Entries  []map[string]json.RawMessage `json:"entries"`
+}
+
+// Reads the entries of a config file and of the files it includes, depth first: a file's own
+// entries, then each include's in turn.  `including` is the chain of files that included this
+// one, to catch include cycles.
+func readEntries(path string, data []byte, defaults map[string]json.RawMessage, including []string) ([]ConfigEntry, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(including, path) {
+		return nil, fmt.Errorf("include cycle: %s includes itself", path)
+	}
+	including = append(including, path)
+
+	var file configFile
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &file.Entries)
+	} else {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if _, ok := file.Defaults["name"]; ok {
+		return nil, fmt.Errorf("%s: defaults can't set an entry's name", path)
+	}
+	if len(file.Defaults) > 0 {
+		merged := maps.Clone(defaults)
+		if merged == nil {
+			merged = make(map[string]json.RawMessage)
+		}
+		maps.Copy(merged, file.Defaults)
+		defaults = merged
+	}
+
+	entries := make([]ConfigEntry, 0, len(file.Entries))
+	for i, fields := range file.Entries {
+		merged := maps.Clone(defaults)
+		if merged == nil {
+			merged = make(map[string]json.RawMessage)
+		}
+		maps.Copy(merged, fields)
+
+		// round trip through JSON so that defaults are decoded exactly like an entry's own settings
+		raw, err := json.Marshal(merged)
+		if err != nil {
+			return nil, err
+		}
+		var entry ConfigEntry
+		if err = json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %w", path, i, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, pattern := range file.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include %q: %w", path, pattern, err)
+		}
+		if matches == nil && !hasGlobMeta(pattern) {
+			// a plain path that doesn't exist is a mistake, a glob matching nothing may not be
+			return nil, fmt.Errorf("%s: included file %s does not exist", path, pattern)
+		}
+
+		for _, match := range matches {
+			data, err := os.ReadFile(match)
+			if err != nil {
+				return nil, err
+			}
+			included, err := readEntries(match, data, defaults, including)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, included...)
+		}
+	}
+
+	return entries, nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
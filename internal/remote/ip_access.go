@@ -0,0 +1,177 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+var ipAccessRejections = metrics.NewCounterVec(
+	"pgproxy_ip_access_rejections_total", "Client connections refused at accept time by a listener's ip_access lists, by the deny CIDR they matched (\"unlisted\" if they matched no allow CIDR).", "listener", "cidr",
+)
+
+var ErrNoListener = errors.New("no such listener")
+
+// Which source addresses a listener accepts connections from, as CIDRs (or single addresses).
+// Connections from an address in `deny` are refused, and so are those from addresses outside
+// `allow` unless it is empty.  Checked as soon as a connection is accepted, before anything is
+// read from it.
+type IPAccess struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// The lists of an IPAccess, parsed
+type ipAccessList struct {
+	allow, deny []netip.Prefix
+}
+
+func (c *IPAccess) parse() (*ipAccessList, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	list := &ipAccessList{}
+	for _, field := range []struct {
+		cidrs []string
+		into  *[]netip.Prefix
+	}{{c.Allow, &list.allow}, {c.Deny, &list.deny}} {
+		for _, cidr := range field.cidrs {
+			prefix, err := parsePrefix(cidr)
+			if err != nil {
+				return nil, err
+			}
+			*field.into = append(*field.into, prefix)
+		}
+	}
+	return list, nil
+}
+
+// Parses a CIDR, or a single address as the prefix of just that address
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", cidr)
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0))
+	}
+	return prefix.Masked(), nil
+}
+
+// Returns "" if the list lets `addr` in, or why it doesn't: the deny CIDR it matched, or
+// "unlisted"
+func (l *ipAccessList) refuse(addr netip.Addr) string {
+	if l == nil {
+		return ""
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range l.deny {
+		if prefix.Contains(addr) {
+			return prefix.String()
+		}
+	}
+	if len(l.allow) == 0 {
+		return ""
+	}
+	for _, prefix := range l.allow {
+		if prefix.Contains(addr) {
+			return ""
+		}
+	}
+	return "unlisted"
+}
+
+// The ip_access of each listener, which config reloads and the admin API replace while the proxy
+// runs
+var ipAccess = struct {
+	sync.RWMutex
+	config map[string]*IPAccess
+	lists  map[string]*ipAccessList
+}{config: make(map[string]*IPAccess), lists: make(map[string]*ipAccessList)}
+
+// Sets the ip_access of every listener from their config, e.g. on startup or after the config was
+// reloaded.  Nothing changes if any of the lists is invalid.
+func LoadIPAccess(listeners []ListenerConfig) error {
+	config, lists := make(map[string]*IPAccess), make(map[string]*ipAccessList)
+	for _, l := range listeners {
+		list, err := l.IPAccess.parse()
+		if err != nil {
+			return fmt.Errorf("listener %s: ip_access: %w", l.Name, err)
+		}
+		config[l.Name], lists[l.Name] = l.IPAccess, list
+	}
+
+	ipAccess.Lock()
+	defer ipAccess.Unlock()
+	ipAccess.config, ipAccess.lists = config, lists
+	return nil
+}
+
+// Replaces the ip_access of a listener, nil to accept connections from anywhere
+func SetIPAccess(listener string, access *IPAccess) error {
+	list, err := access.parse()
+	if err != nil {
+		return err
+	}
+
+	ipAccess.Lock()
+	defer ipAccess.Unlock()
+	if _, ok := ipAccess.config[listener]; !ok {
+		return fmt.Errorf("%w: %s", ErrNoListener, listener)
+	}
+	ipAccess.config[listener], ipAccess.lists[listener] = access, list
+	slog.Info("ip access changed", "listener", listener, "ip_access", access)
+	return nil
+}
+
+// The current ip_access of a listener, nil if it has none
+func IPAccessOf(listener string) (*IPAccess, error) {
+	ipAccess.RLock()
+	defer ipAccess.RUnlock()
+
+	access, ok := ipAccess.config[listener]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoListener, listener)
+	}
+	return access, nil
+}
+
+// Called as soon as a listener accepts a connection.  Returns false, counting the refusal, if the
+// listener's ip_access doesn't let the connection's source address in.  Connections without an IP
+// address (on Unix sockets) are always let in.
+func AdmitIP(listener string, remoteAddr net.Addr) bool {
+	tcp, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return true
+	}
+
+	ipAccess.RLock()
+	reason := ipAccess.lists[listener].refuse(addr)
+	ipAccess.RUnlock()
+	if reason == "" {
+		return true
+	}
+
+	ipAccessRejections.With(listener, reason).Inc()
+	return false
+}
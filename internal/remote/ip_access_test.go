@@ -0,0 +1,54 @@
+package remote
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestIPAccess(t *testing.T) {
+	listeners := []ListenerConfig{
+		{Name: "app", IPAccess: &IPAccess{Allow: []string{"10.0.0.0/8", "192.168.1.7"}, Deny: []string{"10.0.66.0/24"}}},
+		{Name: "open"},
+	}
+	if err := LoadIPAccess(listeners); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = LoadIPAccess(nil) }()
+
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+	for _, tt := range []struct {
+		listener, ip string
+		admitted     bool
+	}{
+		{"app", "10.1.2.3", true},
+		{"app", "::ffff:10.1.2.3", true},
+		{"app", "10.0.66.9", false},
+		{"app", "192.168.1.7", true},
+		{"app", "192.168.1.8", false},
+		{"open", "203.0.113.5", true},
+	} {
+		if admitted := AdmitIP(tt.listener, addr(tt.ip)); admitted != tt.admitted {
+			t.Errorf("expected %s admitted by %s to be %v", tt.ip, tt.listener, tt.admitted)
+		}
+	}
+	if AdmitIP("app", &net.UnixAddr{Name: "/tmp/.s.PGSQL.5432", Net: "unix"}) != true {
+		t.Error("expected Unix socket clients to be admitted")
+	}
+	if denied, unlisted := ipAccessRejections.With("app", "10.0.66.0/24").Value(), ipAccessRejections.With("app", "unlisted").Value(); denied != 1 || unlisted != 1 {
+		t.Errorf("expected one rejection per CIDR, got %d denied and %d unlisted", denied, unlisted)
+	}
+
+	if err := SetIPAccess("open", &IPAccess{Deny: []string{"203.0.113.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	if AdmitIP("open", addr("203.0.113.5")) {
+		t.Error("expected the updated list to apply")
+	}
+	if err := SetIPAccess("open", &IPAccess{Deny: []string{"not a cidr"}}); err == nil {
+		t.Error("expected an invalid CIDR to be refused")
+	}
+	if err := SetIPAccess("missing", nil); !errors.Is(err, ErrNoListener) {
+		t.Errorf("expected no such listener, got %v", err)
+	}
+}
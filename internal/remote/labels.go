@@ -0,0 +1,96 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// Label names are restricted to what metrics systems accept as label (or tag) names
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func init() {
+	// one series per label of every entry, so that dashboards can join any metric with an entry
+	// label on its labels, e.g. to sum queries per team
+	metrics.NewGaugeFunc("pgproxy_entry_label", "Labels of entries, always 1.", []string{"entry", "label", "value"}, func(emit func([]string, int64)) {
+		for _, entry := range Routes() {
+			for _, key := range slices.Sorted(maps.Keys(entry.Labels)) {
+				emit([]string{entry.Name, key, entry.Labels[key]}, 1)
+			}
+		}
+	})
+}
+
+func validateLabels(labels map[string]string) error {
+	for key := range labels {
+		if !labelName.MatchString(key) {
+			return fmt.Errorf("invalid label name %q, expected letters, digits and underscores", key)
+		}
+	}
+	return nil
+}
+
+// The labels of the entry named `entry`, nil if it has none or there is no such entry
+func EntryLabels(entry string) map[string]string {
+	for _, e := range Routes() {
+		if e.Name == entry {
+			return e.Labels
+		}
+	}
+	return nil
+}
+
+// Wraps a log handler to add the labels of the entry named by a record's "entry" attribute, as a
+// "labels" group, so that logs can be filtered by team or environment like metrics and audit
+// events
+func LabelHandler(h slog.Handler) slog.Handler {
+	return labelHandler{Handler: h}
+}
+
+type labelHandler struct {
+	slog.Handler
+	// the entry named by the attributes the handler was derived with, if any
+	entry string
+}
+
+func (h labelHandler) Handle(ctx context.Context, r slog.Record) error {
+	entry := h.entry
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "entry" && a.Value.Kind() == slog.KindString {
+			entry = a.Value.String()
+			return false
+		}
+		return true
+	})
+
+	labels := EntryLabels(entry)
+	if len(labels) > 0 {
+		attrs := make([]any, 0, len(labels))
+		for _, key := range slices.Sorted(maps.Keys(labels)) {
+			attrs = append(attrs, slog.String(key, labels[key]))
+		}
+		r = r.Clone()
+		r.AddAttrs(slog.Group("labels", attrs...))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h labelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for _, a := range attrs {
+		if a.Key == "entry" && a.Value.Kind() == slog.KindString {
+			h.entry = a.Value.String()
+		}
+	}
+	h.Handler = h.Handler.WithAttrs(attrs)
+	return h
+}
+
+func (h labelHandler) WithGroup(name string) slog.Handler {
+	h.Handler = h.Handler.WithGroup(name)
+	return h
+}
@@ -0,0 +1,49 @@
+package remote
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	if err := validateLabels(map[string]string{"team": "payments", "cost_center": "42"}); err != nil {
+		t.Errorf("expected valid labels, got %v", err)
+	}
+	if err := validateLabels(map[string]string{"team-name": "payments"}); err == nil {
+		t.Error("expected a label name with a dash to be rejected")
+	}
+
+	routes.Lock()
+	previous := routes.entries
+	routes.entries = []ConfigEntry{{Name: "billing", Labels: map[string]string{"team": "payments", "env": "prod"}}, {Name: "other"}}
+	routes.Unlock()
+	defer func() {
+		routes.Lock()
+		routes.entries = previous
+		routes.Unlock()
+	}()
+
+	if labels := EntryLabels("billing"); labels["team"] != "payments" {
+		t.Errorf("expected the billing entry's labels, got %v", labels)
+	}
+	if labels := EntryLabels("missing"); labels != nil {
+		t.Errorf("expected no labels for a missing entry, got %v", labels)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(LabelHandler(slog.NewTextHandler(&buf, nil)))
+	logger.Info("hello", "entry", "billing")
+	logger.With("entry", "billing").Info("derived")
+	logger.Info("unlabelled", "entry", "other")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for _, line := range lines[:2] {
+		if !strings.Contains(line, "labels.env=prod labels.team=payments") {
+			t.Errorf("expected the entry's labels in %q", line)
+		}
+	}
+	if strings.Contains(lines[2], "labels.") {
+		t.Errorf("expected no labels in %q", lines[2])
+	}
+}
@@ -0,0 +1,244 @@
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// Maintenance mode: while an entry is in maintenance, its new clients are answered by the proxy
+// instead of being given an upstream connection, so that planned downtime shows up as a friendly
+// error rather than connection failures or timeouts.  Sessions that started before are left
+// alone.
+
+var maintenanceResponses = metrics.NewCounterVec(
+	"pgproxy_maintenance_responses_total", "Clients of entries in maintenance turned away at startup or after a query (rejected), and health checks answered with a canned response (health_check).", "entry", "response",
+)
+
+func init() {
+	metrics.NewGaugeFunc("pgproxy_entry_maintenance", "Whether an entry is in maintenance mode.", []string{"entry"}, func(emit func([]string, int64)) {
+		for _, entry := range Routes() {
+			var on int64
+			if _, ok := maintenanceOf(&entry); ok {
+				on = 1
+			}
+			emit([]string{entry.Name}, on)
+		}
+	})
+}
+
+// Default error of entries in maintenance
+const defaultMaintenanceMessage = "the database is undergoing maintenance"
+
+// How an entry answers clients while in maintenance
+type Maintenance struct {
+	// whether the entry starts in maintenance, until the admin API turns it off
+	Enabled bool `json:"enabled"`
+	// the SQLSTATE of the error clients get, default 57P03 (cannot_connect_now)
+	Code string `json:"code"`
+	// the message of the error clients get, e.g. "the database is undergoing maintenance, retry
+	// after 10:00 UTC"
+	Message string `json:"message"`
+	// queries answered with a canned result during maintenance, e.g. a load balancer's
+	// "SELECT 1".  If there are any, clients are let in, and only get the error (and are
+	// disconnected) once they send anything else.
+	HealthChecks []CannedResponse `json:"health_checks"`
+}
+
+// The result the proxy answers a query with itself
+type CannedResponse struct {
+	// the query, compared ignoring case, surrounding whitespace and a trailing semicolon
+	Query string `json:"query"`
+	// column names, default a single "?column?"
+	Columns []string `json:"columns"`
+	// rows of text values, e.g. [["1"]]
+	Rows [][]string `json:"rows"`
+}
+
+func (m *Maintenance) validate() error {
+	if err := validateSQLState(m.Code); err != nil {
+		return err
+	}
+	for _, check := range m.HealthChecks {
+		if normalizeHealthCheck(check.Query) == "" {
+			return errors.New("health checks need a query")
+		}
+		columns := max(len(check.Columns), 1)
+		for _, row := range check.Rows {
+			if len(row) != columns {
+				return fmt.Errorf("health check %q has a row of %d values for %d columns", check.Query, len(row), columns)
+			}
+		}
+	}
+	return nil
+}
+
+// Empty codes stand for the default
+func validateSQLState(code string) error {
+	if code != "" && (len(code) != 5 || strings.IndexFunc(code, func(r rune) bool { return (r < '0' || r > '9') && (r < 'A' || r > 'Z') }) >= 0) {
+		return fmt.Errorf("invalid SQLSTATE %q", code)
+	}
+	return nil
+}
+
+func normalizeHealthCheck(query string) string {
+	query = strings.TrimSpace(strings.TrimRight(strings.TrimSpace(query), ";"))
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+// The error of an entry in maintenance
+type maintenanceError struct {
+	code, message string
+}
+
+// Maintenance turned on or off through the admin API by entry name, which takes precedence over
+// the entry's config until the process restarts.  nil turns maintenance off.
+var maintenanceOverrides = struct {
+	sync.RWMutex
+	m map[string]*maintenanceError
+}{m: make(map[string]*maintenanceError)}
+
+// Whether an entry is in maintenance, and the error its clients get if so
+func maintenanceOf(entry *ConfigEntry) (maintenanceError, bool) {
+	maintenanceOverrides.RLock()
+	override, ok := maintenanceOverrides.m[entry.Name]
+	maintenanceOverrides.RUnlock()
+
+	var err maintenanceError
+	switch {
+	case ok && override == nil:
+		return err, false
+	case ok:
+		err = *override
+	case entry.Maintenance == nil || !entry.Maintenance.Enabled:
+		return err, false
+	}
+
+	if err.code == "" && entry.Maintenance != nil {
+		err.code = entry.Maintenance.Code
+	}
+	if err.message == "" && entry.Maintenance != nil {
+		err.message = entry.Maintenance.Message
+	}
+	if err.code == "" {
+		err.code = codec.SQLStateCannotConnectNow
+	}
+	if err.message == "" {
+		err.message = defaultMaintenanceMessage
+	}
+	return err, true
+}
+
+// Puts an entry in maintenance (`on`) or takes it out, for clients that connect from now on.
+// `code` and `message` replace those of the entry's config, unless empty.
+func SetMaintenance(entry *ConfigEntry, on bool, code, message string) error {
+	if err := validateSQLState(code); err != nil {
+		return err
+	}
+
+	maintenanceOverrides.Lock()
+	defer maintenanceOverrides.Unlock()
+	if on {
+		maintenanceOverrides.m[entry.Name] = &maintenanceError{code: code, message: message}
+	} else {
+		maintenanceOverrides.m[entry.Name] = nil
+	}
+	slog.Info("maintenance mode changed", "entry", entry.Name, "on", on)
+	return nil
+}
+
+// Called once a client has been matched to an entry: returns whether the session is to be served
+// by ServeMaintenance instead of being given an upstream connection, or a *PolicyError turning the
+// client away if the entry is in maintenance without health checks (or the client wants
+// replication, which health checks don't speak).
+func checkMaintenance(a *association) (bool, error) {
+	err, on := maintenanceOf(a.config)
+	if !on {
+		return false, nil
+	}
+	if a.replication != "" || a.config.Maintenance == nil || len(a.config.Maintenance.HealthChecks) == 0 {
+		maintenanceResponses.With(a.entry, "rejected").Inc()
+		return false, &PolicyError{Code: err.code, Message: err.message}
+	}
+	return true, nil
+}
+
+// Whether a session started while its entry was in maintenance, and must be served by
+// ServeMaintenance
+func InMaintenance(client net.Conn) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	return a != nil && a.maintenance
+}
+
+// Answers the messages of a session that started while its entry was in maintenance: health check
+// queries with their canned results, and anything else with the maintenance error, ending the
+// session.  Returns once the session is over.
+func ServeMaintenance(client net.Conn, reader *bufio.Reader) error {
+	associations.Lock()
+	a := associations.m[client]
+	associations.Unlock()
+	if a == nil {
+		return errors.New("no associated client")
+	}
+	maintenance, _ := maintenanceOf(a.config)
+	var checks []CannedResponse
+	if a.config.Maintenance != nil {
+		checks = a.config.Maintenance.HealthChecks
+	}
+
+	for {
+		message, err := codec.ReadMessage(reader)
+		if err != nil {
+			return err
+		}
+		if message.Type == codec.MessageTypeTerminate {
+			return nil
+		}
+
+		i := -1
+		if message.Type == codec.MessageTypeQuery {
+			query := normalizeHealthCheck(message.ParseAsQuery().QueryString)
+			i = slices.IndexFunc(checks, func(c CannedResponse) bool { return normalizeHealthCheck(c.Query) == query })
+		}
+		if i < 0 {
+			maintenanceResponses.With(a.entry, "rejected").Inc()
+			_, err = client.Write(codec.NewErrorResponse(codec.ErrorSeverityFatal, maintenance.code, maintenance.message).Data)
+			return err
+		}
+
+		maintenanceResponses.With(a.entry, "health_check").Inc()
+		if _, err = client.Write(checks[i].encode()); err != nil {
+			return err
+		}
+	}
+}
+
+// The messages answering a query with the canned result
+func (c *CannedResponse) encode() []byte {
+	columns := c.Columns
+	if len(columns) == 0 {
+		columns = []string{"?column?"}
+	}
+
+	buf := codec.NewRowDescription(columns...).Data
+	for _, row := range c.Rows {
+		values := make([]*string, len(row))
+		for i := range row {
+			values[i] = &row[i]
+		}
+		buf = append(buf, codec.NewDataRow(values...).Data...)
+	}
+	buf = append(buf, codec.NewCommandComplete(fmt.Sprintf("SELECT %d", len(c.Rows))).Data...)
+	return append(buf, codec.NewReadyForQueryMessage(codec.BackendTransactionStatusIdle).Data...)
+}
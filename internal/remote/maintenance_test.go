@@ -0,0 +1,92 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestMaintenance(t *testing.T) {
+	entry := &ConfigEntry{Name: "maintained", Maintenance: &Maintenance{
+		Message:      "back at 10:00 UTC",
+		HealthChecks: []CannedResponse{{Query: "SELECT 1", Rows: [][]string{{"1"}}}},
+	}}
+	if err := entry.Maintenance.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Maintenance{HealthChecks: []CannedResponse{{Query: "SELECT 1, 2", Columns: []string{"a", "b"}, Rows: [][]string{{"1"}}}}}).validate(); err == nil {
+		t.Error("expected a row without a value for each column to be rejected")
+	}
+	if err := SetMaintenance(entry, true, "5703", ""); err == nil {
+		t.Error("expected an invalid SQLSTATE to be rejected")
+	}
+	defer func() {
+		maintenanceOverrides.Lock()
+		delete(maintenanceOverrides.m, entry.Name)
+		maintenanceOverrides.Unlock()
+	}()
+
+	if _, on := maintenanceOf(entry); on {
+		t.Error("expected the entry not to be in maintenance until turned on")
+	}
+	if err := SetMaintenance(entry, true, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	maintenance, on := maintenanceOf(entry)
+	if !on || maintenance.code != codec.SQLStateCannotConnectNow || maintenance.message != "back at 10:00 UTC" {
+		t.Errorf("expected the configured error in maintenance, got %+v (%v)", maintenance, on)
+	}
+
+	// a replication client can't be answered with health checks
+	if _, err := checkMaintenance(&association{config: entry, entry: entry.Name, replication: "database"}); err == nil {
+		t.Error("expected a replication client to be turned away")
+	}
+
+	a := &association{session: "s1", config: entry, entry: entry.Name}
+	if a.maintenance, _ = checkMaintenance(a); !a.maintenance {
+		t.Fatal("expected the session to be served by the proxy")
+	}
+	client, other, cleanup := associate(a)
+	defer cleanup()
+
+	requests := append(codec.NewQuery(" select 1; ").Data, codec.NewQuery("SELECT now()").Data...)
+	done := make(chan error, 1)
+	go func() { done <- ServeMaintenance(client, bufio.NewReader(bytes.NewReader(requests))) }()
+
+	reader := bufio.NewReader(other)
+	var types []codec.MessageType
+	for {
+		message, err := codec.ReadMessage(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, message.Type)
+		if message.Type == codec.MessageTypeErrorResponse {
+			parsed, _ := message.ParseAsErrorResponse()
+			if parsed.Code != codec.SQLStateCannotConnectNow || parsed.Severity != codec.ErrorSeverityFatal {
+				t.Errorf("expected a FATAL 57P03 error, got %+v", parsed)
+			}
+			break
+		}
+	}
+	expected := []codec.MessageType{
+		codec.MessageTypeRowDescription, codec.MessageTypeDataRow, codec.MessageTypeCommandComplete,
+		codec.MessageTypeReadyForQuery, codec.MessageTypeErrorResponse,
+	}
+	if !slices.Equal(types, expected) {
+		t.Errorf("expected %v, got %v", expected, types)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := SetMaintenance(entry, false, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, on := maintenanceOf(&ConfigEntry{Name: entry.Name, Maintenance: &Maintenance{Enabled: true}}); on {
+		t.Error("expected turning maintenance off to override the config")
+	}
+}
@@ -0,0 +1,121 @@
+package remote
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Settings of an entry specialized for some of its users, like pgbouncer's per-user settings, e.g.
+// a bigger pool and no statement_timeout for a batch job's role.  Fields that are unset keep the
+// entry's value.
+type ConfigOverride struct {
+	// who the override applies to
+	Users []string `json:"users"`
+
+	Pool             *PoolConfig   `json:"pool"`
+	PoolMode         string        `json:"pool_mode"`
+	ConnectTimeout   Duration      `json:"connect_timeout"`
+	ServerResetQuery *string       `json:"server_reset_query"`
+	Guardrails       *Guardrails   `json:"guardrails"`
+	Policy           *AccessPolicy `json:"policy"`
+}
+
+// Returns the entry as it applies to `user`, i.e. with the first override listing the user
+// applied.  Users with an override get pools of their own.
+func (e *ConfigEntry) forUser(user string) *ConfigEntry {
+	for i := range e.Overrides {
+		if slices.Contains(e.Overrides[i].Users, user) {
+			return e.withOverride(i)
+		}
+	}
+	return e
+}
+
+func (e *ConfigEntry) withOverride(i int) *ConfigEntry {
+	o := &e.Overrides[i]
+	entry := *e
+	entry.override = i + 1
+
+	if o.Pool != nil {
+		entry.Pool = o.Pool
+		if o.Pool.PoolMode != "" {
+			entry.PoolMode = o.Pool.PoolMode
+		}
+	}
+	if o.PoolMode != "" {
+		entry.PoolMode = o.PoolMode
+		if entry.Pool != nil && entry.Pool.PoolMode != "" {
+			// the entry's pool block may name its own pool_mode, which the override replaces too
+			pool := *entry.Pool
+			pool.PoolMode = o.PoolMode
+			entry.Pool = &pool
+		}
+	}
+	if o.ConnectTimeout != 0 {
+		entry.ConnectTimeout = o.ConnectTimeout
+	}
+	if o.ServerResetQuery != nil {
+		entry.ServerResetQuery = o.ServerResetQuery
+	}
+	if o.Guardrails != nil {
+		entry.Guardrails = o.Guardrails
+	}
+	if o.Policy != nil {
+		entry.Policy = o.Policy
+	}
+
+	return &entry
+}
+
+// Validates the settings that overrides may change
+func (e *ConfigEntry) validate() error {
+	if e.Guardrails != nil {
+		if err := e.Guardrails.validate(); err != nil {
+			return fmt.Errorf("invalid guardrails: %w", err)
+		}
+	}
+
+	switch e.poolMode() {
+	case PoolModeSession, PoolModeTransaction, PoolModeStatement:
+	default:
+		return fmt.Errorf("unknown pool_mode %q", e.poolMode())
+	}
+	if e.Pool != nil {
+		if err := e.Pool.validate(e); err != nil {
+			return fmt.Errorf("invalid pool: %w", err)
+		}
+	}
+
+	if e.Policy != nil {
+		if err := e.Policy.validate(); err != nil {
+			return fmt.Errorf("invalid policy: %w", err)
+		}
+	}
+
+	if e.StartupParameters != nil {
+		if err := e.StartupParameters.validate(e); err != nil {
+			return fmt.Errorf("invalid startup_parameters: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Validates each override as applied to the entry
+func (e *ConfigEntry) validateOverrides() error {
+	for i := range e.Overrides {
+		o := &e.Overrides[i]
+		if len(o.Users) == 0 {
+			return fmt.Errorf("override %d applies to no users", i)
+		}
+		if o.Pool != nil && o.PoolMode != "" && o.Pool.PoolMode != "" && o.Pool.PoolMode != o.PoolMode {
+			return fmt.Errorf("override %d: pool_mode %q conflicts with pool.pool_mode %q", i, o.PoolMode, o.Pool.PoolMode)
+		}
+
+		entry := e.withOverride(i)
+		if err := entry.validate(); err != nil {
+			return fmt.Errorf("override %d: %w", i, err)
+		}
+	}
+	return nil
+}
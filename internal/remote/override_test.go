@@ -0,0 +1,65 @@
+package remote
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverrides(t *testing.T) {
+	config, err := readTestConfig(t, `{"entries": [{
+		"name": "app",
+		"connect_timeout": "2s",
+		"pool": {"pool_mode": "transaction", "pool_size": 10, "max_client_conn": 100},
+		"guardrails": {"statement_timeout": "30s"},
+		"overrides": [
+			{"users": ["batch"], "pool": {"pool_size": 2}, "pool_mode": "session", "guardrails": {}},
+			{"users": ["batch", "report"], "connect_timeout": "20s"}
+		]
+	}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &config.Entries[0]
+
+	if e := entry.forUser("alice"); e != entry {
+		t.Errorf("expected users without an override to get the entry, got %+v", e)
+	}
+
+	batch := entry.forUser("batch")
+	if batch.poolMode() != PoolModeSession || batch.Pool.size() != 2 || batch.Guardrails.StatementTimeout != 0 {
+		t.Errorf("expected the first override listing batch to apply, got %+v", batch)
+	}
+	if batch.connectTimeout() != 2*time.Second {
+		t.Errorf("expected batch to keep the entry's connect_timeout, got %s", batch.connectTimeout())
+	}
+	if entry.poolMode() != PoolModeTransaction || entry.Pool.size() != 10 {
+		t.Errorf("expected the override to leave the entry alone, got %+v", entry)
+	}
+
+	report := entry.forUser("report")
+	if report.connectTimeout() != 20*time.Second || report.poolMode() != PoolModeTransaction {
+		t.Errorf("expected report to get the second override, got %+v", report)
+	}
+
+	target := ConfigTarget{Name: "primary"}
+	if getPool(entry, target) == getPool(batch, target) || getPool(batch, target) == getPool(report, target) {
+		t.Error("expected each override to get pools of its own")
+	}
+	if getPool(report, target) != getPool(entry.forUser("report"), target) {
+		t.Error("expected sessions of the same override to share pools")
+	}
+
+	for _, tt := range []struct{ overrides, err string }{
+		{`[{"pool_mode": "session"}]`, "no users"},
+		{`[{"users": ["batch"], "pool_mode": "connection"}]`, "unknown pool_mode"},
+		{`[{"users": ["batch"], "pool_mode": "session", "pool": {"pool_mode": "transaction"}}]`, "conflicts"},
+		{`[{"users": ["batch"], "pool": {"reserve_pool_size": 2}}]`, "requires a pool_size"},
+		{`[{"users": ["batch"], "guardrails": {"statement_timeout": "-1s"}}]`, "invalid guardrails"},
+	} {
+		_, err := readTestConfig(t, `{"entries": [{"name": "app", "overrides": `+tt.overrides+`}]}`)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("expected %s to be rejected with %q, got %v", tt.overrides, tt.err, err)
+		}
+	}
+}
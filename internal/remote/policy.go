@@ -0,0 +1,301 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+	"github.com/michaelhelvey/pgproxy/internal/ratelimit"
+)
+
+// Restricts when and how much the users of an entry may use it
+type AccessPolicy struct {
+	// when users may connect.  A user may connect during any schedule that lists them (or lists no
+	// users), and at any time if no schedule applies to them.
+	Schedules []Schedule `json:"schedules"`
+	// concurrent sessions each user may have on the entry, unlimited if 0
+	MaxSessionsPerUser int `json:"max_sessions_per_user"`
+	// requests (queries, or extended protocol batches) each user may start per minute across all
+	// their sessions on the entry, unlimited if 0
+	MaxQueriesPerMinute int `json:"max_queries_per_minute"`
+	// token bucket limits on the requests and bytes each client (or user) sends, unlimited if unset
+	RateLimit *RateLimit `json:"rate_limit"`
+	// only log and count the sessions and requests the policy would refuse, e.g. to try out a new
+	// policy against live traffic before enforcing it
+	DryRun bool `json:"dry_run"`
+
+	queries *ratelimit.Keyed
+}
+
+// A daily time window, e.g. {"users": ["etl"], "from": "09:00", "to": "18:00", "days": ["mon",
+// "tue", "wed", "thu", "fri"], "timezone": "Europe/Berlin"}.  A window with `to` before `from` runs
+// past midnight.
+type Schedule struct {
+	// who the window applies to, everyone if empty
+	Users []string `json:"users"`
+	// "mon" to "sun", every day if empty.  For windows past midnight this is the day they start.
+	Days []string `json:"days"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	// IANA time zone name, the proxy's local time if empty
+	Timezone string `json:"timezone"`
+
+	from, to time.Duration
+	days     []time.Weekday
+	location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (p *AccessPolicy) validate() error {
+	for i := range p.Schedules {
+		if err := p.Schedules[i].parse(); err != nil {
+			return fmt.Errorf("schedule %d: %w", i, err)
+		}
+	}
+
+	if p.MaxQueriesPerMinute > 0 {
+		p.queries = ratelimit.NewKeyed(float64(p.MaxQueriesPerMinute)/60, p.MaxQueriesPerMinute)
+	}
+	if p.RateLimit != nil {
+		if err := p.RateLimit.validate(); err != nil {
+			return fmt.Errorf("rate_limit: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Schedule) parse() error {
+	var err error
+	if s.from, err = parseTimeOfDay(s.From); err != nil {
+		return err
+	}
+	if s.to, err = parseTimeOfDay(s.To); err != nil {
+		return err
+	}
+
+	for _, day := range s.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", day)
+		}
+		s.days = append(s.days, weekday)
+	}
+
+	s.location = time.Local
+	if s.Timezone != "" {
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parses "HH:MM" into the time since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (s *Schedule) appliesTo(user string) bool {
+	return len(s.Users) == 0 || slices.Contains(s.Users, user)
+}
+
+func (s *Schedule) contains(now time.Time) bool {
+	now = now.In(s.location)
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	day := now.Weekday()
+
+	if s.from > s.to && sinceMidnight < s.to {
+		// the early morning part of a window that started the day before
+		day = (day + 6) % 7
+	} else if s.from > s.to && sinceMidnight >= s.from {
+		// the evening part of a window past midnight
+	} else if sinceMidnight < s.from || sinceMidnight >= s.to {
+		return false
+	}
+
+	return len(s.days) == 0 || slices.Contains(s.days, day)
+}
+
+// Whether `user` may connect at `now`
+func (p *AccessPolicy) allowsConnectionAt(user string, now time.Time) bool {
+	applies := false
+	for i := range p.Schedules {
+		s := &p.Schedules[i]
+		if !s.appliesTo(user) {
+			continue
+		}
+		if s.contains(now) {
+			return true
+		}
+		applies = true
+	}
+
+	return !applies
+}
+
+// A session or request the proxy refuses itself because of an entry's AccessPolicy (or the
+// pool's max_client_conn, or statement pooling), with the SQLSTATE and message to send the client
+type PolicyError struct {
+	Code    string
+	Message string
+	// for refused requests, the transaction status to report in the ReadyForQuery that ends them
+	Status codec.BackendTransactionStatus
+	// for requests that can't be refused in place, e.g. because earlier ones are still in flight,
+	// whether the session must be ended instead
+	Fatal bool
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// Checks the access policy of a client's entry once the client has authenticated, and counts the
+// client towards its user's session limit if it may connect.  Returns a *PolicyError if it may not.
+func AdmitSession(client net.Conn) error {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
+		return errors.New("no associated client")
+	}
+
+	policy := a.config.Policy
+	if policy == nil {
+		a.admitted = true
+		return nil
+	}
+
+	if !policy.allowsConnectionAt(a.user, time.Now()) {
+		err := &PolicyError{
+			Code:    codec.SQLStateInvalidAuthorization,
+			Message: fmt.Sprintf("role %q is not permitted to connect to %s at this time", a.user, a.entry),
+		}
+		if !policy.DryRun {
+			return err
+		}
+		wouldRefuse(a, "schedules", err)
+	}
+
+	if policy.MaxSessionsPerUser > 0 {
+		sessions := 0
+		for _, other := range associations.m {
+			if other.admitted && other.entry == a.entry && other.user == a.user {
+				sessions++
+			}
+		}
+		if sessions >= policy.MaxSessionsPerUser {
+			err := &PolicyError{
+				Code:    codec.SQLStateTooManyConnections,
+				Message: fmt.Sprintf("too many connections for role %q", a.user),
+			}
+			if !policy.DryRun {
+				return err
+			}
+			wouldRefuse(a, "max_sessions_per_user", err)
+		}
+	}
+
+	a.admitted = true
+	return nil
+}
+
+// Called by the relay before BeginRequest for every message from the client.  Returns a
+// *PolicyError if the message starts a request over the user's query rate limit, in which case
+// the relay must answer the request itself rather than forwarding it.
+//
+// A request refused while others are still in flight can't be answered in turn, so the refusal
+// ends the session instead, like CheckStatementPooling's.
+func CheckRequest(client net.Conn, messageType codec.MessageType) error {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil || a.config.Policy == nil || a.config.Policy.queries == nil || !a.startsRequest(messageType) {
+		return nil
+	}
+
+	if a.config.Policy.queries.Allow(a.user) {
+		return nil
+	}
+
+	err := &PolicyError{
+		Code:    codec.SQLStateConfigurationLimitExceeded,
+		Message: fmt.Sprintf("query rate limit of %d per minute exceeded for role %q", a.config.Policy.MaxQueriesPerMinute, a.user),
+		Status:  a.txStatus,
+		Fatal:   a.pending > 0 || a.unsynced,
+	}
+	if a.config.Policy.DryRun {
+		wouldRefuse(a, "max_queries_per_minute", err)
+		return nil
+	}
+	return err
+}
+
+// Whether a message from the client starts a request.  Called with the associations lock held.
+func (a *association) startsRequest(messageType codec.MessageType) bool {
+	switch messageType {
+	case codec.MessageTypeQuery, codec.MessageTypeFunctionCall:
+		return true
+	case codec.MessageTypeParse, codec.MessageTypeBind, codec.MessageTypeDescribe,
+		codec.MessageTypeExecute, codec.MessageTypeClose:
+		// only the first message of an extended protocol batch starts a request
+		return !a.unsynced
+	default:
+		return false
+	}
+}
+
+// Called by the relay like CheckRequest.  In statement pooling mode, returns a *PolicyError for a
+// request that would leave a transaction block open (a Query like `BEGIN; UPDATE ...`, or the
+// Parse of a BEGIN), which the relay must answer itself.  With requests in flight, the refusal
+// ends the session, as it couldn't be answered in turn.
+func CheckStatementPooling(client net.Conn, message *codec.Message) error {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil || a.config.poolMode() != PoolModeStatement {
+		return nil
+	}
+
+	if !query.OpensTransaction(messageStatements(message)) {
+		return nil
+	}
+	return &PolicyError{
+		Code:    codec.SQLStateFeatureNotSupported,
+		Message: fmt.Sprintf("transaction blocks are not allowed in statement pooling mode (entry %s)", a.entry),
+		Status:  a.txStatus,
+		Fatal:   a.pending > 0 || a.unsynced,
+	}
+}
+
+// The statements of a Query or Parse message, nil for other messages
+func messageStatements(message *codec.Message) [][]query.Token {
+	switch message.Type {
+	case codec.MessageTypeQuery:
+		return query.Statements(query.Tokenize(message.ParseAsQuery().QueryString))
+	case codec.MessageTypeParse:
+		if parsed, err := message.ParseAsParse(); err == nil {
+			return query.Statements(query.Tokenize(parsed.QueryString))
+		}
+	}
+	return nil
+}
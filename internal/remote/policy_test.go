@@ -0,0 +1,162 @@
+package remote
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestScheduleContains(t *testing.T) {
+	policy := &AccessPolicy{Schedules: []Schedule{
+		{Users: []string{"analyst"}, Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "09:00", To: "18:00", Timezone: "UTC"},
+		{Users: []string{"etl"}, Days: []string{"fri"}, From: "22:00", To: "04:00", Timezone: "UTC"},
+	}}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2026-10-16 is a Friday
+	at := func(day, hour, minute int) time.Time { return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC) }
+	cases := []struct {
+		user string
+		now  time.Time
+		want bool
+	}{
+		{"analyst", at(16, 9, 0), true},
+		{"analyst", at(16, 17, 59), true},
+		{"analyst", at(16, 18, 0), false},
+		{"analyst", at(17, 12, 0), false},
+		{"etl", at(16, 23, 0), true},
+		{"etl", at(17, 3, 0), true},
+		{"etl", at(16, 3, 0), false},
+		{"etl", at(17, 23, 0), false},
+		{"admin", at(17, 3, 0), true},
+	}
+
+	for _, c := range cases {
+		if got := policy.allowsConnectionAt(c.user, c.now); got != c.want {
+			t.Errorf("allowsConnectionAt(%s, %v) = %v, want %v", c.user, c.now, got, c.want)
+		}
+	}
+
+	for _, invalid := range []Schedule{{From: "9am", To: "18:00"}, {From: "09:00", To: "18:00", Days: []string{"someday"}}, {From: "09:00", To: "18:00", Timezone: "Nowhere/Special"}} {
+		if err := (&AccessPolicy{Schedules: []Schedule{invalid}}).validate(); err == nil {
+			t.Errorf("expected schedule %+v to be invalid", invalid)
+		}
+	}
+}
+
+func TestAccessPolicyLimits(t *testing.T) {
+	policy := &AccessPolicy{MaxSessionsPerUser: 1, MaxQueriesPerMinute: 2}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	entry := &ConfigEntry{Name: "limited", Policy: policy}
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, _, cleanup := associate(&association{config: entry, entry: entry.Name, user: "alice", txStatus: codec.BackendTransactionStatusIdle})
+		defer cleanup()
+		clients = append(clients, client)
+	}
+
+	var policyErr *PolicyError
+	if err := AdmitSession(clients[0]); err != nil {
+		t.Fatalf("expected first session to be admitted, got %v", err)
+	}
+	if err := AdmitSession(clients[1]); !errors.As(err, &policyErr) || policyErr.Code != codec.SQLStateTooManyConnections {
+		t.Fatalf("expected second session to be over the limit, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := CheckRequest(clients[0], codec.MessageTypeQuery); err != nil {
+			t.Fatalf("expected query %d to be allowed, got %v", i+1, err)
+		}
+	}
+	// messages that don't start a request aren't limited
+	if err := CheckRequest(clients[0], codec.MessageTypeSync); err != nil {
+		t.Fatalf("expected Sync not to count as a request, got %v", err)
+	}
+	if err := CheckRequest(clients[0], codec.MessageTypeParse); !errors.As(err, &policyErr) || policyErr.Code != codec.SQLStateConfigurationLimitExceeded || policyErr.Fatal {
+		t.Fatalf("expected batch over the rate limit to be refused, got %v", err)
+	}
+
+	// a request pipelined behind one in flight can't be answered in turn, so it ends the session
+	BeginRequest(clients[0], codec.MessageTypeQuery)
+	if err := CheckRequest(clients[0], codec.MessageTypeQuery); !errors.As(err, &policyErr) || !policyErr.Fatal {
+		t.Fatalf("expected pipelined query over the rate limit to end the session, got %v", err)
+	}
+}
+
+func TestCheckStatementPooling(t *testing.T) {
+	entry := &ConfigEntry{Name: "statements", PoolMode: PoolModeStatement}
+	a := &association{config: entry, entry: entry.Name, txStatus: codec.BackendTransactionStatusIdle}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	for _, sql := range []string{"SELECT 1", "UPDATE jobs SET done = true; SELECT 1", "BEGIN; UPDATE jobs SET done = true; COMMIT"} {
+		message := codec.NewQuery(sql)
+		if err := CheckStatementPooling(client, &message); err != nil {
+			t.Errorf("expected %q to be allowed, got %v", sql, err)
+		}
+	}
+
+	var policyErr *PolicyError
+	message := codec.NewQuery("BEGIN; UPDATE jobs SET done = true")
+	if err := CheckStatementPooling(client, &message); !errors.As(err, &policyErr) || policyErr.Code != codec.SQLStateFeatureNotSupported || policyErr.Fatal {
+		t.Errorf("expected a query leaving a transaction open to be refused, got %v", err)
+	}
+
+	// behind another query, or as the second Parse of a pipeline, it can't be answered in turn
+	for _, pipelined := range []func(){func() { a.pending = 1 }, func() { a.pending, a.unsynced = 0, true }} {
+		associations.Lock()
+		pipelined()
+		associations.Unlock()
+		parse := codec.NewBuilder(codec.MessageTypeParse).String("").String("BEGIN").Int16(0).Message()
+		for _, message := range []codec.Message{message, parse} {
+			if err := CheckStatementPooling(client, &message); !errors.As(err, &policyErr) || !policyErr.Fatal {
+				t.Errorf("expected a pipelined transaction block to end the session, got %v", err)
+			}
+		}
+	}
+
+	entry.PoolMode = PoolModeTransaction
+	if err := CheckStatementPooling(client, &message); err != nil {
+		t.Errorf("expected transactions to be allowed in transaction pooling mode, got %v", err)
+	}
+}
+
+func TestAccessPolicyDryRun(t *testing.T) {
+	policy := &AccessPolicy{MaxSessionsPerUser: 1, MaxQueriesPerMinute: 1, DryRun: true}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	entry := &ConfigEntry{Name: "trying", Policy: policy}
+	sessions := dryRunRefusals.With(entry.Name, "max_sessions_per_user")
+	queries := dryRunRefusals.With(entry.Name, "max_queries_per_minute")
+	beforeSessions, beforeQueries := sessions.Value(), queries.Value()
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, _, cleanup := associate(&association{config: entry, entry: entry.Name, user: "alice", txStatus: codec.BackendTransactionStatusIdle})
+		defer cleanup()
+		clients = append(clients, client)
+
+		if err := AdmitSession(client); err != nil {
+			t.Fatalf("expected a dry run policy to admit every session, got %v", err)
+		}
+		if err := CheckRequest(client, codec.MessageTypeQuery); err != nil {
+			t.Fatalf("expected a dry run policy to allow every request, got %v", err)
+		}
+	}
+
+	if counted := sessions.Value() - beforeSessions; counted != 1 {
+		t.Errorf("expected one session counted as would be refused, got %d", counted)
+	}
+	if counted := queries.Value() - beforeQueries; counted != 1 {
+		t.Errorf("expected one request counted as would be refused, got %d", counted)
+	}
+}
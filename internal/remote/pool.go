@@ -0,0 +1,514 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// How much of an upstream an entry may use, like pgbouncer's per-database pool settings.  Limits
+// are per target of the entry.
+type PoolConfig struct {
+	// same as the entry's pool_mode, which may be set in either place
+	PoolMode string `json:"pool_mode"`
+	// the most upstream connections to keep open, unlimited if 0.  Clients wait for a connection
+	// to be released when all of them are in use.
+	PoolSize int `json:"pool_size"`
+	// extra connections clients may open once they have waited for `reserve_pool_timeout`
+	// (default DefaultReservePoolTimeout)
+	ReservePoolSize    int      `json:"reserve_pool_size"`
+	ReservePoolTimeout Duration `json:"reserve_pool_timeout"`
+	// extra connections only `emergency_users` may open, straight away, once the pool and its
+	// reserve are in use, so that operators can still get in during an incident.  They are closed
+	// rather than kept idle when released.  Emergency users aren't held to max_client_conn either.
+	EmergencyPoolSize int      `json:"emergency_pool_size"`
+	EmergencyUsers    []string `json:"emergency_users"`
+	// the most client sessions the entry serves at once, unlimited if 0
+	MaxClientConn int `json:"max_client_conn"`
+	// how long a client may wait for an upstream connection before it gets an error, defaults to
+	// DefaultQueryWaitTimeout
+	QueryWaitTimeout Duration `json:"query_wait_timeout"`
+	// when clients of several users wait for a connection, hand freed connections to the waiting
+	// user holding the fewest, so that one busy user can't take the whole pool
+	FairQueuing bool `json:"fair_queuing"`
+}
+
+const (
+	DefaultReservePoolTimeout = 5 * time.Second
+	DefaultQueryWaitTimeout   = 120 * time.Second
+)
+
+var ErrQueryWaitTimeout = errors.New("timed out waiting for an upstream connection")
+
+func (c *PoolConfig) validate(entry *ConfigEntry) error {
+	if c.PoolMode != "" && entry.PoolMode != "" && c.PoolMode != entry.PoolMode {
+		return fmt.Errorf("pool_mode %q conflicts with the entry's pool_mode %q", c.PoolMode, entry.PoolMode)
+	}
+	if c.PoolSize < 0 || c.ReservePoolSize < 0 || c.EmergencyPoolSize < 0 || c.MaxClientConn < 0 ||
+		c.ReservePoolTimeout < 0 || c.QueryWaitTimeout < 0 {
+		return errors.New("sizes and timeouts can't be negative")
+	}
+	if c.PoolSize == 0 && c.ReservePoolSize > 0 {
+		return errors.New("reserve_pool_size requires a pool_size")
+	}
+	if c.EmergencyPoolSize > 0 && (c.PoolSize == 0 || len(c.EmergencyUsers) == 0) {
+		return errors.New("emergency_pool_size requires a pool_size and emergency_users")
+	}
+	if c.PoolSize > 0 && entry.MinPoolSize > c.PoolSize {
+		return fmt.Errorf("min_pool_size %d is larger than pool_size %d", entry.MinPoolSize, c.PoolSize)
+	}
+	return nil
+}
+
+func (c *PoolConfig) size() int {
+	if c == nil {
+		return 0
+	}
+	return c.PoolSize
+}
+
+// The most client sessions the entry serves at once for `user`, unlimited if 0
+func (c *PoolConfig) maxClientConn(user string) int {
+	if c == nil || c.emergencyUser(user) {
+		return 0
+	}
+	return c.MaxClientConn
+}
+
+func (c *PoolConfig) emergencyUser(user string) bool {
+	return c != nil && c.EmergencyPoolSize > 0 && slices.Contains(c.EmergencyUsers, user)
+}
+
+func (c *PoolConfig) fairQueuing() bool {
+	return c != nil && c.FairQueuing
+}
+
+func (c *PoolConfig) reservePoolTimeout() time.Duration {
+	if c.ReservePoolTimeout > 0 {
+		return time.Duration(c.ReservePoolTimeout)
+	}
+	return DefaultReservePoolTimeout
+}
+
+func (c *PoolConfig) queryWaitTimeout() time.Duration {
+	if c.QueryWaitTimeout > 0 {
+		return time.Duration(c.QueryWaitTimeout)
+	}
+	return DefaultQueryWaitTimeout
+}
+
+// Run on pooled connections before they are handed to a new client, unless the entry configures
+// server_reset_query
+const DefaultServerResetQuery = "DISCARD ALL"
+
+func (e *ConfigEntry) serverResetQuery() string {
+	if e.ServerResetQuery != nil {
+		return *e.ServerResetQuery
+	}
+
+	return DefaultServerResetQuery
+}
+
+// How often pools check that they still hold at least min_pool_size connections, in addition to
+// checking whenever a connection is closed
+const poolMaintenanceInterval = 5 * time.Second
+
+// Upstream connections for one target of an entry.  Connections are handed to a single client
+// at a time, and go back into the pool when the client's session (or, in transaction pooling mode,
+// transaction) ends cleanly.
+type pool struct {
+	entry  ConfigEntry
+	target ConfigTarget
+
+	mu   sync.Mutex
+	idle []*pgx.Conn
+	// idle + in use + currently dialing
+	open int
+	// closed (and replaced) whenever a connection is released or closed, to wake up the clients
+	// waiting for one
+	freed chan struct{}
+
+	replenish chan struct{}
+	// set once the pool's entry changed, see retireEntry
+	retired bool
+
+	// with fair_queuing: the user each connection in use was handed to, and how many connections
+	// each user holds and how many of their sessions are waiting for one
+	holders map[*pgx.Conn]string
+	users   map[string]*poolUser
+}
+
+type poolUser struct {
+	active, waiting int
+}
+
+var pools = struct {
+	sync.Mutex
+	m map[string]*pool
+}{m: make(map[string]*pool)}
+
+func getPool(entry *ConfigEntry, target ConfigTarget) *pool {
+	key := entry.poolKey(target)
+
+	pools.Lock()
+	defer pools.Unlock()
+
+	if p := pools.m[key]; p != nil {
+		return p
+	}
+
+	p := &pool{
+		entry: *entry, target: target, freed: make(chan struct{}), replenish: make(chan struct{}, 1),
+		holders: make(map[*pgx.Conn]string), users: make(map[string]*poolUser),
+	}
+	pools.m[key] = p
+	go p.maintain()
+
+	return p
+}
+
+// Dials min_pool_size connections for every target of every pooled entry in the background, so
+// that the first clients after a deploy or failover don't pay for a cold connect
+func Prewarm(configs []ConfigEntry) {
+	for i := range configs {
+		// the pools of templated entries are only known once their clients connect, and shadow
+		// entries get no clients
+		if configs[i].MinPoolSize <= 0 || configs[i].templated() || configs[i].Shadow {
+			continue
+		}
+
+		for _, t := range configs[i].AllTargets() {
+			getPool(&configs[i], t)
+		}
+	}
+}
+
+// Keeps the pool at or above min_pool_size
+func (p *pool) maintain() {
+	ticker := time.NewTicker(poolMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		p.fill()
+
+		p.mu.Lock()
+		retired := p.retired
+		p.mu.Unlock()
+		if retired {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.replenish:
+		}
+	}
+}
+
+func (p *pool) fill() {
+	for {
+		if isDraining(p.entry.Name, p.target.Name) {
+			return
+		}
+
+		p.mu.Lock()
+		if p.retired || p.open >= p.entry.MinPoolSize {
+			p.mu.Unlock()
+			return
+		}
+		p.open++
+		p.mu.Unlock()
+
+		conn, err := connect(&p.entry, p.target, "pgproxy [pool]", "", nil)
+		if err != nil {
+			slog.Error("could not pre-warm pool connection", "entry", p.entry.Name, "target", p.target.Name, "error", err)
+			p.closed()
+			// wait for the next maintenance tick rather than hammering a failing upstream
+			return
+		}
+
+		slog.Debug("pre-warmed pool connection", "entry", p.entry.Name, "target", p.target.Name)
+		p.mu.Lock()
+		p.idle = append(p.idle, conn)
+		p.wake()
+		p.mu.Unlock()
+	}
+}
+
+// Takes an idle connection from the pool, or returns nil if there is none.  Unless
+// `applicationName` is empty, connections are re-tagged with the new client's application_name,
+// which doubles as a liveness check for connections that may have been dropped by the upstream
+// while idle.
+func (p *pool) acquire(applicationName string) *pgx.Conn {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if applicationName == "" {
+			return conn
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.entry.connectTimeout())
+		_, err := conn.PgConn().ExecParams(
+			ctx, "SELECT set_config('application_name', $1, false)", [][]byte{[]byte(applicationName)}, nil, nil, nil,
+		).Close()
+		cancel()
+
+		if err == nil {
+			return conn
+		}
+
+		slog.Warn("discarding broken pool connection", "entry", p.entry.Name, "target", p.target.Name, "error", err)
+		conn.Close(context.Background())
+		p.closed()
+	}
+}
+
+// Gives a client a connection: an idle one if there is one, otherwise a new one if the pool has
+// room for it.  A full pool makes the client wait until a connection is released, dipping into
+// the reserve once it has waited for reserve_pool_timeout, and failing with ErrQueryWaitTimeout
+// once it has waited for query_wait_timeout.  Emergency users may open emergency connections
+// instead of waiting.  With fair_queuing, a client leaves the connections it could take to the
+// clients of users that hold fewer.  `tag` is as for acquire, and `applicationName` is what new
+// connections are dialed with.
+func (p *pool) get(tag, applicationName, user string) (*pgx.Conn, error) {
+	config := p.entry.Pool
+	start := time.Now()
+	fair := config.fairQueuing() && !config.emergencyUser(user)
+	if fair {
+		p.mu.Lock()
+		p.user(user).waiting++
+		p.mu.Unlock()
+		defer func() {
+			p.mu.Lock()
+			p.user(user).waiting--
+			p.forgetUser(user)
+			// a client that was yielding to this one may take a connection now
+			p.wake()
+			p.mu.Unlock()
+		}()
+	}
+
+	for {
+		p.mu.Lock()
+		yield := fair && p.outranked(user)
+		p.mu.Unlock()
+
+		if !yield {
+			if conn := p.acquire(tag); conn != nil {
+				p.handedOut(conn, user, fair)
+				return conn, nil
+			}
+		}
+
+		p.mu.Lock()
+		if !yield && len(p.idle) > 0 {
+			// released since we looked
+			p.mu.Unlock()
+			continue
+		}
+
+		waited := time.Since(start)
+		size := config.size()
+		reserve := 0
+		if size > 0 && waited >= config.reservePoolTimeout() {
+			reserve = config.ReservePoolSize
+		}
+		if config.emergencyUser(user) {
+			reserve = config.ReservePoolSize + config.EmergencyPoolSize
+		}
+		if !yield && (size == 0 || p.open < size+reserve) {
+			p.open++
+			p.mu.Unlock()
+
+			conn, err := connect(&p.entry, p.target, applicationName, "", nil)
+			if err != nil {
+				p.closed()
+				return nil, err
+			}
+			p.handedOut(conn, user, fair)
+			return conn, nil
+		}
+		freed := p.freed
+		p.mu.Unlock()
+
+		if waited >= config.queryWaitTimeout() {
+			return nil, fmt.Errorf("%w after %s", ErrQueryWaitTimeout, config.queryWaitTimeout())
+		}
+		timeout := config.queryWaitTimeout() - waited
+		if config.ReservePoolSize > 0 && waited < config.reservePoolTimeout() {
+			timeout = min(timeout, config.reservePoolTimeout()-waited)
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-freed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Called with p.mu held
+func (p *pool) user(name string) *poolUser {
+	u := p.users[name]
+	if u == nil {
+		u = &poolUser{}
+		p.users[name] = u
+	}
+	return u
+}
+
+// Drops a user who holds nothing and waits for nothing.  Called with p.mu held.
+func (p *pool) forgetUser(name string) {
+	if u := p.users[name]; u != nil && u.active == 0 && u.waiting == 0 {
+		delete(p.users, name)
+	}
+}
+
+// Whether a client of `user` should leave freed connections to another user's waiting clients,
+// because that user holds fewer connections.  Called with p.mu held.
+func (p *pool) outranked(user string) bool {
+	active := p.user(user).active
+	for name, u := range p.users {
+		if name != user && u.waiting > 0 && u.active < active {
+			return true
+		}
+	}
+	return false
+}
+
+// Records which user a connection was handed to, for fair_queuing
+func (p *pool) handedOut(conn *pgx.Conn, user string, fair bool) {
+	if !fair {
+		return
+	}
+
+	p.mu.Lock()
+	p.holders[conn] = user
+	p.user(user).active++
+	p.mu.Unlock()
+}
+
+// Records that a connection handed out by get is no longer in use, before it is released or closed
+func (p *pool) returned(conn *pgx.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	user, ok := p.holders[conn]
+	if !ok {
+		return
+	}
+	delete(p.holders, conn)
+	p.user(user).active--
+	p.forgetUser(user)
+}
+
+// Wakes up the clients waiting for a connection.  Called with p.mu held.
+func (p *pool) wake() {
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+// Records that one of the pool's connections was closed
+func (p *pool) closed() {
+	p.mu.Lock()
+	p.open--
+	p.wake()
+	p.mu.Unlock()
+
+	select {
+	case p.replenish <- struct{}{}:
+	default:
+	}
+}
+
+// Returns a connection to the pool.  When a session ends (`reset`), the entry's server_reset_query
+// is run first so that session state (GUCs, temp tables, advisory locks, prepared statements...)
+// doesn't leak to the next client; if it fails, or doesn't leave the connection idle, the
+// connection is closed instead.  Between transactions in transaction pooling mode there is no
+// reset: sessions that change session state are pinned instead.
+func (p *pool) release(conn *pgx.Conn, reset bool) {
+	if query := p.entry.serverResetQuery(); reset && query != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), p.entry.connectTimeout())
+		_, err := conn.PgConn().Exec(ctx, query).ReadAll()
+		cancel()
+
+		if err == nil && conn.PgConn().TxStatus() != 'I' {
+			err = fmt.Errorf("connection not idle after reset (status %c)", conn.PgConn().TxStatus())
+		}
+
+		if err != nil {
+			slog.Warn("closing pool connection after failed reset", "entry", p.entry.Name, "target", p.target.Name, "error", err)
+			conn.Close(context.Background())
+			p.closed()
+			return
+		}
+	}
+
+	p.mu.Lock()
+	if size := p.entry.Pool.size(); p.retired || size > 0 && p.open > size+p.entry.Pool.ReservePoolSize {
+		// an emergency connection, which must be free for the next emergency, or one dialed with
+		// settings the entry no longer has
+		p.mu.Unlock()
+		conn.Close(context.Background())
+		p.closed()
+		return
+	}
+	p.idle = append(p.idle, conn)
+	p.wake()
+	p.mu.Unlock()
+}
+
+// Closes the pool's idle connections, e.g. because its target is being drained, and returns how
+// many there were
+func (p *pool) closeIdle() int {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.Close(context.Background())
+		p.closed()
+	}
+	return len(idle)
+}
+
+// Closes the pool's idle connections, and those in use once they are released, for a pool whose
+// entry changed and that no new session will use
+func (p *pool) retire() {
+	p.mu.Lock()
+	p.retired = true
+	p.mu.Unlock()
+
+	p.closeIdle()
+}
+
+// Closes the idle connections of the pools for the target, including those of the entry's overrides
+func closeIdlePoolConns(entry, target string) {
+	var matching []*pool
+	pools.Lock()
+	for _, p := range pools.m {
+		if p.entry.Name == entry && p.target.Name == target {
+			matching = append(matching, p)
+		}
+	}
+	pools.Unlock()
+
+	for _, p := range matching {
+		p.closeIdle()
+	}
+}
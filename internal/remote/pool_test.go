@@ -0,0 +1,117 @@
+package remote
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestPoolConfig(t *testing.T) {
+	config, err := readTestConfig(t, `{"entries": [{
+		"name": "app",
+		"pool": {"pool_mode": "transaction", "pool_size": 10, "reserve_pool_size": 2, "max_client_conn": 100}
+	}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := &config.Entries[0]; entry.poolMode() != PoolModeTransaction || !entry.pooled() {
+		t.Errorf("expected a transaction pooled entry, got %+v", entry)
+	}
+
+	for _, tt := range []struct{ entry, err string }{
+		{`{"pool_mode": "session", "pool": {"pool_mode": "transaction"}}`, "conflicts"},
+		{`{"pool_mode": "connection"}`, "unknown pool_mode"},
+		{`{"pool": {"reserve_pool_size": 2}}`, "requires a pool_size"},
+		{`{"min_pool_size": 5, "pool": {"pool_size": 2}}`, "larger than pool_size"},
+		{`{"pool": {"pool_size": -1}}`, "negative"},
+		{`{"lazy_connect": true, "auth_query": "SELECT passwd FROM pg_shadow WHERE usename = $1"}`, "lazy_connect"},
+	} {
+		_, err := readTestConfig(t, `{"entries": [`+tt.entry+`]}`)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("expected %s to be rejected with %q, got %v", tt.entry, tt.err, err)
+		}
+	}
+}
+
+func TestPoolWait(t *testing.T) {
+	entry := &ConfigEntry{Name: "full", Pool: &PoolConfig{PoolSize: 1, QueryWaitTimeout: Duration(50 * time.Millisecond)}}
+	p := &pool{entry: *entry, target: ConfigTarget{Name: "full", Provider: "none"}, freed: make(chan struct{}), open: 1}
+
+	start := time.Now()
+	if _, err := p.get("", "app", "alice"); !errors.Is(err, ErrQueryWaitTimeout) {
+		t.Fatalf("expected a full pool to time out, got %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("expected to wait for query_wait_timeout, waited %s", waited)
+	}
+
+	// the reserve lets the client dial, which fails for want of a provider
+	p.entry.Pool = &PoolConfig{PoolSize: 1, ReservePoolSize: 1, ReservePoolTimeout: Duration(10 * time.Millisecond)}
+	if _, err := p.get("", "app", "alice"); err == nil || errors.Is(err, ErrQueryWaitTimeout) {
+		t.Errorf("expected to dial a reserve connection, got %v", err)
+	}
+
+	// a released connection wakes up waiting clients
+	p.entry.Pool = &PoolConfig{PoolSize: 1}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.closed()
+	}()
+	if _, err := p.get("", "app", "alice"); err == nil || errors.Is(err, ErrQueryWaitTimeout) {
+		t.Errorf("expected to dial once a connection was closed, got %v", err)
+	}
+	if p.open != 0 {
+		t.Errorf("expected failed dials to give their slot back, got %d open", p.open)
+	}
+}
+
+func TestEmergencyPool(t *testing.T) {
+	config := &PoolConfig{PoolSize: 1, QueryWaitTimeout: Duration(20 * time.Millisecond), EmergencyPoolSize: 1, EmergencyUsers: []string{"postgres"}}
+	p := &pool{entry: ConfigEntry{Name: "full", Pool: config}, target: ConfigTarget{Name: "full", Provider: "none"}, freed: make(chan struct{}), open: 1}
+
+	if _, err := p.get("", "app", "alice"); !errors.Is(err, ErrQueryWaitTimeout) {
+		t.Errorf("expected other users to wait for the full pool, got %v", err)
+	}
+	// the emergency user dials straight away, which fails for want of a provider
+	if _, err := p.get("", "psql", "postgres"); err == nil || errors.Is(err, ErrQueryWaitTimeout) {
+		t.Errorf("expected the emergency user to dial an emergency connection, got %v", err)
+	}
+
+	if config.maxClientConn("postgres") != 0 {
+		t.Error("expected emergency users not to be held to max_client_conn")
+	}
+	if err := (&PoolConfig{EmergencyPoolSize: 1}).validate(&ConfigEntry{}); err == nil {
+		t.Error("expected an emergency pool without pool_size or users to be rejected")
+	}
+}
+
+func TestFairQueuing(t *testing.T) {
+	config := &PoolConfig{PoolSize: 2, QueryWaitTimeout: Duration(20 * time.Millisecond), FairQueuing: true}
+	p := &pool{
+		entry: ConfigEntry{Name: "shared", Pool: config}, target: ConfigTarget{Name: "shared", Provider: "none"}, freed: make(chan struct{}),
+		holders: make(map[*pgx.Conn]string), users: map[string]*poolUser{"alice": {active: 1}, "bob": {waiting: 1}},
+	}
+
+	// alice already holds a connection, so the room left goes to bob, who is waiting
+	if _, err := p.get("", "app", "alice"); !errors.Is(err, ErrQueryWaitTimeout) {
+		t.Errorf("expected alice to leave the free connection to bob, got %v", err)
+	}
+	p.users["bob"].waiting = 0
+	// bob got his connection, alice dials, which fails for want of a provider
+	if _, err := p.get("", "app", "alice"); err == nil || errors.Is(err, ErrQueryWaitTimeout) {
+		t.Errorf("expected alice to dial once nobody with fewer connections waits, got %v", err)
+	}
+	if u := p.users["alice"]; u == nil || u.active != 1 || u.waiting != 0 {
+		t.Errorf("expected alice to hold one connection and wait for none, got %+v", u)
+	}
+
+	conn := &pgx.Conn{}
+	p.handedOut(conn, "carol", true)
+	p.returned(conn)
+	if _, ok := p.users["carol"]; ok || len(p.holders) != 0 {
+		t.Errorf("expected returned connections to be forgotten, got %v %v", p.users, p.holders)
+	}
+}
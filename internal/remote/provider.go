@@ -0,0 +1,184 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/redact"
+)
+
+// Providers resolve provider_meta into the config for an upstream connection.  The proxy originates
+// the upstream startup message itself (via pgx), so providers return a config rather than a
+// connection so that the proxy can adjust it before dialing.
+type ConfigProvider interface {
+	GetConnConfig(metadata map[string]string) (*pgx.ConnConfig, error)
+}
+
+// Connects with a connection string (`url`, a URL or keyword/value string), a service of a
+// pg_service.conf file (`service`), or both, in which case the url's settings win.  As with
+// libpq, services are looked up in `servicefile` (default $PGSERVICEFILE or ~/.pg_service.conf),
+// and connections without a password look theirs up in `passfile` (default $PGPASSFILE or
+// ~/.pgpass), so that upstream credentials can live where the rest of the tooling keeps them.
+type StaticProvider struct{}
+
+// provider_meta keys of the StaticProvider passed on as connection settings
+var staticSettings = []string{"service", "servicefile", "passfile"}
+
+func (p StaticProvider) GetConnConfig(metadata map[string]string) (*pgx.ConnConfig, error) {
+	connString := metadata["url"]
+	if len(connString) == 0 && len(metadata["service"]) == 0 {
+		return nil, errors.New("not able to find required 'url' (or 'service') key on provider_meta")
+	}
+
+	settings := map[string]string{}
+	for _, key := range staticSettings {
+		if value := metadata[key]; value != "" {
+			settings[key] = value
+		}
+	}
+	if path := settings["passfile"]; path != "" {
+		// libpq ignores password files others can read, pgx doesn't
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read passfile: %w", err)
+		}
+		if info.Mode().Perm()&0o077 != 0 {
+			return nil, fmt.Errorf("passfile %s has group or world access, permissions should be u=rw (0600) or less", path)
+		}
+	}
+
+	connString, err := withConnSettings(connString, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("StaticProvider: getting new connection from url", "url", redact.String(connString))
+
+	return pgx.ParseConfig(connString)
+}
+
+// Adds settings to a connection string, in whichever format it is
+func withConnSettings(connString string, settings map[string]string) (string, error) {
+	if len(settings) == 0 {
+		return connString, nil
+	}
+
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		u, err := url.Parse(connString)
+		if err != nil {
+			// the error would show the url, password and all
+			return "", errors.New("could not parse url")
+		}
+		query := u.Query()
+		for key, value := range settings {
+			query.Set(key, value)
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	var b strings.Builder
+	b.WriteString(connString)
+	for key, value := range settings {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+		fmt.Fprintf(&b, "%s='%s'", key, value)
+	}
+	return b.String(), nil
+}
+
+// Connects with the environment, for containers configured without files: the URL in the
+// variable named by `url_env` (e.g. "DATABASE_URL"), or the libpq variables (PGHOST, PGPORT,
+// PGUSER, PGPASSWORD, PGDATABASE, ...), each prefixed with `prefix` if set (e.g. ORDERS_PGHOST),
+// so that several entries can each have their own.
+type EnvProvider struct{}
+
+// libpq environment variables, and the settings they stand for
+var libpqEnv = map[string]string{
+	"PGHOST":               "host",
+	"PGPORT":               "port",
+	"PGDATABASE":           "dbname",
+	"PGUSER":               "user",
+	"PGPASSWORD":           "password",
+	"PGPASSFILE":           "passfile",
+	"PGSERVICE":            "service",
+	"PGSERVICEFILE":        "servicefile",
+	"PGAPPNAME":            "application_name",
+	"PGCONNECT_TIMEOUT":    "connect_timeout",
+	"PGSSLMODE":            "sslmode",
+	"PGSSLCERT":            "sslcert",
+	"PGSSLKEY":             "sslkey",
+	"PGSSLROOTCERT":        "sslrootcert",
+	"PGTARGETSESSIONATTRS": "target_session_attrs",
+}
+
+func (p EnvProvider) GetConnConfig(metadata map[string]string) (*pgx.ConnConfig, error) {
+	if name := metadata["url_env"]; name != "" {
+		connString := os.Getenv(name)
+		if connString == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		slog.Info("EnvProvider: getting new connection from environment", "variable", name)
+		return pgx.ParseConfig(connString)
+	}
+
+	// pgx reads the unprefixed variables itself, as defaults for whatever we don't set
+	prefix := metadata["prefix"]
+	settings := map[string]string{}
+	for variable, setting := range libpqEnv {
+		if value := os.Getenv(prefix + variable); value != "" {
+			settings[setting] = value
+		}
+	}
+	if settings["host"] == "" && settings["service"] == "" && os.Getenv("PGHOST") == "" && os.Getenv("PGSERVICE") == "" {
+		// rather than quietly connecting to localhost
+		return nil, fmt.Errorf("neither %sPGHOST nor %sPGSERVICE is set", prefix, prefix)
+	}
+
+	connString, err := withConnSettings("", settings)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("EnvProvider: getting new connection from environment", "prefix", prefix)
+	return pgx.ParseConfig(connString)
+}
+
+// Providers by the name entries refer to them with
+var providers = struct {
+	sync.RWMutex
+	m map[string]ConfigProvider
+}{m: map[string]ConfigProvider{
+	"static": StaticProvider{},
+	"env":    EnvProvider{},
+}}
+
+// Makes a provider available to entries as `name`, for programs embedding the proxy that resolve
+// upstreams with a system of their own.  Register providers before reading the config, which
+// refuses entries naming unknown providers.  Panics if the name is taken, like sql.Register.
+func RegisterProvider(name string, provider ConfigProvider) {
+	providers.Lock()
+	defer providers.Unlock()
+
+	if provider == nil {
+		panic("remote: RegisterProvider provider is nil")
+	}
+	if _, taken := providers.m[name]; taken {
+		panic("remote: RegisterProvider called twice for provider " + name)
+	}
+	providers.m[name] = provider
+}
+
+func getProvider(typ string) ConfigProvider {
+	providers.RLock()
+	defer providers.RUnlock()
+
+	return providers.m[typ]
+}
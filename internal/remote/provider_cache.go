@@ -0,0 +1,178 @@
+package remote
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// Caches what providers resolve provider_meta to, for entries with a provider_cache, so that
+// providers that are expensive to ask (a secrets manager, an HTTP endpoint, a command) aren't
+// asked for every new upstream connection.  A cached config is refreshed in the background at a
+// random point in the last quarter of its ttl, so that the configs cached together don't all
+// expire together, and is used until it is refreshed or expires.  Concurrent lookups of the same
+// config share a single call to the provider.  A refresh that finds new credentials recycles the
+// entry's pooled connections (see rotation.go).
+type ProviderCacheConfig struct {
+	// how long a provider's config is used for
+	TTL Duration `json:"ttl"`
+}
+
+var providerLookups = metrics.NewCounterVec(
+	"pgproxy_provider_lookups_total", "Upstream configs looked up for entries with a provider_cache, by result (hit, miss or refresh).", "entry", "result",
+)
+
+// Least number of configs cached before expired ones are swept out
+const providerCacheSweepSize = 1024
+
+type providerCache struct {
+	sync.Mutex
+	m map[string]*cachedConfig
+	// the size at which expired configs are next swept out
+	sweepAt int
+	now     func() time.Time
+	// called when a refreshed config has new credentials, see rotation.go
+	rotated func(entry string)
+}
+
+type cachedConfig struct {
+	config             *pgx.ConnConfig
+	refreshAt, expires time.Time
+	// the lookup in flight, nil if there is none
+	flight *providerFlight
+}
+
+type providerFlight struct {
+	done chan struct{}
+	err  error
+}
+
+var providerConfigs = &providerCache{
+	m: make(map[string]*cachedConfig), sweepAt: providerCacheSweepSize, now: time.Now,
+	rotated: func(entry string) { rotatePools(entry) },
+}
+
+// Resolves a target's provider_meta with its provider, through the cache if the entry has one
+func resolveConnConfig(entry *ConfigEntry, target ConfigTarget) (*pgx.ConnConfig, error) {
+	provider := getProvider(target.Provider)
+	if provider == nil {
+		return nil, fmt.Errorf("could not identify auth provider for type %s", target.Provider)
+	}
+	lookup := func() (*pgx.ConnConfig, error) { return provider.GetConnConfig(target.ProviderMeta) }
+
+	if entry.ProviderCache == nil {
+		return lookup()
+	}
+	// fmt prints maps sorted by key
+	key := entry.Name + "\x00" + target.Name + "\x00" + target.Provider + "\x00" + fmt.Sprint(target.ProviderMeta)
+	return providerConfigs.get(entry.Name, key, time.Duration(entry.ProviderCache.TTL), lookup)
+}
+
+// Returns a copy of the cached config, which the caller may change
+func (c *providerCache) get(entry, key string, ttl time.Duration, lookup func() (*pgx.ConnConfig, error)) (*pgx.ConnConfig, error) {
+	c.Lock()
+	item := c.m[key]
+	if item == nil {
+		if len(c.m) >= c.sweepAt {
+			c.sweep()
+		}
+		item = &cachedConfig{}
+		c.m[key] = item
+	}
+
+	for {
+		now := c.now()
+		if item.config != nil && now.Before(item.expires) {
+			if !now.Before(item.refreshAt) && item.flight == nil {
+				c.fetch(entry, item, ttl, lookup)
+				providerLookups.With(entry, "refresh").Inc()
+			} else {
+				providerLookups.With(entry, "hit").Inc()
+			}
+			config := item.config.Copy()
+			c.Unlock()
+			return config, nil
+		}
+
+		f := item.flight
+		if f == nil {
+			f = c.fetch(entry, item, ttl, lookup)
+			providerLookups.With(entry, "miss").Inc()
+		}
+		c.Unlock()
+		<-f.done
+		if f.err != nil {
+			return nil, f.err
+		}
+		c.Lock()
+	}
+}
+
+// Starts looking up a config for the item.  Called with the lock held.
+func (c *providerCache) fetch(entry string, item *cachedConfig, ttl time.Duration, lookup func() (*pgx.ConnConfig, error)) *providerFlight {
+	f := &providerFlight{done: make(chan struct{})}
+	item.flight = f
+
+	go func() {
+		config, err := lookup()
+
+		c.Lock()
+		rotated := false
+		if err == nil {
+			now := c.now()
+			rotated = item.config != nil && credentialsChanged(item.config, config)
+			item.config = config
+			item.expires = now.Add(ttl)
+			item.refreshAt = now.Add(ttl * 3 / 4).Add(rand.N(max(ttl/4, 1)))
+		} else if item.config != nil {
+			slog.Warn("could not refresh provider config, using the cached one until it expires", "entry", entry, "error", err)
+		}
+		item.flight = nil
+		f.err = err
+		c.Unlock()
+		close(f.done)
+
+		if rotated {
+			c.rotated(entry)
+		}
+	}()
+
+	return f
+}
+
+// Drops expired configs.  Called with the lock held.
+func (c *providerCache) sweep() {
+	now := c.now()
+	for key, item := range c.m {
+		if item.flight == nil && !now.Before(item.expires) {
+			delete(c.m, key)
+		}
+	}
+	c.sweepAt = max(2*len(c.m), providerCacheSweepSize)
+}
+
+// Drops an entry's cached configs, so that its next upstream connections ask its providers
+// again.  Returns the number of configs dropped.
+func InvalidateProviderCache(entry *ConfigEntry) int {
+	return providerConfigs.invalidate(entry.Name)
+}
+
+func (c *providerCache) invalidate(entry string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	n := 0
+	for key := range c.m {
+		if strings.HasPrefix(key, entry+"\x00") {
+			delete(c.m, key)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,102 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+var providerErrors = metrics.NewCounterVec(
+	"pgproxy_provider_errors_total", "Upstream connections that failed because their provider or upstream refused, by kind (auth_failed, not_found, unreachable or quota_exceeded).", "entry", "kind",
+)
+
+// Why an upstream couldn't be resolved or reached
+type ProviderErrorKind string
+
+const (
+	// the provider (or the upstream) didn't accept the credentials it was given
+	ProviderAuthFailed ProviderErrorKind = "auth_failed"
+	// there is no secret (or upstream database) for what the client asked for
+	ProviderNotFound ProviderErrorKind = "not_found"
+	// the provider (or the upstream) couldn't be reached
+	ProviderUnreachable ProviderErrorKind = "unreachable"
+	// the provider (or the upstream) is out of capacity, e.g. rate limited or at max_connections
+	ProviderQuotaExceeded ProviderErrorKind = "quota_exceeded"
+)
+
+// An error that providers return to say why they failed, which decides what the client is told.
+// Connecting with what the provider returned fails with one too, when the upstream's answer is
+// clear enough.  Other errors reach the client as a bare 08001.
+type ProviderError struct {
+	Kind ProviderErrorKind
+	Err  error
+}
+
+func NewProviderError(kind ProviderErrorKind, err error) *ProviderError {
+	return &ProviderError{Kind: kind, Err: err}
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// The SQLSTATE the client is sent
+func (e *ProviderError) SQLState() string {
+	switch e.Kind {
+	case ProviderAuthFailed:
+		return codec.SQLStateConnectionRejected
+	case ProviderNotFound:
+		return codec.SQLStateInvalidCatalogName
+	case ProviderQuotaExceeded:
+		return codec.SQLStateTooManyConnections
+	default:
+		return codec.SQLStateUnableToEstablishConnection
+	}
+}
+
+// What the client is told, which leaves out the details of the provider's error
+func (e *ProviderError) ClientMessage() string {
+	switch e.Kind {
+	case ProviderAuthFailed:
+		return "the upstream did not accept the proxy's credentials"
+	case ProviderNotFound:
+		return "no upstream database was found for this connection"
+	case ProviderQuotaExceeded:
+		return "the upstream is out of capacity, try again later"
+	default:
+		return "the upstream is unreachable"
+	}
+}
+
+// Classifies an error from dialing an upstream, counting those it recognizes
+func classifyConnectError(entry string, err error) error {
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) {
+		var pgErr *pgconn.PgError
+		var netErr net.Error
+		switch {
+		case errors.As(err, &pgErr) && (pgErr.Code == codec.SQLStateInvalidAuthorization || pgErr.Code == codec.SQLStateInvalidPassword):
+			providerErr = NewProviderError(ProviderAuthFailed, err)
+		case errors.As(err, &pgErr) && pgErr.Code == codec.SQLStateInvalidCatalogName:
+			providerErr = NewProviderError(ProviderNotFound, err)
+		case errors.As(err, &pgErr) && (pgErr.Code == codec.SQLStateTooManyConnections || pgErr.Code == codec.SQLStateConfigurationLimitExceeded):
+			providerErr = NewProviderError(ProviderQuotaExceeded, err)
+		case errors.As(err, &netErr):
+			providerErr = NewProviderError(ProviderUnreachable, err)
+		default:
+			return err
+		}
+		err = providerErr
+	}
+
+	providerErrors.With(entry, string(providerErr.Kind)).Inc()
+	return err
+}
@@ -0,0 +1,47 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestClassifyConnectError(t *testing.T) {
+	notFound := providerErrors.With("app", string(ProviderNotFound))
+	before := notFound.Value()
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	cases := []struct {
+		err      error
+		kind     ProviderErrorKind
+		sqlState string
+	}{
+		{NewProviderError(ProviderNotFound, errors.New("no secret at db/tenant42")), ProviderNotFound, codec.SQLStateInvalidCatalogName},
+		{fmt.Errorf("vault: %w", NewProviderError(ProviderQuotaExceeded, errors.New("429"))), ProviderQuotaExceeded, codec.SQLStateTooManyConnections},
+		{&pgconn.PgError{Severity: "FATAL", Code: "28P01"}, ProviderAuthFailed, codec.SQLStateConnectionRejected},
+		{&pgconn.PgError{Severity: "FATAL", Code: "3D000"}, ProviderNotFound, codec.SQLStateInvalidCatalogName},
+		{&pgconn.PgError{Severity: "FATAL", Code: "53300"}, ProviderQuotaExceeded, codec.SQLStateTooManyConnections},
+		{fmt.Errorf("failed to connect: %w", refused), ProviderUnreachable, codec.SQLStateUnableToEstablishConnection},
+	}
+	for _, tt := range cases {
+		var providerErr *ProviderError
+		if err := classifyConnectError("app", tt.err); !errors.As(err, &providerErr) || providerErr.Kind != tt.kind {
+			t.Errorf("expected %v to be classified as %s, got %v", tt.err, tt.kind, err)
+			continue
+		}
+		if providerErr.SQLState() != tt.sqlState {
+			t.Errorf("expected %s to be reported as %s, got %s", tt.kind, tt.sqlState, providerErr.SQLState())
+		}
+	}
+
+	plain := errors.New("unexpected")
+	if err := classifyConnectError("app", plain); err != plain {
+		t.Errorf("expected other errors to be left alone, got %v", err)
+	}
+	if counted := notFound.Value() - before; counted != 2 {
+		t.Errorf("expected two not_found errors to be counted, got %d", counted)
+	}
+}
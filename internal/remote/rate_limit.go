@@ -0,0 +1,148 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/ratelimit"
+)
+
+var rateLimited = metrics.NewCounterVec(
+	"pgproxy_rate_limited_total", "Client messages held back (delayed) or requests refused (rejected) by an entry's rate_limit.", "entry", "action",
+)
+
+// Token bucket limits on what clients send an entry, e.g. {"queries_per_second": 50,
+// "bytes_per_second": 1048576} to keep a runaway batch job from overwhelming a small upstream
+type RateLimit struct {
+	// RateLimitPerClient (the default) for a bucket per client session, or RateLimitPerUser for
+	// one per user across their sessions on the entry
+	Per string `json:"per"`
+	// requests (queries, extended protocol batches, function calls) per second, unlimited if 0
+	QueriesPerSecond float64 `json:"queries_per_second"`
+	// requests that may be sent at once above the rate, defaults to queries_per_second (at least 1)
+	Burst int `json:"burst"`
+	// bytes of messages (including COPY data) per second, of which up to a second's worth may be
+	// sent at once, unlimited if 0
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	// what happens to requests over the limits, RateLimitDelay (the default) or RateLimitReject
+	Exceeded string `json:"exceeded"`
+
+	queries, bytes *ratelimit.Keyed
+}
+
+// Values for RateLimit.Per and RateLimit.Exceeded
+const (
+	RateLimitPerClient = "client"
+	RateLimitPerUser   = "user"
+	// hold requests back until they are within the limits
+	RateLimitDelay = "delay"
+	// refuse requests over the limits with a 53400 error
+	RateLimitReject = "reject"
+)
+
+func (l *RateLimit) validate() error {
+	switch l.Per {
+	case "", RateLimitPerClient, RateLimitPerUser:
+	default:
+		return fmt.Errorf("unknown per %q", l.Per)
+	}
+	switch l.Exceeded {
+	case "", RateLimitDelay, RateLimitReject:
+	default:
+		return fmt.Errorf("unknown exceeded %q", l.Exceeded)
+	}
+	if l.QueriesPerSecond < 0 || l.BytesPerSecond < 0 || l.Burst < 0 {
+		return errors.New("rates and burst can't be negative")
+	}
+	if l.QueriesPerSecond == 0 && l.BytesPerSecond == 0 {
+		return errors.New("queries_per_second or bytes_per_second is required")
+	}
+
+	if l.QueriesPerSecond > 0 {
+		l.queries = ratelimit.NewKeyed(l.QueriesPerSecond, l.Burst)
+	}
+	if l.BytesPerSecond > 0 {
+		l.bytes = ratelimit.NewKeyed(float64(l.BytesPerSecond), int(l.BytesPerSecond))
+	}
+	return nil
+}
+
+// The bucket a session's messages are counted in, and who that is for error messages.  Called
+// with the associations lock held.
+func (l *RateLimit) key(a *association) (string, string) {
+	if l.Per == RateLimitPerUser {
+		return a.user, fmt.Sprintf("role %q", a.user)
+	}
+	return a.session, "this connection"
+}
+
+// Called by the relay like CheckRequest, for every message from the client.  Returns how long to
+// hold the message back under the entry's rate_limit, or a *PolicyError if its request must be
+// refused instead, in which case the relay answers it itself.  Requests are only refused while
+// nothing else is in flight; messages that can't be refused are counted all the same.
+func ThrottleRequest(client net.Conn, message *codec.Message) (time.Duration, error) {
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.config.Policy == nil || a.config.Policy.RateLimit == nil {
+		associations.Unlock()
+		return 0, nil
+	}
+	policy, limit := a.config.Policy, a.config.Policy.RateLimit
+	starts := a.startsRequest(message.Type)
+	refusable := starts && a.pending == 0
+	key, who := limit.key(a)
+	status := a.txStatus
+	associations.Unlock()
+
+	// a dry run logs what would be refused, rather than what would be delayed by how long, which
+	// isn't known without holding messages back
+	if limit.Exceeded == RateLimitReject || policy.DryRun {
+		var err *PolicyError
+		switch {
+		case starts && limit.queries != nil && refusable:
+			if !limit.queries.Allow(key) {
+				err = &PolicyError{
+					Code:    codec.SQLStateConfigurationLimitExceeded,
+					Message: fmt.Sprintf("query rate limit of %g per second exceeded for %s", limit.QueriesPerSecond, who),
+				}
+			}
+		case starts && limit.queries != nil:
+			limit.queries.Take(key, 1)
+		}
+		if err == nil && refusable && limit.bytes != nil && limit.bytes.Take(key, 0) > 0 {
+			err = &PolicyError{
+				Code:    codec.SQLStateConfigurationLimitExceeded,
+				Message: fmt.Sprintf("byte rate limit of %d per second exceeded for %s", limit.BytesPerSecond, who),
+			}
+		}
+
+		if err != nil && !policy.DryRun {
+			rateLimited.With(a.entry, "rejected").Inc()
+			err.Status = status
+			return 0, err
+		}
+		if err != nil {
+			wouldRefuse(a, "rate_limit", err)
+		}
+		if limit.bytes != nil {
+			limit.bytes.Take(key, float64(message.Length))
+		}
+		return 0, nil
+	}
+
+	var wait time.Duration
+	if starts && limit.queries != nil {
+		wait = limit.queries.Take(key, 1)
+	}
+	if limit.bytes != nil {
+		wait = max(wait, limit.bytes.Take(key, float64(message.Length)))
+	}
+	if wait > 0 {
+		rateLimited.With(a.entry, "delayed").Inc()
+	}
+	return wait, nil
+}
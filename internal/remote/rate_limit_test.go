@@ -0,0 +1,73 @@
+package remote
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestThrottleRequest(t *testing.T) {
+	message := codec.NewQuery("SELECT 1")
+	query := &message
+	cases := []struct {
+		name  string
+		limit RateLimit
+		check func(t *testing.T, clients []net.Conn)
+	}{
+		{"reject", RateLimit{QueriesPerSecond: 1, Exceeded: RateLimitReject}, func(t *testing.T, clients []net.Conn) {
+			if _, err := ThrottleRequest(clients[0], query); err != nil {
+				t.Fatalf("expected the first query to go through, got %v", err)
+			}
+			var policyErr *PolicyError
+			if _, err := ThrottleRequest(clients[0], query); !errors.As(err, &policyErr) || policyErr.Code != codec.SQLStateConfigurationLimitExceeded {
+				t.Fatalf("expected the second query to be refused, got %v", err)
+			}
+			if _, err := ThrottleRequest(clients[1], query); err != nil {
+				t.Fatalf("expected another client to have its own bucket, got %v", err)
+			}
+		}},
+		{"delay per user", RateLimit{QueriesPerSecond: 10, Burst: 1, Per: RateLimitPerUser}, func(t *testing.T, clients []net.Conn) {
+			if wait, err := ThrottleRequest(clients[0], query); err != nil || wait != 0 {
+				t.Fatalf("expected the first query to go straight through, got %v (%v)", wait, err)
+			}
+			if wait, err := ThrottleRequest(clients[1], query); err != nil || wait < 90*time.Millisecond || wait > 100*time.Millisecond {
+				t.Fatalf("expected the user's next query to wait about 100ms, got %v (%v)", wait, err)
+			}
+		}},
+		{"bytes", RateLimit{BytesPerSecond: 100, Exceeded: RateLimitReject}, func(t *testing.T, clients []net.Conn) {
+			copyData := &codec.Message{Type: codec.MessageTypeCopyData, Length: 200}
+			if _, err := ThrottleRequest(clients[0], copyData); err != nil {
+				t.Fatalf("expected data already sent to be counted rather than refused, got %v", err)
+			}
+			if _, err := ThrottleRequest(clients[0], query); err == nil {
+				t.Fatal("expected the next query to be refused while over the byte rate")
+			}
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			limit := c.limit
+			entry := &ConfigEntry{Name: "limited", Policy: &AccessPolicy{RateLimit: &limit}}
+			if err := entry.Policy.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			var clients []net.Conn
+			for _, session := range []string{"s1", "s2"} {
+				client, _, cleanup := associate(&association{session: session, config: entry, entry: entry.Name, user: "batch", txStatus: codec.BackendTransactionStatusIdle})
+				defer cleanup()
+				clients = append(clients, client)
+			}
+
+			c.check(t, clients)
+		})
+	}
+
+	if err := (&RateLimit{Exceeded: RateLimitReject}).validate(); err == nil {
+		t.Error("expected a rate limit without rates to be invalid")
+	}
+}
@@ -0,0 +1,392 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+// Reconnecting sessions (see ConfigEntry.Reconnect): when the upstream connection of a session in
+// session pooling mode drops while the session is idle outside a transaction, e.g. because the
+// upstream restarted, the session gets a new connection instead of ending.  The session state the
+// client set up (SET values and prepared statements) is tracked as the client sets it up, and set
+// up again on the new connection before the client's next request reaches it.  Sessions holding
+// state that can't be set up again (LISTEN, temporary tables, session advisory locks...) aren't
+// reconnected.
+
+var upstreamReconnects = metrics.NewCounterVec(
+	"pgproxy_upstream_reconnects_total", "Sessions given a new upstream connection after theirs dropped, by result.", "entry", "result",
+)
+
+// Returned by Reconnect for sessions that can't be reconnected, which must end instead
+var ErrNotReconnectable = errors.New("session can't be reconnected")
+
+// The session state a client set up on its upstream connection, as the messages that set it up
+type sessionState struct {
+	// only used by the session's relay, and by Reconnect while the relay waits for it, but held
+	// apart from the associations lock so that statements aren't tokenized under it
+	mu    sync.Mutex
+	steps []replayStep
+	// SET statements run in a transaction block that is still open, which only count once it
+	// commits
+	uncommitted []replayStep
+	// why the session holds state that can't be set up again, e.g. "LISTEN", empty if it doesn't
+	unreplayable string
+}
+
+type replayStep struct {
+	// "set <parameter>" or "prepared <name>"
+	key     string
+	message codec.Message
+}
+
+// Adds a step, dropping the last one with the same key unless a prepared statement came after it
+// (whose plan may depend on it, e.g. through the search_path)
+func (s *sessionState) add(step replayStep) {
+	if i := slices.IndexFunc(s.steps, func(other replayStep) bool { return other.key == step.key }); i >= 0 &&
+		!slices.ContainsFunc(s.steps[i+1:], func(other replayStep) bool { return strings.HasPrefix(other.key, "prepared ") }) {
+		s.steps = slices.Delete(s.steps, i, i+1)
+	}
+	s.steps = append(s.steps, step)
+}
+
+func (s *sessionState) deallocate(name string) {
+	s.steps = slices.DeleteFunc(s.steps, func(step replayStep) bool {
+		return step.key == "prepared "+name || name == "" && strings.HasPrefix(step.key, "prepared ")
+	})
+}
+
+// Records the session state a client message sets up, for sessions of entries that reconnect.
+// Called by the relay for every message it forwards, after BeginRequest.
+func TrackSessionState(client net.Conn, message *codec.Message) {
+	switch message.Type {
+	case codec.MessageTypeQuery, codec.MessageTypeParse, codec.MessageTypeClose:
+	default:
+		return
+	}
+
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.replay == nil {
+		associations.Unlock()
+		return
+	}
+	state, status := a.replay, a.txStatus
+	associations.Unlock()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.unreplayable != "" {
+		return
+	}
+
+	switch message.Type {
+	case codec.MessageTypeQuery:
+		state.track(message.ParseAsQuery().QueryString, status)
+
+	case codec.MessageTypeParse:
+		parsed, err := message.ParseAsParse()
+		if err != nil {
+			return
+		}
+		// the statements of a Parse only run once executed, but SETs are rare enough there that
+		// counting them straight away is good enough
+		state.track(parsed.QueryString, status)
+		if parsed.Name != "" {
+			state.add(replayStep{"prepared " + parsed.Name, codec.Message{Type: message.Type, Length: message.Length, Data: slices.Clone(message.Data)}})
+		}
+
+	case codec.MessageTypeClose:
+		// 'S' for a prepared statement, then its name
+		data := message.Data[codec.MessageDataStartIndex:]
+		if len(data) > 1 && data[0] == 'S' {
+			if name, _, _ := strings.Cut(string(data[1:]), "\x00"); name != "" {
+				state.deallocate(name)
+			}
+		}
+	}
+}
+
+// Tracks the statements of a Query (or Parse), sent with the session's transaction in `status`
+func (s *sessionState) track(sql string, status codec.BackendTransactionStatus) {
+	inBlock, failed := status != codec.BackendTransactionStatusIdle, status == codec.BackendTransactionStatusFailed
+	tokens := query.Tokenize(sql)
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && !(tokens[i].Kind == query.TokenPunct && tokens[i].Text == ";") {
+			continue
+		}
+		statement := tokens[start:i]
+		end := len(sql)
+		if i < len(tokens) {
+			end = tokens[i].Pos
+		}
+		if len(statement) > 0 {
+			inBlock = s.trackStatement(statement, sql[statement[0].Pos:end], inBlock, failed)
+		}
+		start = i + 1
+	}
+}
+
+// Tracks one statement, and returns whether the session is in a transaction block after it.
+// `failed` if the block already failed, in which case COMMIT rolls it back.
+func (s *sessionState) trackStatement(statement []query.Token, text string, inBlock, failed bool) bool {
+	switch query.TransactionBoundary(statement) {
+	case query.BoundaryBegin:
+		return true
+	case query.BoundaryCommit:
+		if !failed {
+			for _, step := range s.uncommitted {
+				s.add(step)
+			}
+		}
+		s.uncommitted = nil
+		return false
+	case query.BoundaryRollback:
+		s.uncommitted = nil
+		return false
+	}
+
+	word := func(i int) string {
+		if i < len(statement) && statement[i].Kind == query.TokenWord {
+			return statement[i].Text
+		}
+		return ""
+	}
+
+	switch word(0) {
+	case "discard":
+		if word(1) == "all" {
+			// everything but what LOAD loaded
+			s.steps, s.uncommitted = nil, nil
+		}
+		return inBlock
+
+	case "deallocate":
+		name := word(1)
+		if name == "prepare" {
+			name = word(2)
+		}
+		if name == "all" {
+			name = ""
+		}
+		s.deallocate(name)
+		return inBlock
+
+	case "reset":
+		// back to the value the connection started with, which a new connection starts with too,
+		// but replayed all the same since RESET ALL undoes the SETs before it
+		s.set(replayStep{"set " + parameterKey(statement, 1), codec.NewQuery(text)}, inBlock)
+		return inBlock
+	}
+
+	mutates, reason := query.MutatesSessionState(statement)
+	switch {
+	case !mutates:
+	case reason == "SET":
+		i := 1
+		if word(1) == "session" && word(2) != "authorization" {
+			i = 2
+		}
+		s.set(replayStep{"set " + parameterKey(statement, i), codec.NewQuery(text)}, inBlock)
+	case reason == "PREPARE":
+		// prepared statements aren't undone by a ROLLBACK
+		s.add(replayStep{"prepared " + word(1), codec.NewQuery(text)})
+	default:
+		s.unreplayable = reason
+	}
+
+	return inBlock
+}
+
+// The parameter a SET or RESET names from `i` on, e.g. "search_path", "myapp.tenant" or
+// "time zone"
+func parameterKey(statement []query.Token, i int) string {
+	if i >= len(statement) {
+		return ""
+	}
+	key := statement[i].Text
+	for i+2 < len(statement) && statement[i+1].Kind == query.TokenPunct && statement[i+1].Text == "." {
+		key += "." + statement[i+2].Text
+		i += 2
+	}
+	switch key {
+	case "time", "session", "xml":
+		if i+1 < len(statement) {
+			key += " " + statement[i+1].Text
+		}
+	}
+	return key
+}
+
+func (s *sessionState) set(step replayStep, inBlock bool) {
+	if inBlock {
+		s.uncommitted = append(s.uncommitted, step)
+		return
+	}
+	s.add(step)
+}
+
+// Whether a session could be reconnected if its upstream connection dropped now: its entry
+// reconnects, it is in session pooling mode, it is idle outside a transaction, and all of its
+// session state can be set up again
+func CanReconnect(client net.Conn) bool {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	return a != nil && a.reconnectable() == nil
+}
+
+// Called with the associations lock held
+func (a *association) reconnectable() error {
+	switch {
+	case a.replay == nil:
+		return fmt.Errorf("%w: entry %s doesn't reconnect", ErrNotReconnectable, a.entry)
+	case a.replication != "" || a.config.sharesConnections():
+		return fmt.Errorf("%w: only regular sessions in session pooling mode reconnect", ErrNotReconnectable)
+	case !a.idle() || a.conn == nil || a.reconnecting != nil:
+		return fmt.Errorf("%w: the session has a request or transaction in flight", ErrNotReconnectable)
+	}
+
+	a.replay.mu.Lock()
+	defer a.replay.mu.Unlock()
+	if a.replay.unreplayable != "" {
+		return fmt.Errorf("%w: the session holds state set up by %s", ErrNotReconnectable, a.replay.unreplayable)
+	}
+	return nil
+}
+
+// Gives a session whose upstream connection dropped a new one, and sets the session's state up on
+// it again.  The client's next request waits (see BeginRequest) until the session is reconnected,
+// which is retried until the entry's connect_timeout runs out, e.g. while the upstream restarts.
+// Returns an error wrapping ErrNotReconnectable if the session can't be reconnected (see
+// CanReconnect), and any other error if reconnecting failed, after which the session must end.
+func Reconnect(client net.Conn) (net.Conn, error) {
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil {
+		associations.Unlock()
+		return nil, errors.New("no associated client")
+	}
+	if err := a.reconnectable(); err != nil {
+		associations.Unlock()
+		return nil, err
+	}
+	gate := make(chan struct{})
+	a.reconnecting = gate
+	old, p, target := a.conn, a.pool, a.target
+	a.conn, a.pool, a.discard = nil, nil, false
+	associations.Unlock()
+
+	a.replay.mu.Lock()
+	a.replay.uncommitted = nil
+	steps := slices.Clone(a.replay.steps)
+	a.replay.mu.Unlock()
+
+	defer func() {
+		associations.Lock()
+		a.reconnecting = nil
+		associations.Unlock()
+		close(gate)
+	}()
+
+	if p != nil {
+		_ = returnToPool(old, p, a.entry, target, false, false)
+	} else {
+		_ = old.Close(context.Background())
+	}
+	slog.Warn("upstream connection dropped, reconnecting session", "entry", a.entry, "target", target, "client", client.RemoteAddr().String())
+
+	start := time.Now()
+	deadline := start.Add(a.config.connectTimeout())
+	backoff := 100 * time.Millisecond
+	for {
+		err := attach(a)
+		if err == nil {
+			if err = replaySessionState(a, steps); err == nil {
+				break
+			}
+			associations.Lock()
+			conn, p := a.conn, a.pool
+			a.conn, a.pool = nil, nil
+			associations.Unlock()
+			if p != nil {
+				_ = returnToPool(conn, p, a.entry, a.target, false, false)
+			} else {
+				_ = conn.Close(context.Background())
+			}
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			upstreamReconnects.With(a.entry, "failed").Inc()
+			return nil, fmt.Errorf("could not reconnect after %s: %w", time.Since(start).Round(time.Millisecond), err)
+		}
+		slog.Debug("could not reconnect session, retrying", "entry", a.entry, "error", err, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, time.Second)
+	}
+
+	upstreamReconnects.With(a.entry, "reconnected").Inc()
+	slog.Info("reconnected session", "entry", a.entry, "target", a.target, "replayed", len(steps), "took", time.Since(start))
+
+	associations.Lock()
+	defer associations.Unlock()
+	return a.conn.PgConn().Conn(), nil
+}
+
+// Runs the messages that set up a session's state on its new upstream connection, each in a
+// request of its own.  Any error fails the reconnect, since the client would otherwise carry on
+// with state it doesn't have.
+func replaySessionState(a *association, steps []replayStep) error {
+	conn := a.conn.PgConn().Conn()
+	if err := conn.SetDeadline(time.Now().Add(a.config.connectTimeout())); err != nil {
+		return err
+	}
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	reader := bufio.NewReader(conn)
+	for _, step := range steps {
+		request := step.message.Data
+		if step.message.Type != codec.MessageTypeQuery {
+			request = append(slices.Clip(request), codec.NewBuilder(codec.MessageTypeSync).Message().Data...)
+		}
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+
+		var failed error
+		for {
+			response, err := codec.ReadMessage(reader)
+			if err != nil {
+				return fmt.Errorf("replaying %s: %w", step.key, err)
+			}
+			if response.Type == codec.MessageTypeErrorResponse && failed == nil {
+				parsed, _ := response.ParseAsErrorResponse()
+				failed = fmt.Errorf("replaying %s: %s (SQLSTATE %s)", step.key, parsed.Message, parsed.Code)
+			}
+			if response.Type == codec.MessageTypeReadyForQuery {
+				break
+			}
+		}
+		if failed != nil {
+			return failed
+		}
+	}
+
+	if reader.Buffered() > 0 {
+		return errors.New("upstream sent more than expected while replaying session state")
+	}
+	return nil
+}
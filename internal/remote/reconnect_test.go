@@ -0,0 +1,64 @@
+package remote
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestSessionStateTracking(t *testing.T) {
+	var idle, inBlock, failed codec.BackendTransactionStatus = codec.BackendTransactionStatusIdle, codec.BackendTransactionStatusInTransaction, codec.BackendTransactionStatusFailed
+	keys := func(s *sessionState) []string {
+		var keys []string
+		for _, step := range s.steps {
+			keys = append(keys, step.key)
+		}
+		return keys
+	}
+
+	s := &sessionState{}
+	s.track("SET search_path = app; SET SESSION myapp.tenant TO 'a'; SET TIME ZONE 'UTC'; SET LOCAL lock_timeout = 1", idle)
+	s.track("SET search_path = other", idle)
+	if want := []string{"set myapp.tenant", "set time zone", "set search_path"}; !slices.Equal(keys(s), want) {
+		t.Errorf("expected %v, got %v", want, keys(s))
+	}
+	if sql := s.steps[2].message.ParseAsQuery().QueryString; sql != "SET search_path = other" {
+		t.Errorf("expected the latest SET to be replayed, got %q", sql)
+	}
+
+	s.track("PREPARE q AS SELECT 1; SET search_path = third; RESET myapp.tenant", idle)
+	if want := []string{"set myapp.tenant", "set time zone", "set search_path", "prepared q", "set search_path", "set myapp.tenant"}; !slices.Equal(keys(s), want) {
+		t.Errorf("expected the SETs the prepared statement may depend on to be kept, got %v", keys(s))
+	}
+
+	s.track("BEGIN; SET statement_timeout = 5", idle)
+	s.track("SET work_mem = '1GB'", inBlock)
+	if len(s.uncommitted) != 2 || slices.Contains(keys(s), "set statement_timeout") {
+		t.Errorf("expected SETs in a transaction block to wait for its COMMIT, got %v", keys(s))
+	}
+	s.track("COMMIT", inBlock)
+	if !slices.Contains(keys(s), "set work_mem") || len(s.uncommitted) != 0 {
+		t.Errorf("expected committed SETs to count, got %v", keys(s))
+	}
+	s.track("BEGIN; SET role = x; ROLLBACK", idle)
+	s.track("BEGIN; SET role = y", idle)
+	s.track("COMMIT", failed)
+	if slices.Contains(keys(s), "set role") {
+		t.Errorf("expected rolled back SETs not to count, got %v", keys(s))
+	}
+
+	s.track("DEALLOCATE PREPARE q", idle)
+	if slices.Contains(keys(s), "prepared q") {
+		t.Errorf("expected the statement to be deallocated, got %v", keys(s))
+	}
+	s.track("DISCARD ALL", idle)
+	if len(s.steps) != 0 {
+		t.Errorf("expected DISCARD ALL to clear the session's state, got %v", keys(s))
+	}
+
+	s.track("SELECT 1; LISTEN jobs", idle)
+	if s.unreplayable != "LISTEN" {
+		t.Errorf("expected LISTEN to be unreplayable, got %q", s.unreplayable)
+	}
+}
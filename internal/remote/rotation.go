@@ -0,0 +1,72 @@
+package remote
+
+import (
+	"log/slog"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// Credential rotation: when an entry's upstream credentials change, its pooled connections are
+// recycled rather than closed on the spot.  Idle ones are closed straight away, and those in use
+// are closed instead of going back to the pool once their session (or, in transaction pooling
+// mode, transaction) is done with them, so that no transaction is interrupted.  Pools dial
+// replacements with the new credentials as usual, and connections that aren't pooled keep their
+// credentials until their session ends.
+//
+// Rotation starts when a provider_cache refresh finds that the provider's config changed, or
+// through RotateCredentials (the admin API).
+
+var recycledConnections = metrics.NewCounterVec(
+	"pgproxy_rotated_connections_total", "Pooled upstream connections recycled because the entry's credentials changed.", "entry",
+)
+
+// Recycles an entry's pooled connections after its provider's credentials changed elsewhere, first
+// dropping its cached provider configs.  Returns the number of connections recycled.
+func RotateCredentials(entry *ConfigEntry) int {
+	providerConfigs.invalidate(entry.Name)
+	return rotatePools(entry.Name)
+}
+
+func rotatePools(entry string) int {
+	recycled := recyclePools(entry, "new credentials")
+	recycledConnections.With(entry).Add(uint64(recycled))
+	return recycled
+}
+
+// Recycles an entry's pooled connections, logging why
+func recyclePools(entry string, reason string) int {
+	var matching []*pool
+	pools.Lock()
+	for _, p := range pools.m {
+		if p.entry.Name == entry {
+			matching = append(matching, p)
+		}
+	}
+	pools.Unlock()
+
+	inUse := 0
+	associations.Lock()
+	for _, a := range associations.m {
+		if a.entry == entry && a.pool != nil && a.conn != nil && !a.discard {
+			a.discard = true
+			inUse++
+		}
+	}
+	associations.Unlock()
+
+	idle := 0
+	for _, p := range matching {
+		idle += p.closeIdle()
+	}
+
+	slog.Info("recycling pooled upstream connections", "reason", reason, "entry", entry, "idle", idle, "in_use", inUse)
+	return idle + inUse
+}
+
+// Whether two configs of a provider reach a different upstream or log in differently, so that
+// connections dialed with the old one must be recycled
+func credentialsChanged(old, new *pgx.ConnConfig) bool {
+	return old.Host != new.Host || old.Port != new.Port || old.Database != new.Database ||
+		old.User != new.User || old.Password != new.Password
+}
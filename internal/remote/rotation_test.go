@@ -0,0 +1,44 @@
+package remote
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestRotateCredentials(t *testing.T) {
+	entry := &ConfigEntry{Name: "rotating", Pool: &PoolConfig{PoolSize: 2}}
+	p := &pool{entry: *entry, target: ConfigTarget{Name: "rotating"}, freed: make(chan struct{}), open: 1}
+	key := entry.poolKey(p.target)
+	pools.Lock()
+	pools.m[key] = p
+	pools.Unlock()
+
+	defer func() {
+		pools.Lock()
+		delete(pools.m, key)
+		pools.Unlock()
+	}()
+
+	a := &association{config: entry, entry: entry.Name, conn: &pgx.Conn{}, pool: p}
+	b := &association{config: &ConfigEntry{Name: "other"}, entry: "other", conn: &pgx.Conn{}, pool: p}
+	_, _, cleanupA := associate(a)
+	defer cleanupA()
+	_, _, cleanupB := associate(b)
+	defer cleanupB()
+
+	if n := RotateCredentials(entry); n != 1 {
+		t.Errorf("expected the connection in use to be recycled, got %d", n)
+	}
+	associations.Lock()
+	defer associations.Unlock()
+	if !a.discard {
+		t.Error("expected the connection in use to be closed once released rather than pooled")
+	}
+	if a.conn == nil {
+		t.Error("expected the session to keep its connection until it is done with it")
+	}
+	if b.discard {
+		t.Error("expected other entries' connections to be left alone")
+	}
+}
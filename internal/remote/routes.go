@@ -0,0 +1,188 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// The entries clients are matched against, which the admin API can add, replace and remove while
+// the proxy runs.  Changes apply to new sessions: existing sessions keep the entry they started
+// with, and the pools of a changed entry are retired so that its new settings take effect.  The
+// slice is replaced on every change rather than modified, so callers may hold on to what Routes
+// returns.
+var routes struct {
+	sync.RWMutex
+	config  *Config
+	path    string
+	entries []ConfigEntry
+}
+
+var ErrRouteExists = errors.New("route already exists")
+var ErrNoRoute = errors.New("no such route")
+
+// Sets the routes to the entries of a config read from `path`, which route changes are persisted
+// to when asked to
+func SetRoutes(config *Config, path string) {
+	routes.Lock()
+	defer routes.Unlock()
+
+	routes.config, routes.path, routes.entries = config, path, config.Entries
+}
+
+// The current entries
+func Routes() []ConfigEntry {
+	routes.RLock()
+	defer routes.RUnlock()
+
+	return routes.entries
+}
+
+// Adds an entry, or replaces the entry of the same name if `replace` is set.  With `persist`, the
+// config file's entries are rewritten to match.
+func PutRoute(entry ConfigEntry, replace bool, persist bool) error {
+	if entry.Name == "" {
+		return errors.New("routes need a name")
+	}
+
+	routes.Lock()
+	defer routes.Unlock()
+
+	if routes.config == nil {
+		return errors.New("routes can't be changed before the config is read")
+	}
+	if err := routes.config.validateEntry(&entry); err != nil {
+		return err
+	}
+
+	entries := slices.Clone(routes.entries)
+	i := slices.IndexFunc(entries, func(e ConfigEntry) bool { return e.Name == entry.Name })
+	switch {
+	case i >= 0 && !replace:
+		return fmt.Errorf("%w: %s", ErrRouteExists, entry.Name)
+	case i >= 0:
+		entries[i] = entry
+	default:
+		entries = append(entries, entry)
+	}
+
+	return setRoutesLocked(entries, entry.Name, persist)
+}
+
+// Removes an entry.  Its sessions carry on until they end.
+func DeleteRoute(name string, persist bool) error {
+	routes.Lock()
+	defer routes.Unlock()
+
+	i := slices.IndexFunc(routes.entries, func(e ConfigEntry) bool { return e.Name == name })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrNoRoute, name)
+	}
+
+	return setRoutesLocked(slices.Delete(slices.Clone(routes.entries), i, i+1), name, persist)
+}
+
+// Called with the routes lock held
+func setRoutesLocked(entries []ConfigEntry, changed string, persist bool) error {
+	if persist {
+		if err := persistRoutes(routes.path, entries); err != nil {
+			return fmt.Errorf("could not persist routes: %w", err)
+		}
+	}
+
+	routes.entries = entries
+	routes.config.Entries = entries
+	retireEntry(changed)
+	slog.Info("routes changed", "entry", changed, "routes", len(entries), "persisted", persist)
+
+	return nil
+}
+
+// Drops what the proxy keeps for an entry that changed: its pools (whose connections in use are
+// closed once released), diagnostic connections and cached provider configs
+func retireEntry(name string) {
+	var retired []*pool
+	pools.Lock()
+	for key, p := range pools.m {
+		if p.entry.Name == name {
+			delete(pools.m, key)
+			retired = append(retired, p)
+		}
+	}
+	pools.Unlock()
+	for _, p := range retired {
+		p.retire()
+	}
+
+	var conns []*diagnosticConn
+	diagnostics.Lock()
+	for key, d := range diagnostics.m {
+		if d.entry.Name == name {
+			delete(diagnostics.m, key)
+			conns = append(conns, d)
+		}
+	}
+	diagnostics.Unlock()
+	for _, d := range conns {
+		d.Lock()
+		if d.conn != nil {
+			d.conn.Close(context.Background())
+		}
+		d.Unlock()
+	}
+
+	providerConfigs.invalidate(name)
+}
+
+// Rewrites the entries of a config file, keeping its other settings.  Files that include others
+// are refused, since the included entries can't be told apart from the file's own.  The file is
+// replaced atomically.
+func persistRoutes(path string, entries []ConfigEntry) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	file := map[string]json.RawMessage{}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err = json.Unmarshal(data, &file); err != nil {
+			return err
+		}
+	}
+	if _, ok := file["include"]; ok {
+		return errors.New("the config file includes other files")
+	}
+	// the entries are written out with their defaults applied
+	delete(file, "defaults")
+
+	if file["entries"], err = json.Marshal(entries); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(file, "", "  "); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if info, err := os.Stat(path); err == nil {
+		_ = tmp.Chmod(info.Mode().Perm())
+	}
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,78 @@
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"max_client_conn": 10, "entries": [{"name": "app"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{MaxClientConn: 10, Entries: []ConfigEntry{{Name: "app"}}}
+	SetRoutes(config, path)
+	defer SetRoutes(&Config{}, "")
+
+	p := &pool{entry: ConfigEntry{Name: "app"}, target: ConfigTarget{Name: "app"}, freed: make(chan struct{})}
+	key := p.entry.poolKey(p.target)
+	pools.Lock()
+	pools.m[key] = p
+	pools.Unlock()
+	defer func() {
+		pools.Lock()
+		delete(pools.m, key)
+		pools.Unlock()
+	}()
+
+	if err := PutRoute(ConfigEntry{Name: "app"}, false, false); !errors.Is(err, ErrRouteExists) {
+		t.Errorf("expected the existing route to be kept, got %v", err)
+	}
+	if err := PutRoute(ConfigEntry{Name: "app", Auth: "magic"}, true, false); err == nil {
+		t.Error("expected an invalid entry to be refused")
+	}
+	before := Routes()
+	if err := PutRoute(ConfigEntry{Name: "app", Affinity: "other"}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if routes := Routes(); len(routes) != 1 || routes[0].Affinity != "other" {
+		t.Errorf("expected the route to be replaced, got %+v", routes)
+	}
+	if before[0].Affinity != "" {
+		t.Error("expected the routes returned earlier to be left alone")
+	}
+	pools.Lock()
+	_, ok := pools.m[key]
+	pools.Unlock()
+	if ok || !p.retired {
+		t.Error("expected the replaced entry's pool to be retired")
+	}
+
+	if err := PutRoute(ConfigEntry{Name: "reports"}, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRoute("app", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRoute("app", true); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("expected the route to be gone, got %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file struct {
+		MaxClientConn int           `json:"max_client_conn"`
+		Entries       []ConfigEntry `json:"entries"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.MaxClientConn != 10 || len(file.Entries) != 1 || file.Entries[0].Name != "reports" {
+		t.Errorf("expected the file's entries to be rewritten and its settings kept, got %s", data)
+	}
+}
@@ -0,0 +1,99 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// How long a scattered query may take on each shard, dialing included
+const scatterTimeout = time.Minute
+
+// Returned by Scatter when shards return different columns
+var ErrShardsDisagree = errors.New("shards disagree on the columns")
+
+// The rows a scattered query returned, each led by the name of the shard (target) it came from.
+// Values are in text format, nil for NULL.
+type ScatterResult struct {
+	Columns []string
+	Rows    [][][]byte
+}
+
+// Runs a query on every target of an entry, treating them as the entry's shards, and gathers
+// their rows in target order.  Each shard gets a connection of its own rather than one from its
+// pool, and the query must be a single statement.  Shards must agree on the result's columns,
+// and if any shard fails the whole query does.
+func Scatter(entry *ConfigEntry, query string) (*ScatterResult, error) {
+	if entry.templated() {
+		return nil, fmt.Errorf("entry %s is templated, so its shards depend on the client", entry.Name)
+	}
+
+	targets := entry.AllTargets()
+	ctx, cancel := context.WithTimeout(context.Background(), scatterTimeout)
+	defer cancel()
+
+	type gathered struct {
+		columns []string
+		rows    [][][]byte
+		err     error
+	}
+	results := make([]gathered, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			columns, rows, err := scatterTo(ctx, entry, target, query)
+			if err != nil {
+				err = fmt.Errorf("shard %s: %w", target.Name, err)
+			}
+			results[i] = gathered{columns, rows, err}
+		}()
+	}
+	wg.Wait()
+
+	result := &ScatterResult{}
+	for i, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		if i == 0 {
+			result.Columns = append([]string{"shard"}, r.columns...)
+		} else if !slices.Equal(result.Columns[1:], r.columns) {
+			return nil, fmt.Errorf("%w: shard %s returned %v rather than %v", ErrShardsDisagree, targets[i].Name, r.columns, result.Columns[1:])
+		}
+
+		shard := []byte(targets[i].Name)
+		for _, row := range r.rows {
+			result.Rows = append(result.Rows, append([][]byte{shard}, row...))
+		}
+	}
+
+	return result, nil
+}
+
+func scatterTo(ctx context.Context, entry *ConfigEntry, target ConfigTarget, query string) ([]string, [][][]byte, error) {
+	conn, err := connect(entry, target, "pgproxy [scatter]", "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close(context.Background())
+
+	// the extended protocol refuses several statements in one, so each shard returns one result
+	result := conn.PgConn().ExecParams(ctx, query, nil, nil, nil, nil).Read()
+	if result.Err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("timed out after %s", scatterTimeout)
+		}
+		return nil, nil, result.Err
+	}
+
+	columns := make([]string, len(result.FieldDescriptions))
+	for i, field := range result.FieldDescriptions {
+		columns[i] = field.Name
+	}
+	return columns, result.Rows, nil
+}
@@ -0,0 +1,69 @@
+package remote
+
+import (
+	"crypto/tls"
+	"reflect"
+	"slices"
+
+	"github.com/michaelhelvey/pgproxy/internal/jsonschema"
+)
+
+// Everything the top level of a config file may hold
+type schemaFile struct {
+	// where editors find this schema, ignored by the proxy
+	Schema string `json:"$schema"`
+	Config
+	Include  []string     `json:"include"`
+	Defaults *ConfigEntry `json:"defaults"`
+}
+
+// Returns a JSON Schema for config files, for editors and for validating configs in CI.  It is
+// generated from the config structs, so settings are only described by name and type: see the
+// README for what they mean, and ReadConfigFromFile for the checks the schema can't express.
+func ConfigSchema() jsonschema.Schema {
+	g := jsonschema.New()
+
+	return g.Document(jsonschema.Schema{
+		"title": "pgproxy config",
+		"oneOf": []any{
+			g.For(reflect.TypeFor[schemaFile]()),
+			g.For(reflect.TypeFor[[]ConfigEntry]()),
+		},
+	})
+}
+
+func (Duration) JSONSchema() jsonschema.Schema {
+	return jsonschema.Schema{"type": "string", "pattern": `^[-+]?((([0-9]+(\.[0-9]*)?)|\.[0-9]+)(ns|us|µs|μs|ms|s|m|h))+$|^[-+]?0$`}
+}
+
+func (Acceptors) JSONSchema() jsonschema.Schema {
+	return jsonschema.Schema{"oneOf": []any{
+		jsonschema.Schema{"type": "integer", "minimum": 0},
+		jsonschema.Schema{"const": "cpus"},
+	}}
+}
+
+func (TLSVersion) JSONSchema() jsonschema.Schema {
+	return enum(tlsVersions)
+}
+
+func (CipherSuite) JSONSchema() jsonschema.Schema {
+	var names []string
+	for _, suite := range tls.CipherSuites() {
+		names = append(names, suite.Name)
+	}
+	return jsonschema.Schema{"enum": names}
+}
+
+func (Curve) JSONSchema() jsonschema.Schema {
+	return enum(curves)
+}
+
+func enum[V any](values map[string]V) jsonschema.Schema {
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return jsonschema.Schema{"enum": names}
+}
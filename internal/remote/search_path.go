@@ -0,0 +1,69 @@
+package remote
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+// Schemas clients confined to a schema (see ConfigRewrite.Schema) may still name, for the system
+// catalogs and their temporary tables
+var systemSchemas = []string{"pg_catalog", "information_schema", "pg_temp"}
+
+// Called by the relay like CheckRequest.  For entries that confine their clients to a schema,
+// returns a *PolicyError for a request that names another schema or changes the search_path.
+// This is a guard against mistakes rather than an isolation boundary, which only the upstream's
+// privileges can provide: names in string literals (e.g. `'other.t'::regclass`) and dynamic SQL
+// aren't caught.  With requests in flight, the refusal ends the session, as it couldn't be
+// answered in turn.
+func CheckSchema(client net.Conn, message *codec.Message) error {
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.config.Rewrite.Schema == "" {
+		associations.Unlock()
+		return nil
+	}
+	schema, database, status, inFlight := a.config.Rewrite.Schema, a.database, a.txStatus, a.pending > 0 || a.unsynced
+	associations.Unlock()
+
+	for _, statement := range messageStatements(message) {
+		if changesSearchPath(statement) {
+			return &PolicyError{
+				Code:    codec.SQLStateInsufficientPrivilege,
+				Message: fmt.Sprintf("search_path can't be changed through database %q", database),
+				Status:  status,
+				Fatal:   inFlight,
+			}
+		}
+		for _, named := range query.Schemas(statement) {
+			if named != schema && !slices.Contains(systemSchemas, named) {
+				return &PolicyError{
+					Code:    codec.SQLStateInsufficientPrivilege,
+					Message: fmt.Sprintf("schema %q is not accessible through database %q", named, database),
+					Status:  status,
+					Fatal:   inFlight,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Whether a statement sets the search_path, with SET or set_config().  Setting it back to its
+// default, which is the confined schema, is allowed.
+func changesSearchPath(statement []query.Token) bool {
+	if name, value, ok := query.SetParameter(statement); ok {
+		return name == "search_path" && value != "default"
+	}
+	for i := 0; i+2 < len(statement); i++ {
+		if statement[i].Kind == query.TokenWord && statement[i].Text == "set_config" && statement[i+1].Text == "(" &&
+			strings.EqualFold(statement[i+2].Text, "'search_path'") {
+			return true
+		}
+	}
+	return false
+}
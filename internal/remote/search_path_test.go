@@ -0,0 +1,56 @@
+package remote
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestCheckSchema(t *testing.T) {
+	entry := &ConfigEntry{Name: "tenants", Rewrite: ConfigRewrite{Database: "shared", Schema: "acme"}}
+	a := &association{config: entry, entry: entry.Name, database: "app", txStatus: codec.BackendTransactionStatusIdle}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	cases := map[string]bool{
+		"SELECT * FROM orders o JOIN acme.customers c ON o.c = c.id": true,
+		"SELECT * FROM pg_catalog.pg_class":                          true,
+		"SET search_path TO DEFAULT":                                 true,
+		"SELECT * FROM globex.orders":                                false,
+		"SET search_path = globex, public":                           false,
+		"SELECT set_config('search_path', 'globex', false)":          false,
+	}
+	for sql, allowed := range cases {
+		message := codec.NewQuery(sql)
+		err := CheckSchema(client, &message)
+		var policyErr *PolicyError
+		if allowed && err != nil {
+			t.Errorf("expected %q to be allowed, got %v", sql, err)
+		} else if !allowed && (!errors.As(err, &policyErr) || policyErr.Code != codec.SQLStateInsufficientPrivilege) {
+			t.Errorf("expected %q to be refused, got %v", sql, err)
+		}
+	}
+
+	var policyErr *PolicyError
+	message := codec.NewBuilder(codec.MessageTypeParse).String("").String("SELECT * FROM globex.orders").Int16(0).Message()
+	if err := CheckSchema(client, &message); !errors.As(err, &policyErr) || policyErr.Fatal {
+		t.Errorf("expected the statement to be refused in place, got %v", err)
+	}
+	associations.Lock()
+	a.pending = 1
+	associations.Unlock()
+	if err := CheckSchema(client, &message); !errors.As(err, &policyErr) || !policyErr.Fatal {
+		t.Errorf("expected a pipelined statement to end the session, got %v", err)
+	}
+
+	config, err := pgx.ParseConfig("postgres://app@localhost/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Rewrite.apply(config)
+	if config.Database != "shared" || config.RuntimeParams["search_path"] != `"acme"` {
+		t.Errorf("expected the upstream database and search_path to be set, got %s and %s", config.Database, config.RuntimeParams["search_path"])
+	}
+}
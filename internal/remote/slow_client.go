@@ -0,0 +1,55 @@
+package remote
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+var slowClientEvictions = metrics.NewCounterVec(
+	"pgproxy_slow_client_evictions_total", "Clients disconnected for not reading what their upstream sent them within slow_client_timeout.", "entry",
+)
+
+// The entry's slow_client_timeout for a session, 0 if unlimited or the session doesn't use a pool.
+// A slow client of an unpooled entry only holds up its own upstream connection.
+func SlowClientTimeout(client net.Conn) time.Duration {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil || a.pool == nil && a.config.poolMode() == PoolModeSession {
+		return 0
+	}
+	return time.Duration(a.config.SlowClientTimeout)
+}
+
+// Called by the relay when a write to the client timed out.  If the entry has a
+// slow_client_timeout, counts the client as evicted and cancels its request in flight, so that
+// the upstream stops working on results nobody reads (and releases its locks) before the relay
+// closes the session.
+func EvictSlowClient(client net.Conn) {
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.config.SlowClientTimeout <= 0 {
+		associations.Unlock()
+		return
+	}
+	var conn *pgconn.PgConn
+	if a.conn != nil && (a.pending > 0 || a.unsynced) {
+		conn = a.conn.PgConn()
+	}
+	timeout := a.config.connectTimeout()
+	associations.Unlock()
+
+	slog.Warn(
+		"evicting client that stopped reading", "entry", a.entry, "session", a.session,
+		"client", client.RemoteAddr().String(), "timeout", time.Duration(a.config.SlowClientTimeout),
+	)
+	slowClientEvictions.With(a.entry).Inc()
+	if conn != nil {
+		cancelRequest(conn, timeout)
+	}
+}
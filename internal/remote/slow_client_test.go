@@ -0,0 +1,33 @@
+package remote
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSlowClient(t *testing.T) {
+	pooled := &ConfigEntry{Name: "slow-pooled", PoolMode: PoolModeTransaction, SlowClientTimeout: Duration(time.Second)}
+	unpooled := &ConfigEntry{Name: "slow-unpooled", SlowClientTimeout: Duration(time.Second)}
+	evictions := slowClientEvictions.With(pooled.Name)
+	before := evictions.Value()
+
+	var clients []net.Conn
+	for _, entry := range []*ConfigEntry{pooled, unpooled} {
+		client, _, cleanup := associate(&association{config: entry, entry: entry.Name})
+		defer cleanup()
+		clients = append(clients, client)
+	}
+
+	if timeout := SlowClientTimeout(clients[0]); timeout != time.Second {
+		t.Errorf("expected the entry's slow_client_timeout, got %v", timeout)
+	}
+	if timeout := SlowClientTimeout(clients[1]); timeout != 0 {
+		t.Errorf("expected no slow_client_timeout for a session without a pool, got %v", timeout)
+	}
+
+	EvictSlowClient(clients[0])
+	if counted := evictions.Value() - before; counted != 1 {
+		t.Errorf("expected the eviction to be counted, got %d", counted)
+	}
+}
@@ -0,0 +1,120 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+// Which of a client's startup parameters reach its upstream connection.  By default none do, other
+// than application_name: upstream connections are opened with the settings of the provider's URL.
+type StartupParameters struct {
+	// client startup parameters (including settings passed as "-c name=value" in options) passed
+	// on to the upstream, e.g. ["search_path", "extra_float_digits"], or ["*"] for all of them
+	Forward []string `json:"forward"`
+	// parameters never passed on even if forward matches them; listing application_name drops the
+	// client's own name from the upstream's
+	Strip []string `json:"strip"`
+	// parameters upstream connections are opened with, whatever the client sent
+	Override map[string]string `json:"override"`
+}
+
+// Startup parameters the proxy handles itself, which are never forwarded or overridden
+var reservedParameters = []string{"user", "database", "options", "replication", "client_encoding"}
+
+func (s *StartupParameters) validate(e *ConfigEntry) error {
+	for _, name := range slices.Concat(s.Forward, s.Strip, slices.Collect(maps.Keys(s.Override))) {
+		if name == "" {
+			return errors.New("parameter names can't be empty")
+		}
+		if slices.Contains(reservedParameters, strings.ToLower(name)) {
+			return fmt.Errorf("parameter %s is handled by the proxy", name)
+		}
+	}
+	if len(s.Forward) == 0 {
+		return nil
+	}
+	// the settings of clients that share connections would leak to each other
+	if e.sharesConnections() {
+		return errors.New("forward requires session pooling, since transaction pooling shares upstream connections")
+	}
+	if e.pooled() && e.serverResetQuery() == "" {
+		return errors.New("forward requires a server_reset_query for pooled connections")
+	}
+	return nil
+}
+
+func (s *StartupParameters) forwards(name string) bool {
+	lower := strings.ToLower(name)
+	if s == nil || slices.Contains(s.Strip, name) || slices.Contains(reservedParameters, lower) || lower == "application_name" {
+		return false
+	}
+	return slices.Contains(s.Forward, "*") || slices.Contains(s.Forward, name)
+}
+
+// The client parameters forwarded to the upstream, nil if none are.  As in Postgres, parameters
+// of the startup message take precedence over settings in options.
+func (s *StartupParameters) forwarded(params, options codec.ConnectionParams) map[string]string {
+	var forwarded map[string]string
+	for _, source := range []codec.ConnectionParams{options, params} {
+		for name, value := range source {
+			if s.forwards(name) {
+				if forwarded == nil {
+					forwarded = make(map[string]string)
+				}
+				forwarded[name] = value
+			}
+		}
+	}
+	return forwarded
+}
+
+// The application_name of the client as the upstream's should start with
+func (s *StartupParameters) applicationName(client string) string {
+	if s == nil {
+		return client
+	}
+	if name, ok := s.Override["application_name"]; ok {
+		return name
+	}
+	if slices.Contains(s.Strip, "application_name") {
+		return ""
+	}
+	return client
+}
+
+// Adds the overrides to the runtime parameters of an upstream connection
+func (s *StartupParameters) apply(params map[string]string) {
+	if s == nil {
+		return
+	}
+	for name, value := range s.Override {
+		if name != "application_name" {
+			params[name] = value
+		}
+	}
+}
+
+// Sets a client's forwarded parameters on a pooled connection it was handed, as session defaults
+// which the server_reset_query undoes once the client is done with it
+func setParameters(conn *pgx.Conn, parameters map[string]string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, name := range slices.Sorted(maps.Keys(parameters)) {
+		_, err := conn.PgConn().ExecParams(
+			ctx, "SELECT set_config($1, $2, false)", [][]byte{[]byte(name), []byte(parameters[name])}, nil, nil, nil,
+		).Close()
+		if err != nil {
+			return fmt.Errorf("could not forward startup parameter %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package remote
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestStartupParameters(t *testing.T) {
+	s := &StartupParameters{Forward: []string{"*"}, Strip: []string{"work_mem"}, Override: map[string]string{"TimeZone": "UTC"}}
+	params := codec.ConnectionParams{"user": "alice", "database": "app", "application_name": "psql", "search_path": "app", "work_mem": "1GB"}
+	options := codec.ConnectionParams{"search_path": "other", "extra_float_digits": "3"}
+
+	forwarded := s.forwarded(params, options)
+	if expected := map[string]string{"search_path": "app", "extra_float_digits": "3"}; !maps.Equal(forwarded, expected) {
+		t.Errorf("expected %v forwarded, got %v", expected, forwarded)
+	}
+	if forwarded := (&StartupParameters{Forward: []string{"DateStyle"}}).forwarded(params, options); forwarded != nil {
+		t.Errorf("expected nothing forwarded, got %v", forwarded)
+	}
+	var none *StartupParameters
+	if forwarded := none.forwarded(params, options); forwarded != nil {
+		t.Errorf("expected nothing forwarded by default, got %v", forwarded)
+	}
+
+	runtime := map[string]string{"TimeZone": "Europe/Paris"}
+	s.apply(runtime)
+	if runtime["TimeZone"] != "UTC" {
+		t.Errorf("expected the override to win, got %v", runtime)
+	}
+
+	for _, tc := range []struct {
+		params   *StartupParameters
+		expected string
+	}{
+		{nil, "psql"},
+		{&StartupParameters{Strip: []string{"application_name"}}, ""},
+		{&StartupParameters{Override: map[string]string{"application_name": "batch"}}, "batch"},
+	} {
+		if name := tc.params.applicationName("psql"); name != tc.expected {
+			t.Errorf("expected application_name %q, got %q", tc.expected, name)
+		}
+	}
+
+	for _, entry := range []ConfigEntry{
+		{StartupParameters: &StartupParameters{Forward: []string{"user"}}},
+		{StartupParameters: &StartupParameters{Override: map[string]string{"client_encoding": "LATIN1"}}},
+		{StartupParameters: &StartupParameters{Forward: []string{"search_path"}}, PoolMode: PoolModeTransaction},
+	} {
+		if err := entry.StartupParameters.validate(&entry); err == nil {
+			t.Errorf("expected %+v to be rejected", entry.StartupParameters)
+		}
+	}
+	entry := ConfigEntry{StartupParameters: &StartupParameters{Override: map[string]string{"TimeZone": "UTC"}}, PoolMode: PoolModeTransaction}
+	if err := entry.StartupParameters.validate(&entry); err != nil {
+		t.Errorf("expected overrides to be allowed in transaction pooling, got %v", err)
+	}
+}
@@ -0,0 +1,662 @@
+package remote
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/memory"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+// pgbouncer-style statistics (SHOW STATS and SHOW POOLS), kept per entry.  Totals are Prometheus
+// counters; averages are recomputed once per stats period, like pgbouncer's stats_period.
+
+const statsPeriod = time.Minute
+
+var (
+	queriesTotal = metrics.NewCounterVec(
+		"pgproxy_queries_total", "Requests (queries, extended protocol batches, function calls) the upstream answered.", "entry",
+	)
+	transactionsTotal = metrics.NewCounterVec(
+		"pgproxy_transactions_total", "Transactions (including autocommitted requests) the upstream finished.", "entry",
+	)
+	queryTimeTotal = metrics.NewCounterVec(
+		"pgproxy_query_time_microseconds_total", "Time spent waiting for the upstream to answer requests.", "entry",
+	)
+	transactionTimeTotal = metrics.NewCounterVec(
+		"pgproxy_transaction_time_microseconds_total", "Time spent in transactions.", "entry",
+	)
+	waitTimeTotal = metrics.NewCounterVec(
+		"pgproxy_wait_time_microseconds_total", "Time clients spent waiting for an upstream connection.", "entry",
+	)
+	waitsTotal = metrics.NewCounterVec(
+		"pgproxy_waits_total", "Times clients waited for an upstream connection.", "entry",
+	)
+	receivedBytesTotal = metrics.NewCounterVec(
+		"pgproxy_client_received_bytes_total", "Bytes received from clients.", "entry",
+	)
+	sentBytesTotal = metrics.NewCounterVec(
+		"pgproxy_client_sent_bytes_total", "Bytes sent to clients.", "entry",
+	)
+	statementsTotal = metrics.NewCounterVec(
+		"pgproxy_statements_total", "Statements clients sent, counting each statement of a multi-statement query, by kind (read, write, transaction or other).", "entry", "kind",
+	)
+	messagesTotal = metrics.NewCounterVec(
+		"pgproxy_messages_total", "Protocol messages relayed, by who sent them (client or server) and type byte.", "entry", "direction", "type",
+	)
+)
+
+// Who sent a relayed message
+const (
+	DirectionClient = "client"
+	DirectionServer = "server"
+)
+
+func init() {
+	poolGauge("pgproxy_pool_clients_active", "Client sessions not waiting for an upstream connection.",
+		func(p PoolStats) int64 { return int64(p.ClientsActive) })
+	poolGauge("pgproxy_pool_clients_waiting", "Client sessions waiting for an upstream connection.",
+		func(p PoolStats) int64 { return int64(p.ClientsWaiting) })
+	poolGauge("pgproxy_pool_servers_active", "Upstream connections held by client sessions.",
+		func(p PoolStats) int64 { return int64(p.ServersActive) })
+	poolGauge("pgproxy_pool_servers_idle", "Idle upstream connections in pools.",
+		func(p PoolStats) int64 { return int64(p.ServersIdle) })
+	poolGauge("pgproxy_pool_max_wait_microseconds", "How long the oldest waiting client has waited for an upstream connection.",
+		func(p PoolStats) int64 { return p.MaxWait.Microseconds() })
+	poolGauge("pgproxy_pool_clients_idle_in_transaction", "Client sessions idle in a transaction.",
+		func(p PoolStats) int64 { return int64(p.ClientsIdleInTransaction) })
+	poolGauge("pgproxy_pool_max_idle_in_transaction_microseconds", "How long the longest idle in transaction client has been idle.",
+		func(p PoolStats) int64 { return p.MaxIdleInTransaction.Microseconds() })
+}
+
+// Registers a gauge, labeled by entry, computed from Pools whenever metrics are read
+func poolGauge(name, help string, value func(PoolStats) int64) {
+	metrics.NewGaugeFunc(name, help, []string{"entry"}, func(emit func([]string, int64)) {
+		for _, p := range Pools() {
+			emit([]string{p.Entry}, value(p))
+		}
+	})
+}
+
+// The counters of an entry
+type entryStats struct {
+	entry, database string
+
+	queries, transactions, queryTime, transactionTime, waitTime, waits, received, sent *metrics.Counter
+	statements                                                                         map[query.Kind]*metrics.Counter
+	// messageKey -> *metrics.Counter, added as message types are first seen
+	messages sync.Map
+	// sessions that got through startup
+	sessions atomic.Uint64
+}
+
+type messageKey struct {
+	direction   string
+	messageType codec.MessageType
+}
+
+// Counts a relayed message
+func (s *entryStats) message(direction string, messageType codec.MessageType) {
+	key := messageKey{direction, messageType}
+	counter, ok := s.messages.Load(key)
+	if !ok {
+		counter, _ = s.messages.LoadOrStore(key, messagesTotal.With(s.entry, direction, string(rune(messageType))))
+	}
+	counter.(*metrics.Counter).Inc()
+}
+
+var entryStatsByName = struct {
+	sync.Mutex
+	m map[string]*entryStats
+	// averages over the last stats period
+	averages map[string]averages
+	// totals at the start of the current stats period
+	previous map[string]Stats
+	once     sync.Once
+}{m: make(map[string]*entryStats), averages: make(map[string]averages), previous: make(map[string]Stats)}
+
+func statsFor(entry, database string) *entryStats {
+	entryStatsByName.once.Do(func() { go computeAverages() })
+
+	entryStatsByName.Lock()
+	defer entryStatsByName.Unlock()
+
+	if s := entryStatsByName.m[entry]; s != nil {
+		return s
+	}
+
+	s := &entryStats{
+		entry:           entry,
+		database:        database,
+		queries:         queriesTotal.With(entry),
+		transactions:    transactionsTotal.With(entry),
+		queryTime:       queryTimeTotal.With(entry),
+		transactionTime: transactionTimeTotal.With(entry),
+		waitTime:        waitTimeTotal.With(entry),
+		waits:           waitsTotal.With(entry),
+		received:        receivedBytesTotal.With(entry),
+		sent:            sentBytesTotal.With(entry),
+		statements:      make(map[query.Kind]*metrics.Counter),
+	}
+	for _, kind := range []query.Kind{query.KindRead, query.KindWrite, query.KindTransaction, query.KindOther} {
+		s.statements[kind] = statementsTotal.With(entry, string(kind))
+	}
+	entryStatsByName.m[entry] = s
+	return s
+}
+
+// Counts the bytes a session relays, for its entry and for the session itself, and remembers the
+// session's latest query.  Safe to use from both directions of the relay at once, and a nil
+// *Traffic counts nothing.
+type Traffic struct {
+	entry          *entryStats
+	received, sent atomic.Uint64
+	query          atomic.Pointer[sessionQuery]
+	// the messages the session's relay holds
+	memory memory.Account
+}
+
+type sessionQuery struct {
+	text  string
+	start time.Time
+}
+
+// Returns the traffic counters for a client's session, nil if it has none
+func SessionTraffic(client net.Conn) *Traffic {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
+		return nil
+	}
+
+	if a.traffic == nil {
+		a.traffic = &Traffic{entry: a.stats}
+	}
+	return a.traffic
+}
+
+// Returns the account of the messages the session's relay holds, nil without a session
+func (t *Traffic) Memory() *memory.Account {
+	if t == nil {
+		return nil
+	}
+	return &t.memory
+}
+
+// Counts bytes received from the client
+func (t *Traffic) Received(n int) {
+	if t != nil {
+		t.received.Add(uint64(n))
+		t.entry.received.Add(uint64(n))
+	}
+}
+
+// Counts bytes sent to the client
+func (t *Traffic) Sent(n int) {
+	if t != nil {
+		t.sent.Add(uint64(n))
+		t.entry.sent.Add(uint64(n))
+	}
+}
+
+// Returns the session's latest query, nil if it has sent none
+func (t *Traffic) latestQuery() *sessionQuery {
+	if t == nil {
+		return nil
+	}
+	return t.query.Load()
+}
+
+// Counts a message received from the client.  The relay may only hold the start of a large message,
+// so its size comes from its length.
+func (t *Traffic) ClientMessage(message *codec.Message) {
+	if t != nil {
+		t.Received(int(message.Length) + 1)
+		t.entry.message(DirectionClient, message.Type)
+	}
+}
+
+// Counts a message sent to the client, like ClientMessage
+func (t *Traffic) ServerMessage(message *codec.Message) {
+	if t != nil {
+		t.Sent(int(message.Length) + 1)
+		t.entry.message(DirectionServer, message.Type)
+	}
+}
+
+// Remembers the query of a Query or Parse message the client sends, and counts its statements
+func (t *Traffic) Request(message *codec.Message) {
+	if t == nil {
+		return
+	}
+
+	var sql string
+	switch message.Type {
+	case codec.MessageTypeQuery:
+		sql = message.ParseAsQuery().QueryString
+	case codec.MessageTypeParse:
+		parsed, err := message.ParseAsParse()
+		if err != nil {
+			return
+		}
+		sql = parsed.QueryString
+	default:
+		return
+	}
+	t.query.Store(&sessionQuery{text: sql, start: time.Now()})
+
+	for _, statement := range query.Statements(query.Tokenize(sql)) {
+		t.entry.statements[query.Classify(statement)].Inc()
+	}
+}
+
+// Accounts for a request the session starts.  Called with the associations lock held, before the
+// request is counted as pending.
+func (a *association) startRequest(messageType codec.MessageType) {
+	if a.pending > 0 || a.unsynced {
+		return
+	}
+
+	switch messageType {
+	case codec.MessageTypeQuery, codec.MessageTypeFunctionCall, codec.MessageTypeSync,
+		codec.MessageTypeParse, codec.MessageTypeBind, codec.MessageTypeDescribe,
+		codec.MessageTypeExecute, codec.MessageTypeClose:
+		now := time.Now()
+		a.requestStart, a.stateChange = now, now
+		if a.txStatus == codec.BackendTransactionStatusIdle {
+			a.transactionStart = now
+		}
+	}
+}
+
+// Accounts for a ReadyForQuery.  Called with the associations lock held, once the answered request
+// is no longer pending.
+func (a *association) endRequest(status codec.BackendTransactionStatus) {
+	if a.stats == nil || a.requestStart.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	a.stats.queries.Inc()
+	a.stats.queryTime.Add(uint64(now.Sub(a.requestStart).Microseconds()))
+	// pipelined requests are answered one after the other
+	a.requestStart = now
+	if a.pending == 0 && !a.unsynced {
+		a.requestStart = time.Time{}
+	}
+
+	if status == codec.BackendTransactionStatusIdle {
+		a.stats.transactions.Inc()
+		a.stats.transactionTime.Add(uint64(now.Sub(a.transactionStart).Microseconds()))
+		a.transactionStart = now
+	}
+}
+
+// Totals (since the proxy started) and averages (over the last stats period) for an entry, as in
+// pgbouncer's SHOW STATS
+type Stats struct {
+	Entry    string
+	Database string
+
+	TotalTransactions    uint64
+	TotalQueries         uint64
+	TotalReceived        uint64
+	TotalSent            uint64
+	TotalTransactionTime time.Duration
+	TotalQueryTime       time.Duration
+	TotalWaitTime        time.Duration
+	totalWaits           uint64
+	// client sessions that got through startup since the proxy started, and that are still open
+	TotalSessions  uint64
+	ActiveSessions int
+
+	averages
+}
+
+type averages struct {
+	// per second
+	AvgTransactions float64
+	AvgQueries      float64
+	AvgReceived     float64
+	AvgSent         float64
+	// per transaction, query and wait
+	AvgTransactionTime time.Duration
+	AvgQueryTime       time.Duration
+	AvgWaitTime        time.Duration
+}
+
+// Returns statistics for every entry that has had a session, sorted by entry
+func EntryStats() []Stats {
+	active := make(map[string]int)
+	associations.Lock()
+	for _, a := range associations.m {
+		active[a.entry]++
+	}
+	associations.Unlock()
+
+	entryStatsByName.Lock()
+	defer entryStatsByName.Unlock()
+
+	stats := make([]Stats, 0, len(entryStatsByName.m))
+	for entry, s := range entryStatsByName.m {
+		total := totals(entry, s)
+		total.averages = entryStatsByName.averages[entry]
+		total.ActiveSessions = active[entry]
+		stats = append(stats, total)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Entry < stats[j].Entry })
+
+	return stats
+}
+
+func totals(entry string, s *entryStats) Stats {
+	return Stats{
+		Entry:                entry,
+		Database:             s.database,
+		TotalTransactions:    s.transactions.Value(),
+		TotalQueries:         s.queries.Value(),
+		TotalReceived:        s.received.Value(),
+		TotalSent:            s.sent.Value(),
+		TotalTransactionTime: time.Duration(s.transactionTime.Value()) * time.Microsecond,
+		TotalQueryTime:       time.Duration(s.queryTime.Value()) * time.Microsecond,
+		TotalWaitTime:        time.Duration(s.waitTime.Value()) * time.Microsecond,
+		totalWaits:           s.waits.Value(),
+		TotalSessions:        s.sessions.Load(),
+	}
+}
+
+// How many messages of a type an entry's sessions relayed in one direction
+type MessageStats struct {
+	Entry     string
+	Direction string
+	Type      codec.MessageType
+	Count     uint64
+}
+
+// Returns the message counts of every entry, sorted by entry, direction and type
+func EntryMessages() []MessageStats {
+	entryStatsByName.Lock()
+	defer entryStatsByName.Unlock()
+
+	var stats []MessageStats
+	for entry, s := range entryStatsByName.m {
+		s.messages.Range(func(key, counter any) bool {
+			k := key.(messageKey)
+			stats = append(stats, MessageStats{Entry: entry, Direction: k.direction, Type: k.messageType, Count: counter.(*metrics.Counter).Value()})
+			return true
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Entry != b.Entry {
+			return a.Entry < b.Entry
+		}
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.Type < b.Type
+	})
+
+	return stats
+}
+
+func computeAverages() {
+	for range time.Tick(statsPeriod) {
+		entryStatsByName.Lock()
+		for entry, s := range entryStatsByName.m {
+			current, previous := totals(entry, s), entryStatsByName.previous[entry]
+			entryStatsByName.averages[entry] = averagesBetween(previous, current, statsPeriod)
+			entryStatsByName.previous[entry] = current
+		}
+		entryStatsByName.Unlock()
+		computeUpstreamAverages()
+	}
+}
+
+func averagesBetween(previous, current Stats, period time.Duration) averages {
+	perSecond := func(previous, current uint64) float64 {
+		return float64(current-previous) / period.Seconds()
+	}
+	per := func(previous, current time.Duration, prevCount, count uint64) time.Duration {
+		if count == prevCount {
+			return 0
+		}
+		return (current - previous) / time.Duration(count-prevCount)
+	}
+
+	return averages{
+		AvgTransactions:    perSecond(previous.TotalTransactions, current.TotalTransactions),
+		AvgQueries:         perSecond(previous.TotalQueries, current.TotalQueries),
+		AvgReceived:        perSecond(previous.TotalReceived, current.TotalReceived),
+		AvgSent:            perSecond(previous.TotalSent, current.TotalSent),
+		AvgTransactionTime: per(previous.TotalTransactionTime, current.TotalTransactionTime, previous.TotalTransactions, current.TotalTransactions),
+		AvgQueryTime:       per(previous.TotalQueryTime, current.TotalQueryTime, previous.TotalQueries, current.TotalQueries),
+		AvgWaitTime:        per(previous.TotalWaitTime, current.TotalWaitTime, previous.totalWaits, current.totalWaits),
+	}
+}
+
+// Client sessions and upstream connections of an entry, as in pgbouncer's SHOW POOLS
+type PoolStats struct {
+	Entry    string
+	Database string
+	// sessions that hold, or can get, an upstream connection without waiting
+	ClientsActive int
+	// sessions waiting for an upstream connection (while dialing, for a pool, or for a paused
+	// entry to resume)
+	ClientsWaiting int
+	// upstream connections held by sessions
+	ServersActive int
+	// idle upstream connections in the entry's pools
+	ServersIdle int
+	// how long the oldest waiting session has been waiting
+	MaxWait time.Duration
+	// sessions idle in a transaction, holding their upstream connection without using it, and
+	// how long the longest of them has been
+	ClientsIdleInTransaction int
+	MaxIdleInTransaction     time.Duration
+	PoolMode                 string
+}
+
+// Returns pool statistics for every entry that has sessions or pools, sorted by entry
+func Pools() []PoolStats {
+	byEntry := map[string]*PoolStats{}
+	get := func(entry *ConfigEntry) *PoolStats {
+		p := byEntry[entry.Name]
+		if p == nil {
+			p = &PoolStats{Entry: entry.Name, Database: entry.Match.Database, PoolMode: entry.poolMode()}
+			byEntry[entry.Name] = p
+		}
+		return p
+	}
+
+	now := time.Now()
+	associations.Lock()
+	for _, a := range associations.m {
+		p := get(a.config)
+		if a.waitingSince.IsZero() {
+			p.ClientsActive++
+		} else {
+			p.ClientsWaiting++
+			p.MaxWait = max(p.MaxWait, now.Sub(a.waitingSince))
+		}
+		if a.conn != nil {
+			p.ServersActive++
+		}
+		if a.idleInTransaction() {
+			p.ClientsIdleInTransaction++
+			p.MaxIdleInTransaction = max(p.MaxIdleInTransaction, now.Sub(a.stateChange))
+		}
+	}
+	associations.Unlock()
+
+	pools.Lock()
+	for _, pool := range pools.m {
+		pool.mu.Lock()
+		get(&pool.entry).ServersIdle += len(pool.idle)
+		pool.mu.Unlock()
+	}
+	pools.Unlock()
+
+	stats := make([]PoolStats, 0, len(byEntry))
+	for _, p := range byEntry {
+		stats = append(stats, *p)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Entry < stats[j].Entry })
+
+	return stats
+}
+
+// The sessions of one user of an entry, e.g. to see whether one user crowds out the others
+type PoolUserStats struct {
+	Entry string
+	User  string
+	// as in PoolStats
+	ClientsActive  int
+	ClientsWaiting int
+	ServersActive  int
+	MaxWait        time.Duration
+}
+
+// Returns statistics for every user with sessions, sorted by entry and user
+func PoolUsers() []PoolUserStats {
+	type key struct{ entry, user string }
+	byUser := map[key]*PoolUserStats{}
+
+	now := time.Now()
+	associations.Lock()
+	for _, a := range associations.m {
+		u := byUser[key{a.entry, a.user}]
+		if u == nil {
+			u = &PoolUserStats{Entry: a.entry, User: a.user}
+			byUser[key{a.entry, a.user}] = u
+		}
+		if a.waitingSince.IsZero() {
+			u.ClientsActive++
+		} else {
+			u.ClientsWaiting++
+			u.MaxWait = max(u.MaxWait, now.Sub(a.waitingSince))
+		}
+		if a.conn != nil {
+			u.ServersActive++
+		}
+	}
+	associations.Unlock()
+
+	stats := make([]PoolUserStats, 0, len(byUser))
+	for _, u := range byUser {
+		stats = append(stats, *u)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Entry != stats[j].Entry {
+			return stats[i].Entry < stats[j].Entry
+		}
+		return stats[i].User < stats[j].User
+	})
+
+	return stats
+}
+
+// A client session, like a row of Postgres' pg_stat_activity
+type SessionStats struct {
+	Session         string
+	Entry           string
+	User            string
+	Database        string
+	ApplicationName string
+	ClientAddr      string
+	// "waiting" (for an upstream connection), "active", "idle", "idle in transaction", "idle in
+	// transaction (aborted)" or "replication"
+	State string
+	// when the session started, when its current transaction started (zero unless it is active
+	// or in a transaction), when its latest query was sent, and when its state last changed
+	Started          time.Time
+	TransactionStart time.Time
+	QueryStart       time.Time
+	StateChange      time.Time
+	// the latest query, which is still running if the session is active
+	Query string
+	// the target and host of the current upstream connection, and its backend's PID (0 if the
+	// session holds no upstream connection, as between transactions in transaction pooling mode)
+	Target     string
+	Upstream   string
+	BackendPID uint32
+	// bytes received from and sent to the client, and of messages the relay holds (see
+	// memory.Account)
+	Received uint64
+	Sent     uint64
+	Buffered int64
+	// protocol anomalies so far, see ProtocolAnomaly
+	Anomalies int
+}
+
+// Returns every client session, sorted by when they started
+func Sessions() []SessionStats {
+	associations.Lock()
+	defer associations.Unlock()
+
+	sessions := make([]SessionStats, 0, len(associations.m))
+	for _, a := range associations.m {
+		s := SessionStats{
+			Session:         a.session,
+			Entry:           a.entry,
+			User:            a.user,
+			Database:        a.database,
+			ApplicationName: a.applicationName,
+			ClientAddr:      a.client.RemoteAddr().String(),
+			State:           a.state(),
+			Started:         a.started,
+			StateChange:     a.stateChange,
+			Upstream:        a.upstream,
+			Anomalies:       a.anomalies,
+		}
+		if a.pending > 0 || a.unsynced || a.txStatus != codec.BackendTransactionStatusIdle {
+			s.TransactionStart = a.transactionStart
+		}
+		if a.conn != nil {
+			s.Target, s.BackendPID = a.target, a.conn.PgConn().PID()
+		}
+		if a.traffic != nil {
+			s.Received, s.Sent, s.Buffered = a.traffic.received.Load(), a.traffic.sent.Load(), a.traffic.memory.Held()
+			if query := a.traffic.query.Load(); query != nil {
+				s.Query, s.QueryStart = query.text, query.start
+			}
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+
+	return sessions
+}
+
+// Whether the session is in a transaction but not running anything, so that it holds on to its
+// upstream connection (and the transaction's locks) for nothing.  Called with the associations
+// lock held.
+func (a *association) idleInTransaction() bool {
+	return a.waitingSince.IsZero() && a.replication == "" && a.pending == 0 && !a.unsynced &&
+		a.txStatus != codec.BackendTransactionStatusIdle
+}
+
+// Called with the associations lock held
+func (a *association) state() string {
+	switch {
+	case !a.waitingSince.IsZero():
+		return "waiting"
+	case a.replication != "":
+		return "replication"
+	case a.pending > 0 || a.unsynced:
+		return "active"
+	case a.txStatus == codec.BackendTransactionStatusInTransaction:
+		return "idle in transaction"
+	case a.txStatus == codec.BackendTransactionStatusFailed:
+		return "idle in transaction (aborted)"
+	default:
+		return "idle"
+	}
+}
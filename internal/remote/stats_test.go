@@ -0,0 +1,151 @@
+package remote
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+func TestRequestStats(t *testing.T) {
+	entry := &ConfigEntry{Name: "stats", Match: ConfigMatch{Database: "app"}}
+	a := &association{config: entry, entry: entry.Name, txStatus: codec.BackendTransactionStatusIdle, stats: statsFor(entry.Name, "app")}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	// an explicit transaction of three queries, then a pipelined extended protocol batch
+	BeginRequest(client, codec.MessageTypeQuery)
+	EndRequest(client, codec.BackendTransactionStatusInTransaction)
+	BeginRequest(client, codec.MessageTypeQuery)
+	EndRequest(client, codec.BackendTransactionStatusInTransaction)
+	BeginRequest(client, codec.MessageTypeQuery)
+	EndRequest(client, codec.BackendTransactionStatusIdle)
+	for _, messageType := range []codec.MessageType{codec.MessageTypeParse, codec.MessageTypeBind, codec.MessageTypeExecute, codec.MessageTypeSync, codec.MessageTypeSync} {
+		BeginRequest(client, messageType)
+	}
+	EndRequest(client, codec.BackendTransactionStatusIdle)
+	EndRequest(client, codec.BackendTransactionStatusIdle)
+	SessionTraffic(client).Received(10)
+	SessionTraffic(client).Sent(20)
+
+	var stats Stats
+	for _, s := range EntryStats() {
+		if s.Entry == "stats" {
+			stats = s
+		}
+	}
+	if stats.Database != "app" || stats.TotalQueries != 5 || stats.TotalTransactions != 3 {
+		t.Errorf("expected 5 queries in 3 transactions on app, got %+v", stats)
+	}
+	if stats.TotalReceived != 10 || stats.TotalSent != 20 {
+		t.Errorf("expected 10 bytes received and 20 sent, got %+v", stats)
+	}
+	var pool PoolStats
+	for _, p := range Pools() {
+		if p.Entry == "stats" {
+			pool = p
+		}
+	}
+	if pool.ClientsActive != 1 || pool.ClientsWaiting != 0 || pool.PoolMode != PoolModeSession {
+		t.Errorf("expected one active client, got %+v", pool)
+	}
+}
+
+func TestAveragesBetween(t *testing.T) {
+	previous := Stats{TotalQueries: 100, TotalQueryTime: time.Second, TotalReceived: 1000}
+	current := Stats{TotalQueries: 160, TotalQueryTime: 4 * time.Second, TotalReceived: 7000}
+
+	avg := averagesBetween(previous, current, time.Minute)
+	if avg.AvgQueries != 1 || avg.AvgReceived != 100 || avg.AvgQueryTime != 50*time.Millisecond {
+		t.Errorf("unexpected averages %+v", avg)
+	}
+	if avg.AvgTransactionTime != 0 {
+		t.Errorf("expected no transaction time without transactions, got %v", avg.AvgTransactionTime)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	entry := &ConfigEntry{Name: "sessions", Match: ConfigMatch{Database: "app"}}
+	a := &association{session: "s1", config: entry, entry: entry.Name, user: "alice", txStatus: codec.BackendTransactionStatusIdle, stats: statsFor(entry.Name, "app"), started: time.Now()}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	traffic := SessionTraffic(client)
+	sleep := append([]byte{byte(codec.MessageTypeQuery), 0, 0, 0, 24}, "SELECT pg_sleep(10)\x00"...)
+	traffic.Request(&codec.Message{Type: codec.MessageTypeQuery, Length: 24, Data: sleep})
+	traffic.Received(25)
+	BeginRequest(client, codec.MessageTypeQuery)
+
+	var session SessionStats
+	for _, s := range Sessions() {
+		if s.Session == "s1" {
+			session = s
+		}
+	}
+	if session.State != "active" || session.Query != "SELECT pg_sleep(10)" || session.QueryStart.IsZero() {
+		t.Errorf("expected an active session running pg_sleep, got %+v", session)
+	}
+	if session.Received != 25 || session.BackendPID != 0 {
+		t.Errorf("expected 25 bytes received and no upstream connection, got %+v", session)
+	}
+	if reads := a.stats.statements[query.KindRead].Value(); reads != 1 {
+		t.Errorf("expected one read statement, got %d", reads)
+	}
+
+	batch := codec.NewQuery("BEGIN; UPDATE jobs SET done = true; COMMIT")
+	traffic.Request(&batch)
+	if writes, transactions := a.stats.statements[query.KindWrite].Value(), a.stats.statements[query.KindTransaction].Value(); writes != 1 || transactions != 2 {
+		t.Errorf("expected the batch counted per statement, got %d writes and %d transaction statements", writes, transactions)
+	}
+	traffic.Request(&codec.Message{Type: codec.MessageTypeQuery, Length: 24, Data: sleep})
+
+	EndRequest(client, codec.BackendTransactionStatusInTransaction)
+	for _, s := range Sessions() {
+		if s.Session == "s1" && (s.State != "idle in transaction" || s.TransactionStart.IsZero() || s.StateChange.IsZero()) {
+			t.Errorf("expected the session to be idle in transaction, got %+v", s)
+		}
+	}
+
+	associations.Lock()
+	a.stateChange = time.Now().Add(-time.Second)
+	associations.Unlock()
+	for _, pool := range Pools() {
+		if pool.Entry == entry.Name && (pool.ClientsIdleInTransaction != 1 || pool.MaxIdleInTransaction < time.Second) {
+			t.Errorf("expected one client idle in transaction for a second, got %+v", pool)
+		}
+	}
+}
+
+func TestMessageStats(t *testing.T) {
+	entry := &ConfigEntry{Name: "messages", Match: ConfigMatch{Database: "app"}}
+	a := &association{config: entry, entry: entry.Name, txStatus: codec.BackendTransactionStatusIdle, stats: statsFor(entry.Name, "app")}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+	a.countSession()
+
+	traffic := SessionTraffic(client)
+	select1 := codec.NewQuery("SELECT 1")
+	traffic.ClientMessage(&select1)
+	for _, messageType := range []codec.MessageType{codec.MessageTypeRowDescription, codec.MessageTypeDataRow, codec.MessageTypeDataRow} {
+		traffic.ServerMessage(&codec.Message{Type: messageType, Length: 4, Data: []byte{byte(messageType), 0, 0, 0, 4}})
+	}
+
+	var got []string
+	for _, m := range EntryMessages() {
+		if m.Entry == "messages" {
+			got = append(got, fmt.Sprintf("%s %c %d", m.Direction, m.Type, m.Count))
+		}
+	}
+	if want := "client Q 1,server D 2,server T 1"; strings.Join(got, ",") != want {
+		t.Errorf("expected messages %s, got %s", want, strings.Join(got, ","))
+	}
+
+	for _, s := range EntryStats() {
+		if s.Entry == "messages" && (s.TotalSessions != 1 || s.ActiveSessions != 1 || s.TotalSent != 15) {
+			t.Errorf("expected one active session and 15 bytes sent, got %+v", s)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net"
+	"sync"
+)
+
+// A single upstream that an entry can route sessions to
+type ConfigTarget struct {
+	// human readable identifier for the target, must be unique within an entry
+	Name string `json:"name"`
+	// what type to cast provider meta to
+	Provider string `json:"provider"`
+	// some kind data used by the provider
+	ProviderMeta map[string]string `json:"provider_meta"`
+	// relative share of new sessions routed to this target, defaults to 1.  Can be adjusted at
+	// runtime with SetTargetWeight.
+	Weight *int `json:"weight,omitempty"`
+}
+
+const (
+	// pick a random target for every new session
+	AffinityNone = ""
+	// route sessions with the same user, database and client IP to the same target
+	AffinityClient = "client"
+)
+
+// Returns the targets for an entry.  Entries with a single upstream can skip the `targets` list
+// and just specify `provider` and `provider_meta` directly.
+func (e *ConfigEntry) AllTargets() []ConfigTarget {
+	if len(e.Targets) > 0 {
+		return e.Targets
+	}
+
+	return []ConfigTarget{{Name: e.Name, Provider: e.Provider, ProviderMeta: e.ProviderMeta}}
+}
+
+// Runtime weight overrides set through the admin API, keyed by entry name and then target name.
+// These take precedence over the weights in the config file until the process restarts.
+var weightOverrides = struct {
+	sync.RWMutex
+	m map[string]map[string]int
+}{m: make(map[string]map[string]int)}
+
+// Changes the share of new sessions routed to a target.  Existing sessions are not affected.
+func SetTargetWeight(entry *ConfigEntry, target string, weight int) error {
+	if weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+
+	found := false
+	for _, t := range entry.AllTargets() {
+		if t.Name == target {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("entry %s has no target named %s", entry.Name, target)
+	}
+
+	weightOverrides.Lock()
+	defer weightOverrides.Unlock()
+
+	if weightOverrides.m[entry.Name] == nil {
+		weightOverrides.m[entry.Name] = make(map[string]int)
+	}
+	weightOverrides.m[entry.Name][target] = weight
+
+	return nil
+}
+
+// Targets that are being drained for maintenance, keyed by entry name and then target name
+var drainingTargets = struct {
+	sync.RWMutex
+	m map[string]map[string]bool
+}{m: make(map[string]map[string]bool)}
+
+// Starts or stops draining a target.  A draining target gets no new sessions, and its existing
+// sessions are closed as soon as they are idle (see EndRequest) so that their clients reconnect to
+// one of the entry's other targets.
+func SetTargetDraining(entry *ConfigEntry, target string, draining bool) error {
+	found := false
+	for _, t := range entry.AllTargets() {
+		if t.Name == target {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("entry %s has no target named %s", entry.Name, target)
+	}
+
+	drainingTargets.Lock()
+	if drainingTargets.m[entry.Name] == nil {
+		drainingTargets.m[entry.Name] = make(map[string]bool)
+	}
+	drainingTargets.m[entry.Name][target] = draining
+	drainingTargets.Unlock()
+
+	if draining {
+		closeIdleSessions(entry.Name, target)
+		closeIdlePoolConns(entry.Name, target)
+	}
+
+	return nil
+}
+
+func isDraining(entry, target string) bool {
+	drainingTargets.RLock()
+	defer drainingTargets.RUnlock()
+
+	return drainingTargets.m[entry][target]
+}
+
+func (e *ConfigEntry) IsDraining(t ConfigTarget) bool {
+	return isDraining(e.Name, t.Name)
+}
+
+// Returns the current weight of a target, taking runtime overrides into account.  Draining targets
+// always have weight 0.
+func (e *ConfigEntry) TargetWeight(t ConfigTarget) int {
+	if e.IsDraining(t) {
+		return 0
+	}
+
+	weightOverrides.RLock()
+	w, ok := weightOverrides.m[e.Name][t.Name]
+	weightOverrides.RUnlock()
+
+	if ok {
+		return w
+	}
+
+	if t.Weight == nil {
+		return 1
+	}
+
+	return *t.Weight
+}
+
+// Picks the target for a new session, in proportion to the target weights.  With client affinity we
+// use (weighted) rendezvous hashing on the client's identity, so that reconnecting clients land on
+// the same target and adding or removing a target only moves the sessions that hashed to it.
+func (e *ConfigEntry) selectTarget(user, database string, clientAddr net.Addr) (ConfigTarget, error) {
+	targets := e.AllTargets()
+	if len(targets) == 1 && !e.IsDraining(targets[0]) {
+		return targets[0], nil
+	}
+
+	weights := make([]int, len(targets))
+	total := 0
+	for i, t := range targets {
+		weights[i] = e.TargetWeight(t)
+		total += weights[i]
+	}
+
+	if total <= 0 {
+		return ConfigTarget{}, fmt.Errorf("all targets of entry %s are draining or have weight 0", e.Name)
+	}
+
+	if e.Affinity != AffinityClient {
+		n := rand.IntN(total)
+		for i, w := range weights {
+			if n < w {
+				return targets[i], nil
+			}
+			n -= w
+		}
+	}
+
+	host := clientAddr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	key := user + "\x00" + database + "\x00" + host
+
+	best := -1
+	var bestScore float64
+	for i, t := range targets {
+		if weights[i] == 0 {
+			continue
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(t.Name))
+
+		// map the hash onto (0, 1) and scale it by the weight: -w/ln(u) gives each target a
+		// share of keys proportional to its weight
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := -float64(weights[i]) / math.Log(u); best == -1 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return targets[best], nil
+}
@@ -0,0 +1,90 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A time.Duration that is written in config files as a string like "30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("expected duration string like \"30s\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Socket options applied to client connections (per listener) or upstream connections (per entry).
+// Unset fields leave the OS/Go defaults alone.
+type TCPOptions struct {
+	// idle time before the first keepalive probe, and the interval between probes.  Useful for
+	// keeping long-lived idle sessions alive through NATs and load balancers that drop idle flows.
+	KeepAlive *Duration `json:"keepalive"`
+	// unanswered keepalive probes after which the connection is dropped, the OS default if unset
+	KeepAliveCount int `json:"keepalive_count"`
+	// disable Nagle's algorithm (Go enables TCP_NODELAY by default)
+	NoDelay *bool `json:"nodelay"`
+	// SO_RCVBUF, in bytes
+	RecvBuffer int `json:"recv_buffer"`
+	// SO_SNDBUF, in bytes
+	SendBuffer int `json:"send_buffer"`
+}
+
+func (o *TCPOptions) Apply(conn net.Conn) error {
+	if o == nil {
+		return nil
+	}
+
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if o.KeepAlive != nil {
+		interval := time.Duration(*o.KeepAlive)
+		err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   interval > 0,
+			Idle:     interval,
+			Interval: interval,
+			Count:    o.KeepAliveCount,
+		})
+		if err != nil {
+			return fmt.Errorf("could not set keepalive: %w", err)
+		}
+	}
+
+	if o.NoDelay != nil {
+		if err := tcp.SetNoDelay(*o.NoDelay); err != nil {
+			return fmt.Errorf("could not set nodelay: %w", err)
+		}
+	}
+
+	if o.RecvBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.RecvBuffer); err != nil {
+			return fmt.Errorf("could not set receive buffer: %w", err)
+		}
+	}
+
+	if o.SendBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.SendBuffer); err != nil {
+			return fmt.Errorf("could not set send buffer: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package remote
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+// Upstream settings (provider_meta values, and rewrite) may be templates with `{{name}}`
+// placeholders, rendered for each client as its session starts, e.g.
+// `postgres://app:{{secret}}@{{params.database}}.cluster.local:5432/{{params.database}}`.  A
+// placeholder names
+//
+//   - `params.<name>`, a startup parameter of the client,
+//   - `claims.<name>`, a claim of the token the client authenticated with (entries with
+//     `auth: "jwt"`), if it is a string, number or boolean,
+//   - a capture group of match.user, by name or number (see tenant.go), or
+//   - another provider_meta key of the same target, whose value is used as is.
+//
+// Values rendered into a `url` are percent-encoded, so that a client can't change anything about
+// the URL but the piece the placeholder stands for.
+
+// Prefix of the placeholders for startup parameters
+const paramsPlaceholder = "params."
+
+// Prefix of the placeholders for token claims
+const claimsPlaceholder = "claims."
+
+// The values of the claims of a verified token that templates may use, by placeholder
+func claimValues(claims map[string]any) map[string]string {
+	values := make(map[string]string, len(claims))
+	for name, claim := range claims {
+		switch v := claim.(type) {
+		case string:
+			values[claimsPlaceholder+name] = v
+		case float64:
+			values[claimsPlaceholder+name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			values[claimsPlaceholder+name] = strconv.FormatBool(v)
+		}
+	}
+	return values
+}
+
+// Renders the placeholders of `s` with `values`, each passed through `escape` if it isn't nil.
+// Every placeholder must have a value.
+func renderTemplate(s string, values map[string]string, escape func(string) string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in %q", s)
+		}
+
+		name := strings.TrimSpace(s[start+2 : start+end])
+		value, ok := values[name]
+		if !ok {
+			return "", fmt.Errorf("no value for placeholder {{%s}}", name)
+		}
+		if escape != nil {
+			value = escape(value)
+		}
+		b.WriteString(s[:start])
+		b.WriteString(value)
+		s = s[start+end+2:]
+	}
+}
+
+// The names of the placeholders in a setting
+func templateNames(s string) ([]string, error) {
+	var names []string
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			return names, nil
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in %q", s)
+		}
+		names = append(names, strings.TrimSpace(s[start+2:start+end]))
+		s = s[start+end+2:]
+	}
+}
+
+// Percent-encodes everything but unreserved characters, which is safe anywhere in a URL
+func escapeURLValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Whether any of the entry's upstream settings has a placeholder
+func (e *ConfigEntry) templated() bool {
+	if strings.Contains(e.Rewrite.Database, "{{") || strings.Contains(e.Rewrite.User, "{{") || strings.Contains(e.Rewrite.Schema, "{{") {
+		return true
+	}
+	for _, t := range e.AllTargets() {
+		for _, value := range t.ProviderMeta {
+			if strings.Contains(value, "{{") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the entry with its upstream settings (and tenancy value) rendered for a client, from its
+// startup parameters, the captures of matchUser and the claims of its token (see claimValues)
+func (e *ConfigEntry) forClient(params codec.ConnectionParams, captures map[string]string, claims map[string]string) (*ConfigEntry, error) {
+	if !e.templated() && !e.Tenancy.templated() {
+		return e, nil
+	}
+
+	values := make(map[string]string, len(params)+len(captures)+len(claims))
+	for name, value := range params {
+		values[paramsPlaceholder+name] = value
+	}
+	for name, value := range captures {
+		values[name] = value
+	}
+	for name, value := range claims {
+		values[name] = value
+	}
+
+	entry := *e
+	var err error
+	if e.Tenancy != nil {
+		tenancy := *e.Tenancy
+		if tenancy.Value, err = renderTemplate(e.Tenancy.Value, values, nil); err != nil {
+			return nil, fmt.Errorf("tenancy.value: %w", err)
+		}
+		entry.Tenancy = &tenancy
+	}
+	// the tenant doesn't change the upstream connection
+	if !e.templated() {
+		return &entry, nil
+	}
+	if entry.ProviderMeta, err = renderMeta(e.ProviderMeta, values); err != nil {
+		return nil, err
+	}
+	if len(e.Targets) > 0 {
+		entry.Targets = make([]ConfigTarget, len(e.Targets))
+		for i, t := range e.Targets {
+			if t.ProviderMeta, err = renderMeta(t.ProviderMeta, values); err != nil {
+				return nil, fmt.Errorf("target %s: %w", t.Name, err)
+			}
+			entry.Targets[i] = t
+		}
+	}
+	if entry.Rewrite.Database, err = renderTemplate(e.Rewrite.Database, values, nil); err != nil {
+		return nil, fmt.Errorf("rewrite.database: %w", err)
+	}
+	if entry.Rewrite.User, err = renderTemplate(e.Rewrite.User, values, nil); err != nil {
+		return nil, fmt.Errorf("rewrite.user: %w", err)
+	}
+	if entry.Rewrite.Schema, err = renderTemplate(e.Rewrite.Schema, values, nil); err != nil {
+		return nil, fmt.Errorf("rewrite.schema: %w", err)
+	}
+
+	// clients whose settings render the same share pools (fmt prints maps sorted by key)
+	if rendered := fmt.Sprint(entry.Rewrite, entry.AllTargets()); rendered != fmt.Sprint(e.Rewrite, e.AllTargets()) {
+		entry.rendered = rendered
+	}
+
+	return &entry, nil
+}
+
+// Renders a provider_meta, whose placeholders may also name its other keys
+func renderMeta(meta map[string]string, values map[string]string) (map[string]string, error) {
+	if meta == nil {
+		return nil, nil
+	}
+
+	withMeta := make(map[string]string, len(values)+len(meta))
+	for key, value := range meta {
+		withMeta[key] = value
+	}
+	// captures and parameters come first, as documented
+	for name, value := range values {
+		withMeta[name] = value
+	}
+
+	rendered := make(map[string]string, len(meta))
+	for key, value := range meta {
+		var escape func(string) string
+		if key == "url" {
+			escape = escapeURLValue
+		}
+
+		var err error
+		if rendered[key], err = renderTemplate(value, withMeta, escape); err != nil {
+			return nil, fmt.Errorf("provider_meta %s: %w", key, err)
+		}
+	}
+	return rendered, nil
+}
+
+// Checks that the entry's placeholders name startup parameters, token claims (for entries
+// authenticating clients with a JWT), capture groups of match.user or provider_meta keys
+func (e *ConfigEntry) validateTemplates() error {
+	var re *regexp.Regexp
+	if e.Match.User != "" {
+		var err error
+		if re, err = e.Match.userPattern(); err != nil {
+			return fmt.Errorf("invalid match.user: %w", err)
+		}
+	}
+	known := func(name string, meta map[string]string) bool {
+		if strings.HasPrefix(name, paramsPlaceholder) && len(name) > len(paramsPlaceholder) {
+			return true
+		}
+		if strings.HasPrefix(name, claimsPlaceholder) && len(name) > len(claimsPlaceholder) && e.Auth == AuthJWT {
+			return true
+		}
+		if _, ok := meta[name]; ok {
+			return true
+		}
+		if re == nil {
+			return false
+		}
+		if i, err := strconv.Atoi(name); err == nil {
+			return i >= 0 && i <= re.NumSubexp()
+		}
+		return name != "" && re.SubexpIndex(name) >= 0
+	}
+
+	check := func(setting string, meta map[string]string) error {
+		names, err := templateNames(setting)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !known(name, meta) {
+				return fmt.Errorf("placeholder {{%s}} is neither a startup parameter (params.<name>), a token claim (claims.<name>, with auth jwt), a capture group of match.user nor a provider_meta key", name)
+			}
+		}
+		return nil
+	}
+
+	for _, setting := range []string{e.Rewrite.Database, e.Rewrite.User, e.Rewrite.Schema} {
+		if err := check(setting, nil); err != nil {
+			return fmt.Errorf("invalid rewrite: %w", err)
+		}
+	}
+	if e.Tenancy != nil {
+		if err := check(e.Tenancy.Value, nil); err != nil {
+			return fmt.Errorf("invalid tenancy: %w", err)
+		}
+	}
+	for _, t := range e.AllTargets() {
+		for key, value := range t.ProviderMeta {
+			if err := check(value, t.ProviderMeta); err != nil {
+				return fmt.Errorf("invalid provider_meta %s: %w", key, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+// Row level tenancy on tables shared between tenants: the statements of the entry's clients are
+// rewritten so that they only see and change the rows of their tenant (see query.Predicate), as
+// a layer of defense behind the application's own filtering.  Like schema confinement, this is a
+// guard rather than an isolation boundary, which row level security policies upstream provide.
+type Tenancy struct {
+	// the shared tables, by name or schema.name
+	Tables []string `json:"tables"`
+	// the column of the tables holding the tenant
+	Column string `json:"column"`
+	// the client's tenant, usually a template resolved as the session starts, e.g. `{{tenant}}`
+	// for a capture group of match.user or `{{params.tenant}}` for a startup parameter
+	Value string `json:"value"`
+}
+
+func (t *Tenancy) validate() error {
+	if len(t.Tables) == 0 {
+		return errors.New("tables are required")
+	}
+	for _, table := range t.Tables {
+		if table == "" || strings.Count(table, ".") > 1 {
+			return fmt.Errorf("table %q must be a name or schema.name", table)
+		}
+	}
+	if t.Column == "" {
+		return errors.New("column is required")
+	}
+	if t.Value == "" {
+		return errors.New("value is required")
+	}
+	return nil
+}
+
+func (t *Tenancy) templated() bool {
+	return t != nil && strings.Contains(t.Value, "{{")
+}
+
+// Called by the relay once the other checks let a client's message through.  For entries with a
+// tenancy, rewrites the statements of Query and Parse messages in place, and returns a
+// *PolicyError for one that uses the shared tables in a way that can't be confined.  Between
+// requests that is refused like other requests, but with requests in flight it ends the session,
+// as a refusal couldn't be answered in turn.
+func ApplyTenancy(client net.Conn, message *codec.Message) error {
+	if message.Type != codec.MessageTypeQuery && message.Type != codec.MessageTypeParse {
+		return nil
+	}
+
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.config.Tenancy == nil {
+		associations.Unlock()
+		return nil
+	}
+	tenancy, status, inFlight := a.config.Tenancy, a.txStatus, a.pending > 0 || a.unsynced
+	associations.Unlock()
+
+	predicate := query.Predicate{Tables: tenancy.Tables, Column: tenancy.Column, Value: tenancy.Value}
+	refuse := func(err error) error {
+		return &PolicyError{Code: codec.SQLStateInsufficientPrivilege, Message: err.Error(), Status: status, Fatal: inFlight}
+	}
+
+	if message.Type == codec.MessageTypeQuery {
+		sql := message.ParseAsQuery().QueryString
+		confined, err := predicate.Apply(sql)
+		if err != nil {
+			return refuse(err)
+		}
+		if confined != sql {
+			*message = codec.NewQuery(confined)
+		}
+		return nil
+	}
+
+	parsed, err := message.ParseAsParse()
+	if err != nil {
+		// the upstream refuses it all the same
+		return nil
+	}
+	confined, err := predicate.Apply(parsed.QueryString)
+	if err != nil {
+		return refuse(err)
+	}
+	if confined != parsed.QueryString {
+		// the parameter types follow the query
+		types := message.Data[codec.MessageDataStartIndex+len(parsed.Name)+1+len(parsed.QueryString)+1 : message.Length+1]
+		*message = codec.NewBuilder(codec.MessageTypeParse).String(parsed.Name).String(confined).Bytes(types).Message()
+	}
+	return nil
+}
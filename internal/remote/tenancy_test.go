@@ -0,0 +1,55 @@
+package remote
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestApplyTenancy(t *testing.T) {
+	entry := &ConfigEntry{Name: "shared", Match: ConfigMatch{User: `[a-z]+\.(?P<tenant>[a-z0-9]+)`}, Tenancy: &Tenancy{Tables: []string{"orders"}, Column: "tenant_id", Value: "{{tenant}}"}}
+	if err := entry.validateTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	captures, _ := entry.Match.matchUser("alice.acme")
+	rendered, err := entry.forClient(codec.ConnectionParams{"user": "alice.acme"}, captures, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.Tenancy.Value != "acme" || entry.Tenancy.Value != "{{tenant}}" || rendered.rendered != "" {
+		t.Fatalf("expected just the tenant to be rendered, got %+v", rendered)
+	}
+
+	a := &association{config: rendered, entry: entry.Name, txStatus: codec.BackendTransactionStatusIdle}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	message := codec.NewQuery("SELECT * FROM orders")
+	if err = ApplyTenancy(client, &message); err != nil || !strings.Contains(message.ParseAsQuery().QueryString, `"tenant_id" = 'acme'`) {
+		t.Errorf("expected the query to be confined, got %q (%v)", message.ParseAsQuery().QueryString, err)
+	}
+
+	types := []byte{0, 1, 0, 0, 0, 23}
+	message = codec.NewBuilder(codec.MessageTypeParse).String("s1").String("DELETE FROM orders WHERE id = $1").Bytes(types).Message()
+	if err = ApplyTenancy(client, &message); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := message.ParseAsParse()
+	if err != nil || parsed.Name != "s1" || !strings.Contains(parsed.QueryString, `"orders"."tenant_id" = 'acme'`) || !strings.HasSuffix(string(message.Data), string(types)) {
+		t.Errorf("expected the statement to be confined and its parameter types kept, got %+v (%v)", parsed, err)
+	}
+
+	var policyErr *PolicyError
+	message = codec.NewQuery("TRUNCATE orders")
+	if err = ApplyTenancy(client, &message); !errors.As(err, &policyErr) || policyErr.Fatal {
+		t.Errorf("expected the statement to be refused in place, got %v", err)
+	}
+	associations.Lock()
+	a.pending = 1
+	associations.Unlock()
+	if err = ApplyTenancy(client, &message); !errors.As(err, &policyErr) || !policyErr.Fatal {
+		t.Errorf("expected a pipelined statement to end the session, got %v", err)
+	}
+}
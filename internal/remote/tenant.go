@@ -0,0 +1,55 @@
+package remote
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Tenant routing: an entry's match.user is a regular expression that the whole user name must
+// match, e.g. `(?P<user>[^.]+)\.(?P<tenant>[a-z0-9_]+)` for users like alice.tenant42, and its
+// capture groups (by name, or by number) fill in the `{{tenant}}` placeholders of the entry's
+// provider_meta, targets and rewrite (see template.go).  One entry can so serve any number of
+// tenant databases, and each tenant gets pools of its own.
+
+// Compiled match.user patterns, since entries are copied around by value
+var userPatterns sync.Map
+
+func (m *ConfigMatch) userPattern() (*regexp.Regexp, error) {
+	if re, ok := userPatterns.Load(m.User); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(`^(?:` + m.User + `)$`)
+	if err != nil {
+		return nil, err
+	}
+	userPatterns.Store(m.User, re)
+	return re, nil
+}
+
+// Whether the user matches the entry, and the values of the pattern's capture groups if so
+func (m *ConfigMatch) matchUser(user string) (map[string]string, bool) {
+	if m.User == "" {
+		return nil, true
+	}
+
+	// checked when the config was read
+	re, err := m.userPattern()
+	if err != nil {
+		return nil, false
+	}
+	match := re.FindStringSubmatch(user)
+	if match == nil {
+		return nil, false
+	}
+
+	captures := make(map[string]string, len(match))
+	for i, name := range re.SubexpNames() {
+		captures[strconv.Itoa(i)] = match[i]
+		if name != "" {
+			captures[name] = match[i]
+		}
+	}
+	return captures, true
+}
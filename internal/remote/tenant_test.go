@@ -0,0 +1,72 @@
+package remote
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestTenantRouting(t *testing.T) {
+	config, err := readTestConfig(t, `{"entries": [{
+		"name": "tenants",
+		"match": {"database": "app", "user": "(?P<user>[^.]+)\\.(?P<tenant>[a-z0-9]+)"},
+		"provider": "static",
+		"provider_meta": {"url": "postgres://{{user}}@db.internal:5432/{{ tenant }}"},
+		"rewrite": {"user": "{{1}}"},
+		"lazy_connect": true
+	}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entryFor := func(user string) *ConfigEntry {
+		client, other := net.Pipe()
+		defer client.Close()
+		defer other.Close()
+
+		params := codec.ConnectionParams{"database": "app", "user": user}
+		if _, err := GetOrAllocConnection(client, "session", config.Entries, &params); err != nil {
+			t.Logf("no entry for %s: %v", user, err)
+			return nil
+		}
+		associations.Lock()
+		entry := associations.m[client].config
+		associations.Unlock()
+		Release(client, true)
+		return entry
+	}
+
+	alice, bob := entryFor("alice.tenant42"), entryFor("bob.tenant7")
+	if alice == nil || bob == nil {
+		t.Fatal("expected users with a tenant suffix to match")
+	}
+	if url := alice.ProviderMeta["url"]; url != "postgres://alice@db.internal:5432/tenant42" {
+		t.Errorf("unexpected url %q", url)
+	}
+	if alice.Rewrite.User != "alice" {
+		t.Errorf("unexpected rewritten user %q", alice.Rewrite.User)
+	}
+	target := alice.AllTargets()[0]
+	if alice.poolKey(target) == bob.poolKey(target) {
+		t.Error("expected tenants to get pools of their own")
+	}
+	if entryFor("alice") != nil || entryFor("alice.tenant42.x") != nil {
+		t.Error("expected users without a tenant suffix not to match")
+	}
+
+	_, err = readTestConfig(t, `{"entries": [{
+		"name": "tenants",
+		"match": {"database": "app", "user": "(?P<tenant>.+)"},
+		"provider": "static",
+		"provider_meta": {"url": "postgres://db.internal/{{tenant_id}}"}
+	}]}`)
+	if err == nil || !strings.Contains(err.Error(), "{{tenant_id}}") {
+		t.Errorf("expected a placeholder without a capture group to be refused, got %v", err)
+	}
+	_, err = readTestConfig(t, `{"entries": [{"name": "tenants", "match": {"user": "(unclosed"}}]}`)
+	if err == nil || !strings.Contains(err.Error(), "match.user") {
+		t.Errorf("expected an invalid pattern to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A TLS protocol version, written in config files as "1.2" or "1.3"
+type TLSVersion uint16
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (v *TLSVersion) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("expected TLS version string like \"1.2\": %w", err)
+	}
+
+	version, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("unknown TLS version %q", s)
+	}
+
+	*v = TLSVersion(version)
+	return nil
+}
+
+// A TLS 1.2 cipher suite, written in config files by its IANA name, e.g.
+// "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384".  Suites Go considers insecure are refused.
+type CipherSuite uint16
+
+func (c *CipherSuite) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == s {
+			*c = CipherSuite(suite.ID)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown or insecure cipher suite %q", s)
+}
+
+// A key exchange curve, written in config files as "X25519", "P-256", "P-384" or "P-521"
+type Curve tls.CurveID
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+func (c *Curve) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	curve, ok := curves[s]
+	if !ok {
+		return fmt.Errorf("unknown curve %q", s)
+	}
+
+	*c = Curve(curve)
+	return nil
+}
+
+// Restrictions on negotiated TLS parameters, for both the client listener and upstream
+// connections.  Unset fields leave Go's defaults alone.
+type TLSPolicy struct {
+	MinVersion TLSVersion `json:"min_version"`
+	// only applies to TLS 1.2 and below, TLS 1.3 suites aren't configurable
+	CipherSuites     []CipherSuite `json:"cipher_suites"`
+	CurvePreferences []Curve       `json:"curve_preferences"`
+}
+
+func (p *TLSPolicy) apply(config *tls.Config) {
+	if p == nil || config == nil {
+		return
+	}
+
+	if p.MinVersion != 0 {
+		config.MinVersion = uint16(p.MinVersion)
+	}
+	if len(p.CipherSuites) > 0 {
+		config.CipherSuites = make([]uint16, len(p.CipherSuites))
+		for i, suite := range p.CipherSuites {
+			config.CipherSuites[i] = uint16(suite)
+		}
+	}
+	if len(p.CurvePreferences) > 0 {
+		config.CurvePreferences = make([]tls.CurveID, len(p.CurvePreferences))
+		for i, curve := range p.CurvePreferences {
+			config.CurvePreferences[i] = tls.CurveID(curve)
+		}
+	}
+}
+
+// How strictly client certificates are checked, see TLSConfig.ClientCert
+const (
+	// client certificates are neither requested nor checked
+	ClientCertNone = "none"
+	// clients may present a certificate, which must then chain to the client CA
+	ClientCertVerify = "verify"
+	// clients must present a certificate that chains to the client CA
+	ClientCertRequire = "require"
+)
+
+// TLS settings for client connections.  Clients opt into TLS with an SSLRequest, as with postgres
+// itself.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// refuse clients that don't ask for TLS
+	Require bool `json:"require"`
+	// PEM bundle of the CAs client certificates must chain to
+	ClientCAFile string `json:"client_ca_file"`
+	// "none" (the default), "verify" or "require", see ClientCertNone etc.
+	ClientCert string `json:"client_cert"`
+	// only allow clients to log in as a user named by their certificate's CN or one of its SANs
+	CertUser bool `json:"cert_user"`
+	TLSPolicy
+}
+
+// Builds the tls.Config for the client listener.  Returns nil if TLS isn't configured.
+func (c *TLSConfig) ServerConfig() (*tls.Config, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	reloader := &certReloader{certFile: c.CertFile, keyFile: c.KeyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	if c.CertUser && c.ClientCert != ClientCertRequire {
+		return nil, errors.New("cert_user requires client_cert to be \"require\"")
+	}
+
+	config := &tls.Config{GetCertificate: reloader.getCertificate}
+	c.TLSPolicy.apply(config)
+
+	switch c.ClientCert {
+	case "", ClientCertNone:
+		return config, nil
+	case ClientCertVerify:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientCertRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client_cert mode %q", c.ClientCert)
+	}
+
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA bundle: %w", err)
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", c.ClientCAFile)
+	}
+
+	return config, nil
+}
+
+// Returns the names a client's verified certificate was issued to: its CN followed by its DNS and
+// email SANs.  Empty if the client didn't connect over TLS or presented no certificate.
+func ClientCertNames(client net.Conn) []string {
+	// a *tls.Conn, or a stream of a tunnel from another proxy
+	tlsConn, ok := client.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+
+	var names []string
+	if cn := certs[0].Subject.CommonName; cn != "" {
+		names = append(names, cn)
+	}
+	names = append(names, certs[0].DNSNames...)
+	names = append(names, certs[0].EmailAddresses...)
+
+	return names
+}
+
+// Whether a client may use this entry based on its certificate
+func (m *ConfigMatch) matchesClientCert(client net.Conn) bool {
+	return m.ClientCert == "" || slices.Contains(ClientCertNames(client), m.ClientCert)
+}
+
+// How often the listener's certificate files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+// Serves the listener's certificate, picking up new versions of the cert/key files as they are
+// rotated, so that renewing a certificate doesn't require a restart (which would drop every
+// session).  If a new version can't be loaded (e.g. the cert was replaced but not yet the key), the
+// previous certificate keeps being served until the next check.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// modification times of the loaded files, and when we last looked at them
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+func (r *certReloader) load() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+
+	r.cert, r.certMod, r.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// Whether either file changed since the certificate was loaded
+func (r *certReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+
+	return !certInfo.ModTime().Equal(r.certMod) || !keyInfo.ModTime().Equal(r.keyMod)
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= certReloadInterval {
+		r.checked = time.Now()
+
+		if r.changed() {
+			if err := r.load(); err != nil {
+				slog.Error("could not reload TLS certificate, keeping the previous one", "error", err)
+			} else {
+				slog.Info("reloaded TLS certificate", "cert_file", r.certFile)
+			}
+		}
+	}
+
+	return r.cert, nil
+}
@@ -0,0 +1,143 @@
+package remote
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	var policy TLSPolicy
+	err := json.Unmarshal([]byte(`{
+		"min_version": "1.2",
+		"cipher_suites": ["TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"],
+		"curve_preferences": ["X25519", "P-256"]
+	}`), &policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config := &tls.Config{}
+	policy.apply(config)
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("unexpected min version %x", config.MinVersion)
+	}
+	if len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("unexpected cipher suites %v", config.CipherSuites)
+	}
+	if len(config.CurvePreferences) != 2 || config.CurvePreferences[0] != tls.X25519 || config.CurvePreferences[1] != tls.CurveP256 {
+		t.Errorf("unexpected curves %v", config.CurvePreferences)
+	}
+
+	// applying twice (e.g. to a shared config) must not accumulate
+	policy.apply(config)
+	if len(config.CipherSuites) != 1 || len(config.CurvePreferences) != 2 {
+		t.Errorf("policy accumulated on second apply: %v %v", config.CipherSuites, config.CurvePreferences)
+	}
+
+	for _, invalid := range []string{
+		`{"min_version": "1.4"}`,
+		`{"cipher_suites": ["TLS_RSA_WITH_RC4_128_SHA"]}`,
+		`{"curve_preferences": ["P-192"]}`,
+	} {
+		if err := json.Unmarshal([]byte(invalid), &TLSPolicy{}); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+}
+
+// Writes a fresh self-signed certificate for `name` to certFile/keyFile
+func writeTestCert(t *testing.T, name, certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, "first", certFile, keyFile)
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	commonName := func() string {
+		cert, err := r.getCertificate(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	writeTestCert(t, "second", certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// files are only checked every certReloadInterval
+	r.checked = time.Now()
+	if got := commonName(); got != "first" {
+		t.Errorf("expected certificate to be reloaded only after the interval, got %q", got)
+	}
+
+	r.checked = time.Time{}
+	if got := commonName(); got != "second" {
+		t.Errorf("expected rotated certificate, got %q", got)
+	}
+
+	// a broken rotation keeps the previous certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	evenLater := later.Add(time.Minute)
+	if err := os.Chtimes(keyFile, evenLater, evenLater); err != nil {
+		t.Fatal(err)
+	}
+	r.checked = time.Time{}
+	if got := commonName(); got != "second" {
+		t.Errorf("expected previous certificate after failed reload, got %q", got)
+	}
+}
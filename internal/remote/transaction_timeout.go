@@ -0,0 +1,78 @@
+package remote
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The entry's max_transaction_duration for a session, 0 if unlimited
+func MaxTransactionDuration(client net.Conn) time.Duration {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
+		return 0
+	}
+	return time.Duration(a.config.MaxTransactionDuration)
+}
+
+// When the session's current transaction (or autocommitted request) outlives the entry's
+// max_transaction_duration, zero if there is no limit or the session isn't in a transaction
+func TransactionDeadline(client net.Conn) time.Time {
+	associations.Lock()
+	defer associations.Unlock()
+
+	a := associations.m[client]
+	if a == nil {
+		return time.Time{}
+	}
+	return a.transactionDeadline()
+}
+
+// Called with the associations lock held
+func (a *association) transactionDeadline() time.Time {
+	limit := time.Duration(a.config.MaxTransactionDuration)
+	if limit <= 0 || a.transactionStart.IsZero() || a.idle() {
+		return time.Time{}
+	}
+	return a.transactionStart.Add(limit)
+}
+
+// Cancels the request in flight of a session whose transaction reached `deadline`, so that the
+// session is soon idle in its (now failed) transaction, where the relay ends it.  Does nothing if
+// the transaction ended meanwhile or nothing is in flight.  Requests started after the deadline,
+// like the relay's ROLLBACK, aren't canceled.
+func CancelOverdueRequest(client net.Conn, deadline time.Time) {
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil || a.conn == nil || a.pending == 0 && !a.unsynced || !a.transactionDeadline().Equal(deadline) ||
+		!a.requestStart.Before(deadline) {
+		associations.Unlock()
+		return
+	}
+	conn, timeout := a.conn.PgConn(), a.config.connectTimeout()
+	associations.Unlock()
+
+	slog.Warn("canceling request of transaction over max_transaction_duration", "entry", a.entry, "session", a.session)
+	cancelRequest(conn, timeout)
+}
+
+// Asks the upstream to cancel whatever `conn` is running, waiting up to `timeout`
+func cancelRequest(conn *pgconn.PgConn, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := conn.CancelRequest(ctx); err != nil {
+		slog.Error("could not cancel upstream request", "error", err)
+	}
+}
+
+// Whether the session's transaction is past its max_transaction_duration
+func TransactionExpired(client net.Conn) bool {
+	deadline := TransactionDeadline(client)
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
@@ -0,0 +1,48 @@
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestTransactionDeadline(t *testing.T) {
+	entry := &ConfigEntry{Name: "limited", MaxTransactionDuration: Duration(time.Minute)}
+	a := &association{config: entry, entry: entry.Name, txStatus: codec.BackendTransactionStatusIdle}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	if MaxTransactionDuration(client) != time.Minute {
+		t.Errorf("expected the entry's limit, got %v", MaxTransactionDuration(client))
+	}
+	if !TransactionDeadline(client).IsZero() {
+		t.Error("expected no deadline before the first request")
+	}
+
+	BeginRequest(client, codec.MessageTypeQuery)
+	deadline := TransactionDeadline(client)
+	if until := time.Until(deadline); until <= 59*time.Second || until > time.Minute {
+		t.Fatalf("expected a deadline a minute after the request started, got %v", deadline)
+	}
+	EndRequest(client, codec.BackendTransactionStatusInTransaction)
+	BeginRequest(client, codec.MessageTypeQuery)
+	if !TransactionDeadline(client).Equal(deadline) {
+		t.Error("expected the deadline to stay that of the start of the transaction")
+	}
+	if TransactionExpired(client) {
+		t.Error("expected the transaction not to be expired yet")
+	}
+
+	associations.Lock()
+	a.transactionStart = a.transactionStart.Add(-time.Hour)
+	associations.Unlock()
+	if !TransactionExpired(client) {
+		t.Error("expected the transaction to be expired")
+	}
+
+	EndRequest(client, codec.BackendTransactionStatusIdle)
+	if !TransactionDeadline(client).IsZero() || TransactionExpired(client) {
+		t.Error("expected no deadline once the transaction ended")
+	}
+}
@@ -0,0 +1,113 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/michaelhelvey/pgproxy/internal/tunnel"
+)
+
+// How an entry reaches upstreams that aren't directly routable from the proxy
+type TunnelConfig struct {
+	// socks5:// or http:// forward proxy that connections go through, see tunnel.Proxy
+	Proxy string           `json:"proxy"`
+	SSH   *SSHTunnelConfig `json:"ssh"`
+	// another pgproxy near the upstreams, with a listener accepting tunnels
+	PGProxy *PGProxyTunnelConfig `json:"pgproxy"`
+
+	// built once and shared by every copy of the entry, so that its upstream connections share
+	// one tunnel
+	once sync.Once
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	err  error
+}
+
+type SSHTunnelConfig struct {
+	tunnel.SSHConfig
+	// defaults to tunnel.DefaultSSHKeepAlive
+	KeepAlive Duration `json:"keepalive"`
+	// defaults to tunnel.DefaultSSHTimeout
+	Timeout Duration `json:"timeout"`
+}
+
+type PGProxyTunnelConfig struct {
+	tunnel.AgentConfig
+	// defaults to tunnel.DefaultAgentKeepAlive
+	KeepAlive Duration `json:"keepalive"`
+	// defaults to tunnel.DefaultAgentTimeout
+	Timeout Duration `json:"timeout"`
+}
+
+func (c *TunnelConfig) dialer() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	c.once.Do(func() {
+		if c.Proxy == "" && c.SSH == nil && c.PGProxy == nil {
+			c.err = errors.New("tunnel: none of proxy, ssh or pgproxy is configured")
+			return
+		}
+		if c.SSH != nil && c.PGProxy != nil {
+			c.err = errors.New("tunnel: ssh and pgproxy can't be combined")
+			return
+		}
+
+		if c.Proxy != "" {
+			proxy, err := tunnel.NewProxy(c.Proxy)
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.dial = proxy.DialContext
+		}
+		if c.PGProxy != nil {
+			// with a proxy as well, the far pgproxy is reached through it
+			config := c.PGProxy.AgentConfig
+			config.KeepAlive, config.Timeout = time.Duration(c.PGProxy.KeepAlive), time.Duration(c.PGProxy.Timeout)
+			config.Dial = c.dial
+			agent, err := tunnel.NewAgent(config)
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.dial = agent.DialContext
+			return
+		}
+		if c.SSH == nil {
+			return
+		}
+
+		// with both, the jump host is reached through the proxy
+		config := c.SSH.SSHConfig
+		config.KeepAlive, config.Timeout = time.Duration(c.SSH.KeepAlive), time.Duration(c.SSH.Timeout)
+		config.Dial = c.dial
+		ssh, err := tunnel.NewSSH(config)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.dial = ssh.DialContext
+	})
+
+	return c.dial, c.err
+}
+
+// Makes upstream connections go through the tunnel.  The upstream's host name is resolved on the
+// far side, as it may only exist in the private network's DNS.
+func (c *TunnelConfig) apply(connConfig *pgx.ConnConfig) error {
+	if c == nil {
+		return nil
+	}
+
+	dial, err := c.dialer()
+	if err != nil {
+		return err
+	}
+
+	connConfig.DialFunc = dial
+	connConfig.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+		return []string{host}, nil
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package remote
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/contention"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+var upstreamErrors = metrics.NewCounterVec(
+	"pgproxy_upstream_errors_total", "ErrorResponses upstreams sent to clients, by SQLSTATE and severity.", "entry", "sqlstate", "severity",
+)
+
+// Severities after which Postgres ends the backend
+var fatalSeverities = []string{"FATAL", "PANIC"}
+
+// Checks an entry's recycle_on_error, whose items are SQLSTATEs (e.g. "25006") or classes of them
+// (e.g. "08")
+func validateRecycleOnError(codes []string) error {
+	for _, code := range codes {
+		if len(code) != 2 && len(code) != 5 || strings.ToUpper(code) != code ||
+			strings.IndexFunc(code, func(r rune) bool { return (r < '0' || r > '9') && (r < 'A' || r > 'Z') }) >= 0 {
+			return fmt.Errorf("%q is neither a SQLSTATE nor a class of them", code)
+		}
+	}
+	return nil
+}
+
+// Whether an error with `code` makes the entry's upstream connections unfit to pool
+func (e *ConfigEntry) recycles(code string) bool {
+	return slices.ContainsFunc(e.RecycleOnError, func(c string) bool { return strings.HasPrefix(code, c) })
+}
+
+// Accounts for an ErrorResponse the upstream sends the client: counts it, logs it with the session's
+// context if it ended the backend, and marks the upstream connection to be closed rather than
+// pooled if it ended the backend or matches the entry's recycle_on_error.  Deadlocks and
+// serialization failures also go to contention.Observe, with the session's latest query.
+func UpstreamError(client net.Conn, message *codec.Message) {
+	parsed, err := message.ParseAsErrorResponse()
+	if err != nil {
+		slog.Warn("could not parse upstream error", "error", err)
+		return
+	}
+
+	associations.Lock()
+	a := associations.m[client]
+	if a == nil {
+		associations.Unlock()
+		return
+	}
+	upstreamErrors.With(a.entry, parsed.Code, parsed.Severity).Inc()
+
+	fatal := slices.Contains(fatalSeverities, parsed.Severity)
+	if fatal {
+		var pid uint32
+		if a.conn != nil {
+			pid = a.conn.PgConn().PID()
+		}
+		slog.Error("upstream ended the session's backend", "session", a.session, "entry", a.entry, "user", a.user,
+			"database", a.database, "target", a.target, "backend_pid", pid,
+			"severity", parsed.Severity, "code", parsed.Code, "message", parsed.Message)
+	}
+	if (fatal || a.config.recycles(parsed.Code)) && !a.discard && a.pool != nil {
+		slog.Info("closing upstream connection instead of pooling it", "session", a.session, "entry", a.entry, "target", a.target, "code", parsed.Code)
+		a.discard = true
+	}
+
+	observed := contention.Error{Entry: a.entry, Target: a.target, Code: parsed.Code}
+	if q := a.traffic.latestQuery(); q != nil {
+		observed.Query = q.text
+	}
+	associations.Unlock()
+
+	if contention.IsContention(parsed.Code) {
+		contention.Observe(observed)
+	}
+}
@@ -0,0 +1,40 @@
+package remote
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestUpstreamError(t *testing.T) {
+	entry := &ConfigEntry{Name: "errors", RecycleOnError: []string{"25006", "08"}}
+	a := &association{config: entry, entry: entry.Name, pool: &pool{}}
+	client, _, cleanup := associate(a)
+	defer cleanup()
+
+	for _, tt := range []struct {
+		severity, code string
+		discard        bool
+	}{
+		{codec.ErrorSeverityError, "42601", false},
+		{codec.ErrorSeverityError, "25006", true},
+		{codec.ErrorSeverityError, "08006", true},
+		{codec.ErrorSeverityFatal, "57P01", true},
+		{"PANIC", "XX000", true},
+	} {
+		a.discard = false
+		message := codec.NewErrorResponse(tt.severity, tt.code, "oops")
+		UpstreamError(client, &message)
+		if a.discard != tt.discard {
+			t.Errorf("expected %s %s to discard the connection: %t", tt.severity, tt.code, tt.discard)
+		}
+	}
+
+	for _, codes := range []string{`["2500"]`, `["25p01"]`, `["25-06"]`} {
+		_, err := readTestConfig(t, `{"entries": [{"name": "app", "recycle_on_error": `+codes+`}]}`)
+		if err == nil || !strings.Contains(err.Error(), "recycle_on_error") {
+			t.Errorf("expected %s to be rejected, got %v", codes, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package remote
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+)
+
+// Per upstream (target of an entry) statistics, for sizing pools: how many connections are open
+// and in use, and how long sessions wait to acquire one
+
+var (
+	upstreamAcquires = metrics.NewCounterVec(
+		"pgproxy_upstream_acquires_total", "Upstream connections sessions acquired, from a pool or dialed.", "entry", "target",
+	)
+	upstreamAcquireWait = metrics.NewCounterVec(
+		"pgproxy_upstream_acquire_wait_microseconds_total", "Time sessions spent acquiring upstream connections.", "entry", "target",
+	)
+	upstreamAcquireTimeouts = metrics.NewCounterVec(
+		"pgproxy_upstream_acquire_timeouts_total", "Sessions that gave up acquiring an upstream connection, after query_wait_timeout or connect_timeout.", "entry", "target",
+	)
+)
+
+func init() {
+	upstreamGauge("pgproxy_upstream_connections_open", "Upstream connections open (or being opened), pooled or held by sessions.",
+		func(u UpstreamStats) int64 { return int64(u.Open) })
+	upstreamGauge("pgproxy_upstream_connections_in_use", "Upstream connections held by sessions.",
+		func(u UpstreamStats) int64 { return int64(u.InUse) })
+	upstreamGauge("pgproxy_upstream_avg_acquire_wait_microseconds", "Average time sessions spent acquiring an upstream connection over the last stats period.",
+		func(u UpstreamStats) int64 { return u.AvgAcquireWait.Microseconds() })
+}
+
+// Registers a gauge, labeled by entry and target, computed from Upstreams whenever metrics are read
+func upstreamGauge(name, help string, value func(UpstreamStats) int64) {
+	metrics.NewGaugeFunc(name, help, []string{"entry", "target"}, func(emit func([]string, int64)) {
+		for _, u := range Upstreams() {
+			emit([]string{u.Entry, u.Target}, value(u))
+		}
+	})
+}
+
+type upstreamKey struct {
+	entry, target string
+}
+
+// The upstreams sessions acquired connections for, with their average acquire wait over the last
+// stats period, and their totals at its start
+var upstreamAverages = struct {
+	sync.Mutex
+	wait     map[upstreamKey]time.Duration
+	previous map[upstreamKey]upstreamTotals
+}{wait: make(map[upstreamKey]time.Duration), previous: make(map[upstreamKey]upstreamTotals)}
+
+type upstreamTotals struct {
+	acquires, waitTime uint64
+}
+
+// Counts a session acquiring an upstream connection for a target, or failing to
+func countAcquire(entry, target string, wait time.Duration, err error) {
+	key := upstreamKey{entry, target}
+	upstreamAverages.Lock()
+	if _, ok := upstreamAverages.previous[key]; !ok {
+		upstreamAverages.previous[key] = upstreamTotals{}
+	}
+	upstreamAverages.Unlock()
+
+	switch {
+	case err == nil:
+		upstreamAcquires.With(entry, target).Inc()
+		upstreamAcquireWait.With(entry, target).Add(uint64(wait.Microseconds()))
+	case errors.Is(err, ErrQueryWaitTimeout), errors.Is(err, ErrConnectTimeout):
+		upstreamAcquireTimeouts.With(entry, target).Inc()
+	}
+}
+
+// Called once per stats period, see computeAverages
+func computeUpstreamAverages() {
+	upstreamAverages.Lock()
+	defer upstreamAverages.Unlock()
+
+	for key, previous := range upstreamAverages.previous {
+		current := upstreamTotals{
+			acquires: upstreamAcquires.With(key.entry, key.target).Value(),
+			waitTime: upstreamAcquireWait.With(key.entry, key.target).Value(),
+		}
+		upstreamAverages.wait[key] = 0
+		if current.acquires > previous.acquires {
+			upstreamAverages.wait[key] = time.Duration((current.waitTime-previous.waitTime)/(current.acquires-previous.acquires)) * time.Microsecond
+		}
+		upstreamAverages.previous[key] = current
+	}
+}
+
+// The upstream connections of a target of an entry, and how sessions acquired them.  The
+// connections of the entry's overrides count towards the entry.
+type UpstreamStats struct {
+	Entry  string
+	Target string
+	// connections open, including those being dialed and idle ones in pools, and those held by
+	// sessions
+	Open  int
+	InUse int
+	// since the proxy started
+	Acquires        uint64
+	AcquireTimeouts uint64
+	// over the last stats period
+	AvgAcquireWait time.Duration
+}
+
+// Returns statistics for every upstream that has connections or had sessions acquire one, sorted
+// by entry and target
+func Upstreams() []UpstreamStats {
+	byKey := map[upstreamKey]*UpstreamStats{}
+	get := func(entry, target string) *UpstreamStats {
+		key := upstreamKey{entry, target}
+		u := byKey[key]
+		if u == nil {
+			u = &UpstreamStats{Entry: entry, Target: target}
+			byKey[key] = u
+		}
+		return u
+	}
+
+	associations.Lock()
+	for _, a := range associations.m {
+		if a.conn == nil {
+			continue
+		}
+		u := get(a.entry, a.target)
+		u.InUse++
+		if a.pool == nil {
+			// pooled connections are counted with their pool
+			u.Open++
+		}
+	}
+	associations.Unlock()
+
+	pools.Lock()
+	for _, p := range pools.m {
+		p.mu.Lock()
+		get(p.entry.Name, p.target.Name).Open += p.open
+		p.mu.Unlock()
+	}
+	pools.Unlock()
+
+	upstreamAverages.Lock()
+	for key := range upstreamAverages.previous {
+		u := get(key.entry, key.target)
+		u.AvgAcquireWait = upstreamAverages.wait[key]
+	}
+	upstreamAverages.Unlock()
+
+	stats := make([]UpstreamStats, 0, len(byKey))
+	for _, u := range byKey {
+		u.Acquires = upstreamAcquires.With(u.Entry, u.Target).Value()
+		u.AcquireTimeouts = upstreamAcquireTimeouts.With(u.Entry, u.Target).Value()
+		stats = append(stats, *u)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Entry != stats[j].Entry {
+			return stats[i].Entry < stats[j].Entry
+		}
+		return stats[i].Target < stats[j].Target
+	})
+
+	return stats
+}
@@ -0,0 +1,58 @@
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestUpstreams(t *testing.T) {
+	entry := &ConfigEntry{Name: "upstreams", Pool: &PoolConfig{PoolSize: 4}}
+	p := &pool{entry: *entry, target: ConfigTarget{Name: "primary"}, freed: make(chan struct{}), open: 3}
+	key := entry.poolKey(p.target)
+	pools.Lock()
+	pools.m[key] = p
+	pools.Unlock()
+
+	_, _, cleanupPooled := associate(&association{config: entry, entry: entry.Name, conn: &pgx.Conn{}, target: "primary", pool: p})
+	defer cleanupPooled()
+	_, _, cleanupDedicated := associate(&association{config: entry, entry: entry.Name, conn: &pgx.Conn{}, target: "replica"})
+	defer cleanupDedicated()
+	defer func() {
+		pools.Lock()
+		delete(pools.m, key)
+		pools.Unlock()
+	}()
+
+	countAcquire(entry.Name, "primary", 10*time.Millisecond, nil)
+	countAcquire(entry.Name, "primary", 30*time.Millisecond, nil)
+	countAcquire(entry.Name, "primary", time.Second, ErrQueryWaitTimeout)
+	computeUpstreamAverages()
+
+	var primary, replica UpstreamStats
+	for _, u := range Upstreams() {
+		switch {
+		case u.Entry == entry.Name && u.Target == "primary":
+			primary = u
+		case u.Entry == entry.Name && u.Target == "replica":
+			replica = u
+		}
+	}
+	if primary.Open != 3 || primary.InUse != 1 {
+		t.Errorf("expected the pool's 3 connections open and 1 in use, got %+v", primary)
+	}
+	if primary.Acquires != 2 || primary.AcquireTimeouts != 1 || primary.AvgAcquireWait != 20*time.Millisecond {
+		t.Errorf("expected 2 acquires averaging 20ms and 1 timeout, got %+v", primary)
+	}
+	if replica.Open != 1 || replica.InUse != 1 {
+		t.Errorf("expected the unpooled connection open and in use, got %+v", replica)
+	}
+
+	computeUpstreamAverages()
+	for _, u := range Upstreams() {
+		if u.Entry == entry.Name && u.Target == "primary" && u.AvgAcquireWait != 0 {
+			t.Errorf("expected no average wait without acquires in the period, got %v", u.AvgAcquireWait)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// The slow query log: requests the upstream took longer than a threshold to answer are logged with
+// their session's context and, optionally, the plan of the statement, which is fetched with
+// `EXPLAIN (FORMAT JSON)` in the background so that the client never waits for it.
+package slowlog
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+)
+
+const (
+	DefaultExplainInterval = 10 * time.Minute
+	DefaultExplainTimeout  = 5 * time.Second
+	// EXPLAINs in flight at once, beyond which slow queries are logged without their plan
+	DefaultMaxExplains = 2
+)
+
+// Fingerprints remembered at once before those explained longer than the interval ago are forgotten
+const maxFingerprints = 4096
+
+var (
+	slowQueries = metrics.NewCounterVec(
+		"pgproxy_slow_queries_total", "Requests the upstream took longer than the slow query threshold to answer.", "entry",
+	)
+	explains = metrics.NewCounterVec(
+		"pgproxy_slow_query_explains_total", "EXPLAINs run for slow queries, by result (ok, error or skipped).", "result",
+	)
+)
+
+type Config struct {
+	// requests taking longer are logged
+	Threshold time.Duration `json:"-"`
+	// whether to log slow statements with their plan
+	Explain bool `json:"explain"`
+	// how often a statement of the same fingerprint (see query.Fingerprint) is explained at most,
+	// defaults to DefaultExplainInterval
+	ExplainInterval time.Duration `json:"-"`
+	// bound on each EXPLAIN, defaults to DefaultExplainTimeout
+	ExplainTimeout time.Duration `json:"-"`
+	// defaults to DefaultMaxExplains
+	MaxExplains int `json:"max_explains"`
+}
+
+// A request the upstream took too long to answer
+type Query struct {
+	Session  string
+	Entry    string
+	User     string
+	Database string
+	Target   string
+	// empty for function calls
+	SQL      string
+	Duration time.Duration
+	// SQLSTATE of the error the upstream answered with, if any
+	Code string
+}
+
+// Runs `EXPLAIN (FORMAT JSON)` followed by a statement where the slow query ran, returning the plan
+type ExplainFunc func(ctx context.Context, statement string) (json.RawMessage, error)
+
+type logger struct {
+	config Config
+	now    func() time.Time
+
+	mu sync.Mutex
+	// when each fingerprint was last explained
+	explained map[string]time.Time
+	// one token per EXPLAIN allowed in flight
+	slots chan struct{}
+}
+
+var current struct {
+	sync.Mutex
+	l *logger
+}
+
+// Starts logging slow queries, if `config` is set
+func Start(config *Config) {
+	if config == nil || config.Threshold <= 0 {
+		return
+	}
+
+	current.Lock()
+	current.l = newLogger(*config)
+	current.Unlock()
+}
+
+func newLogger(config Config) *logger {
+	if config.ExplainInterval <= 0 {
+		config.ExplainInterval = DefaultExplainInterval
+	}
+	if config.ExplainTimeout <= 0 {
+		config.ExplainTimeout = DefaultExplainTimeout
+	}
+	if config.MaxExplains <= 0 {
+		config.MaxExplains = DefaultMaxExplains
+	}
+
+	return &logger{config: config, now: time.Now, explained: make(map[string]time.Time), slots: make(chan struct{}, config.MaxExplains)}
+}
+
+func get() *logger {
+	current.Lock()
+	defer current.Unlock()
+	return current.l
+}
+
+func Enabled() bool {
+	return get() != nil
+}
+
+// Whether a request that took `d` is slow
+func Slow(d time.Duration) bool {
+	l := get()
+	return l != nil && d >= l.config.Threshold
+}
+
+// Logs a slow query.  If explaining is on and `explain` is set, the statement is explained first,
+// in the background, unless a statement of the same fingerprint was explained recently.
+func Observe(q Query, explain ExplainFunc) {
+	l := get()
+	if l == nil || q.Duration < l.config.Threshold {
+		return
+	}
+	slowQueries.With(q.Entry).Inc()
+
+	if !l.config.Explain || explain == nil || !Explainable(q.SQL) {
+		l.write(q, nil, nil)
+		return
+	}
+
+	fingerprint := query.Fingerprint(q.SQL)
+	if !l.claim(fingerprint) {
+		explains.With("skipped").Inc()
+		l.write(q, nil, nil)
+		return
+	}
+
+	go func() {
+		defer func() { <-l.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.config.ExplainTimeout)
+		defer cancel()
+
+		plan, err := explain(ctx, q.SQL)
+		if err != nil {
+			explains.With("error").Inc()
+		} else {
+			explains.With("ok").Inc()
+		}
+		l.write(q, plan, err)
+	}()
+}
+
+// Reserves an EXPLAIN for a fingerprint, which fails if one was run within the interval or too
+// many are in flight.  A successful claim holds a slot until the caller releases it.
+func (l *logger) claim(fingerprint string) bool {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if last, ok := l.explained[fingerprint]; ok && now.Sub(last) < l.config.ExplainInterval {
+		return false
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		return false
+	}
+
+	if len(l.explained) >= maxFingerprints {
+		for f, last := range l.explained {
+			if now.Sub(last) >= l.config.ExplainInterval {
+				delete(l.explained, f)
+			}
+		}
+	}
+	l.explained[fingerprint] = now
+
+	return true
+}
+
+// Logs a slow query, with its plan as compact JSON if there is one.  The plan goes in as a string,
+// which log redaction leaves readable.
+func (l *logger) write(q Query, plan json.RawMessage, explainErr error) {
+	attrs := []any{"session", q.Session, "entry", q.Entry, "user", q.User, "database", q.Database, "target", q.Target,
+		"duration", q.Duration, "query", q.SQL}
+	if q.Code != "" {
+		attrs = append(attrs, "code", q.Code)
+	}
+	if plan != nil {
+		attrs = append(attrs, "plan", string(plan))
+	}
+	if explainErr != nil {
+		attrs = append(attrs, "explain_error", explainErr)
+	}
+
+	slog.Warn("slow query", attrs...)
+}
+
+// Whether a request can be explained: it must be a single SELECT, DML or VALUES statement without
+// parameters, since the plan is fetched without the values a client bound.  EXPLAIN without
+// ANALYZE only plans the statement, so explaining a write doesn't run it.
+func Explainable(sql string) bool {
+	statements := query.Statements(query.Tokenize(sql))
+	if len(statements) != 1 {
+		return false
+	}
+
+	statement := statements[0]
+	for _, t := range statement {
+		if t.Kind == query.TokenParam {
+			return false
+		}
+	}
+	if statement[0].Kind != query.TokenWord {
+		return false
+	}
+	switch statement[0].Text {
+	case "select", "insert", "update", "delete", "merge", "with", "values", "table":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,91 @@
+package slowlog
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExplainable(t *testing.T) {
+	cases := map[string]bool{
+		"SELECT * FROM orders WHERE id = 1":              true,
+		"with recent as (select 1) select * from recent": true,
+		"UPDATE orders SET paid = true;":                 true,
+		"SELECT * FROM orders WHERE id = $1":             false,
+		"SELECT 1; SELECT 2":                             false,
+		"VACUUM orders":                                  false,
+		"":                                               false,
+	}
+	for sql, want := range cases {
+		if got := Explainable(sql); got != want {
+			t.Errorf("Explainable(%q) = %v, want %v", sql, got, want)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newLogger(Config{Threshold: time.Second, Explain: true, ExplainInterval: time.Minute, MaxExplains: 1})
+	l.now = func() time.Time { return now }
+
+	if !l.claim("a") {
+		t.Fatal("expected the first EXPLAIN of a fingerprint to be allowed")
+	}
+	if l.claim("b") {
+		t.Error("expected no EXPLAIN while the only slot is taken")
+	}
+	<-l.slots
+
+	if l.claim("a") {
+		t.Error("expected the fingerprint to be rate limited within the interval")
+	}
+	if !l.claim("b") {
+		t.Error("expected another fingerprint to be allowed")
+	}
+	<-l.slots
+
+	now = now.Add(time.Minute)
+	if !l.claim("a") {
+		t.Error("expected the fingerprint to be allowed again after the interval")
+	}
+}
+
+func TestObserve(t *testing.T) {
+	current.Lock()
+	current.l = newLogger(Config{Threshold: time.Second, Explain: true})
+	current.Unlock()
+	defer func() {
+		current.Lock()
+		current.l = nil
+		current.Unlock()
+	}()
+
+	explained := make(chan string, 2)
+	explain := func(ctx context.Context, statement string) (json.RawMessage, error) {
+		explained <- statement
+		return json.RawMessage(`[{"Plan":{"Node Type":"Seq Scan"}}]`), nil
+	}
+
+	if Slow(time.Millisecond) || !Slow(2*time.Second) {
+		t.Error("unexpected threshold")
+	}
+	Observe(Query{Entry: "app", SQL: "SELECT 1", Duration: time.Millisecond}, explain)
+	Observe(Query{Entry: "app", SQL: "SELECT * FROM orders WHERE id = 1", Duration: 2 * time.Second}, explain)
+	// the same fingerprint, explained already
+	Observe(Query{Entry: "app", SQL: "SELECT * FROM orders WHERE id = 2", Duration: 2 * time.Second}, explain)
+
+	select {
+	case statement := <-explained:
+		if statement != "SELECT * FROM orders WHERE id = 1" {
+			t.Errorf("unexpected statement explained %q", statement)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the slow statement to be explained")
+	}
+	select {
+	case statement := <-explained:
+		t.Errorf("expected one EXPLAIN per fingerprint, also got %q", statement)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
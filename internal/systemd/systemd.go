@@ -0,0 +1,133 @@
+// Integration with systemd: socket activation (sd_listen_fds) and service notifications
+// (sd_notify), so that pgproxy can run as a Type=notify service with a .socket unit holding its
+// listening socket across restarts.
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The first file descriptor systemd passes, after stdin, stdout and stderr
+const listenFdsStart = 3
+
+// A listening socket passed by systemd, with the name given by FileDescriptorName= in its .socket
+// unit (the unit's name by default)
+type Listener struct {
+	net.Listener
+	Name string
+}
+
+// Returns the listening sockets systemd passed to this process (LISTEN_FDS), none if it wasn't
+// socket activated.  The environment variables are unset so they aren't inherited by children.
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]Listener, 0, n)
+	for i := range n {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		// FileListener dups the descriptor
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %d (%s) passed by systemd is not a listening socket: %w", fd, name, err)
+		}
+
+		listeners = append(listeners, Listener{Listener: ln, Name: name})
+	}
+
+	return listeners, nil
+}
+
+// Sends a state such as "READY=1" or "STOPPING=1" to the service manager (sd_notify).  Does
+// nothing if the process isn't run by systemd with NotifyAccess (NOTIFY_SOCKET is unset).
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// abstract namespace
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("could not notify systemd: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("could not notify systemd: %w", err)
+	}
+	return nil
+}
+
+// Returns the watchdog interval systemd expects keep-alives within (WatchdogSec=), zero if the
+// watchdog isn't enabled for this process
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC")
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Sends WATCHDOG=1 at half the watchdog interval, so that systemd restarts the proxy if it stops
+// responding.  Does nothing if the watchdog isn't enabled.
+func StartWatchdog() error {
+	interval, err := WatchdogInterval()
+	if err != nil || interval == 0 {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(interval / 2) {
+			if err := Notify("WATCHDOG=1"); err != nil {
+				slog.Error("could not send watchdog keep-alive", "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAgentKeepAlive = 30 * time.Second
+	DefaultAgentTimeout   = 10 * time.Second
+)
+
+// Another pgproxy near the upstreams, with a `tunnel` listener, that upstream connections are
+// multiplexed to over one mutual TLS connection
+type AgentConfig struct {
+	// tls://host:port of the far proxy's tunnel listener, or wss://host[:port][/path] to carry the
+	// tunnel in a WebSocket
+	Address string `json:"address"`
+	// the certificate this proxy identifies itself with, re-read on every reconnect so that it can
+	// be rotated
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// PEM bundle of the CAs the far proxy's certificate must chain to, the system roots if unset
+	CAFile string `json:"ca_file"`
+	// name to verify the far proxy's certificate against, the address's host if unset
+	ServerName string `json:"server_name"`
+	// how often to check that the far proxy is still there, defaults to DefaultAgentKeepAlive
+	KeepAlive time.Duration `json:"-"`
+	// bounds connecting to the far proxy, defaults to DefaultAgentTimeout
+	Timeout time.Duration `json:"-"`
+	// reaches the far proxy, e.g. through a Proxy, directly if nil
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
+}
+
+// Dials upstreams as streams of one tunnel to the far proxy, which picks the upstream by the
+// startup parameters like for any other client.  The tunnel is opened on first use, and reopened
+// when it breaks or the far proxy shuts down.
+type Agent struct {
+	config    *AgentConfig
+	url       *url.URL
+	address   string
+	tlsConfig *tls.Config
+
+	mu  sync.Mutex
+	mux *Mux
+}
+
+func NewAgent(config AgentConfig) (*Agent, error) {
+	if config.Address == "" || config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("pgproxy tunnel: address, cert_file and key_file are required")
+	}
+	if !strings.Contains(config.Address, "://") {
+		config.Address = "tls://" + config.Address
+	}
+	u, err := url.Parse(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("pgproxy tunnel: invalid address: %w", err)
+	}
+
+	address := u.Host
+	switch u.Scheme {
+	case "tls":
+		if u.Port() == "" {
+			return nil, errors.New("pgproxy tunnel: address needs a port")
+		}
+	case "wss":
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("pgproxy tunnel: unsupported scheme %q, expected tls or wss", u.Scheme)
+	}
+
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = DefaultAgentKeepAlive
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultAgentTimeout
+	}
+
+	// fail early on unusable files, though they are read again on every connect
+	if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+		return nil, fmt.Errorf("pgproxy tunnel: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+			return &cert, err
+		},
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("pgproxy tunnel: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("pgproxy tunnel: no certificates in %s", config.CAFile)
+		}
+	}
+
+	return &Agent{config: &config, url: u, address: address, tlsConfig: tlsConfig}, nil
+}
+
+// Opens a stream to the far proxy.  `addr` is ignored, the far proxy decides where the stream
+// goes.  Matches pgconn.DialFunc.
+func (a *Agent) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	mux, err := a.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stream, err := mux.Open(); err == nil {
+		return stream, nil
+	}
+
+	// the tunnel broke or is going away since it was last used; retry once on a fresh one
+	a.reset(mux)
+	if mux, err = a.connect(ctx); err != nil {
+		return nil, err
+	}
+	stream, err := mux.Open()
+	if err != nil {
+		return nil, fmt.Errorf("pgproxy tunnel to %s: %w", a.address, err)
+	}
+	return stream, nil
+}
+
+// Returns the tunnel, opening one if there is none
+func (a *Agent) connect(ctx context.Context) (*Mux, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.mux != nil {
+		if a.mux.usable() {
+			return a.mux, nil
+		}
+		// going away, its streams finish without us
+		a.mux = nil
+	}
+
+	dial := a.config.Dial
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.config.Timeout)
+	defer cancel()
+
+	tcp, err := dial(ctx, "tcp", a.address)
+	if err != nil {
+		return nil, fmt.Errorf("pgproxy tunnel: could not reach %s: %w", a.address, err)
+	}
+	mux, err := a.handshake(ctx, tcp)
+	if err != nil {
+		tcp.Close()
+		return nil, fmt.Errorf("pgproxy tunnel: could not connect to %s: %w", a.address, err)
+	}
+
+	a.mux = mux
+	slog.Info("pgproxy tunnel connected", "address", a.config.Address)
+
+	go a.keepAlive(mux)
+	go func() {
+		<-mux.Done()
+		slog.Info("pgproxy tunnel disconnected", "address", a.config.Address, "error", mux.err)
+		a.reset(mux)
+	}()
+
+	return mux, nil
+}
+
+func (a *Agent) handshake(ctx context.Context, tcp net.Conn) (*Mux, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tcp.SetDeadline(deadline)
+	}
+
+	tlsConn := tls.Client(tcp, a.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn = tlsConn
+	if a.url.Scheme == "wss" {
+		var err error
+		if conn, err = dialWebSocket(tlsConn, a.url); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.Write([]byte(muxPreface)); err != nil {
+		return nil, err
+	}
+
+	_ = tcp.SetDeadline(time.Time{})
+	return newMux(conn, tlsConn.ConnectionState(), nil), nil
+}
+
+// Forgets a tunnel that can't be used for new streams, so that the next dial opens a new one.  A
+// tunnel going away is left to finish its streams.
+func (a *Agent) reset(mux *Mux) {
+	a.mu.Lock()
+	if a.mux == mux {
+		a.mux = nil
+	}
+	a.mu.Unlock()
+
+	mux.drain()
+}
+
+// Closes the tunnel if the far proxy stops answering keepalives, which TCP alone may not notice
+// for a long time
+func (a *Agent) keepAlive(mux *Mux) {
+	ticker := time.NewTicker(a.config.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mux.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := mux.ping(a.config.Timeout); err != nil {
+			slog.Warn("pgproxy tunnel keepalive failed, reconnecting", "address", a.config.Address, "error", err)
+			return
+		}
+	}
+}
+
+// Closes the tunnel, which breaks every upstream connection through it
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	mux := a.mux
+	a.mux = nil
+	a.mu.Unlock()
+
+	if mux == nil {
+		return nil
+	}
+	return mux.Close()
+}
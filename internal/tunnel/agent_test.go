@@ -0,0 +1,229 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Writes a certificate for `name` signed by `ca` (self-signed if nil) to dir/name.crt and
+// dir/name.key
+func writeCert(t *testing.T, dir, name string, ca *tls.Certificate) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, any(key)
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	_ = os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600)
+	_ = os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600)
+
+	cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+// Starts a tunnel server that echoes every stream, and returns its address and the config of an
+// agent trusted by it
+func echoTunnelServer(t *testing.T) (*Server, AgentConfig) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil)
+	server := writeCert(t, dir, "localhost", &ca)
+	writeCert(t, dir, "edge", &ca)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ln, &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	t.Cleanup(func() { s.Close() })
+
+	go func() {
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn); conn.Close() }()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return s, AgentConfig{
+		Address:  "tls://localhost:" + port,
+		CertFile: filepath.Join(dir, "edge.crt"),
+		KeyFile:  filepath.Join(dir, "edge.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+}
+
+func TestAgent(t *testing.T) {
+	for _, scheme := range []string{"tls", "wss"} {
+		t.Run(scheme, func(t *testing.T) {
+			_, config := echoTunnelServer(t)
+			config.Address = scheme + config.Address[len("tls"):]
+			agent, err := NewAgent(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer agent.Close()
+
+			// more data than fits in a window in both directions, on many streams at once
+			payload := bytes.Repeat([]byte("0123456789abcdef"), 3*muxWindow/16)
+			var wg sync.WaitGroup
+			for range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					conn, err := agent.DialContext(context.Background(), "tcp", "ignored:5432")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer conn.Close()
+
+					go func() { _, _ = conn.Write(payload) }()
+					echoed := make([]byte, len(payload))
+					if _, err := io.ReadFull(conn, echoed); err != nil || !bytes.Equal(echoed, payload) {
+						t.Errorf("expected the payload echoed through the tunnel (%v)", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			agent.mu.Lock()
+			streams := len(agent.mux.streams)
+			agent.mu.Unlock()
+			if streams != 0 {
+				t.Errorf("expected closed streams to be forgotten, %d left", streams)
+			}
+		})
+	}
+}
+
+func TestAgentDeadline(t *testing.T) {
+	_, config := echoTunnelServer(t)
+	agent, err := NewAgent(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	conn, err := agent.DialContext(context.Background(), "tcp", "ignored:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the read deadline to expire, got %v", err)
+	}
+}
+
+func TestAgentReconnect(t *testing.T) {
+	server, config := echoTunnelServer(t)
+	agent, err := NewAgent(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	conn, err := agent.DialContext(context.Background(), "tcp", "ignored:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo := func() error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+	if err := echo(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server going away lets open streams finish, but no new ones
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	if err := echo(); err != nil {
+		t.Errorf("expected a stream to outlive its server closing, got %v", err)
+	}
+	if _, err := agent.DialContext(context.Background(), "tcp", "ignored:5432"); err == nil {
+		t.Error("expected a closed server to accept no new streams")
+	}
+
+	conn.Close()
+	agent.mu.Lock()
+	mux := agent.mux
+	agent.mu.Unlock()
+	if mux != nil {
+		t.Error("expected the agent to forget a tunnel going away")
+	}
+}
+
+func TestAgentRefusesUntrustedClient(t *testing.T) {
+	_, config := echoTunnelServer(t)
+	// a certificate from a CA the server doesn't trust
+	dir := t.TempDir()
+	other := writeCert(t, dir, "other-ca", nil)
+	writeCert(t, dir, "edge", &other)
+	config.CertFile, config.KeyFile = filepath.Join(dir, "edge.crt"), filepath.Join(dir, "edge.key")
+
+	agent, err := NewAgent(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	conn, err := agent.DialContext(context.Background(), "tcp", "ignored:5432")
+	if err == nil {
+		// TLS 1.3 clients learn about a rejected certificate on their first read
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if err == nil {
+		t.Error("expected a client certificate from an unknown CA to be refused")
+	}
+}
@@ -0,0 +1,540 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Connections between proxies carry many streams, one per upstream connection, in frames of
+//
+//	type (1 byte) | stream id (4 bytes) | payload length (4 bytes) | payload
+//
+// after the dialing side sends muxPreface.  Only the dialing side opens streams.  Each direction
+// of a stream may have up to muxWindow bytes in flight that the receiver hasn't read yet, and the
+// receiver extends the window with frameWindow as it reads, so that one slow stream can't hold up
+// the others.
+const (
+	muxPreface   = "PGPXMUX1"
+	muxHeaderLen = 9
+	muxMaxFrame  = 32 * 1024
+	muxWindow    = 256 * 1024
+)
+
+const (
+	// opens the stream
+	frameOpen byte = iota + 1
+	frameData
+	// payload is the number of bytes the sender may send on top of its window
+	frameWindow
+	// the stream is closed, or the stream opened was refused
+	frameClose
+	// keepalive, answered with framePong
+	framePing
+	framePong
+	// no new streams, the tunnel closes once its streams are done
+	frameGoAway
+)
+
+var (
+	errMuxClosed    = errors.New("tunnel closed")
+	errMuxGoingAway = errors.New("tunnel going away")
+	errStreamClosed = errors.New("tunnel stream closed by peer")
+)
+
+type Mux struct {
+	conn net.Conn
+	// the state of the TLS connection the tunnel runs over
+	tls tls.ConnectionState
+	// called for each stream the peer opens, which is refused if it returns false; nil if the peer
+	// may not open streams
+	onOpen func(*Stream) bool
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	streams   map[uint32]*Stream
+	nextID    uint32
+	goingAway bool
+	err       error
+	done      chan struct{}
+	pongs     chan struct{}
+}
+
+// Starts multiplexing over `conn`, after the preface
+func newMux(conn net.Conn, state tls.ConnectionState, onOpen func(*Stream) bool) *Mux {
+	m := &Mux{
+		conn:    conn,
+		tls:     state,
+		onOpen:  onOpen,
+		streams: map[uint32]*Stream{},
+		done:    make(chan struct{}),
+		pongs:   make(chan struct{}, 1),
+	}
+	go m.recv()
+	return m
+}
+
+// Opens a new stream to the peer
+func (m *Mux) Open() (*Stream, error) {
+	m.mu.Lock()
+	switch {
+	case m.err != nil:
+		m.mu.Unlock()
+		return nil, m.err
+	case m.goingAway:
+		m.mu.Unlock()
+		return nil, errMuxGoingAway
+	}
+	m.nextID++
+	s := newStream(m, m.nextID)
+	m.streams[s.id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(frameOpen, s.id, nil); err != nil {
+		m.forget(s.id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Closed once the tunnel is
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Whether new streams can be opened
+func (m *Mux) usable() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err == nil && !m.goingAway
+}
+
+// Checks that the peer is still there, closing the tunnel if it doesn't answer within `timeout`
+func (m *Mux) ping(timeout time.Duration) error {
+	select {
+	case <-m.pongs:
+	default:
+	}
+
+	if err := m.writeFrame(framePing, 0, nil); err != nil {
+		return err
+	}
+
+	select {
+	case <-m.pongs:
+		return nil
+	case <-m.done:
+		return m.err
+	case <-time.After(timeout):
+		err := errors.New("tunnel keepalive timed out")
+		m.close(err)
+		return err
+	}
+}
+
+// Tells the peer not to open any more streams, and closes the tunnel once the current ones are
+// done
+func (m *Mux) GoAway() {
+	if m.drain() {
+		_ = m.writeFrame(frameGoAway, 0, nil)
+	}
+}
+
+// Stops new streams, returning false if the tunnel is already closed
+func (m *Mux) drain() bool {
+	m.mu.Lock()
+	m.goingAway = true
+	open, idle := m.err == nil, len(m.streams) == 0
+	m.mu.Unlock()
+
+	if open && idle {
+		go m.close(errMuxClosed)
+	}
+	return open
+}
+
+// Closes the tunnel, and with it every stream
+func (m *Mux) Close() error {
+	m.close(errMuxClosed)
+	return nil
+}
+
+func (m *Mux) close(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = map[uint32]*Stream{}
+	close(m.done)
+	m.mu.Unlock()
+
+	m.conn.Close()
+	for _, s := range streams {
+		s.fail(err)
+	}
+}
+
+func (m *Mux) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderLen, muxHeaderLen+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	m.writeMu.Lock()
+	_, err := m.conn.Write(frame)
+	m.writeMu.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("tunnel: %w", err)
+		m.close(err)
+		return err
+	}
+	return nil
+}
+
+func (m *Mux) recv() {
+	br := bufio.NewReader(m.conn)
+	header := make([]byte, muxHeaderLen)
+
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			m.close(fmt.Errorf("tunnel: %w", err))
+			return
+		}
+		typ, id, n := header[0], binary.BigEndian.Uint32(header[1:]), binary.BigEndian.Uint32(header[5:])
+		if n > muxMaxFrame {
+			m.close(errors.New("tunnel: frame too large"))
+			return
+		}
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			m.close(fmt.Errorf("tunnel: %w", err))
+			return
+		}
+		if err := m.handle(typ, id, payload); err != nil {
+			m.close(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) handle(typ byte, id uint32, payload []byte) error {
+	switch typ {
+	case frameOpen:
+		if m.onOpen == nil {
+			return errors.New("tunnel: peer may not open streams")
+		}
+
+		m.mu.Lock()
+		if _, exists := m.streams[id]; exists {
+			m.mu.Unlock()
+			return fmt.Errorf("tunnel: stream %d opened twice", id)
+		}
+		var s *Stream
+		if !m.goingAway {
+			s = newStream(m, id)
+			m.streams[id] = s
+		}
+		m.mu.Unlock()
+
+		if s == nil || !m.onOpen(s) {
+			m.forget(id)
+			// not from this goroutine, which has to keep reading for the peer to make progress
+			go m.writeFrame(frameClose, id, nil)
+		}
+
+	case frameData:
+		if s := m.stream(id); s != nil {
+			return s.receive(payload)
+		}
+
+	case frameWindow:
+		if len(payload) != 4 {
+			return errors.New("tunnel: invalid window frame")
+		}
+		if s := m.stream(id); s != nil {
+			s.extend(binary.BigEndian.Uint32(payload))
+		}
+
+	case frameClose:
+		if s := m.stream(id); s != nil {
+			s.closedByPeer()
+		}
+
+	case framePing:
+		go m.writeFrame(framePong, 0, nil)
+
+	case framePong:
+		select {
+		case m.pongs <- struct{}{}:
+		default:
+		}
+
+	case frameGoAway:
+		m.drain()
+
+	default:
+		return fmt.Errorf("tunnel: unknown frame type %d", typ)
+	}
+
+	return nil
+}
+
+func (m *Mux) stream(id uint32) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+// Forgets a closed stream, closing the tunnel if it was the last one of a tunnel going away
+func (m *Mux) forget(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	idle := m.goingAway && m.err == nil && len(m.streams) == 0
+	m.mu.Unlock()
+
+	if idle {
+		go m.close(errMuxClosed)
+	}
+}
+
+// One connection through a tunnel
+type Stream struct {
+	mux *Mux
+	id  uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// received but not read yet
+	buf []byte
+	// bytes read since the peer's window was last extended
+	unacked int
+	// bytes the peer will still accept
+	window int
+	// set once the stream is closed locally, by the peer, or with the tunnel
+	closed, peerClosed bool
+	err                error
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	s := &Stream{mux: m, id: id, window: muxWindow}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 {
+		var err error
+		switch {
+		case s.closed:
+			err = net.ErrClosed
+		case s.peerClosed:
+			err = io.EOF
+		case s.err != nil:
+			err = s.err
+		case expired(s.readDeadline):
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		s.cond.Wait()
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	s.unacked += n
+	var ack int
+	if s.unacked >= muxWindow/2 && !s.peerClosed {
+		ack, s.unacked = s.unacked, 0
+	}
+	s.mu.Unlock()
+
+	if ack > 0 {
+		_ = s.mux.writeFrame(frameWindow, s.id, binary.BigEndian.AppendUint32(nil, uint32(ack)))
+	}
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		s.mu.Lock()
+		for {
+			var err error
+			switch {
+			case s.closed:
+				err = net.ErrClosed
+			case s.peerClosed:
+				err = errStreamClosed
+			case s.err != nil:
+				err = s.err
+			case expired(s.writeDeadline):
+				err = os.ErrDeadlineExceeded
+			}
+			if err != nil {
+				s.mu.Unlock()
+				return written, err
+			}
+			if s.window > 0 {
+				break
+			}
+			s.cond.Wait()
+		}
+		n := min(len(p), s.window, muxMaxFrame)
+		s.window -= n
+		s.mu.Unlock()
+
+		if err := s.mux.writeFrame(frameData, s.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	notify := !s.peerClosed && s.err == nil
+	s.stopTimers()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.mux.forget(s.id)
+	if notify {
+		return s.mux.writeFrame(frameClose, s.id, nil)
+	}
+	return nil
+}
+
+func (s *Stream) receive(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	if len(s.buf)+s.unacked+len(payload) > muxWindow {
+		return fmt.Errorf("tunnel: peer overran the window of stream %d", s.id)
+	}
+	s.buf = append(s.buf, payload...)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Stream) extend(n uint32) {
+	s.mu.Lock()
+	s.window += int(n)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) closedByPeer() {
+	s.mu.Lock()
+	s.peerClosed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.mux.forget(s.id)
+}
+
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.stopTimers()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// The tunnel's addresses, so that clients through it are identified by the far proxy's address
+func (s *Stream) LocalAddr() net.Addr {
+	return s.mux.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.mux.conn.RemoteAddr()
+}
+
+// The state of the TLS connection the tunnel runs over, e.g. for the far proxy's certificate
+func (s *Stream) ConnectionState() tls.ConnectionState {
+	return s.mux.tls
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.readTimer = s.wakeAt(s.readTimer, t)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.writeTimer = s.wakeAt(s.writeTimer, t)
+	s.mu.Unlock()
+	return nil
+}
+
+// Replaces `timer` with one that wakes up blocked reads and writes at `t`, so that they notice the
+// deadline passing
+func (s *Stream) wakeAt(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+
+	return time.AfterFunc(time.Until(t), func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+}
+
+func (s *Stream) stopTimers() {
+	for _, timer := range []*time.Timer{s.readTimer, s.writeTimer} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
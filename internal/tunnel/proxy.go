@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// A forward proxy that upstream connections are made through, for networks where egress must go
+// through one: `socks5://[user:password@]host:port` or `http://[user:password@]host:port` (HTTP
+// CONNECT).  Host names are resolved by the proxy in both cases.
+type Proxy struct {
+	url     *url.URL
+	address string
+}
+
+func NewProxy(rawURL string) (*Proxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid url: %w", err)
+	}
+
+	var defaultPort string
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	case "http":
+		defaultPort = "80"
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme %q, expected socks5 or http", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("proxy: url has no host")
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return &Proxy{url: u, address: net.JoinHostPort(u.Hostname(), port)}, nil
+}
+
+// Opens a connection to `addr` through the proxy.  Matches pgconn.DialFunc.
+func (p *Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: could not reach %s: %w", p.address, err)
+	}
+
+	// the handshake is bounded by the context like the dial
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+
+	if p.url.Scheme == "http" {
+		conn, err = p.connect(conn, addr)
+	} else {
+		err = p.socks5(conn, addr)
+	}
+
+	if !stop() || err != nil {
+		conn.Close()
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("proxy %s: could not reach %s: %w", p.address, addr, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Sends an HTTP CONNECT request for `addr` (RFC 9110 section 9.3.6)
+func (p *Proxy) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if p.url.User != nil {
+		password, _ := p.url.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.url.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// the upstream already said something, which mustn't get lost in the buffer
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+const (
+	socksVersion       = 5
+	socksNoAuth        = 0
+	socksPasswordAuth  = 2
+	socksNoAcceptable  = 0xff
+	socksConnect       = 1
+	socksAddressIPv4   = 1
+	socksAddressDomain = 3
+	socksAddressIPv6   = 4
+)
+
+var socksReplies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Negotiates a SOCKS5 CONNECT to `addr` (RFC 1928), with username/password authentication
+// (RFC 1929) if the proxy's url has credentials
+func (p *Proxy) socks5(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(socksNoAuth)
+	if p.url.User != nil {
+		method = socksPasswordAuth
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	if reply[1] != method {
+		if reply[1] == socksNoAcceptable && method == socksNoAuth {
+			return errors.New("SOCKS5 proxy requires authentication")
+		}
+		return errors.New("SOCKS5 proxy refused the authentication method")
+	}
+
+	if method == socksPasswordAuth {
+		user := p.url.User.Username()
+		password, _ := p.url.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 username and password are limited to 255 bytes")
+		}
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(password))), password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socksAddressIPv4), ip4...)
+		} else {
+			req = append(append(req, socksAddressIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("host name too long for SOCKS5")
+		}
+		req = append(append(req, socksAddressDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address, which is of no interest
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		if msg, ok := socksReplies[header[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("SOCKS5 proxy replied %d", header[1])
+	}
+
+	var skip int
+	switch header[3] {
+	case socksAddressIPv4:
+		skip = net.IPv4len
+	case socksAddressIPv6:
+		skip = net.IPv6len
+	case socksAddressDomain:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		skip = int(header[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy replied with unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// Serves each connection to a new listener with `handshake`, which returns the address to connect
+// to, or "" to refuse, and then relays
+func fakeProxy(t *testing.T, handshake func(conn net.Conn, br *bufio.Reader) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				addr := handshake(conn, br)
+				if addr == "" {
+					return
+				}
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() { _, _ = io.Copy(upstream, br) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// A SOCKS5 proxy that requires user "u" with password "p" and domain name addresses
+func socks5Handshake(conn net.Conn, br *bufio.Reader) string {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(br, greeting); err != nil || greeting[2] != socksPasswordAuth {
+		_, _ = conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return ""
+	}
+	_, _ = conn.Write([]byte{socksVersion, socksPasswordAuth})
+
+	auth := make([]byte, 2)
+	_, _ = io.ReadFull(br, auth)
+	user := make([]byte, auth[1])
+	_, _ = io.ReadFull(br, user)
+	n, _ := br.ReadByte()
+	password := make([]byte, n)
+	_, _ = io.ReadFull(br, password)
+	if string(user) != "u" || string(password) != "p" {
+		_, _ = conn.Write([]byte{1, 1})
+		return ""
+	}
+	_, _ = conn.Write([]byte{1, 0})
+
+	req := make([]byte, 5)
+	_, _ = io.ReadFull(br, req)
+	host := make([]byte, req[4]+2)
+	_, _ = io.ReadFull(br, host)
+	port := binary.BigEndian.Uint16(host[req[4]:])
+	_, _ = conn.Write([]byte{socksVersion, 0, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(string(host[:req[4]]), strconv.Itoa(int(port)))
+}
+
+func connectHandshake(conn net.Conn, br *bufio.Reader) string {
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return ""
+	}
+	// user "u", password "p"
+	if req.Header.Get("Proxy-Authorization") != "Basic dTpw" {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return ""
+	}
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host
+}
+
+func TestProxy(t *testing.T) {
+	_, port, _ := net.SplitHostPort(echoServer(t))
+	// a host name, which the proxy resolves
+	upstream := net.JoinHostPort("localhost", port)
+
+	for _, tt := range []struct {
+		scheme    string
+		handshake func(net.Conn, *bufio.Reader) string
+	}{
+		{"socks5", socks5Handshake},
+		{"http", connectHandshake},
+	} {
+		t.Run(tt.scheme, func(t *testing.T) {
+			address := fakeProxy(t, tt.handshake)
+
+			proxy, err := NewProxy(tt.scheme + "://u:p@" + address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := proxy.DialContext(context.Background(), "tcp", upstream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("expected ping echoed through the proxy, got %q (%v)", buf, err)
+			}
+
+			wrong, _ := NewProxy(tt.scheme + "://u:wrong@" + address)
+			if _, err := wrong.DialContext(context.Background(), "tcp", upstream); err == nil {
+				t.Error("expected wrong proxy credentials to be refused")
+			}
+		})
+	}
+
+	if _, err := NewProxy("https://proxy:3128"); err == nil {
+		t.Error("expected an unsupported scheme to be rejected")
+	}
+}
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// bounds the TLS and WebSocket handshakes and the preface of new tunnels
+	serverHandshakeTimeout = 10 * time.Second
+	// how long to wait before accepting again after a failed accept
+	serverAcceptBackoff = 100 * time.Millisecond
+)
+
+// Accepts tunnels from other proxies' Agents on `ln`, over mutual TLS, optionally in a WebSocket.
+// The streams within them are accepted as connections, so that the server is used like any other
+// net.Listener.
+type Server struct {
+	ln     net.Listener
+	config *tls.Config
+
+	streams   chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	muxes map[*Mux]bool
+}
+
+// `config` should require client certificates, as anyone else connecting can reach whatever the
+// proxy can
+func NewServer(ln net.Listener, config *tls.Config) *Server {
+	s := &Server{
+		ln:      ln,
+		config:  config,
+		streams: make(chan *Stream),
+		closed:  make(chan struct{}),
+		muxes:   map[*Mux]bool{},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *Server) Accept() (net.Conn, error) {
+	select {
+	case stream := <-s.streams:
+		return stream, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops accepting tunnels and streams.  The tunnels' current streams carry on, and each tunnel
+// closes once they are done.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.ln.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for mux := range s.muxes {
+			mux.GoAway()
+		}
+	})
+	return err
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("error accepting tunnel", "error", err)
+			time.Sleep(serverAcceptBackoff)
+			continue
+		}
+
+		go func() {
+			if err := s.handshake(conn); err != nil {
+				slog.Warn("could not establish tunnel", "addr", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (s *Server) handshake(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(serverHandshakeTimeout))
+
+	tlsConn := tls.Server(conn, s.config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(tlsConn)
+	var tunnel net.Conn = &bufferedConn{Conn: tlsConn, r: br}
+	if start, err := br.Peek(4); err == nil && string(start) == "GET " {
+		if tunnel, err = acceptWebSocket(tlsConn, br); err != nil {
+			return err
+		}
+	}
+
+	preface := make([]byte, len(muxPreface))
+	if _, err := io.ReadFull(tunnel, preface); err != nil {
+		return err
+	}
+	if string(preface) != muxPreface {
+		return errors.New("not a pgproxy tunnel")
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	mux := newMux(tunnel, state, s.accept)
+
+	s.mu.Lock()
+	s.muxes[mux] = true
+	s.mu.Unlock()
+	select {
+	case <-s.closed:
+		mux.GoAway()
+	default:
+	}
+
+	var identity string
+	if len(state.PeerCertificates) > 0 {
+		identity = state.PeerCertificates[0].Subject.CommonName
+	}
+	slog.Info("tunnel connected", "addr", conn.RemoteAddr().String(), "identity", identity)
+
+	go func() {
+		<-mux.Done()
+		slog.Info("tunnel disconnected", "addr", conn.RemoteAddr().String(), "identity", identity, "error", mux.err)
+
+		s.mu.Lock()
+		delete(s.muxes, mux)
+		s.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// Hands a new stream to Accept, refusing it once the server is closed
+func (s *Server) accept(stream *Stream) bool {
+	select {
+	case s.streams <- stream:
+		return true
+	case <-s.closed:
+		return false
+	}
+}
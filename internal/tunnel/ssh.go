@@ -0,0 +1,238 @@
+// Ways of reaching upstreams that aren't directly routable from the proxy, e.g. databases in a
+// private VPC behind an SSH jump host.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	DefaultSSHKeepAlive = 30 * time.Second
+	DefaultSSHTimeout   = 10 * time.Second
+)
+
+// An SSH jump host that upstream connections are forwarded through (like `ssh -J`), with
+// public key authentication
+type SSHConfig struct {
+	// host:port of the jump host, port 22 if omitted
+	Address string `json:"address"`
+	User    string `json:"user"`
+	// private key in OpenSSH or PEM format
+	KeyFile       string `json:"key_file"`
+	KeyPassphrase string `json:"key_passphrase"`
+	// known_hosts file the jump host's key must be in
+	KnownHostsFile string `json:"known_hosts_file"`
+	// accept any host key instead, for testing only
+	InsecureIgnoreHostKey bool `json:"insecure_ignore_host_key"`
+	// how often to check that the jump host is still there, defaults to DefaultSSHKeepAlive
+	KeepAlive time.Duration `json:"-"`
+	// bounds connecting to the jump host, defaults to DefaultSSHTimeout
+	Timeout time.Duration `json:"-"`
+	// reaches the jump host, e.g. through a Proxy, directly if nil
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
+}
+
+// Dials upstreams through one SSH connection to the jump host, which every upstream connection
+// shares as a separate channel.  The SSH connection is opened on first use, and reopened when it
+// breaks.
+type SSH struct {
+	config *SSHConfig
+	client *ssh.ClientConfig
+
+	mu   sync.Mutex
+	conn *ssh.Client
+}
+
+func NewSSH(config SSHConfig) (*SSH, error) {
+	if config.Address == "" || config.User == "" || config.KeyFile == "" {
+		return nil, errors.New("ssh tunnel: address, user and key_file are required")
+	}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		config.Address = net.JoinHostPort(config.Address, "22")
+	}
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = DefaultSSHKeepAlive
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultSSHTimeout
+	}
+
+	key, err := os.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ssh tunnel: %w", err)
+	}
+	var signer ssh.Signer
+	if config.KeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(config.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ssh tunnel: invalid key_file: %w", err)
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case config.KnownHostsFile != "":
+		if hostKeyCallback, err = knownhosts.New(config.KnownHostsFile); err != nil {
+			return nil, fmt.Errorf("ssh tunnel: invalid known_hosts_file: %w", err)
+		}
+	case config.InsecureIgnoreHostKey:
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("ssh tunnel: known_hosts_file is required to verify the jump host")
+	}
+
+	return &SSH{
+		config: &config,
+		client: &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         config.Timeout,
+		},
+	}, nil
+}
+
+// Opens a connection to `addr` as seen from the jump host.  Matches pgconn.DialFunc.
+func (s *SSH) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) || ctx.Err() != nil {
+		// the jump host refused to forward (e.g. the upstream is down), nothing wrong with the
+		// SSH connection itself
+		return nil, fmt.Errorf("ssh tunnel via %s: %w", s.config.Address, err)
+	}
+
+	// the SSH connection broke since it was last used; retry once on a fresh one
+	s.reset(client)
+	if client, err = s.connect(ctx); err != nil {
+		return nil, err
+	}
+	conn, err = client.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("ssh tunnel via %s: %w", s.config.Address, err)
+	}
+	return conn, nil
+}
+
+// Returns the SSH connection, opening one if there is none
+func (s *SSH) connect(ctx context.Context) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	dial := s.config.Dial
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+	tcp, err := dial(dialCtx, "tcp", s.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("ssh tunnel: could not reach %s: %w", s.config.Address, err)
+	}
+
+	// the handshake isn't bound by a context, so bound it with a deadline
+	_ = tcp.SetDeadline(time.Now().Add(s.config.Timeout))
+	conn, chans, reqs, err := ssh.NewClientConn(tcp, s.config.Address, s.client)
+	if err != nil {
+		tcp.Close()
+		return nil, fmt.Errorf("ssh tunnel: could not connect to %s: %w", s.config.Address, err)
+	}
+	_ = tcp.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(conn, chans, reqs)
+	s.conn = client
+	slog.Info("ssh tunnel connected", "address", s.config.Address, "user", s.config.User)
+
+	go s.keepAlive(client)
+	go func() {
+		err := client.Wait()
+		slog.Warn("ssh tunnel disconnected", "address", s.config.Address, "error", err)
+		s.reset(client)
+	}()
+
+	return client, nil
+}
+
+// Forgets a broken SSH connection, so that the next dial opens a new one
+func (s *SSH) reset(client *ssh.Client) {
+	s.mu.Lock()
+	if s.conn == client {
+		s.conn = nil
+	}
+	s.mu.Unlock()
+
+	client.Close()
+}
+
+// Closes the SSH connection if the jump host stops answering keepalives, which TCP alone may not
+// notice for a long time
+func (s *SSH) keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(s.config.KeepAlive)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		current := s.conn == client
+		s.mu.Unlock()
+		if !current {
+			return
+		}
+
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+
+		select {
+		case err := <-answered:
+			if err == nil {
+				continue
+			}
+		case <-time.After(s.config.Timeout):
+		}
+
+		slog.Warn("ssh tunnel keepalive failed, reconnecting", "address", s.config.Address)
+		s.reset(client)
+		return
+	}
+}
+
+// Closes the SSH connection, which breaks every upstream connection through it
+func (s *SSH) Close() error {
+	s.mu.Lock()
+	client := s.conn
+	s.conn = nil
+	s.mu.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
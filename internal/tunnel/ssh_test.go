@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Runs an SSH server that accepts `clientKey` and forwards direct-tcpip channels, counting the SSH
+// connections it accepts.  Returns its address and its host key.
+func fakeJumpHost(t *testing.T, clientKey ssh.PublicKey, connections *atomic.Int32) (string, ssh.PublicKey) {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "tunnel" || string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			tcp, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, chans, reqs, err := ssh.NewServerConn(tcp, config)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				connections.Add(1)
+				go ssh.DiscardRequests(reqs)
+
+				for newChannel := range chans {
+					var target struct {
+						Host       string
+						Port       uint32
+						OriginHost string
+						OriginPort uint32
+					}
+					if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+						_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+						continue
+					}
+					upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+					if err != nil {
+						_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						upstream.Close()
+						continue
+					}
+					go ssh.DiscardRequests(requests)
+					go func() { _, _ = io.Copy(channel, upstream); channel.Close() }()
+					go func() { _, _ = io.Copy(upstream, channel); upstream.Close() }()
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), hostSigner.PublicKey()
+}
+
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn); conn.Close() }()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestSSHTunnel(t *testing.T) {
+	dir := t.TempDir()
+	clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, _ := ssh.NewPublicKey(clientPub)
+
+	var connections atomic.Int32
+	jumpHost, hostKey := fakeJumpHost(t, sshPub, &connections)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{jumpHost}, hostKey)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	upstream := echoServer(t)
+
+	tunnel, err := NewSSH(SSHConfig{Address: jumpHost, User: "tunnel", KeyFile: keyFile, KnownHostsFile: knownHosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	echo := func() {
+		t.Helper()
+		conn, err := tunnel.DialContext(context.Background(), "tcp", upstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("expected ping echoed through the tunnel, got %q (%v)", buf, err)
+		}
+	}
+
+	echo()
+	echo()
+	if n := connections.Load(); n != 1 {
+		t.Errorf("expected upstream connections to share one SSH connection, got %d", n)
+	}
+
+	// a broken SSH connection is replaced on the next dial
+	tunnel.mu.Lock()
+	tunnel.conn.Conn.Close()
+	tunnel.mu.Unlock()
+	echo()
+	if n := connections.Load(); n != 2 {
+		t.Errorf("expected the tunnel to reconnect, got %d SSH connections", n)
+	}
+
+	// an unknown host key is refused
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSSH(SSHConfig{Address: jumpHost, User: "tunnel", KeyFile: keyFile, KnownHostsFile: empty})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err = other.DialContext(context.Background(), "tcp", upstream); err == nil {
+		t.Error("expected a jump host missing from known_hosts to be refused")
+	}
+}
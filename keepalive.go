@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+)
+
+// Sends the client of an idle session a ParameterStatus once it has been idle for the entry's
+// client_keepalive, and again every client_keepalive while it stays idle, so that NATs and load
+// balancers that drop quiet flows see traffic.  The backend may send ParameterStatus at any time,
+// and the one sent repeats the latest the client was told about, with the same value, so it
+// changes nothing.  It is only written while the session is idle and nothing else is being written
+// to the client.  Sessions wait between keepalives on a timer rather than a goroutine, so that
+// parked sessions stay cheap.
+//
+// A nil *clientKeepalive (client_keepalive unset) does nothing.
+type clientKeepalive struct {
+	client   net.Conn
+	out      *codec.Writer
+	interval time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+	sent  time.Time
+	// the latest ParameterStatus sent to the client
+	status  codec.Message
+	stopped bool
+}
+
+func startClientKeepalive(client net.Conn, out *codec.Writer) *clientKeepalive {
+	interval := remote.ClientKeepalive(client)
+	if interval <= 0 {
+		return nil
+	}
+
+	// the startup sequence ended with these
+	advertised := remote.AdvertisedParameters(client)
+	last := advertised[len(advertised)-1]
+	k := &clientKeepalive{client: client, out: out, interval: interval, status: codec.NewParameterStatus(last.Key, last.Value)}
+	k.mu.Lock()
+	k.timer = time.AfterFunc(interval, k.tick)
+	k.mu.Unlock()
+	return k
+}
+
+func (k *clientKeepalive) tick() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.stopped {
+		return
+	}
+
+	next := k.interval
+	if since, idle := remote.IdleSince(k.client); idle {
+		if k.sent.After(since) {
+			since = k.sent
+		}
+		if wait := k.interval - time.Since(since); wait > 0 {
+			next = wait
+		} else {
+			idle := func() bool {
+				_, idle := remote.IdleSince(k.client)
+				return idle
+			}
+			written, err := k.out.TryWriteMessage(k.status, idle)
+			if err != nil {
+				// the relay finds out for itself
+				slog.Debug("could not send keepalive to client", "error", err)
+				return
+			}
+			if written {
+				k.sent = time.Now()
+				remote.CountClientKeepalive(k.client)
+			}
+		}
+	}
+	k.timer.Reset(next)
+}
+
+// Called by the relay for every message it forwards to the client, to keep track of the latest
+// ParameterStatus
+func (k *clientKeepalive) observe(message *codec.Message) {
+	if k == nil || message.Type != codec.MessageTypeParameterStatus || len(message.Data) != int(message.Length)+1 {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.status = codec.Message{Type: message.Type, Length: message.Length, Data: bytes.Clone(message.Data)}
+}
+
+func (k *clientKeepalive) stop() {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.stopped = true
+	k.timer.Stop()
+}
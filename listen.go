@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+	"github.com/michaelhelvey/pgproxy/internal/systemd"
+)
+
+// Opens the sockets of each listener, in order: one, or one per acceptor.  If the proxy was socket
+// activated, the sockets systemd passed are used instead, so that they survive restarts: the one
+// named after a listener (FileDescriptorName=), or the only one if there is a single listener.
+func listen(listeners []remote.ListenerConfig) ([][]net.Listener, error) {
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]net.Listener{}
+	for _, ln := range activated {
+		byName[ln.Name] = ln
+	}
+	if len(listeners) == 1 && len(activated) == 1 {
+		byName = map[string]net.Listener{listeners[0].Name: activated[0]}
+	}
+
+	lns := make([][]net.Listener, 0, len(listeners))
+	closeAll := func() {
+		for _, sockets := range lns {
+			for _, ln := range sockets {
+				ln.Close()
+			}
+		}
+		for _, ln := range byName {
+			ln.Close()
+		}
+	}
+
+	for _, lc := range listeners {
+		if ln := byName[lc.Name]; ln != nil {
+			slog.Info("using socket passed by systemd", "listener", lc.Name)
+			if lc.Acceptors.Count() > 1 {
+				slog.Warn("ignoring acceptors of a listener whose socket systemd passed", "listener", lc.Name)
+			}
+			delete(byName, lc.Name)
+			lns = append(lns, []net.Listener{ln})
+			continue
+		}
+
+		sockets, err := listenOn(lc)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		lns = append(lns, sockets)
+	}
+
+	for name, ln := range byName {
+		slog.Warn("ignoring socket passed by systemd that matches no listener", "name", name, "addr", ln.Addr().String())
+		ln.Close()
+	}
+
+	return lns, nil
+}
+
+func listenOn(lc remote.ListenerConfig) ([]net.Listener, error) {
+	if !lc.Unix() {
+		return listenTCP(lc.Listen, lc.Acceptors.Count())
+	}
+
+	// a socket left behind by a previous run that didn't shut down cleanly would make the bind
+	// fail, but don't remove anything that isn't a socket
+	if info, err := os.Lstat(lc.Listen); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(lc.Listen); err != nil {
+			return nil, fmt.Errorf("could not remove stale socket %s: %w", lc.Listen, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", lc.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", lc.Listen, err)
+	}
+	// clients on the same host connect as whichever user they are, and authenticate like any
+	// other client
+	if err := os.Chmod(lc.Listen, 0o777); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("could not make %s accessible: %w", lc.Listen, err)
+	}
+	return []net.Listener{ln}, nil
+}
+
+// Opens `n` sockets on `addr`, all bound with SO_REUSEPORT if there are several, so that the kernel
+// spreads new connections across them and each can have its own accept loop.  Sockets after the
+// first are bound to the first one's address, which matters when `addr` has port 0.
+func listenTCP(addr string, n int) ([]net.Listener, error) {
+	if n == 1 {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("could not listen on %s: %w", addr, err)
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+	var sockets []net.Listener
+	for range n {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, ln := range sockets {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("could not listen on %s: %w", addr, err)
+		}
+		sockets = append(sockets, ln)
+		addr = ln.Addr().String()
+	}
+	return sockets, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import "syscall"
+
+// SO_REUSEPORT, which package syscall doesn't define for Linux
+const soReusePort = 0xf
+
+// Sets SO_REUSEPORT on a socket before it is bound (net.ListenConfig.Control)
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -2,33 +2,66 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
-	"sync"
-
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/admin"
+	"github.com/michaelhelvey/pgproxy/internal/admission"
+	"github.com/michaelhelvey/pgproxy/internal/audit"
+	"github.com/michaelhelvey/pgproxy/internal/auth"
 	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/contention"
+	"github.com/michaelhelvey/pgproxy/internal/export"
+	"github.com/michaelhelvey/pgproxy/internal/lifecycle"
+	"github.com/michaelhelvey/pgproxy/internal/memory"
+	"github.com/michaelhelvey/pgproxy/internal/metrics"
+	"github.com/michaelhelvey/pgproxy/internal/ratelimit"
+	"github.com/michaelhelvey/pgproxy/internal/redact"
 	"github.com/michaelhelvey/pgproxy/internal/remote"
+	"github.com/michaelhelvey/pgproxy/internal/slowlog"
+	"github.com/michaelhelvey/pgproxy/internal/systemd"
+	"github.com/michaelhelvey/pgproxy/internal/tunnel"
 )
 
 // -------------------------------------------------------------------------------------------------
 // Global variables and initialization
 // -------------------------------------------------------------------------------------------------
 
+var handlerPanics = metrics.NewCounter("pgproxy_handler_panics_total", "Panics recovered while handling client sessions.")
+
 var logLevel = new(slog.LevelVar)
 var configPath string
+var adminAddr string
 
 func parseFlags() {
 	logger := slog.New(
-		slog.NewTextHandler(
+		remote.LabelHandler(slog.NewTextHandler(
 			os.Stdout,
-			&slog.HandlerOptions{AddSource: true, Level: logLevel},
-		),
+			&slog.HandlerOptions{AddSource: true, Level: logLevel, ReplaceAttr: redact.ReplaceAttr},
+		)),
 	)
 	slog.SetDefault(logger)
 	logLevelFlag := flag.String("log-level", "INFO", "set log level for program")
+	flag.StringVar(&adminAddr, "admin-addr", "", "address to serve the admin HTTP API on (disabled if empty)")
 	flag.Parse()
 
 	switch *logLevelFlag {
@@ -60,213 +93,892 @@ func writePacket(conn net.Conn, packet codec.Message) error {
 	return nil
 }
 
-// Reads from client connection until the startup sequence is complete and a remote connection
-// is allocated
-func handleClientStartup(client net.Conn, reader *bufio.Reader, configs []remote.ConfigEntry) error {
+// Short random identifier for a client session, used to correlate proxy logs with upstream
+// backends (see remote.GetOrAllocConnection)
+func newSessionID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// How long a client may take to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// How long a client may take to get through startup and authenticate, like postgres'
+// authentication_timeout.  Waiting for an upstream connection doesn't count.
+const authenticationTimeout = time.Minute
+
+// Runs the startup sequence for a new client.  If the client negotiates TLS, the returned connection
+// and reader replace the ones passed in for the rest of the session.  Clients are only given an
+// upstream connection once they authenticated, unless their credential is looked up on it (see
+// remote.AuthQueryClient).
+func handleClientStartup(client net.Conn, sessionID string, reader *bufio.Reader, l *listener) (net.Conn, *bufio.Reader, error) {
+	configs := l.entries()
+	deadline := time.Now().Add(authenticationTimeout)
+	_ = client.SetDeadline(deadline)
+
 	for {
 		message, err := codec.ReadMessage(reader)
 		if err != nil {
 			slog.Error("could not parse message from client", "error", err)
 			client.Close()
-			return nil
+			return client, reader, nil
 		}
 
 		if message.Type == codec.MessageTypeTerminate {
 			slog.Info("terminating connection", "clientAddr", client.RemoteAddr().String())
 			client.Close()
-			return nil
+			return client, reader, nil
 		}
 
 		if message.Type == codec.MessageTypeSSLRequest {
-			response := []byte{'N'}
-			_, err = client.Write(response)
+			if _, isTLS := client.(*tls.Conn); l.tls == nil || isTLS {
+				if _, err = client.Write([]byte{'N'}); err != nil {
+					return client, reader, err
+				}
+				continue
+			}
+
+			// anything the client sent after its SSLRequest arrived unencrypted, and must not be
+			// treated as if it came over TLS
+			if reader.Buffered() > 0 {
+				rejectClient(client, codec.SQLStateProtocolViolation, "received unencrypted data after SSL request")
+				return client, reader, errors.New("received unencrypted data after SSL request")
+			}
+
+			if _, err = client.Write([]byte{'S'}); err != nil {
+				return client, reader, err
+			}
+
+			tlsConn := tls.Server(client, l.tls)
+			ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+			err = tlsConn.HandshakeContext(ctx)
+			cancel()
 			if err != nil {
-				return err
+				client.Close()
+				return client, reader, fmt.Errorf("TLS handshake failed: %w", err)
 			}
+
+			client, reader = tlsConn, bufio.NewReader(tlsConn)
+			continue
 		}
 
 		if message.Type == codec.MessageTypeStartup {
 			params, err := message.ParseStartupParameters()
 			if err != nil {
-				return err
+				rejectClient(client, codec.SQLStateProtocolViolation, err.Error())
+				return client, reader, err
 			}
 			slog.Debug("parsed startup parameters", "params", params)
 
-			remoteConn, err := remote.GetOrAllocConnection(client, configs, &params.Params)
+			if params.ProtocolMajor != codec.ProtocolMajorVersion {
+				msg := fmt.Sprintf(
+					"unsupported frontend protocol %d.%d: server supports %d.0 to %d.%d",
+					params.ProtocolMajor, params.ProtocolMinor,
+					codec.ProtocolMajorVersion, codec.ProtocolMajorVersion, codec.ProtocolMinorVersion,
+				)
+				rejectClient(client, codec.SQLStateFeatureNotSupported, msg)
+				return client, reader, errors.New(msg)
+			}
+
+			if err = checkClientTLS(client, l.tlsConfig, params.Params["user"]); err != nil {
+				rejectClient(client, codec.SQLStateInvalidAuthorization, err.Error())
+				return client, reader, err
+			}
+
+			// like postgres, we answer newer minor versions and protocol extensions we don't know
+			// with the version we do speak, and the client decides whether it can live with that
+			var unsupported []string
+			for key := range params.Params {
+				if strings.HasPrefix(key, "_pq_.") {
+					unsupported = append(unsupported, key)
+					delete(params.Params, key)
+				}
+			}
+			if params.ProtocolMinor > codec.ProtocolMinorVersion || len(unsupported) > 0 {
+				sort.Strings(unsupported)
+				if err = writePacket(client, codec.NewNegotiateProtocolVersion(codec.ProtocolMinorVersion, unsupported)); err != nil {
+					return client, reader, err
+				}
+			}
+
+			if params.Params["database"] == remote.AdminDatabase && len(l.config.AdminUsers) > 0 {
+				_ = client.SetDeadline(time.Time{})
+				return client, reader, serveConsole(client, reader, params.Params["user"], l)
+			}
+
+			err = remote.RouteClient(client, sessionID, configs, params.Params)
+			var policyErr *remote.PolicyError
+			if errors.As(err, &policyErr) {
+				slog.Warn("rejecting client", "database", params.Params["database"], "reason", policyErr.Message)
+				rejectClient(client, policyErr.Code, policyErr.Message)
+			}
 			if err != nil {
-				return err
+				return client, reader, err
+			}
+
+			var remoteConn net.Conn
+			if remote.AuthQueryClient(client) {
+				if remoteConn, deadline, err = connectClient(client); err != nil {
+					return client, reader, err
+				}
+			}
+
+			if err = authenticateClient(client, reader, params.Params["user"], params.Params["database"], deadline, l); err != nil {
+				return client, reader, err
+			}
+
+			if err = remote.AdmitSession(client); errors.As(err, &policyErr) {
+				slog.Info("access policy rejected client", "user", params.Params["user"], "reason", policyErr.Message)
+				rejectClient(client, policyErr.Code, policyErr.Message)
+			}
+			if err != nil {
+				return client, reader, err
+			}
+
+			if err = admitClient(client, params.Params, l); err != nil {
+				return client, reader, err
 			}
 
-			slog.Debug("allocated remote connection for new client", "client", remoteConn)
+			if remoteConn, _, err = connectClient(client); err != nil {
+				return client, reader, err
+			}
 
 			if err = writePacket(client, codec.NewAuthenticationOkMessage()); err != nil {
-				return err
+				return client, reader, err
 			}
 
 			// FIXME: need to respect remote for these packets
-			if err = writePacket(client, codec.NewParameterStatus("client_encoding", "UTF8")); err != nil {
-				return err
+			for _, param := range remote.AdvertisedParameters(client) {
+				if err = writePacket(client, codec.NewParameterStatus(param.Key, param.Value)); err != nil {
+					return client, reader, err
+				}
 			}
 
-			if err = writePacket(client, codec.NewParameterStatus("DateStyle", "ISO")); err != nil {
-				return err
+			notice := remote.EntryStartupNotice(client)
+			if notice == nil {
+				notice = l.config.StartupNotice
+			}
+			// lazily connected sessions have no upstream to tell the client about yet
+			if remoteConn != nil {
+				if text := notice.Text(remoteConn.RemoteAddr().String()); text != "" {
+					if err = writePacket(client, codec.NewNotice(text)); err != nil {
+						return client, reader, err
+					}
+				}
 			}
 
-			if err = writePacket(
-				client,
-				codec.NewNotice(
-					fmt.Sprintf("PGPROXY: proxy successfully connected through to remote at: %s", remoteConn.RemoteAddr().String()),
-				),
-			); err != nil {
-				return err
+			if err = writePacket(client, codec.NewReadyForQueryMessage(remote.StartupTransactionStatus(client))); err != nil {
+				return client, reader, err
 			}
 
-			if err = writePacket(client, codec.NewReadyForQueryMessage(codec.BackendTransactionStatusIdle)); err != nil {
-				return err
+			_ = client.SetDeadline(time.Time{})
+			return client, reader, nil
+		}
+	}
+}
+
+// Gives a routed client its upstream connection (see remote.ConnectClient).  The client isn't
+// held to the authentication timeout while it waits for it, only before and after: returns the
+// client's new deadline.
+func connectClient(client net.Conn) (net.Conn, time.Time, error) {
+	_ = client.SetDeadline(time.Time{})
+	remoteConn, err := remote.ConnectClient(client)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	slog.Debug("allocated remote connection for new client", "client", remoteConn)
+	deadline := time.Now().Add(authenticationTimeout)
+	_ = client.SetDeadline(deadline)
+	return remoteConn, deadline, nil
+}
+
+// Checks the client's password with its entry's auth method, its auth_query, or the auth file if
+// the entry has neither.  Clients are trusted if none of these are configured.  On failure the
+// client has been sent an error.  Checks made elsewhere (LDAP) give up at `deadline`, like the
+// client's own reads and writes.
+func authenticateClient(client net.Conn, reader *bufio.Reader, user, database string, deadline time.Time, l *listener) error {
+	var err error
+	method := remote.AuthMethod(client)
+	if method == remote.AuthLDAP || method == remote.AuthJWT {
+		var password string
+		password, err = auth.ReadCleartextPassword(client, reader)
+		if err == nil {
+			if method == remote.AuthLDAP {
+				err = l.ldap.Authenticate(user, password, deadline)
+			} else {
+				var claims map[string]any
+				if claims, err = l.jwt.Authenticate(password, user, database); err == nil {
+					remote.SetClaims(client, claims)
+				}
+			}
+		}
+		if err != nil && !errors.Is(err, auth.ErrPasswordMismatch) {
+			slog.Error("could not check password", "method", method, "user", user, "error", err)
+		} else if err != nil && method == remote.AuthJWT {
+			slog.Info("rejected client token", "user", user, "database", database, "reason", err)
+		}
+	} else {
+		var credential *auth.Credential
+		var required bool
+		credential, required, err = remote.ClientCredential(client, user)
+		if err != nil {
+			rejectClient(client, codec.SQLStateInvalidAuthorization, "could not look up credentials")
+			return err
+		}
+		if !required {
+			if l.userlist == nil {
+				event := clientEvent(client, audit.AuthSucceeded, "")
+				event.Details = map[string]any{"method": "trust"}
+				audit.Record(event)
+				return nil
 			}
+			credential = l.userlist.Credential(user)
+		}
+
+		method = "password"
+		err = auth.Authenticate(client, reader, user, credential)
+	}
+
+	return finishAuthentication(client, user, method, err, l)
+}
+
+// Records the outcome of a login attempt, and on failure throttles the client and sends it an
+// error
+func finishAuthentication(client net.Conn, user, method string, err error, l *listener) error {
+	if err != nil {
+		event := clientEvent(client, audit.AuthFailed, err.Error())
+		event.User = user
+		event.Details = map[string]any{"method": method}
+		audit.Record(event)
+
+		if errors.Is(err, auth.ErrPasswordMismatch) && l.lockout != nil {
+			ip := clientHost(client)
+			delay, banned := l.lockout.Fail(ip, user)
+			if banned {
+				slog.Warn("banning client IP after repeated failed logins", "client", ip, "user", user)
+				audit.Record(clientEvent(client, audit.ClientBanned, "too many failed logins"))
+			}
+			time.Sleep(delay)
+		}
+		rejectClient(client, codec.SQLStateInvalidPassword, fmt.Sprintf("password authentication failed for user %q", user))
+		return err
+	}
+
+	event := clientEvent(client, audit.AuthSucceeded, "")
+	event.User = user
+	event.Details = map[string]any{"method": method}
+	audit.Record(event)
+
+	if l.lockout != nil {
+		l.lockout.Succeed(user)
+	}
+	return nil
+}
+
+// An audit event about a client, with what we know about its session filled in
+func clientEvent(client net.Conn, eventType audit.EventType, reason string) audit.Event {
+	id := remote.SessionIdentity(client)
+	return audit.Event{
+		Type:       eventType,
+		Session:    id.Session,
+		ClientAddr: clientHost(client),
+		User:       id.User,
+		Database:   id.Database,
+		Entry:      id.Entry,
+		Labels:     id.Labels,
+		Reason:     reason,
+	}
+}
+
+// Enforces the listener's TLS requirements for a client that is about to log in as `user`
+func checkClientTLS(client net.Conn, config *remote.TLSConfig, user string) error {
+	if config == nil {
+		return nil
+	}
 
-			return nil
+	if _, isTLS := client.(*tls.Conn); !isTLS {
+		if config.Require {
+			return errors.New("pgproxy requires SSL connections")
 		}
+		return nil
+	}
+
+	if config.CertUser && !slices.Contains(remote.ClientCertNames(client), user) {
+		return fmt.Errorf("certificate authentication failed for user %q", user)
+	}
+
+	return nil
+}
+
+// Recovers from a panic while handling a session, so that one malformed or malicious client can't
+// take down the whole proxy.  Must be deferred directly; `cleanup` should close whatever sockets
+// are needed for the rest of the session to unwind.
+func recoverSession(addr string, cleanup func()) {
+	if r := recover(); r != nil {
+		handlerPanics.Inc()
+		slog.Error("recovered from panic in session handler", "client", addr, "panic", r, "stack", string(debug.Stack()))
+		cleanup()
+	}
+}
+
+// Asks the admission webhook, if there is one, whether to let an authenticated client in.  On
+// failure the client has been sent an error.
+func admitClient(client net.Conn, params map[string]string, l *listener) error {
+	if l.admission == nil {
+		return nil
+	}
+
+	host := clientHost(client)
+	err := l.admission.Admit(admission.Request{
+		ClientAddr:      host,
+		User:            params["user"],
+		Database:        params["database"],
+		ApplicationName: params["application_name"],
+	})
+	if rejected, ok := err.(*admission.RejectedError); ok {
+		slog.Info("admission webhook rejected client", "client", host, "user", params["user"], "error", err)
+		rejectClient(client, codec.SQLStateInvalidAuthorization, rejected.Message)
+		return err
 	}
+	if err != nil {
+		slog.Error("could not ask admission webhook", "error", err)
+		rejectClient(client, codec.SQLStateInvalidAuthorization, l.admission.ErrorMessage)
+		return err
+	}
+
+	return nil
+}
+
+// The IP address of a client
+func clientHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// The state client sessions need, prepared once per listener when the server starts
+type listener struct {
+	config *remote.Config
+	name   string
+	// which of the routes clients of this listener may connect to
+	scope remote.ListenerConfig
+	// nil if clients can't use TLS
+	tls       *tls.Config
+	tlsConfig *remote.TLSConfig
+	// nil if there is no auth file
+	userlist *auth.Userlist
+	// nil if no LDAP server is configured
+	ldap *auth.LDAP
+	// nil if JWT authentication isn't configured
+	jwt *auth.JWTVerifier
+	// nil if there is no admission webhook
+	admission *admission.Webhook
+	// nil if failed logins aren't throttled
+	lockout *ratelimit.Lockout
+	// nil unless sessions are parked between transactions (client_engine "epoll")
+	engine *engine
+}
+
+// The entries clients of the listener may connect to, as the routes currently are
+func (l *listener) entries() []remote.ConfigEntry {
+	return l.scope.Scope(remote.Routes())
 }
 
-func handleClient(conn net.Conn, configs []remote.ConfigEntry) {
+// Serves a client until its session ends, or until the session is parked (see
+// transactionRelay.run), in which case it is carried on by resumeSession.  Accounts for the end of
+// the session in activeSessions.
+func handleClient(conn net.Conn, l *listener) {
+	parked := false
+	defer func() {
+		if !parked {
+			activeSessions.Add(-1)
+		}
+	}()
+
+	configs := l.entries()
+	writeTimeout := time.Duration(l.config.WriteTimeout)
+
 	addr := conn.RemoteAddr().String()
-	slog.Info("handling new client connection", "addr", addr)
+	sessionID := newSessionID()
+	slog.Info("handling new client connection", "addr", addr, "session", sessionID)
 	reader := bufio.NewReader(conn)
 
+	defer recoverSession(addr, func() {
+		conn.Close()
+		_ = remote.Cleanup(conn)
+	})
+
 	// 1) handle startup sequence
-	err := handleClientStartup(conn, reader, configs)
+	conn, reader, err := handleClientStartup(conn, sessionID, reader, l)
+	if errors.Is(err, errConsoleFinished) {
+		return
+	}
 	if err != nil {
 		slog.Error("fatal: error in startup sequence", "error", err)
+		event := clientEvent(conn, audit.ConnectionRejected, err.Error())
+		event.Session = sessionID
+		audit.Record(event)
+		var providerErr *remote.ProviderError
+		if errors.Is(err, remote.ErrConnectTimeout) || errors.Is(err, remote.ErrQueryWaitTimeout) || errors.As(err, &providerErr) {
+			rejectUpstreamError(conn, err)
+			return
+		}
 		conn.Close()
+		// the client may have been given an upstream connection before startup failed (e.g. it
+		// didn't authenticate), which can still go back to its pool
+		_ = remote.Release(conn, true)
 		return
 	}
 
-	remoteConn, err := remote.GetOrAllocConnection(conn, configs, nil)
+	remoteConn, err := remote.GetOrAllocConnection(conn, sessionID, configs, nil)
 	if err != nil {
 		slog.Error("fatal: could not get remote connection after successful startup sequence", "error", err)
 		conn.Close()
 		return
 	}
 
-	slog.Debug("initializing bidirectional copy between client and remote")
-
-	remoteReader := bufio.NewReader(remoteConn)
-
-	var wg sync.WaitGroup
+	if remote.InMaintenance(conn) {
+		slog.Info("answering client of entry in maintenance", "addr", addr, "session", sessionID)
+		event := clientEvent(conn, audit.ConnectionAccepted, "")
+		event.Details = map[string]any{"maintenance": true}
+		audit.Record(event)
+		if err = remote.ServeMaintenance(conn, reader); err != nil && !isClosedErr(err) {
+			slog.Error("could not answer client of entry in maintenance", "error", err)
+		}
+		conn.Close()
+		_ = remote.Release(conn, true)
+		return
+	}
 
-	wg.Add(2)
-	client := make(chan bool)
-	server := make(chan bool)
+	event := clientEvent(conn, audit.ConnectionAccepted, "")
+	_, isTLS := conn.(*tls.Conn)
+	event.Details = map[string]any{"tls": isTLS, "replication": remote.IsReplication(conn)}
+	audit.Record(event)
 
-	go func() {
-		// asynchronously copy every message from the remote back to the client
-		defer func() {
-			// when we exit, signal the client
-			client <- true
-		}()
-		defer wg.Done()
-
-		for {
-			select {
-			case <-server:
-				slog.Info("server->client process: exiting because received quit flag")
-				return
-			default:
-				message, err := codec.ReadMessage(remoteReader)
-				if err != nil {
-					slog.Error("fatal: error reading from remote", "error", err)
-					return
-				}
-				slog.Debug("handling message from remote", "message", message)
+	started := time.Now()
+	export.Publish(exportRecord(conn, export.RecordSessionStart))
 
-				_, err = conn.Write(message.Data)
+	slog.Debug("initializing bidirectional copy between client and remote")
 
-				if err != nil {
-					slog.Error("fatal: error writing message to client", "error", err)
-					return
-				}
+	idle := &idleTimeout{
+		client:         conn,
+		timeout:        time.Duration(l.config.IdleInTransactionSessionTimeout),
+		maxTransaction: remote.MaxTransactionDuration(conn),
+	}
+	var reusable bool
+	if remote.IsReplication(conn) {
+		relayReplication(conn, reader, remoteConn, addr, writeTimeout)
+	} else if remote.IsTransactionPooled(conn) {
+		// the connection taken during startup is only needed once the client starts a transaction
+		remote.Detach(conn, true)
+		relay := newTransactionRelay(conn, reader, addr, writeTimeout, idle)
+		if parkable, ok := conn.(*parkableConn); ok {
+			relay.park = func() bool { return parkable.park(func() { go resumeSession(relay, addr, started) }) }
+		}
+		if reusable, parked = relay.run(false); parked {
+			return
+		}
+	} else {
+		if remoteConn == nil {
+			remoteConn, err = attachOnFirstMessage(conn, reader)
+			if err != nil {
+				slog.Error("fatal: could not get upstream connection for lazily connected session", "error", err)
+				rejectUpstreamError(conn, err)
 			}
 		}
-	}()
+		// nil if the client left without sending anything
+		reusable = remoteConn == nil || relaySession(conn, reader, remoteConn, addr, writeTimeout, idle)
+	}
 
-	go func() {
-		// copy every message from the client to the remote
-		defer func() {
-			server <- true
-		}()
-		defer wg.Done()
-
-		for {
-			select {
-			case <-client:
-				slog.Info("client->server process: exiting because received quit flag")
-				return
-			default:
-				message, err := codec.ReadMessage(reader)
-				if err != nil {
-					slog.Error("fatal: error reading client message", "error", err)
-					return
-				}
-				slog.Debug("handling message from client", "message", message)
+	endSession(conn, addr, started, reusable)
+}
 
-				if message.Type == codec.MessageTypeTerminate {
-					slog.Info("client exiting after terminate message")
-					return
-				}
+// Carries on with a parked session (see transactionRelay.run) once its client sent something
+func resumeSession(relay *transactionRelay, addr string, started time.Time) {
+	conn := relay.conn
+	defer recoverSession(addr, func() {
+		conn.Close()
+		_ = remote.Cleanup(conn)
+		activeSessions.Add(-1)
+	})
 
-				_, err = remoteConn.Write(message.Data)
+	if reusable, parked := relay.run(true); !parked {
+		endSession(conn, addr, started, reusable)
+		activeSessions.Add(-1)
+	}
+}
 
-				if err != nil {
-					slog.Error("fatal: error writing to remote", "error", err)
-					return
-				}
-			}
-		}
-	}()
+func endSession(conn net.Conn, addr string, started time.Time, reusable bool) {
+	sessionEnd := exportRecord(conn, export.RecordSessionEnd)
+	sessionEnd.DurationMs = durationMs(time.Since(started))
+	export.Publish(sessionEnd)
 
-	wg.Wait()
-	fmt.Println("CLEANING UP")
-	err = remote.Cleanup(conn)
+	slog.Debug("relay finished, cleaning up", "client", addr)
+	err := remote.Release(conn, reusable)
 	if err != nil {
 		slog.Error("error cleaning up remote connection", "error", err)
 	}
 
 	err = conn.Close()
-	if err != nil {
+	if err != nil && !errors.Is(err, net.ErrClosed) {
 		slog.Error("error cleaning up client connection", "error", err)
 	}
-	slog.Info("exiting from client handler", "client", conn.RemoteAddr().String())
+	slog.Info("exiting from client handler", "client", addr)
+}
+
+// Bounds for backing off after temporary accept errors (e.g. running out of file descriptors), so
+// that we don't hot-loop on Accept while the condition persists
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+var activeSessions atomic.Int64
+
+// Returns a function reporting whether a newly accepted connection is within the configured accept
+// rate limit
+func newAcceptLimiter(limit *remote.AcceptRateLimit) func(conn net.Conn) bool {
+	if limit == nil || limit.PerSecond <= 0 {
+		return func(net.Conn) bool { return true }
+	}
+
+	if !limit.PerIP {
+		bucket := ratelimit.NewBucket(limit.PerSecond, limit.Burst)
+		return func(net.Conn) bool { return bucket.Allow() }
+	}
+
+	buckets := ratelimit.NewKeyed(limit.PerSecond, limit.Burst)
+	return func(conn net.Conn) bool {
+		host := clientHost(conn)
+
+		return buckets.Allow(host)
+	}
+}
+
+// Sends a fatal error to a client we won't serve and closes the connection
+func rejectClient(conn net.Conn, code string, msg string) {
+	defer conn.Close()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	// errors of ours, e.g. from dialing the upstream, may quote connection strings
+	msg = redact.String(msg)
+	if err := writePacket(conn, codec.NewErrorResponse(codec.ErrorSeverityFatal, code, msg)); err != nil {
+		slog.Debug("could not write rejection to client", "error", err)
+	}
+}
+
+// Tells a client why it couldn't get an upstream connection, without the details of provider
+// errors
+func rejectUpstreamError(conn net.Conn, err error) {
+	var providerErr *remote.ProviderError
+	switch {
+	case errors.As(err, &providerErr):
+		rejectClient(conn, providerErr.SQLState(), providerErr.ClientMessage())
+	case errors.Is(err, remote.ErrConnectTimeout) || errors.Is(err, remote.ErrQueryWaitTimeout):
+		rejectClient(conn, codec.SQLStateUnableToEstablishConnection, err.Error())
+	default:
+		rejectClient(conn, codec.SQLStateUnableToEstablishConnection, "could not get upstream connection")
+	}
 }
 
 func server() error {
-	configs, err := remote.ReadConfigFromFile(configPath)
+	config, err := remote.ReadConfigFromFile(configPath)
 	if err != nil {
 		return fmt.Errorf("could not read config from file: %w", err)
 	}
-	slog.Info("read proxy config", "config", configs)
+	redact.SetKeys(config.SensitiveKeys)
+	codec.SetStrict(config.StrictProtocol)
+	slog.Info("read proxy config", "config", config)
+	remote.SetRoutes(config, configPath)
+	remote.Prewarm(config.Entries)
+	if err = remote.LoadIPAccess(config.AllListeners()); err != nil {
+		return err
+	}
+	go reloadOnHangup()
+
+	if err = audit.Start(config.Audit); err != nil {
+		return err
+	}
+	contention.Start(config.ContentionAlerts.Build())
+	slowlog.Start(config.SlowQueries.Build())
+	memory.Start(config.Memory)
+	if err = export.Start(config.Export.Build()); err != nil {
+		return err
+	}
+	if err = metrics.StartStatsd(config.Statsd.Build()); err != nil {
+		return err
+	}
+	shutdown, lease := config.Lifecycle.Build()
+	if err = lifecycle.StartLease(lease); err != nil {
+		return err
+	}
+
+	base := listener{config: config, ldap: config.LDAP.Authenticator(), jwt: config.JWT.Verifier()}
+	base.admission, base.lockout = config.AdmissionWebhook.Build(), config.AuthLockout.Build()
+	if config.ClientEngine == remote.ClientEngineEpoll {
+		if base.engine, err = newEngine(); err != nil {
+			return err
+		}
+	}
+	if config.AuthFile != "" {
+		if base.userlist, err = auth.NewUserlist(config.AuthFile); err != nil {
+			return err
+		}
+	}
+
+	var listeners []*listener
+	for _, lc := range config.AllListeners() {
+		l := base
+		l.name, l.scope, l.tlsConfig = lc.Name, lc, lc.TLS
+		if l.tls, err = lc.TLS.ServerConfig(); err != nil {
+			return fmt.Errorf("listener %s: %w", lc.Name, err)
+		}
+		listeners = append(listeners, &l)
+	}
+
+	if adminAddr != "" {
+		go func() {
+			slog.Info("admin API listening", "addr", adminAddr)
+			if err := http.ListenAndServe(adminAddr, admin.NewHandler()); err != nil {
+				slog.Error("admin API exited", "error", err)
+			}
+		}()
+	}
 
-	ln, err := net.Listen("tcp", "127.0.0.1:5433")
+	sockets, err := listen(config.AllListeners())
 	if err != nil {
-		return fmt.Errorf("could not listen on 5433: %w", err)
+		return err
+	}
+
+	for i, lc := range config.AllListeners() {
+		if lc.Tunnel {
+			// TLS is for the tunnels, the streams within them are plaintext
+			for j := range sockets[i] {
+				sockets[i][j] = tunnel.NewServer(sockets[i][j], listeners[i].tls)
+			}
+			listeners[i].tls, listeners[i].tlsConfig = nil, nil
+		}
+	}
+
+	var addrs []string
+	var lns []net.Listener
+	for i, group := range sockets {
+		addr := group[0].Addr().String()
+		slog.Info("server listening", "listener", listeners[i].name, "addr", addr, "entries", len(listeners[i].entries()), "acceptors", len(group))
+		addrs = append(addrs, addr)
+		lns = append(lns, group...)
+	}
+	if err = systemd.Notify("READY=1\nSTATUS=accepting connections on " + strings.Join(addrs, ", ")); err != nil {
+		slog.Error("could not notify systemd", "error", err)
+	}
+	if err = systemd.StartWatchdog(); err != nil {
+		return err
 	}
 
-	slog.Info("server listening on port 5433")
+	stopping := make(chan struct{})
+	go awaitShutdown(lns, shutdown, stopping)
+
+	allowAccept := newAcceptLimiter(config.AcceptRateLimit)
+	errs := make(chan error, len(lns))
+	for i, group := range sockets {
+		for _, ln := range group {
+			go func() { errs <- acceptClients(ln, listeners[i], allowAccept) }()
+		}
+	}
+
+	for range lns {
+		if err = <-errs; !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	select {
+	case <-stopping:
+		drainSessions(shutdown.Timeout)
+		return nil
+	default:
+		return err
+	}
+}
+
+// Accepts clients on one socket of a listener until it is closed, which it returns net.ErrClosed for
+func acceptClients(ln net.Listener, l *listener, allowAccept func(conn net.Conn) bool) error {
+	config := l.config
+	var backoff time.Duration
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			slog.Error("error accepting connection", "error", err)
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			slog.Error("error accepting connection", "listener", l.name, "error", err, "backoff", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if !remote.AdmitIP(l.name, conn.RemoteAddr()) {
+			slog.Debug("rejecting connection refused by ip_access", "listener", l.name, "addr", conn.RemoteAddr().String())
+			audit.Record(audit.Event{Type: audit.ConnectionRejected, ClientAddr: clientHost(conn), Reason: "ip access"})
+			conn.Close()
+			continue
+		}
+
+		if !allowAccept(conn) {
+			slog.Debug("rejecting connection over accept rate limit", "addr", conn.RemoteAddr().String())
+			audit.Record(audit.Event{Type: audit.ConnectionRejected, ClientAddr: clientHost(conn), Reason: "accept rate limit"})
+			conn.Close()
+			continue
+		}
+
+		if l.lockout != nil && l.lockout.Banned(clientHost(conn)) {
+			slog.Debug("rejecting connection from banned IP", "addr", conn.RemoteAddr().String())
+			audit.Record(audit.Event{Type: audit.ConnectionRejected, ClientAddr: clientHost(conn), Reason: "banned after failed logins"})
+			go rejectClient(conn, codec.SQLStateInvalidAuthorization, "too many failed login attempts")
+			continue
+		}
+
+		if config.MaxClientConn > 0 && activeSessions.Load() >= int64(config.MaxClientConn) {
+			slog.Warn("rejecting connection over max_client_conn", "addr", conn.RemoteAddr().String())
+			audit.Record(audit.Event{Type: audit.ConnectionRejected, ClientAddr: clientHost(conn), Reason: "max_client_conn"})
+			go rejectClient(conn, codec.SQLStateTooManyConnections, "too many client connections")
+			continue
+		}
+
+		if refuse, reason := memory.Refuse(); refuse {
+			slog.Warn("rejecting connection over memory budget", "addr", conn.RemoteAddr().String(), "reason", reason)
+			audit.Record(audit.Event{Type: audit.ConnectionRejected, ClientAddr: clientHost(conn), Reason: "memory budget"})
+			go rejectClient(conn, codec.SQLStateOutOfMemory, "out of memory")
+			continue
+		}
+
+		if err := config.TCP.Apply(conn); err != nil {
+			slog.Error("could not apply socket options to client connection", "error", err)
+			conn.Close()
+			continue
 		}
 
-		go handleClient(conn, configs)
+		activeSessions.Add(1)
+		go handleClient(l.engine.wrap(conn), l)
+	}
+}
+
+// Runs `pgproxy config <command>`: `schema` writes the JSON Schema of config files to stdout
+func configCommand(args []string) error {
+	switch args[0] {
+	case "schema":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(remote.ConfigSchema())
+	default:
+		return fmt.Errorf("unknown config command %q", args[0])
 	}
 }
 
+// Runs `pgproxy admin <command>` against the admin API of a running proxy at --admin-addr:
+// `add-route <file|->` adds or replaces the entry read from the file (or stdin), and
+// `remove-route <name>` removes one.  With --persist the proxy also rewrites its config file.
+func adminCommand(args []string) error {
+	flags := flag.NewFlagSet("admin "+args[0], flag.ContinueOnError)
+	persist := flags.Bool("persist", false, "also rewrite the proxy's config file")
+	// flags may come before or after the argument
+	var positional []string
+	for rest := args[1:]; ; rest = rest[1:] {
+		if err := flags.Parse(rest); err != nil {
+			return err
+		}
+		if rest = flags.Args(); len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: pgproxy admin add-route <file|-> [--persist] | remove-route <name> [--persist]")
+	}
+	addr := adminAddr
+	if addr == "" {
+		addr = "127.0.0.1:6433"
+	}
+	query := ""
+	if *persist {
+		query = "?persist=true"
+	}
+
+	var request *http.Request
+	var err error
+	switch args[0] {
+	case "add-route":
+		var data []byte
+		if positional[0] == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(positional[0])
+		}
+		if err != nil {
+			return err
+		}
+		var entry struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("could not parse entry: %w", err)
+		}
+		if entry.Name == "" {
+			return errors.New("the entry has no name")
+		}
+		request, err = http.NewRequest(http.MethodPut, "http://"+addr+"/routes/"+url.PathEscape(entry.Name)+query, bytes.NewReader(data))
+	case "remove-route":
+		request, err = http.NewRequest(http.MethodDelete, "http://"+addr+"/routes/"+url.PathEscape(positional[0])+query, nil)
+	default:
+		return fmt.Errorf("unknown admin command %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
 func main() {
 	parseFlags()
 
+	if flag.NArg() > 1 && flag.Arg(0) == "config" {
+		if err := configCommand(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	if flag.NArg() > 1 && flag.Arg(0) == "psql" {
+		if err := psqlCommand(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	if flag.NArg() > 1 && flag.Arg(0) == "admin" {
+		if err := adminCommand(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
 	err := server()
 	if err != nil {
 		panic(fmt.Errorf("could not start server: %w", err))
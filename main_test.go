@@ -1 +1,180 @@
 package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/memory"
+)
+
+func TestBudgetedReaderStreams(t *testing.T) {
+	// a row larger than relayChunkSize, twice, then a ReadyForQuery
+	row := []byte{byte(codec.MessageTypeDataRow), 0, 0, 0, 0}
+	row = append(row, bytes.Repeat([]byte{'x'}, 3*relayChunkSize)...)
+	binary.BigEndian.PutUint32(row[1:], uint32(len(row)-1))
+	ready := codec.NewReadyForQueryMessage(codec.BackendTransactionStatusIdle)
+	input := append(append(append([]byte{}, row...), row...), ready.Data...)
+
+	var account memory.Account
+	r := &budgetedReader{reader: bufio.NewReader(bytes.NewReader(input)), account: &account, streamed: streamedServerMessages}
+
+	message, err := r.next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if message.Type != codec.MessageTypeDataRow || int(message.Length) != len(row)-1 || len(message.Data) != codec.MessageDataStartIndex {
+		t.Fatalf("expected just the header of the row, got %v (%d bytes)", message.Type, len(message.Data))
+	}
+	if account.Held() > relayChunkSize {
+		t.Errorf("expected at most %d bytes held, got %d", relayChunkSize, account.Held())
+	}
+
+	client, server := net.Pipe()
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(client)
+		received <- data
+	}()
+	if err = r.forward(codec.NewWriter(server), message); err != nil {
+		t.Fatalf("unexpected error forwarding: %v", err)
+	}
+	server.Close()
+	if data := <-received; !bytes.Equal(data, row) {
+		t.Errorf("expected the whole row to be forwarded, got %d bytes", len(data))
+	}
+
+	// the second row isn't forwarded, and is skipped
+	if message, err = r.next(); err != nil || message.Type != codec.MessageTypeDataRow {
+		t.Fatalf("expected the second row, got %v (%v)", message, err)
+	}
+	if message, err = r.next(); err != nil || !bytes.Equal(message.Data, ready.Data) {
+		t.Fatalf("expected the ReadyForQuery, got %v (%v)", message, err)
+	}
+
+	r.release()
+	if account.Held() != 0 {
+		t.Errorf("expected nothing held after the release, got %d", account.Held())
+	}
+}
+
+func TestEngineParks(t *testing.T) {
+	e, err := newEngine()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := e.wrap(accepted).(*parkableConn)
+
+	resumed := make(chan struct{}, 1)
+	resume := func() { resumed <- struct{}{} }
+	expectResumed := func(why string) {
+		t.Helper()
+		select {
+		case <-resumed:
+		case <-time.After(time.Second):
+			t.Fatalf("expected the session to be resumed %s", why)
+		}
+	}
+
+	if !conn.park(resume) {
+		t.Fatal("expected the connection to be parked")
+	}
+	select {
+	case <-resumed:
+		t.Fatal("expected the session to stay parked while the client is quiet")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err = client.Write([]byte("Q")); err != nil {
+		t.Fatal(err)
+	}
+	expectResumed("once the client sent something")
+
+	// closing a parked connection resumes its session, exactly once
+	if _, err = io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.park(resume) {
+		t.Fatal("expected the connection to be parked again")
+	}
+	conn.Close()
+	expectResumed("when the connection was closed")
+	select {
+	case <-resumed:
+		t.Error("expected the session to be resumed once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if parkedSessions.Value() != 0 {
+		t.Errorf("expected no parked sessions, got %d", parkedSessions.Value())
+	}
+}
+
+func TestListenAcceptors(t *testing.T) {
+	sockets, err := listenTCP("127.0.0.1:0", 3)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer func() {
+		for _, ln := range sockets {
+			ln.Close()
+		}
+	}()
+
+	if len(sockets) != 3 {
+		t.Fatalf("expected 3 sockets, got %d", len(sockets))
+	}
+	addr := sockets[0].Addr().String()
+	for _, ln := range sockets[1:] {
+		if ln.Addr().String() != addr {
+			t.Errorf("expected every socket on %s, got %s", addr, ln.Addr())
+		}
+	}
+
+	// whichever socket the kernel picks, each connection is accepted exactly once
+	accepted := make(chan struct{}, 10)
+	for _, ln := range sockets {
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				accepted <- struct{}{}
+			}
+		}()
+	}
+	for range 10 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	for range 10 {
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+			t.Fatal("expected every connection to be accepted")
+		}
+	}
+}
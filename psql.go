@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+)
+
+// Runs `pgproxy psql <route>`: a minimal interactive client for checking a route, which connects
+// through the proxy listening on the config's address (or --addr) with the database and options
+// the route matches, or with --direct straight to the route's upstream as the proxy would, and
+// prints the protocol messages exchanged alongside the results of the statements typed in.
+// Passwords come from PGPASSWORD or the passfile, as with libpq.
+func psqlCommand(args []string) error {
+	flags := flag.NewFlagSet("psql", flag.ContinueOnError)
+	config := flags.String("config", "config.json", "config file the route is read from")
+	addr := flags.String("addr", "", "address of the proxy (default the listen address of the route's listener)")
+	user := flags.String("user", "", "user to connect as through the proxy (default PGUSER or the OS user)")
+	direct := flags.Bool("direct", false, "connect straight to the route's upstream rather than through the proxy")
+	// flags may come before or after the argument
+	var positional []string
+	for rest := args; ; rest = rest[1:] {
+		if err := flags.Parse(rest); err != nil {
+			return err
+		}
+		if rest = flags.Args(); len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: pgproxy psql [--config <file>] [--addr <address>] [--user <user>] [--direct] <route>")
+	}
+
+	proxyConfig, err := remote.ReadConfigFromFile(*config)
+	if err != nil {
+		return fmt.Errorf("could not read config from file: %w", err)
+	}
+	i := slices.IndexFunc(proxyConfig.Entries, func(e remote.ConfigEntry) bool { return e.Name == positional[0] })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", remote.ErrNoRoute, positional[0])
+	}
+	entry := &proxyConfig.Entries[i]
+
+	var connConfig *pgconn.Config
+	if *direct {
+		upstream, err := remote.UpstreamConfig(entry)
+		if err != nil {
+			return err
+		}
+		connConfig = &upstream.Config
+	} else {
+		if connConfig, err = proxiedConfig(proxyConfig, entry, *addr, *user); err != nil {
+			return err
+		}
+	}
+	connConfig.RuntimeParams["application_name"] = "pgproxy psql"
+	connConfig.BuildFrontend = func(r io.Reader, w io.Writer) *pgproto3.Frontend {
+		frontend := pgproto3.NewFrontend(r, w)
+		frontend.Trace(os.Stdout, pgproto3.TracerOptions{SuppressTimestamps: true})
+		return frontend
+	}
+	connConfig.OnNotice = func(_ *pgconn.PgConn, notice *pgconn.Notice) {
+		fmt.Printf("%s:  %s\n", notice.Severity, notice.Message)
+	}
+
+	ctx := context.Background()
+	conn, err := pgconn.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	return psqlLoop(ctx, conn, entry.Name, os.Stdin, os.Stdout)
+}
+
+// The config to connect through the proxy with so that the client is routed to `entry`
+func proxiedConfig(proxyConfig *remote.Config, entry *remote.ConfigEntry, addr string, user string) (*pgconn.Config, error) {
+	unix := false
+	if addr == "" {
+		for _, l := range proxyConfig.AllListeners() {
+			if len(l.Scope([]remote.ConfigEntry{*entry})) > 0 {
+				addr, unix = l.Listen, l.Unix()
+				break
+			}
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("no listener serves route %s", entry.Name)
+		}
+	}
+
+	// the rest (sslmode, passfile...) comes from the environment, as with libpq
+	settings := ""
+	if !unix {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		settings = fmt.Sprintf("host='%s' port=%s", host, port)
+	}
+	connConfig, err := pgconn.ParseConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	if unix {
+		// libpq's host names the directory of the socket, but listen is the socket itself
+		connConfig.DialFunc = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}
+	}
+
+	if entry.Match.Database == "" {
+		return nil, fmt.Errorf("route %s doesn't match a database", entry.Name)
+	}
+	connConfig.Database = entry.Match.Database
+	if user != "" {
+		connConfig.User = user
+	}
+	if options := startupOptions(entry.Match.Options); options != "" {
+		connConfig.RuntimeParams["options"] = options
+	}
+	return connConfig, nil
+}
+
+// Builds the startup `options` making the settings of a route's match, e.g. "-c pgproxy.route=a"
+func startupOptions(settings map[string]string) string {
+	var args []string
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		// backslashes escape spaces and themselves
+		setting := strings.NewReplacer(`\`, `\\`, " ", `\ `).Replace(name + "=" + settings[name])
+		args = append(args, "-c", setting)
+	}
+	return strings.Join(args, " ")
+}
+
+// Reads statements from `in` until it ends or \q, running each once it ends with a semicolon
+func psqlLoop(ctx context.Context, conn *pgconn.PgConn, route string, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	var statement strings.Builder
+	for {
+		prompt := "=> "
+		if statement.Len() > 0 {
+			prompt = "-> "
+		}
+		fmt.Fprint(out, route+prompt)
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if statement.Len() == 0 && line == `\q` {
+			return nil
+		}
+		if line == "" {
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+		if !strings.HasSuffix(line, ";") {
+			continue
+		}
+
+		if err := runStatement(ctx, conn, strings.TrimSpace(statement.String()), out); err != nil {
+			return err
+		}
+		statement.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if statement.Len() > 0 {
+		return runStatement(ctx, conn, strings.TrimSpace(statement.String()), out)
+	}
+	return nil
+}
+
+// Runs a statement (or several separated by semicolons) and prints the results.  Errors the
+// server answers with are printed too; the error returned is for a connection that broke.
+func runStatement(ctx context.Context, conn *pgconn.PgConn, sql string, out io.Writer) error {
+	results, err := conn.Exec(ctx, sql).ReadAll()
+	for _, result := range results {
+		printResult(out, result)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		fmt.Fprintf(out, "%s:  %s (SQLSTATE %s)\n", pgErr.Severity, pgErr.Message, pgErr.Code)
+		err = nil
+	}
+	if err == nil && conn.IsClosed() {
+		err = errors.New("the server closed the connection")
+	}
+	return err
+}
+
+func printResult(out io.Writer, result *pgconn.Result) {
+	if len(result.FieldDescriptions) > 0 {
+		w := tabwriter.NewWriter(out, 0, 0, 1, ' ', 0)
+		names := make([]string, len(result.FieldDescriptions))
+		for i, field := range result.FieldDescriptions {
+			names[i] = field.Name
+		}
+		fmt.Fprintln(w, strings.Join(names, "\t| "))
+		for _, row := range result.Rows {
+			values := make([]string, len(row))
+			for i, value := range row {
+				if value == nil {
+					values[i] = "NULL"
+				} else {
+					values[i] = string(value)
+				}
+			}
+			fmt.Fprintln(w, strings.Join(values, "\t| "))
+		}
+		w.Flush()
+	}
+	fmt.Fprintln(out, result.CommandTag.String())
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+)
+
+func TestStartupOptions(t *testing.T) {
+	settings := map[string]string{"pgproxy.route": "analytics", "search_path": `a b\c`}
+	options := startupOptions(settings)
+	if expected := `-c pgproxy.route=analytics -c search_path=a\ b\\c`; options != expected {
+		t.Errorf("expected %q, got %q", expected, options)
+	}
+
+	parsed, err := codec.ParseOptions(options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !maps.Equal(parsed, codec.ConnectionParams(settings)) {
+		t.Errorf("expected the options to parse back to %v, got %v", settings, parsed)
+	}
+	if options := startupOptions(nil); options != "" {
+		t.Errorf("expected no options, got %q", options)
+	}
+}
@@ -0,0 +1,1091 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/audit"
+	"github.com/michaelhelvey/pgproxy/internal/codec"
+	"github.com/michaelhelvey/pgproxy/internal/memory"
+	"github.com/michaelhelvey/pgproxy/internal/query"
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+)
+
+// Implemented by *net.TCPConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Propagates a half-close (FIN) to the other side of the relay.  Relays flush their writes whenever
+// their source has nothing more buffered (see budgetedReader.forward), so there is nothing to flush
+// first.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		if err := cw.CloseWrite(); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Debug("could not half-close connection", "error", err)
+		}
+		return
+	}
+
+	conn.Close()
+}
+
+// Writes to a relay peer, giving up if the peer doesn't accept the data within `timeout` (if set),
+// so that a stalled reader can't pin the other side of the session forever
+func writeWithTimeout(conn net.Conn, data []byte, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Write(data)
+	return err
+}
+
+// Writes to a relay peer with writeWithTimeout, for the codec.Writer relays forward messages through
+type timeoutWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w timeoutWriter) Write(p []byte) (int, error) {
+	if err := writeWithTimeout(w.conn, p, w.timeout); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func newRelayWriter(conn net.Conn, timeout time.Duration) *codec.Writer {
+	return codec.NewWriter(timeoutWriter{conn: conn, timeout: timeout})
+}
+
+// The timeout for writes to a session's client: the proxy's write_timeout, or the entry's
+// slow_client_timeout if that is shorter (see remote.SlowClientTimeout)
+func clientWriteTimeout(conn net.Conn, writeTimeout time.Duration) time.Duration {
+	if slow := remote.SlowClientTimeout(conn); slow > 0 && (writeTimeout <= 0 || slow < writeTimeout) {
+		return slow
+	}
+	return writeTimeout
+}
+
+// Called when forwarding the upstream's messages to the client failed, before the session is torn
+// down: a client that stopped reading is evicted (see remote.EvictSlowClient)
+func clientWriteFailed(conn net.Conn, err error) {
+	slog.Error("fatal: error writing message to client", "error", err)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		remote.EvictSlowClient(conn)
+	}
+}
+
+// Messages larger than this that the relay doesn't need to look into are forwarded in pieces of this
+// size as they arrive, rather than read whole first
+const relayChunkSize = 64 * 1024
+
+// Message types the relay only forwards, and may stream (see relayChunkSize): rows and COPY data
+// from the upstream, and COPY data and Bind messages (with their parameters) from the client
+var (
+	streamedServerMessages = []codec.MessageType{codec.MessageTypeDataRow, codec.MessageTypeCopyData}
+	streamedClientMessages = []codec.MessageType{codec.MessageTypeCopyData, codec.MessageTypeBind}
+)
+
+// Reads the messages of one direction of a relay, bounding the bytes it holds at a time: large
+// messages of the `streamed` types are returned with just their header, the rest of them being
+// copied over by forward in pieces, so that the direction only reads as fast as the other side
+// takes what it writes, however large a result set or COPY is.  The bytes held are reserved in the
+// memory budget (see memory.Account.Acquire) before they are read, and released once the next
+// message is read or the direction finishes.
+//
+// Protocol anomalies in what the direction reads are reported for `session` (see
+// remote.ProtocolAnomaly), unless it is nil.
+type budgetedReader struct {
+	reader   *bufio.Reader
+	account  *memory.Account
+	streamed []codec.MessageType
+	session  net.Conn
+	// the side the messages come from, "client" or "server"
+	direction string
+	held      int
+	// bytes of the current message still to be copied by forward, and the buffer they go through
+	remaining int
+	chunk     []byte
+	// the Data of a streamed message, valid until the next call to next
+	header [codec.MessageDataStartIndex]byte
+}
+
+func (r *budgetedReader) next() (*codec.Message, error) {
+	message, err := r.read()
+	if r.session == nil {
+		return message, err
+	}
+
+	var protocolErr *codec.ProtocolError
+	if errors.As(err, &protocolErr) {
+		// the session ends either way
+		_ = remote.ProtocolAnomaly(r.session, r.direction, remote.AnomalyMalformed, protocolErr.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kind := ""
+	switch {
+	case !codec.IsTyped(byte(message.Type)):
+		kind = remote.AnomalyUnexpected
+	case !codec.KnownMessageType(message.Type):
+		kind = remote.AnomalyUnknownType
+	case !codec.SentBy(message.Type, r.direction == "client"):
+		kind = remote.AnomalyUnexpected
+	}
+	if kind != "" {
+		if err = remote.ProtocolAnomaly(r.session, r.direction, kind, message.Type.String()); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+func (r *budgetedReader) read() (*codec.Message, error) {
+	r.release()
+	// a streamed message that wasn't forwarded, e.g. the rows of a refused or reaped session
+	if r.remaining > 0 {
+		n, err := r.reader.Discard(r.remaining)
+		r.remaining -= n
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// typed messages announce their length, startup-style ones don't appear in a relay
+	header, err := r.reader.Peek(codec.MessageDataStartIndex)
+	if err != nil || !codec.IsTyped(header[0]) {
+		return codec.ReadMessage(r.reader)
+	}
+	messageType, length := codec.MessageType(header[0]), binary.BigEndian.Uint32(header[1:])
+
+	if int(length)+1 <= relayChunkSize || !slices.Contains(r.streamed, messageType) || length < 4 {
+		r.held = int(length) + 1
+		r.account.Acquire(r.held)
+		return codec.ReadMessage(r.reader)
+	}
+
+	r.held = relayChunkSize
+	r.account.Acquire(r.held)
+	if _, _, err = codec.ReadHeader(r.reader); err != nil {
+		return nil, err
+	}
+	r.remaining = int(length) - 4
+	return &codec.Message{Type: messageType, Length: length, Data: codec.AppendHeader(r.header[:0], messageType, length)}, nil
+}
+
+// Writes a message returned by next to `dst`, copying over the rest of it if it is streamed.  A
+// streamed message holds `dst` until it is complete, so that what else is written to it (refusals,
+// keepalives) can't land in the middle.  What `dst` buffers is flushed once nothing more is
+// buffered to read, so that nothing is held back while the relay waits for its source.
+func (r *budgetedReader) forward(dst *codec.Writer, message *codec.Message) error {
+	if r.remaining == 0 {
+		if err := dst.WriteMessage(*message); err != nil {
+			return err
+		}
+	} else if err := dst.Exclusive(r.stream(message)); err != nil {
+		return err
+	}
+
+	if r.reader.Buffered() == 0 {
+		return dst.Flush()
+	}
+	return nil
+}
+
+// Writes a streamed message, its header and then the rest of it as it is read
+func (r *budgetedReader) stream(message *codec.Message) func(out io.Writer) error {
+	return func(out io.Writer) error {
+		if _, err := out.Write(message.Data); err != nil {
+			return err
+		}
+
+		if r.chunk == nil {
+			r.chunk = make([]byte, relayChunkSize)
+		}
+		for r.remaining > 0 {
+			n, err := io.ReadFull(r.reader, r.chunk[:min(r.remaining, len(r.chunk))])
+			r.remaining -= n
+			if err != nil {
+				return fmt.Errorf("could not read message: %w", err)
+			}
+			if _, err = out.Write(r.chunk[:n]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Skips a message returned by next instead of forwarding it, flushing `dst` like forward would
+// have, so that what was forwarded before it isn't held back
+func (r *budgetedReader) drop(dst *codec.Writer) error {
+	if r.reader.Buffered() == 0 {
+		return dst.Flush()
+	}
+	return nil
+}
+
+func (r *budgetedReader) release() {
+	r.account.Release(r.held)
+	r.held = 0
+}
+
+// Whether an error just means the other side went away
+func isClosedErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+// Answers the client requests the entry's policies refuse in place of the upstream
+type refusals struct {
+	client net.Conn
+	// shared with the direction forwarding the upstream's messages to the client
+	out *codec.Writer
+	// set after refusing an extended protocol batch, whose remaining messages are dropped up to the
+	// Sync, which gets a ReadyForQuery with `status`
+	discarding bool
+	status     codec.BackendTransactionStatus
+}
+
+// Checks a client message against the entry's access policy (see remote.CheckRequest and
+// remote.ThrottleRequest), statement pooling (see remote.CheckStatementPooling), guardrails (see
+// remote.CheckGuardrails), schema confinement (see remote.CheckSchema) and tenancy (see
+// remote.ApplyTenancy).  Returns true if the message was refused (or dropped as part of a refused
+// batch) and must not be forwarded, and an error if the session must end, because a write failed
+// or the refusal ends it.
+func (r *refusals) refuse(message *codec.Message) (bool, error) {
+	if r.discarding {
+		if message.Type != codec.MessageTypeSync {
+			return true, nil
+		}
+		r.discarding = false
+		return true, r.out.WriteMessage(codec.NewReadyForQueryMessage(r.status))
+	}
+
+	var policyErr *remote.PolicyError
+	var delay time.Duration
+	err := remote.CheckStatementPooling(r.client, message)
+	if err == nil {
+		err = remote.CheckGuardrails(r.client, message)
+	}
+	if err == nil {
+		err = remote.CheckSchema(r.client, message)
+	}
+	if err == nil {
+		err = remote.CheckRequest(r.client, message.Type)
+	}
+	if err == nil {
+		delay, err = remote.ThrottleRequest(r.client, message)
+	}
+	if err == nil {
+		// rewrites the message, so goes last
+		err = remote.ApplyTenancy(r.client, message)
+	}
+	if !errors.As(err, &policyErr) {
+		// held back under the entry's rate_limit
+		time.Sleep(delay)
+		return false, nil
+	}
+	slog.Info("refusing client request", "reason", policyErr.Message)
+	audit.Record(clientEvent(r.client, audit.RequestRefused, policyErr.Message))
+
+	if policyErr.Fatal {
+		if err = r.out.WriteMessage(codec.NewErrorResponse(codec.ErrorSeverityFatal, policyErr.Code, policyErr.Message)); err == nil {
+			err = r.out.Flush()
+		}
+		return true, errors.Join(policyErr, err)
+	}
+
+	err = r.out.WriteMessage(codec.NewErrorResponse(codec.ErrorSeverityError, policyErr.Code, policyErr.Message))
+	if err != nil {
+		return true, err
+	}
+	if message.Type != codec.MessageTypeQuery && message.Type != codec.MessageTypeFunctionCall {
+		// the client may be waiting for the error already, after a Flush
+		r.discarding, r.status = true, policyErr.Status
+		return true, r.out.Flush()
+	}
+
+	return true, r.out.WriteMessage(codec.NewReadyForQueryMessage(policyErr.Status))
+}
+
+// Enforces the idle_in_transaction_session_timeout and the entry's max_transaction_duration: a read
+// deadline is armed on the client whenever the upstream reports the session idle in a transaction,
+// and cleared once the client starts its next request, so that the relay's read of the client
+// fails if the client sits on an open transaction for too long.  A request still running when its
+// transaction reaches max_transaction_duration is canceled, which leaves the session idle in the
+// failed transaction, past its deadline.
+type idleTimeout struct {
+	client  net.Conn
+	timeout time.Duration
+	// the entry's max_transaction_duration
+	maxTransaction time.Duration
+	// orders arming the deadline against clearing it, so that it is never left armed for a session
+	// that has started a new request
+	mu sync.Mutex
+	// the deadline of the transaction `cancel` was armed for
+	deadline time.Time
+	cancel   *time.Timer
+	// set once the session is being reaped, after which the relay swallows the upstream's messages
+	// up to the ReadyForQuery for the ROLLBACK
+	reaped atomic.Bool
+}
+
+func (t *idleTimeout) beginRequest(messageType codec.MessageType) {
+	remote.BeginRequest(t.client, messageType)
+	if t.timeout <= 0 && t.maxTransaction <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_ = t.client.SetReadDeadline(time.Time{})
+	if t.maxTransaction <= 0 {
+		return
+	}
+	if deadline := remote.TransactionDeadline(t.client); !deadline.IsZero() && !deadline.Equal(t.deadline) {
+		if t.cancel != nil {
+			t.cancel.Stop()
+		}
+		t.deadline = deadline
+		t.cancel = time.AfterFunc(time.Until(deadline), func() { remote.CancelOverdueRequest(t.client, deadline) })
+	}
+}
+
+// Wraps remote.EndRequest
+func (t *idleTimeout) endRequest(status codec.BackendTransactionStatus) bool {
+	drain := remote.EndRequest(t.client, status)
+	if t.timeout <= 0 && t.maxTransaction <= 0 {
+		return drain
+	}
+
+	t.mu.Lock()
+	if remote.IdleInTransaction(t.client) {
+		var deadline time.Time
+		if t.timeout > 0 {
+			deadline = time.Now().Add(t.timeout)
+		}
+		if transaction := remote.TransactionDeadline(t.client); !transaction.IsZero() && (deadline.IsZero() || transaction.Before(deadline)) {
+			deadline = transaction
+		}
+		_ = t.client.SetReadDeadline(deadline)
+	}
+	t.mu.Unlock()
+
+	return drain
+}
+
+// Whether reading from the client failed because the session was idle in a transaction for too
+// long, or its transaction ran for too long
+func (t *idleTimeout) expired(err error) bool {
+	return (t.timeout > 0 || t.maxTransaction > 0) && errors.Is(err, os.ErrDeadlineExceeded) && remote.IdleInTransaction(t.client)
+}
+
+// Rolls back the session's transaction on `upstream` and tells the client its session is over.
+// The relay must then read the upstream up to the ReadyForQuery, after which the connection can go
+// back to its pool.
+func (t *idleTimeout) reap(upstream net.Conn, writeTimeout time.Duration) error {
+	code, msg := codec.SQLStateIdleInTransactionSessionTimeout, "terminating connection due to idle-in-transaction timeout"
+	if remote.TransactionExpired(t.client) {
+		slog.Warn("terminating session over max_transaction_duration", "client", t.client.RemoteAddr().String(), "limit", t.maxTransaction)
+		code, msg = codec.SQLStateTransactionTimeout, "terminating connection due to transaction timeout"
+	} else {
+		slog.Warn("terminating session idle in transaction", "client", t.client.RemoteAddr().String(), "timeout", t.timeout)
+	}
+	t.reaped.Store(true)
+
+	err := writeWithTimeout(t.client, codec.NewErrorResponse(codec.ErrorSeverityFatal, code, msg).Data, writeTimeout)
+	if err != nil {
+		slog.Debug("could not write timeout to client", "error", err)
+	}
+
+	remote.BeginRequest(t.client, codec.MessageTypeQuery)
+	return writeWithTimeout(upstream, codec.NewQuery("ROLLBACK").Data, writeTimeout)
+}
+
+// The upstream side of a session relay, which is replaced if the session reconnects (see
+// remote.Reconnect)
+type sessionUpstream struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	out    *codec.Writer
+}
+
+func newSessionUpstream(conn net.Conn, writeTimeout time.Duration) *sessionUpstream {
+	return &sessionUpstream{conn: conn, reader: bufio.NewReader(conn), out: newRelayWriter(conn, writeTimeout)}
+}
+
+// Relays messages between a client and the upstream connection it holds for its whole session.
+// Returns whether the upstream connection was left in a state where it can be reused.
+func relaySession(conn net.Conn, reader *bufio.Reader, remoteConn net.Conn, addr string, writeTimeout time.Duration, idle *idleTimeout) bool {
+	pooled := remote.IsPooled(conn)
+	activity := newActivity(conn)
+	traffic := remote.SessionTraffic(conn)
+	clientOut := newRelayWriter(conn, clientWriteTimeout(conn, writeTimeout))
+	keepalive := startClientKeepalive(conn, clientOut)
+	defer keepalive.stop()
+
+	// guards `upstream`, and `ending`, which is set once either side is done and the session must
+	// not reconnect anymore
+	var mu sync.Mutex
+	upstream, ending := newSessionUpstream(remoteConn, writeTimeout), false
+	current := func() *sessionUpstream {
+		mu.Lock()
+		defer mu.Unlock()
+		return upstream
+	}
+
+	// Each direction runs until its source is exhausted.  A clean EOF (or Terminate from the client)
+	// is propagated to the other side as a half-close, so that the other direction can finish
+	// delivering whatever is in flight before it sees EOF in turn.  Any other error tears down
+	// both sockets, which unblocks the other direction immediately.
+	//
+	// Pooled upstream connections outlive the session, so instead of half-closing them when the
+	// client finishes we interrupt the server->client direction with a read deadline, and hand the
+	// connection back to the pool if nothing was left in flight.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	clientFinished, serverStopped := false, false
+
+	closeBoth := func() {
+		mu.Lock()
+		ending = true
+		remoteConn := upstream.conn
+		mu.Unlock()
+
+		conn.Close()
+		remoteConn.Close()
+	}
+
+	// called with mu held
+	stopUpstream := func() {
+		if pooled {
+			_ = upstream.conn.SetReadDeadline(time.Now())
+		} else {
+			closeWrite(upstream.conn)
+		}
+	}
+	finishClient := func() {
+		clientFinished = true
+		mu.Lock()
+		ending = true
+		stopUpstream()
+		mu.Unlock()
+	}
+
+	// Gives the session a new upstream connection after its own dropped, if it can have one.
+	// Returns an error wrapping remote.ErrNotReconnectable if it can't.
+	reconnect := func() error {
+		mu.Lock()
+		done := ending
+		mu.Unlock()
+		if done {
+			return remote.ErrNotReconnectable
+		}
+
+		remoteConn, err := remote.Reconnect(conn)
+		if err != nil {
+			if !errors.Is(err, remote.ErrNotReconnectable) {
+				slog.Error("fatal: could not reconnect session", "error", err)
+			}
+			return err
+		}
+
+		mu.Lock()
+		upstream = newSessionUpstream(remoteConn, writeTimeout)
+		if ending {
+			// the client finished while the session reconnected
+			stopUpstream()
+		}
+		mu.Unlock()
+		return nil
+	}
+
+	go func() {
+		// copy every message from the remote back to the client
+		defer wg.Done()
+		defer recoverSession(addr, closeBoth)
+		messages := &budgetedReader{reader: current().reader, account: traffic.Memory(), streamed: streamedServerMessages, session: conn, direction: "server"}
+		defer messages.release()
+		// carries on reading from the session's new upstream connection
+		reconnected := func() {
+			messages.release()
+			messages.reader, messages.remaining = current().reader, 0
+		}
+
+		for {
+			message, err := messages.next()
+			if err != nil {
+				if pooled && errors.Is(err, os.ErrDeadlineExceeded) {
+					slog.Debug("server->client: stopped after client finished")
+					serverStopped = true
+				} else if reconnect() == nil {
+					reconnected()
+					continue
+				} else if isClosedErr(err) {
+					slog.Debug("server->client: remote closed connection")
+					closeWrite(conn)
+				} else {
+					slog.Error("fatal: error reading from remote", "error", err)
+					closeBoth()
+				}
+				return
+			}
+			slog.Debug("handling message from remote", "message", message)
+			traffic.ServerMessage(message)
+			keepalive.observe(message)
+			if message.Type == codec.MessageTypeErrorResponse {
+				remote.UpstreamError(conn, message)
+
+				// the upstream ending an idle session, e.g. because it is shutting down
+				if parsed, _ := message.ParseAsErrorResponse(); parsed.Severity == codec.ErrorSeverityFatal && remote.CanReconnect(conn) {
+					if err = reconnect(); err == nil {
+						reconnected()
+						continue
+					} else if !errors.Is(err, remote.ErrNotReconnectable) {
+						// the upstream's error is all the client gets
+						_ = messages.forward(clientOut, message)
+						closeBoth()
+						return
+					}
+				}
+			}
+
+			isReady := message.Type == codec.MessageTypeReadyForQuery && len(message.Data) > codec.MessageDataStartIndex
+			drain := false
+			if isReady {
+				drain = idle.endRequest(codec.BackendTransactionStatus(message.Data[codec.MessageDataStartIndex]))
+			}
+			if idle.reaped.Load() {
+				// the client is gone, and the connection can be reused once the ROLLBACK is answered
+				serverStopped = isReady
+				if isReady {
+					return
+				}
+				continue
+			}
+			activity.serverMessage(message)
+			if remote.DropAsyncMessage(conn, message) {
+				err = messages.drop(clientOut)
+			} else {
+				err = messages.forward(clientOut, message)
+			}
+			if err != nil {
+				clientWriteFailed(conn, err)
+				closeBoth()
+				return
+			}
+
+			if drain {
+				slog.Info("closing idle draining session", "client", addr)
+				closeBoth()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		// copy every message from the client to the remote
+		defer wg.Done()
+		defer recoverSession(addr, closeBoth)
+		refused := &refusals{client: conn, out: clientOut}
+		messages := &budgetedReader{reader: reader, account: traffic.Memory(), streamed: streamedClientMessages, session: conn, direction: "client"}
+		defer messages.release()
+
+		for {
+			message, err := messages.next()
+			if err != nil {
+				if idle.expired(err) {
+					if err := idle.reap(current().conn, writeTimeout); err != nil {
+						slog.Error("fatal: error writing to remote", "error", err)
+						closeBoth()
+						return
+					}
+					clientFinished = true
+				} else if isClosedErr(err) {
+					slog.Debug("client->server: client closed connection")
+					finishClient()
+				} else {
+					slog.Error("fatal: error reading client message", "error", err)
+					closeBoth()
+				}
+				return
+			}
+			slog.Debug("handling message from client", "message", message)
+			traffic.ClientMessage(message)
+
+			if message.Type == codec.MessageTypeTerminate {
+				slog.Info("client exiting after terminate message")
+				finishClient()
+				return
+			}
+
+			if skip, err := refused.refuse(message); skip {
+				if err != nil {
+					slog.Error("fatal: error refusing client request", "error", err)
+					closeBoth()
+					return
+				}
+				continue
+			}
+
+			// waits while the session reconnects, after which it has a new upstream connection
+			idle.beginRequest(message.Type)
+			remote.TrackSessionState(conn, message)
+			traffic.Request(message)
+			activity.clientMessage(message)
+			if err = messages.forward(current().out, message); err != nil {
+				slog.Error("fatal: error writing to remote", "error", err)
+				closeBoth()
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	return clientFinished && serverStopped && current().reader.Buffered() == 0
+}
+
+// For lazily connected sessions (see remote.ConfigEntry.LazyConnect) in session pooling mode:
+// waits for the client's first message and attaches the session to an upstream connection, unless
+// the client is leaving (with a Terminate, or by disconnecting), in which case it returns nil
+func attachOnFirstMessage(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	first, err := reader.Peek(1)
+	if err != nil || codec.MessageType(first[0]) == codec.MessageTypeTerminate {
+		return nil, nil
+	}
+
+	remoteConn, _, err := remote.Attach(conn)
+	return remoteConn, err
+}
+
+// Relays a replication session byte for byte.  Once streaming starts, both sides exchange CopyData
+// with no ReadyForQuery in between (and a standby may send feedback at any time), so we don't try
+// to follow the protocol at all.  The upstream connection is never reused.
+func relayReplication(conn net.Conn, reader *bufio.Reader, remoteConn net.Conn, addr string, writeTimeout time.Duration) {
+	traffic := remote.SessionTraffic(conn)
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	closeBoth := func() {
+		conn.Close()
+		remoteConn.Close()
+	}
+
+	pipe := func(dst net.Conn, src io.Reader, direction string, count func(n int)) {
+		defer wg.Done()
+		defer recoverSession(addr, closeBoth)
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				count(n)
+				if err := writeWithTimeout(dst, buf[:n], writeTimeout); err != nil {
+					slog.Error("fatal: error writing replication stream", "direction", direction, "error", err)
+					closeBoth()
+					return
+				}
+			}
+			if err != nil {
+				if isClosedErr(err) {
+					slog.Debug("replication stream closed", "direction", direction)
+					closeWrite(dst)
+				} else {
+					slog.Error("fatal: error reading replication stream", "direction", direction, "error", err)
+					closeBoth()
+				}
+				return
+			}
+		}
+	}
+
+	// the client reader may already hold bytes sent right after startup
+	go pipe(remoteConn, reader, "client->server", traffic.Received)
+	go pipe(conn, remoteConn, "server->client", traffic.Sent)
+
+	wg.Wait()
+}
+
+// Returns why a client message ties the session to its upstream connection, or "" if it doesn't
+func sessionStateChange(message *codec.Message) string {
+	var sql string
+
+	switch message.Type {
+	case codec.MessageTypeQuery:
+		sql = message.ParseAsQuery().QueryString
+	case codec.MessageTypeParse:
+		parsed, err := message.ParseAsParse()
+		if err != nil {
+			return ""
+		}
+		if parsed.Name != "" {
+			return "named prepared statement"
+		}
+		sql = parsed.QueryString
+	case codec.MessageTypeFunctionCall:
+		// fastpath calls are almost always the lo_* large object functions, whose descriptors only
+		// live until the end of the transaction, so they don't need the session pinned
+		if call, err := message.ParseAsFunctionCall(); err == nil {
+			slog.Debug("relaying fastpath function call", "oid", call.FunctionOID, "arguments", len(call.Arguments))
+		}
+		return ""
+	default:
+		return ""
+	}
+
+	// a simple Query may hold several statements, including whole transactions
+	if mutates, reason := query.BatchMutatesSessionState(query.Statements(query.Tokenize(sql))); mutates {
+		return reason
+	}
+
+	return ""
+}
+
+// An upstream connection a transaction pooled client currently holds, along with the goroutine
+// copying its messages back to the client
+type attachment struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	out    *codec.Writer
+	// closed when the server->client goroutine exits
+	done chan struct{}
+	// set by the server->client goroutine when it was stopped by a read deadline
+	stopped bool
+}
+
+// Relays messages for a client in transaction pooling mode: an upstream connection is taken from
+// the pool when the client starts sending work, and handed back as soon as the upstream reports
+// that it is idle again.  Sessions that change session state are pinned to their connection (see
+// remote.Pin).
+//
+// Between transactions the session holds nothing but its client connection, and can be parked
+// (see run) so that it doesn't need a goroutine of its own until the client sends more.
+type transactionRelay struct {
+	conn         net.Conn
+	addr         string
+	writeTimeout time.Duration
+	idle         *idleTimeout
+	// what is forwarded to the client, which only holds a buffer while it has something buffered
+	out       *codec.Writer
+	keepalive *clientKeepalive
+
+	// guards `current`, so that the client->server direction never writes to a connection that
+	// the server->client direction is handing back to the pool
+	mu      sync.Mutex
+	current *attachment
+
+	activity *activity
+	traffic  *remote.Traffic
+	refused  *refusals
+	messages *budgetedReader
+
+	// parks the session (see run), nil if it can't be
+	park func() bool
+	// orders waking the client->server direction up, so that it parks once the session goes idle,
+	// against it starting to read the client's next message
+	wake    sync.Mutex
+	waiting bool
+	woken   bool
+}
+
+func newTransactionRelay(conn net.Conn, reader *bufio.Reader, addr string, writeTimeout time.Duration, idle *idleTimeout) *transactionRelay {
+	traffic := remote.SessionTraffic(conn)
+	out := newRelayWriter(conn, clientWriteTimeout(conn, writeTimeout))
+	return &transactionRelay{
+		conn:         conn,
+		addr:         addr,
+		writeTimeout: writeTimeout,
+		idle:         idle,
+		out:          out,
+		keepalive:    startClientKeepalive(conn, out),
+		activity:     newActivity(conn),
+		traffic:      traffic,
+		refused:      &refusals{client: conn, out: out},
+		messages:     &budgetedReader{reader: reader, account: traffic.Memory(), streamed: streamedClientMessages, session: conn, direction: "client"},
+	}
+}
+
+func (r *transactionRelay) closeAll() {
+	r.conn.Close()
+	r.mu.Lock()
+	if r.current != nil {
+		r.current.conn.Close()
+	}
+	r.mu.Unlock()
+}
+
+// Copies every message from the remote back to the client, until the client is idle
+func (r *transactionRelay) pump(a *attachment) {
+	conn, idle, activity, traffic := r.conn, r.idle, r.activity, r.traffic
+
+	defer close(a.done)
+	defer recoverSession(r.addr, func() {
+		conn.Close()
+		a.conn.Close()
+	})
+	messages := &budgetedReader{reader: a.reader, account: traffic.Memory(), streamed: streamedServerMessages, session: conn, direction: "server"}
+	defer messages.release()
+
+	for {
+		message, err := messages.next()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Debug("server->client: stopped after client finished")
+				a.stopped = true
+			} else {
+				slog.Error("fatal: error reading from remote", "error", err)
+				conn.Close()
+				a.conn.Close()
+			}
+			return
+		}
+		slog.Debug("handling message from remote", "message", message)
+		traffic.ServerMessage(message)
+		r.keepalive.observe(message)
+		if message.Type == codec.MessageTypeErrorResponse {
+			remote.UpstreamError(conn, message)
+		}
+
+		if message.Type == codec.MessageTypeNotificationResponse {
+			// the connection is listening on a channel without the client having sent a LISTEN we
+			// recognized (e.g. one run from a function), so further notifications must reach the
+			// same client
+			remote.Pin(conn, "LISTEN")
+		}
+
+		isReady := message.Type == codec.MessageTypeReadyForQuery && len(message.Data) > codec.MessageDataStartIndex
+		drain := false
+		if isReady {
+			drain = idle.endRequest(codec.BackendTransactionStatus(message.Data[codec.MessageDataStartIndex]))
+		}
+		if idle.reaped.Load() {
+			// the client is gone, and the connection can be reused once the ROLLBACK is answered
+			if a.stopped = isReady; isReady {
+				return
+			}
+			continue
+		}
+		activity.serverMessage(message)
+		if remote.DropAsyncMessage(conn, message) {
+			err = messages.drop(r.out)
+		} else {
+			err = messages.forward(r.out, message)
+		}
+		if err != nil {
+			clientWriteFailed(conn, err)
+			conn.Close()
+			a.conn.Close()
+			return
+		}
+
+		if !isReady {
+			continue
+		}
+
+		r.mu.Lock()
+		if remote.CanDetach(conn) {
+			remote.Detach(conn, a.reader.Buffered() == 0)
+			r.current = nil
+			r.mu.Unlock()
+			r.interrupt()
+			return
+		}
+		r.mu.Unlock()
+
+		if drain {
+			// only pinned sessions stay attached while idle
+			slog.Info("closing idle pinned draining session", "client", r.addr)
+			conn.Close()
+			a.conn.Close()
+			return
+		}
+	}
+}
+
+// Relays the client's messages until the session ends, and returns whether the upstream
+// connection held at the end of the session (if any) can be reused.
+//
+// If the relay has a `park` function, it is offered the session whenever the session is between
+// transactions with nothing left to read: if it takes it, run returns right away with `parked` set,
+// and must be called again with `resumed` set once the client has sent more.
+func (r *transactionRelay) run(resumed bool) (reusable bool, parked bool) {
+	conn, idle := r.conn, r.idle
+	if r.messages.reader == nil {
+		r.messages.reader = readers.Get().(*bufio.Reader)
+		r.messages.reader.Reset(conn)
+	}
+
+	for {
+		if r.park != nil && !resumed {
+			if r.parkable() {
+				// nothing is buffered, and the session may be resumed elsewhere as soon as it is
+				// parked
+				r.messages.release()
+				reader := r.messages.reader
+				r.messages.reader = nil
+				reader.Reset(nil)
+				readers.Put(reader)
+				if r.park() {
+					return false, true
+				}
+				r.messages.reader = readers.Get().(*bufio.Reader)
+				r.messages.reader.Reset(conn)
+			} else if r.wait() {
+				continue
+			}
+		}
+		resumed = false
+
+		message, err := r.messages.next()
+		if err != nil {
+			if idle.expired(err) {
+				// a session idle in a transaction holds on to its upstream connection
+				r.mu.Lock()
+				err = idle.reap(r.current.conn, r.writeTimeout)
+				r.mu.Unlock()
+				if err != nil {
+					slog.Error("fatal: error writing to remote", "error", err)
+					r.closeAll()
+				}
+			} else if isClosedErr(err) {
+				slog.Debug("client->server: client closed connection")
+			} else {
+				slog.Error("fatal: error reading client message", "error", err)
+				r.closeAll()
+			}
+			break
+		}
+		slog.Debug("handling message from client", "message", message)
+		r.traffic.ClientMessage(message)
+
+		if message.Type == codec.MessageTypeTerminate {
+			slog.Info("client exiting after terminate message")
+			break
+		}
+
+		if skip, err := r.refused.refuse(message); skip {
+			if err != nil {
+				slog.Error("fatal: error refusing client request", "error", err)
+				r.closeAll()
+				break
+			}
+			continue
+		}
+
+		idle.beginRequest(message.Type)
+		r.traffic.Request(message)
+		r.activity.clientMessage(message)
+		if reason := sessionStateChange(message); reason != "" {
+			remote.Pin(conn, reason)
+		}
+
+		r.mu.Lock()
+		if r.current == nil {
+			remoteConn, _, err := remote.Attach(conn)
+			if err != nil {
+				r.mu.Unlock()
+				slog.Error("fatal: could not get upstream connection for transaction", "error", err)
+				rejectUpstreamError(conn, err)
+				break
+			}
+
+			r.current = &attachment{
+				conn: remoteConn, reader: bufio.NewReader(remoteConn), out: newRelayWriter(remoteConn, r.writeTimeout),
+				done: make(chan struct{}),
+			}
+			go r.pump(r.current)
+		}
+		err = r.messages.forward(r.current.out, message)
+		r.mu.Unlock()
+
+		if err != nil {
+			slog.Error("fatal: error writing to remote", "error", err)
+			r.closeAll()
+			break
+		}
+	}
+	r.messages.release()
+	r.keepalive.stop()
+
+	// stop the server->client direction if the client still holds a connection (e.g. because it
+	// is pinned, or disconnected mid-transaction)
+	r.mu.Lock()
+	a := r.current
+	if a != nil && !idle.reaped.Load() {
+		_ = a.conn.SetReadDeadline(time.Now())
+	}
+	r.mu.Unlock()
+
+	if a == nil {
+		return true, false
+	}
+
+	<-a.done
+
+	return a.stopped && a.reader.Buffered() == 0, false
+}
+
+// Whether the session holds no upstream connection and has nothing left to read, so that its
+// next message can only come from the client's socket
+func (r *transactionRelay) parkable() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.current == nil && r.messages.remaining == 0 && r.messages.reader.Buffered() == 0
+}
+
+// Waits for the client's next message to start arriving, unless the session goes idle first, in
+// which case it returns true so that the session can be parked.  The server->client direction
+// interrupts the wait (see interrupt) when it hands the upstream connection back.
+func (r *transactionRelay) wait() bool {
+	r.wake.Lock()
+	r.waiting = true
+	r.wake.Unlock()
+
+	// the session may have gone idle just before
+	idle := r.parkable()
+	if !idle {
+		// errors are left for the read that follows, except the one the interruption causes
+		_, _ = r.messages.reader.Peek(1)
+	}
+
+	r.wake.Lock()
+	r.waiting = false
+	if r.woken {
+		r.woken, idle = false, true
+		_ = r.conn.SetReadDeadline(time.Time{})
+	}
+	r.wake.Unlock()
+
+	return idle
+}
+
+// Wakes the client->server direction up if it is waiting for the client (see wait)
+func (r *transactionRelay) interrupt() {
+	if r.park == nil {
+		return
+	}
+
+	r.wake.Lock()
+	defer r.wake.Unlock()
+	if r.waiting {
+		r.woken = true
+		_ = r.conn.SetReadDeadline(time.Now())
+	}
+}
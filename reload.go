@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+)
+
+// Re-reads the config file on every SIGHUP and applies what can change while the proxy runs: the
+// listeners' ip_access.  Everything else still takes a restart (or the admin API, for routes).
+func reloadOnHangup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfig()
+	}
+}
+
+func reloadConfig() {
+	config, err := remote.ReadConfigFromFile(configPath)
+	if err != nil {
+		slog.Error("could not reload config, keeping the current one", "error", err)
+		return
+	}
+	if err = remote.LoadIPAccess(config.AllListeners()); err != nil {
+		slog.Error("could not reload ip_access, keeping the current lists", "error", err)
+		return
+	}
+	slog.Info("reloaded config", "path", configPath)
+}
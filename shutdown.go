@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/michaelhelvey/pgproxy/internal/lifecycle"
+	"github.com/michaelhelvey/pgproxy/internal/remote"
+	"github.com/michaelhelvey/pgproxy/internal/systemd"
+)
+
+// How often sessions are checked for having become idle while draining
+const drainPollInterval = 100 * time.Millisecond
+
+// Waits for SIGTERM (or SIGINT), then shuts down the way Kubernetes expects from a pod that is
+// being terminated (and tells systemd we are stopping):
+//
+//  1. turn unready (see lifecycle.Ready) and give up the lease, if any, so a standby takes over
+//  2. keep accepting clients for `config.Delay`, until endpoints and load balancers have caught up
+//  3. stop accepting, closing the listeners, and close `stopping` so that the server knows to
+//     drain
+//
+// A second signal terminates the proxy straight away.
+func awaitShutdown(lns []net.Listener, config lifecycle.ShutdownConfig, stopping chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+
+	slog.Info("shutting down, no longer ready", "signal", sig.String(), "delay", config.Delay)
+	lifecycle.StartDraining()
+	if err := systemd.Notify("STOPPING=1\nSTATUS=draining sessions"); err != nil {
+		slog.Error("could not notify systemd", "error", err)
+	}
+	lifecycle.ReleaseLease()
+	time.Sleep(config.Delay)
+
+	close(stopping)
+	for _, ln := range lns {
+		if err := ln.Close(); err != nil {
+			slog.Error("could not close listener", "error", err)
+		}
+	}
+}
+
+// Closes sessions as they become idle, so that transactions in flight can finish, and returns
+// once all sessions are gone or `timeout` (default lifecycle.DefaultShutdownTimeout) passes
+func drainSessions(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = lifecycle.DefaultShutdownTimeout
+	}
+	slog.Info("draining sessions", "sessions", activeSessions.Load(), "timeout", timeout)
+
+	deadline := time.Now().Add(timeout)
+	for activeSessions.Load() > 0 && time.Now().Before(deadline) {
+		remote.DrainSessions()
+		time.Sleep(drainPollInterval)
+	}
+
+	if n := activeSessions.Load(); n > 0 {
+		slog.Warn("shutdown timeout expired, closing remaining sessions", "sessions", n)
+		return
+	}
+	slog.Info("all sessions drained")
+}